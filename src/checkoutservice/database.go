@@ -6,106 +6,400 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"time"
 
-	_ "github.com/lib/pq"
 	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const maxOrdersPageSize = 100
+
+// healthCheckTimeout bounds HealthCheck when the caller's context has no
+// deadline, so a probe can't sit waiting on a starved pool.
+const healthCheckTimeout = 2 * time.Second
+
+// maxBatchGetOrders bounds how many IDs BatchGetOrders accepts in one call.
+const maxBatchGetOrders = 500
+
+// pqUniqueViolation is the Postgres SQLSTATE for a unique constraint
+// violation.
+const pqUniqueViolation = "23505"
+
+var (
+	ErrOrderConflict = errors.New("an order with the same ID but different contents already exists")
+	ErrOrderNotFound = errors.New("order not found")
+	// ErrConcurrentModification is returned by the versioned update
+	// methods when the order was changed after the caller read it. Re-read
+	// the order and retry with its new version.
+	ErrConcurrentModification = errors.New("order was modified concurrently")
+	// ErrDatabaseUnavailable wraps errors caused by the database being
+	// unreachable, as opposed to it rejecting the request.
+	ErrDatabaseUnavailable = errors.New("order database unavailable")
+)
+
+const selectOrdersQuery = `
+		SELECT
+			order_id, shipping_tracking_id,
+			total_amount_units, total_amount_nanos, total_amount_currency,
+			shipping_cost_units, shipping_cost_nanos, shipping_cost_currency,
+			shipping_address_street, shipping_address_city,
+			shipping_address_state, shipping_address_country,
+			shipping_address_zip, status, created_at, updated_at,
+			cancelled_at, cancellation_reason, version
+		FROM orders`
+
+// userOrdersQuery selects all of a user's orders, newest first.
+const userOrdersQuery = selectOrdersQuery + `
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+	`
+
+// orderInsertQuery and itemInsertQuery are the statements SaveOrder
+// prepares once and reuses.
+const (
+	orderInsertQuery = `
+		INSERT INTO orders (
+			order_id, user_id, user_email, user_currency,
+			shipping_tracking_id,
+			total_amount_units, total_amount_nanos, total_amount_currency,
+			shipping_cost_units, shipping_cost_nanos, shipping_cost_currency,
+			shipping_address_street, shipping_address_city,
+			shipping_address_state, shipping_address_country,
+			shipping_address_zip, status, created_at, updated_at,
+			user_email_lookup
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20)`
+
+	itemInsertQuery = `
+		INSERT INTO order_items (
+			order_id, product_id, quantity,
+			cost_units, cost_nanos, cost_currency, created_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7)`
 )
 
 type OrderDatabase struct {
 	db *sql.DB
+	// ops tracks in-flight operations so Shutdown can wait for them.
+	ops opTracker
+	// stmts caches the statements SaveOrder prepares on db.
+	stmts stmtCache
+	// cache holds GetOrder results; nil unless WithOrderCache is set.
+	cache *orderCache
+	// replica, when set, serves the read-only methods. It is nil when no
+	// replica is configured or it was unreachable at startup.
+	replica *sql.DB
+	dialect dialect
+	opts    dbOptions
+	tracer  trace.Tracer
+}
+
+// OrderRecord is an order as stored in the database: the OrderResult sent
+// back to the customer plus the bookkeeping columns it has no field for.
+type OrderRecord struct {
+	Order     *pb.OrderResult
+	Total     *pb.Money
+	Status    OrderStatus
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// CancelledAt is zero unless the order was cancelled.
+	CancelledAt        time.Time
+	CancellationReason string
+	// Version starts at 1 and increases with every update. Pass it to the
+	// AtVersion update methods to detect concurrent changes.
+	Version int64
+	// Payment is the masked payment saved with SaveOrderWithPayment, or nil.
+	// Only GetOrder and GetOrderForUpdate load it.
+	Payment *PaymentInfo
+	// UserID, Email and UserCurrency are the customer's, as in the
+	// PlaceOrderRequest. Only SaveOrders uses them; reads leave them empty.
+	UserID       string
+	Email        string
+	UserCurrency string
+	// ItemsError is set by GetUserOrdersPartial when the order's items
+	// couldn't be loaded, in which case Order.Items is empty.
+	ItemsError error
 }
 
-func NewOrderDatabase(connectionString string) (*OrderDatabase, error) {
-	db, err := sql.Open("postgres", connectionString)
+// queryer is satisfied by both *sql.DB and *sql.Tx so read helpers can run
+// inside or outside a transaction.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// NewOrderDatabase connects to the database named by connectionString: a
+// sqlite:// URL for SQLite, a mysql:// URL for MySQL, anything else for
+// Postgres.
+func NewOrderDatabase(connectionString string, opts ...Option) (*OrderDatabase, error) {
+	o := newDBOptions(opts)
+	d, dsn := dialectFor(connectionString)
+	if err := o.tables.validate(d); err != nil {
+		return nil, err
+	}
+	db, err := openDB(d, dsn, o)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Successfully connected to %s database", d.system())
+	return newOrderDatabase(db, d, o), nil
+}
+
+// openDB opens a connection pool configured from o and checks that the
+// database is reachable.
+func openDB(d dialect, dsn string, o dbOptions) (*sql.DB, error) {
+	db, err := sql.Open(d.driverName(), dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
-	db.SetMaxOpenConns(25)
-	db.SetMaxIdleConns(5)
-	db.SetConnMaxLifetime(5 * time.Minute)
+	o.configurePool(db)
+	d.configurePool(db)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	if err := db.PingContext(ctx); err != nil {
-		return nil, fmt.Errorf("failed to ping database: %w", err)
+		db.Close()
+		return nil, fmt.Errorf("%w: failed to ping database: %w", ErrDatabaseUnavailable, err)
+	}
+	return db, nil
+}
+
+func newOrderDatabase(db *sql.DB, d dialect, o dbOptions) *OrderDatabase {
+	return &OrderDatabase{
+		db:      db,
+		dialect: d,
+		opts:    o,
+		cache:   newOrderCache(o.orderCacheSize, o.orderCacheTTL),
+		tracer:  o.tracerProvider.Tracer(databaseTracerName),
+	}
+}
+
+// Stats reports the state of the connection pool, e.g. to tell whether
+// the open connection limit is being hit.
+func (odb *OrderDatabase) Stats() sql.DBStats {
+	return odb.db.Stats()
+}
+
+// HealthCheck pings the primary and returns nil if it answers before ctx
+// ends. It is meant for readiness probes, so unlike the ping in
+// NewOrderDatabase it can be called for the lifetime of the process.
+func (odb *OrderDatabase) HealthCheck(ctx context.Context) error {
+	if err := odb.beginOp(); err != nil {
+		return err
 	}
+	defer odb.endOp()
 
-	log.Info("Successfully connected to PostgreSQL database")
-	return &OrderDatabase{db: db}, nil
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, healthCheckTimeout)
+		defer cancel()
+	}
+	if err := odb.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("%w: %w", ErrDatabaseUnavailable, err)
+	}
+	return nil
 }
 
 func (odb *OrderDatabase) Close() error {
+	stmtErr := odb.closeStmts()
+	var replicaErr error
+	if odb.replica != nil {
+		replicaErr = odb.replica.Close()
+	}
 	if odb.db != nil {
-		return odb.db.Close()
+		if err := odb.db.Close(); err != nil {
+			return err
+		}
+	}
+	return errors.Join(replicaErr, stmtErr)
+}
+
+func (odb *OrderDatabase) SaveOrder(ctx context.Context, req *pb.PlaceOrderRequest, orderResult *pb.OrderResult, totalAmount *pb.Money) (err error) {
+	ctx, span := odb.startSpan(ctx, "SaveOrder",
+		attribute.String("order.id", orderResult.GetOrderId()),
+		attribute.Int("order.item_count", len(orderResult.GetItems())),
+	)
+	defer func() { endSpan(span, err) }()
+
+	if err = odb.beginOp(); err != nil {
+		return err
+	}
+	defer odb.endOp()
+
+	ctx, cancel := odb.withQueryTimeout(ctx)
+	defer cancel()
+
+	if err = validateOrder(req, orderResult, totalAmount); err != nil {
+		return err
+	}
+
+	defer odb.cache.invalidate(orderResult.OrderId)
+	err = odb.withRetry(ctx, "SaveOrder", func() error {
+		return odb.saveOrder(ctx, req, orderResult, totalAmount, nil)
+	})
+	if err != nil {
+		return odb.recordFailedOrder(ctx, req, orderResult, totalAmount, nil, err)
 	}
 	return nil
 }
 
-func (odb *OrderDatabase) SaveOrder(ctx context.Context, req *pb.PlaceOrderRequest, orderResult *pb.OrderResult, totalAmount *pb.Money) error {
-	tx, err := odb.db.BeginTx(ctx, nil)
+// SaveOrderWithPayment is SaveOrder that also stores the masked details of
+// the card the order was paid with in order_payments, in the same
+// transaction. payment is rejected with ErrInvalidPayment unless it holds
+// only masked details; see validatePayment. Saving an order again that
+// already exists with the same contents doesn't check or change its
+// stored payment.
+func (odb *OrderDatabase) SaveOrderWithPayment(ctx context.Context, req *pb.PlaceOrderRequest, orderResult *pb.OrderResult, totalAmount *pb.Money, payment *PaymentInfo) (err error) {
+	ctx, span := odb.startSpan(ctx, "SaveOrderWithPayment",
+		attribute.String("order.id", orderResult.GetOrderId()),
+		attribute.Int("order.item_count", len(orderResult.GetItems())),
+	)
+	defer func() { endSpan(span, err) }()
+
+	if err = odb.beginOp(); err != nil {
+		return err
+	}
+	defer odb.endOp()
+
+	ctx, cancel := odb.withQueryTimeout(ctx)
+	defer cancel()
+
+	if err = validateOrder(req, orderResult, totalAmount); err != nil {
+		return err
+	}
+	if err = validatePayment(payment); err != nil {
+		return fmt.Errorf("order %s: %w", orderResult.OrderId, err)
+	}
+
+	defer odb.cache.invalidate(orderResult.OrderId)
+	err = odb.withRetry(ctx, "SaveOrderWithPayment", func() error {
+		return odb.saveOrder(ctx, req, orderResult, totalAmount, payment)
+	})
+	if err != nil {
+		return odb.recordFailedOrder(ctx, req, orderResult, totalAmount, payment, err)
+	}
+	return nil
+}
+
+// saveOrder writes the order, its items, its OutboxOrderPlaced event and,
+// unless it is nil, payment.
+func (odb *OrderDatabase) saveOrder(ctx context.Context, req *pb.PlaceOrderRequest, orderResult *pb.OrderResult, totalAmount *pb.Money, payment *PaymentInfo) error {
+	email, err := odb.encryptField(req.Email)
+	if err != nil {
+		return err
+	}
+	address, err := odb.encryptAddress(req.Address)
+	if err != nil {
+		return err
+	}
+	// The timestamp columns have no time zone, so always write UTC.
+	now := time.Now().UTC()
+	event, err := odb.orderPlacedPayload(req, orderResult, now)
+	if err != nil {
+		return err
+	}
+
+	insertOrder, err := odb.prepare(ctx, orderInsertQuery)
+	if err != nil {
+		return err
+	}
+	insertItem, err := odb.prepare(ctx, itemInsertQuery)
+	if err != nil {
+		return err
+	}
+
+	tx, err := odb.db.BeginTx(ctx, odb.opts.saveTxOptions())
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer tx.Rollback()
 
-	orderInsertQuery := `
-		INSERT INTO orders (
-			order_id, user_id, user_email, user_currency,
-			shipping_tracking_id, total_amount_units, total_amount_nanos,
-			shipping_cost_units, shipping_cost_nanos,
-			shipping_address_street, shipping_address_city,
-			shipping_address_state, shipping_address_country,
-			shipping_address_zip, created_at, updated_at
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
-	`
-
-	now := time.Now()
-	_, err = tx.ExecContext(ctx, orderInsertQuery,
+	_, err = tx.StmtContext(ctx, insertOrder).ExecContext(ctx,
 		orderResult.OrderId,
 		req.UserId,
-		req.Email,
+		email,
 		req.UserCurrency,
 		orderResult.ShippingTrackingId,
 		totalAmount.Units,
 		totalAmount.Nanos,
+		totalAmount.CurrencyCode,
 		orderResult.ShippingCost.Units,
 		orderResult.ShippingCost.Nanos,
-		req.Address.StreetAddress,
-		req.Address.City,
-		req.Address.State,
-		req.Address.Country,
-		req.Address.ZipCode,
+		orderResult.ShippingCost.CurrencyCode,
+		address.StreetAddress,
+		address.City,
+		address.State,
+		address.Country,
+		address.ZipCode,
+		// Orders are only persisted once the card has been charged.
+		OrderStatusPaid,
 		now,
 		now,
+		odb.emailLookup(req.Email),
 	)
 	if err != nil {
+		if odb.dialect.isUniqueViolation(err) {
+			// Most likely a retry of a save whose commit succeeded but whose
+			// response was lost; the transaction is aborted either way.
+			tx.Rollback()
+			return odb.checkDuplicateOrder(ctx, req, orderResult, totalAmount)
+		}
 		return fmt.Errorf("failed to insert order: %w", err)
 	}
 
-	itemInsertQuery := `
-		INSERT INTO order_items (
-			order_id, product_id, quantity, cost_units, cost_nanos, created_at
-		) VALUES ($1, $2, $3, $4, $5, $6)
-	`
-
-	for _, item := range orderResult.Items {
-		_, err = tx.ExecContext(ctx, itemInsertQuery,
+	insertItemTx := tx.StmtContext(ctx, insertItem)
+	for i, item := range orderResult.Items {
+		_, err = insertItemTx.ExecContext(ctx,
 			orderResult.OrderId,
 			item.Item.ProductId,
 			item.Item.Quantity,
 			item.Cost.Units,
 			item.Cost.Nanos,
+			item.Cost.CurrencyCode,
 			now,
 		)
 		if err != nil {
-			return fmt.Errorf("failed to insert order item: %w", err)
+			// The transaction rolls back, so none of the order is saved;
+			// say which item was rejected and why.
+			switch {
+			case odb.dialect.isUniqueViolation(err):
+				return fmt.Errorf("order %s item %d (product %s) is a duplicate: %w", orderResult.OrderId, i, item.Item.ProductId, err)
+			case odb.dialect.isConstraintViolation(err):
+				return fmt.Errorf("order %s item %d (product %s) violates a constraint: %w", orderResult.OrderId, i, item.Item.ProductId, err)
+			default:
+				return fmt.Errorf("failed to insert order %s item %d (product %s): %w", orderResult.OrderId, i, item.Item.ProductId, err)
+			}
 		}
 	}
 
+	if payment != nil {
+		_, err = odb.execContext(ctx, tx, paymentInsertQuery,
+			orderResult.OrderId,
+			payment.CardLastFour,
+			payment.CardType,
+			payment.ProcessorTxnID,
+			payment.Authorized,
+			now,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to insert order payment: %w", err)
+		}
+	}
+
+	// Written in the same transaction, so the event is published if and
+	// only if the order is saved.
+	if err := odb.insertOutboxEvent(ctx, tx, orderResult.OrderId, OutboxOrderPlaced, event, now); err != nil {
+		return err
+	}
+
 	if err := tx.Commit(); err != nil {
 		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
@@ -114,66 +408,798 @@ func (odb *OrderDatabase) SaveOrder(ctx context.Context, req *pb.PlaceOrderReque
 	return nil
 }
 
-func (odb *OrderDatabase) GetOrder(ctx context.Context, orderID string) (*pb.OrderResult, error) {
+// checkDuplicateOrder is called when an order ID is already taken. It
+// returns nil if the stored order is the one being saved, and
+// ErrOrderConflict if it differs.
+func (odb *OrderDatabase) checkDuplicateOrder(ctx context.Context, req *pb.PlaceOrderRequest, orderResult *pb.OrderResult, totalAmount *pb.Money) error {
 	orderQuery := `
-		SELECT 
-			order_id, shipping_tracking_id,
-			shipping_cost_units, shipping_cost_nanos,
+		SELECT
+			user_id, user_email, user_currency, shipping_tracking_id,
+			total_amount_units, total_amount_nanos, total_amount_currency,
+			shipping_cost_units, shipping_cost_nanos, shipping_cost_currency,
 			shipping_address_street, shipping_address_city,
 			shipping_address_state, shipping_address_country,
 			shipping_address_zip
-		FROM orders 
+		FROM orders
+		WHERE order_id = $1
+	`
+
+	var stored pb.PlaceOrderRequest
+	var storedTrackingID string
+	var storedTotal, storedShipping pb.Money
+	var storedAddress pb.Address
+
+	err := odb.queryRowContext(ctx, odb.db, orderQuery, orderResult.OrderId).Scan(
+		&stored.UserId,
+		&stored.Email,
+		&stored.UserCurrency,
+		&storedTrackingID,
+		&storedTotal.Units,
+		&storedTotal.Nanos,
+		&storedTotal.CurrencyCode,
+		&storedShipping.Units,
+		&storedShipping.Nanos,
+		&storedShipping.CurrencyCode,
+		&storedAddress.StreetAddress,
+		&storedAddress.City,
+		&storedAddress.State,
+		&storedAddress.Country,
+		&storedAddress.ZipCode,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to query existing order %s: %w", orderResult.OrderId, err)
+	}
+	// Ciphertexts use a random nonce, so compare the decrypted values.
+	if stored.Email, err = odb.decryptField(stored.Email); err != nil {
+		return err
+	}
+	if err = odb.decryptAddress(&storedAddress); err != nil {
+		return err
+	}
+
+	storedItems, err := odb.getOrderItems(ctx, odb.db, []string{orderResult.OrderId})
+	if err != nil {
+		return err
+	}
+
+	same := stored.UserId == req.UserId &&
+		stored.Email == req.Email &&
+		stored.UserCurrency == req.UserCurrency &&
+		storedTrackingID == orderResult.ShippingTrackingId &&
+		sameAmount(&storedTotal, totalAmount) &&
+		sameAmount(&storedShipping, orderResult.ShippingCost) &&
+		storedAddress.StreetAddress == req.Address.StreetAddress &&
+		storedAddress.City == req.Address.City &&
+		storedAddress.State == req.Address.State &&
+		storedAddress.Country == req.Address.Country &&
+		storedAddress.ZipCode == req.Address.ZipCode &&
+		sameItems(storedItems[orderResult.OrderId], orderResult.Items)
+	if !same {
+		return fmt.Errorf("%w: %s", ErrOrderConflict, orderResult.OrderId)
+	}
+
+	log.Infof("Order %s was already saved, skipping duplicate insert", orderResult.OrderId)
+	return nil
+}
+
+func sameAmount(a, b *pb.Money) bool {
+	return a.GetUnits() == b.GetUnits() &&
+		a.GetNanos() == b.GetNanos() &&
+		a.GetCurrencyCode() == b.GetCurrencyCode()
+}
+
+func sameItems(stored, items []*pb.OrderItem) bool {
+	if len(stored) != len(items) {
+		return false
+	}
+	for i := range items {
+		if stored[i].GetItem().GetProductId() != items[i].GetItem().GetProductId() ||
+			stored[i].GetItem().GetQuantity() != items[i].GetItem().GetQuantity() ||
+			!sameAmount(stored[i].GetCost(), items[i].GetCost()) {
+			return false
+		}
+	}
+	return true
+}
+
+// UpdateOrderStatus moves the order to status and records the change in its
+// audit trail, returning ErrInvalidStatusTransition if the order's current
+// status does not allow it.
+func (odb *OrderDatabase) UpdateOrderStatus(ctx context.Context, orderID string, status OrderStatus) (err error) {
+	ctx, span := odb.startSpan(ctx, "UpdateOrderStatus",
+		attribute.String("order.id", orderID),
+		attribute.String("order.status", string(status)),
+	)
+	defer func() { endSpan(span, err) }()
+
+	if err = odb.beginOp(); err != nil {
+		return err
+	}
+	defer odb.endOp()
+
+	ctx, cancel := odb.withQueryTimeout(ctx)
+	defer cancel()
+
+	defer odb.cache.invalidate(orderID)
+	return odb.updateOrderStatus(ctx, orderID, status, anyVersion)
+}
+
+// UpdateOrderStatusAtVersion is UpdateOrderStatus for a read-modify-write:
+// it only applies if the order is still at version, the OrderRecord.Version
+// the caller read, and fails with ErrConcurrentModification otherwise. No
+// row lock is held between the read and the write.
+func (odb *OrderDatabase) UpdateOrderStatusAtVersion(ctx context.Context, orderID string, version int64, status OrderStatus) (err error) {
+	ctx, span := odb.startSpan(ctx, "UpdateOrderStatusAtVersion",
+		attribute.String("order.id", orderID),
+		attribute.String("order.status", string(status)),
+		attribute.Int64("order.version", version),
+	)
+	defer func() { endSpan(span, err) }()
+
+	if err = odb.beginOp(); err != nil {
+		return err
+	}
+	defer odb.endOp()
+
+	ctx, cancel := odb.withQueryTimeout(ctx)
+	defer cancel()
+
+	defer odb.cache.invalidate(orderID)
+	return odb.updateOrderStatus(ctx, orderID, status, version)
+}
+
+// anyVersion makes an update apply whatever the order's version is.
+const anyVersion int64 = 0
+
+func (odb *OrderDatabase) updateOrderStatus(ctx context.Context, orderID string, status OrderStatus, version int64) error {
+	if !status.IsValid() {
+		return fmt.Errorf("unknown order status %q", status)
+	}
+
+	err := odb.withRetry(ctx, "UpdateOrderStatus", func() error {
+		return odb.withTx(ctx, func(tx *sql.Tx) error {
+			// The status before the change goes in the audit trail; the lock
+			// keeps it current until the update commits.
+			var current OrderStatus
+			var currentVersion int64
+			statusQuery := `SELECT status, version FROM orders WHERE order_id = $1` + odb.dialect.lockRows()
+			err := odb.queryRowContext(ctx, tx, statusQuery, orderID).Scan(&current, &currentVersion)
+			if err != nil {
+				if err == sql.ErrNoRows {
+					return fmt.Errorf("%w: %s", ErrOrderNotFound, orderID)
+				}
+				return fmt.Errorf("failed to query order status: %w", err)
+			}
+
+			// The transition and version are also checked in the statement
+			// that applies it, so a concurrent update can't slip in between
+			// the check and the write where lockRows takes no lock.
+			now := time.Now().UTC()
+			fromStatus, fromArgs := odb.dialect.anyOf("status", 4, statusesLeadingTo(status))
+			updateQuery := `
+				UPDATE orders
+				SET status = $1, updated_at = $2, version = version + 1
+				WHERE order_id = $3 AND ` + fromStatus
+			args := append([]interface{}{status, now, orderID}, fromArgs...)
+			if version != anyVersion {
+				updateQuery += fmt.Sprintf(" AND version = $%d", len(args)+1)
+				args = append(args, version)
+			}
+
+			result, err := odb.execContext(ctx, tx, updateQuery, args...)
+			if err != nil {
+				return fmt.Errorf("failed to update order status: %w", err)
+			}
+			updated, err := result.RowsAffected()
+			if err != nil {
+				return fmt.Errorf("failed to update order status: %w", err)
+			}
+			if updated == 0 {
+				if version != anyVersion && currentVersion != version {
+					return fmt.Errorf("%w: order %s is at version %d, not %d", ErrConcurrentModification, orderID, currentVersion, version)
+				}
+				return fmt.Errorf("%w: order %s cannot move from %s to %s", ErrInvalidStatusTransition, orderID, current, status)
+			}
+			return odb.recordOrderEvent(ctx, tx, orderID, OrderEventStatusChanged, current, status, "", now)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	log.Infof("Order %s moved to status %s", orderID, status)
+	return nil
+}
+
+// CancelOrder marks an order CANCELLED, recording when and why, and adds a
+// cancellation event to its audit trail. The row is kept so GetOrder still
+// returns it. Orders that have shipped, or were already cancelled, fail with
+// ErrOrderNotCancellable.
+func (odb *OrderDatabase) CancelOrder(ctx context.Context, orderID, reason string) (err error) {
+	ctx, span := odb.startSpan(ctx, "CancelOrder", attribute.String("order.id", orderID))
+	defer func() { endSpan(span, err) }()
+
+	if err = odb.beginOp(); err != nil {
+		return err
+	}
+	defer odb.endOp()
+
+	ctx, cancel := odb.withQueryTimeout(ctx)
+	defer cancel()
+
+	defer odb.cache.invalidate(orderID)
+	return odb.withRetry(ctx, "CancelOrder", func() error {
+		return odb.withTx(ctx, func(tx *sql.Tx) error {
+			return odb.cancelOrder(ctx, tx, orderID, reason)
+		})
+	})
+}
+
+func (odb *OrderDatabase) cancelOrder(ctx context.Context, tx *sql.Tx, orderID, reason string) error {
+	var current OrderStatus
+	statusQuery := `SELECT status FROM orders WHERE order_id = $1` + odb.dialect.lockRows()
+	err := odb.queryRowContext(ctx, tx, statusQuery, orderID).Scan(&current)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("%w: %s", ErrOrderNotFound, orderID)
+		}
+		return fmt.Errorf("failed to query order status: %w", err)
+	}
+	if !current.CanTransitionTo(OrderStatusCancelled) {
+		return fmt.Errorf("%w: order %s is %s", ErrOrderNotCancellable, orderID, current)
+	}
+
+	now := time.Now().UTC()
+	cancelQuery := `
+		UPDATE orders
+		SET status = $1, cancelled_at = $2, cancellation_reason = $3, updated_at = $2,
+			version = version + 1
+		WHERE order_id = $4
+	`
+	if _, err := odb.execContext(ctx, tx, cancelQuery, OrderStatusCancelled, now, reason, orderID); err != nil {
+		return fmt.Errorf("failed to cancel order: %w", err)
+	}
+	if err := odb.recordOrderEvent(ctx, tx, orderID, OrderEventCancelled, current, OrderStatusCancelled, reason, now); err != nil {
+		return err
+	}
+
+	log.Infof("Order %s cancelled", orderID)
+	return nil
+}
+
+func (odb *OrderDatabase) GetOrder(ctx context.Context, orderID string) (_ *OrderRecord, err error) {
+	ctx, span := odb.startSpan(ctx, "GetOrder", attribute.String("order.id", orderID))
+	defer func() { endSpan(span, err) }()
+
+	if err = odb.beginOp(); err != nil {
+		return nil, err
+	}
+	defer odb.endOp()
+
+	ctx, cancel := odb.withQueryTimeout(ctx)
+	defer cancel()
+
+	// WithPrimaryRead asks for the latest state, so it skips the cache.
+	if primary, _ := ctx.Value(primaryReadKey{}).(bool); !primary {
+		if record, ok := odb.cache.get(orderID); ok {
+			span.SetAttributes(attribute.Bool("db.cache_hit", true))
+			return record, nil
+		}
+	}
+
+	orderQuery := selectOrdersQuery + `
 		WHERE order_id = $1
 	`
 
+	generation := odb.cache.startRead()
+	var record *OrderRecord
+	err = odb.withReadRetry(ctx, "GetOrder", func(q *sql.DB) (err error) {
+		record, err = odb.getOrder(ctx, q, orderQuery, orderID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Cached orders were verified when they were put.
+	if odb.opts.verifyTotals {
+		if err = VerifyOrderTotals(record.Order, record.Total); err != nil {
+			return nil, err
+		}
+	}
+	odb.cache.put(orderID, record, generation)
+	span.SetAttributes(attribute.Int("order.item_count", len(record.Order.Items)))
+	return record, nil
+}
+
+// BatchGetOrders fetches the given orders and their items in two queries.
+// The result is keyed by order ID; IDs with no matching order are left out
+// rather than reported as errors.
+func (odb *OrderDatabase) BatchGetOrders(ctx context.Context, orderIDs []string) (_ map[string]*OrderRecord, err error) {
+	ctx, span := odb.startSpan(ctx, "BatchGetOrders", attribute.Int("order.id_count", len(orderIDs)))
+	defer func() { endSpan(span, err) }()
+
+	if err = odb.beginOp(); err != nil {
+		return nil, err
+	}
+	defer odb.endOp()
+
+	ctx, cancel := odb.withQueryTimeout(ctx)
+	defer cancel()
+
+	if len(orderIDs) > maxBatchGetOrders {
+		return nil, fmt.Errorf("too many order IDs: %d, at most %d per call", len(orderIDs), maxBatchGetOrders)
+	}
+	found := make(map[string]*OrderRecord, len(orderIDs))
+	if len(orderIDs) == 0 {
+		return found, nil
+	}
+
+	idCond, args := odb.dialect.anyOf("order_id", 1, orderIDs)
+	orderQuery := selectOrdersQuery + `
+		WHERE ` + idCond + `
+	`
+
+	var orders []*OrderRecord
+	err = odb.withReadRetry(ctx, "BatchGetOrders", func(q *sql.DB) (err error) {
+		orders, err = odb.queryOrders(ctx, q, orderQuery, args...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range orders {
+		found[record.Order.OrderId] = record
+	}
+	span.SetAttributes(attribute.Int("db.rows_returned", len(orders)))
+	return found, nil
+}
+
+// GetOrderForUpdate reads an order like GetOrder but also takes a row lock
+// on it with SELECT ... FOR UPDATE. The lock is held until tx commits or
+// rolls back, so concurrent read-modify-write cycles on the same order run
+// one after another instead of overwriting each other. On SQLite, which
+// has no row locks, transactions are serialized anyway.
+func (odb *OrderDatabase) GetOrderForUpdate(ctx context.Context, tx *sql.Tx, orderID string) (*OrderRecord, error) {
+	orderQuery := selectOrdersQuery + `
+		WHERE order_id = $1` + odb.dialect.lockRows() + `
+	`
+
+	return odb.getOrder(ctx, tx, orderQuery, orderID)
+}
+
+// WithTx runs fn inside a transaction, committing if fn returns nil and
+// rolling back otherwise. Any row locks fn takes, e.g. through
+// GetOrderForUpdate, are released when the transaction ends.
+func (odb *OrderDatabase) WithTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	if err := odb.beginOp(); err != nil {
+		return err
+	}
+	defer odb.endOp()
+
+	// fn can write to any order, so none of the cached ones can be trusted.
+	defer odb.cache.invalidateAll()
+	return odb.withTx(ctx, fn)
+}
+
+func (odb *OrderDatabase) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := odb.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func (odb *OrderDatabase) getOrder(ctx context.Context, q queryer, orderQuery string, orderID string) (*OrderRecord, error) {
+	record, err := odb.scanOrder(odb.queryRowContext(ctx, q, orderQuery, orderID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("%w: %s", ErrOrderNotFound, orderID)
+		}
+		return nil, fmt.Errorf("failed to query order: %w", err)
+	}
+
+	items, err := odb.getOrderItems(ctx, q, []string{orderID})
+	if err != nil {
+		return nil, err
+	}
+
+	record.Order.Items = items[orderID]
+	if record.Payment, err = odb.getOrderPayment(ctx, q, orderID); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (odb *OrderDatabase) GetUserOrders(ctx context.Context, userID string) (_ []*OrderRecord, err error) {
+	ctx, span := odb.startSpan(ctx, "GetUserOrders", attribute.String("user.id", userID))
+	defer func() { endSpan(span, err) }()
+
+	if err = odb.beginOp(); err != nil {
+		return nil, err
+	}
+	defer odb.endOp()
+
+	ctx, cancel := odb.withQueryTimeout(ctx)
+	defer cancel()
+
+	var orders []*OrderRecord
+	err = odb.withReadRetry(ctx, "GetUserOrders", func(q *sql.DB) (err error) {
+		orders, err = odb.queryOrders(ctx, q, userOrdersQuery, userID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("db.rows_returned", len(orders)))
+	return orders, nil
+}
+
+// GetLatestOrder returns the user's most recent order with its items, for
+// the confirmation page after checkout, without loading the user's other
+// orders. It fails with ErrOrderNotFound if the user has no orders. Right
+// after SaveOrder, wrap ctx with WithPrimaryRead so a lagging replica can't
+// return the order before.
+func (odb *OrderDatabase) GetLatestOrder(ctx context.Context, userID string) (_ *pb.OrderResult, err error) {
+	ctx, span := odb.startSpan(ctx, "GetLatestOrder", attribute.String("user.id", userID))
+	defer func() { endSpan(span, err) }()
+
+	if err = odb.beginOp(); err != nil {
+		return nil, err
+	}
+	defer odb.endOp()
+
+	ctx, cancel := odb.withQueryTimeout(ctx)
+	defer cancel()
+
+	// order_id breaks ties between orders placed in the same instant.
+	orderQuery := selectOrdersQuery + `
+		WHERE user_id = $1
+		ORDER BY created_at DESC, order_id DESC
+		LIMIT 1
+	`
+
+	var orders []*OrderRecord
+	err = odb.withReadRetry(ctx, "GetLatestOrder", func(q *sql.DB) (err error) {
+		orders, err = odb.queryOrders(ctx, q, orderQuery, userID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(orders) == 0 {
+		return nil, fmt.Errorf("%w: user %s has no orders", ErrOrderNotFound, userID)
+	}
+	span.SetAttributes(attribute.Int("order.item_count", len(orders[0].Order.Items)))
+	return orders[0].Order, nil
+}
+
+// GetUserOrdersPartial is GetUserOrders for display paths that would rather
+// show what they can than nothing. If an order's items can't be loaded, the
+// order is still returned, without items and with ItemsError set, and the
+// other orders are unaffected. It fails only if the orders themselves can't
+// be read.
+func (odb *OrderDatabase) GetUserOrdersPartial(ctx context.Context, userID string) (_ []*OrderRecord, err error) {
+	ctx, span := odb.startSpan(ctx, "GetUserOrdersPartial", attribute.String("user.id", userID))
+	defer func() { endSpan(span, err) }()
+
+	if err = odb.beginOp(); err != nil {
+		return nil, err
+	}
+	defer odb.endOp()
+
+	ctx, cancel := odb.withQueryTimeout(ctx)
+	defer cancel()
+
+	q := odb.reader(ctx)
+	var orders []*OrderRecord
+	err = odb.retryOn(ctx, "GetUserOrdersPartial", q, func() (err error) {
+		orders, err = odb.queryOrderRows(ctx, q, userOrdersQuery, userID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	failed := odb.attachOrderItemsPartial(ctx, q, orders)
+	span.SetAttributes(
+		attribute.Int("db.rows_returned", len(orders)),
+		attribute.Int("order.items_failed_count", failed),
+	)
+	return orders, nil
+}
+
+// attachOrderItemsPartial loads the items of orders in one query and, if
+// that fails, order by order, so that an order whose items can't be loaded
+// gets ItemsError rather than failing the others. It returns how many
+// orders got ItemsError.
+func (odb *OrderDatabase) attachOrderItemsPartial(ctx context.Context, q queryer, orders []*OrderRecord) int {
+	if len(orders) == 0 {
+		return 0
+	}
+	err := odb.attachOrderItems(ctx, q, orders)
+	if err == nil {
+		return 0
+	}
+	if ctx.Err() != nil {
+		// Every order would fail the same way.
+		err = withContextError(ctx, err)
+		for _, record := range orders {
+			record.ItemsError = err
+		}
+		return len(orders)
+	}
+
+	failed := 0
+	for _, record := range orders {
+		if err := odb.attachOrderItems(ctx, q, []*OrderRecord{record}); err != nil {
+			log.Warnf("Failed to load the items of order %s: %v", record.Order.OrderId, err)
+			record.ItemsError = withContextError(ctx, err)
+			failed++
+		}
+	}
+	return failed
+}
+
+// CountUserOrders returns how many orders the user has, without loading
+// them. A user with no orders has a count of 0.
+func (odb *OrderDatabase) CountUserOrders(ctx context.Context, userID string) (_ int64, err error) {
+	ctx, span := odb.startSpan(ctx, "CountUserOrders", attribute.String("user.id", userID))
+	defer func() { endSpan(span, err) }()
+
+	if err = odb.beginOp(); err != nil {
+		return 0, err
+	}
+	defer odb.endOp()
+
+	ctx, cancel := odb.withQueryTimeout(ctx)
+	defer cancel()
+
+	var count int64
+	err = odb.withReadRetry(ctx, "CountUserOrders", func(q *sql.DB) (err error) {
+		count, err = odb.countUserOrders(ctx, q, userID)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (odb *OrderDatabase) countUserOrders(ctx context.Context, q queryer, userID string) (int64, error) {
+	var count int64
+	countQuery := `SELECT COUNT(*) FROM orders WHERE user_id = $1`
+	if err := odb.queryRowContext(ctx, q, countQuery, userID).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count orders: %w", err)
+	}
+	return count, nil
+}
+
+// GetUserOrdersPaged returns one page of the user's orders, newest first
+// with ties broken by order ID, together with the total number of orders
+// the user has. limit is capped at maxOrdersPageSize.
+func (odb *OrderDatabase) GetUserOrdersPaged(ctx context.Context, userID string, limit, offset int) (_ []*OrderRecord, _ int, err error) {
+	ctx, span := odb.startSpan(ctx, "GetUserOrdersPaged",
+		attribute.String("user.id", userID),
+		attribute.Int("page.limit", limit),
+		attribute.Int("page.offset", offset),
+	)
+	defer func() { endSpan(span, err) }()
+
+	if err = odb.beginOp(); err != nil {
+		return nil, 0, err
+	}
+	defer odb.endOp()
+
+	ctx, cancel := odb.withQueryTimeout(ctx)
+	defer cancel()
+
+	if limit <= 0 {
+		return nil, 0, fmt.Errorf("invalid page limit %d: must be positive", limit)
+	}
+	if offset < 0 {
+		return nil, 0, fmt.Errorf("invalid page offset %d: must not be negative", offset)
+	}
+	if limit > maxOrdersPageSize {
+		limit = maxOrdersPageSize
+	}
+
+	var orders []*OrderRecord
+	var total int
+	err = odb.withReadRetry(ctx, "GetUserOrdersPaged", func(q *sql.DB) (err error) {
+		orders, total, err = odb.getUserOrdersPaged(ctx, q, userID, limit, offset)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	span.SetAttributes(attribute.Int("db.rows_returned", len(orders)))
+	return orders, total, nil
+}
+
+func (odb *OrderDatabase) getUserOrdersPaged(ctx context.Context, q *sql.DB, userID string, limit, offset int) ([]*OrderRecord, int, error) {
+	// Repeatable read gives the count and the page the same snapshot, so the
+	// total can't disagree with the rows returned.
+	tx, err := q.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	total, err := odb.countUserOrders(ctx, tx, userID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	orderQuery := selectOrdersQuery + `
+		WHERE user_id = $1
+		ORDER BY created_at DESC, order_id DESC
+		LIMIT $2 OFFSET $3
+	`
+
+	orders, err := odb.queryOrders(ctx, tx, orderQuery, userID, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return orders, int(total), nil
+}
+
+// queryOrders runs an order query built on selectOrdersQuery and attaches
+// the items of every returned order, preserving the query's row order.
+func (odb *OrderDatabase) queryOrders(ctx context.Context, q queryer, orderQuery string, args ...interface{}) ([]*OrderRecord, error) {
+	orders, err := odb.queryOrderRows(ctx, q, orderQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	if err := odb.attachOrderItems(ctx, q, orders); err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+// queryOrderRows is queryOrders without the items.
+func (odb *OrderDatabase) queryOrderRows(ctx context.Context, q queryer, orderQuery string, args ...interface{}) ([]*OrderRecord, error) {
+	rows, err := odb.queryContext(ctx, q, orderQuery, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query orders: %w", err)
+	}
+	defer rows.Close()
+
+	var orders []*OrderRecord
+	for rows.Next() {
+		record, err := odb.scanOrder(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan order: %w", err)
+		}
+		orders = append(orders, record)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating orders: %w", err)
+	}
+	return orders, nil
+}
+
+// attachOrderItems loads the items of orders in a single query and sets
+// them on each order.
+func (odb *OrderDatabase) attachOrderItems(ctx context.Context, q queryer, orders []*OrderRecord) error {
+	if len(orders) == 0 {
+		return nil
+	}
+
+	orderIDs := make([]string, len(orders))
+	for i, record := range orders {
+		orderIDs[i] = record.Order.OrderId
+	}
+
+	items, err := odb.getOrderItems(ctx, q, orderIDs)
+	if err != nil {
+		return err
+	}
+	for _, record := range orders {
+		record.Order.Items = items[record.Order.OrderId]
+	}
+	return nil
+}
+
+// scanOrder reads a row of selectOrdersQuery, decrypting the shipping
+// address if it was stored encrypted.
+func (odb *OrderDatabase) scanOrder(row rowScanner) (*OrderRecord, error) {
 	var order pb.OrderResult
-	var shippingCost pb.Money
+	var total, shippingCost pb.Money
 	var address pb.Address
+	var status OrderStatus
+	var createdAt, updatedAt time.Time
+	var cancelledAt sql.NullTime
+	var cancellationReason sql.NullString
+	var version int64
 
-	err := odb.db.QueryRowContext(ctx, orderQuery, orderID).Scan(
+	err := row.Scan(
 		&order.OrderId,
 		&order.ShippingTrackingId,
+		&total.Units,
+		&total.Nanos,
+		&total.CurrencyCode,
 		&shippingCost.Units,
 		&shippingCost.Nanos,
+		&shippingCost.CurrencyCode,
 		&address.StreetAddress,
 		&address.City,
 		&address.State,
 		&address.Country,
 		&address.ZipCode,
+		&status,
+		&createdAt,
+		&updatedAt,
+		&cancelledAt,
+		&cancellationReason,
+		&version,
 	)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("order not found: %s", orderID)
-		}
-		return nil, fmt.Errorf("failed to query order: %w", err)
+		return nil, err
+	}
+
+	if err = odb.decryptAddress(&address); err != nil {
+		return nil, err
 	}
 
 	order.ShippingCost = &shippingCost
 	order.ShippingAddress = &address
+	return &OrderRecord{
+		Order:              &order,
+		Total:              &total,
+		Status:             status,
+		CreatedAt:          createdAt,
+		UpdatedAt:          updatedAt,
+		CancelledAt:        cancelledAt.Time,
+		CancellationReason: cancellationReason.String,
+		Version:            version,
+	}, nil
+}
 
+// getOrderItems loads the items of all the given orders in a single query,
+// keyed by order ID. Orders without items have no entry in the map.
+func (odb *OrderDatabase) getOrderItems(ctx context.Context, q queryer, orderIDs []string) (map[string][]*pb.OrderItem, error) {
+	idCond, args := odb.dialect.anyOf("order_id", 1, orderIDs)
 	itemsQuery := `
-		SELECT product_id, quantity, cost_units, cost_nanos
-		FROM order_items 
-		WHERE order_id = $1
+		SELECT order_id, product_id, quantity, cost_units, cost_nanos, cost_currency
+		FROM order_items
+		WHERE ` + idCond + `
+		ORDER BY order_id, id
 	`
 
-	rows, err := odb.db.QueryContext(ctx, itemsQuery, orderID)
+	rows, err := odb.queryContext(ctx, q, itemsQuery, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query order items: %w", err)
 	}
 	defer rows.Close()
 
-	var items []*pb.OrderItem
+	items := make(map[string][]*pb.OrderItem, len(orderIDs))
 	for rows.Next() {
+		var orderID string
 		var item pb.OrderItem
 		var cartItem pb.CartItem
 		var cost pb.Money
 
 		err := rows.Scan(
+			&orderID,
 			&cartItem.ProductId,
 			&cartItem.Quantity,
 			&cost.Units,
 			&cost.Nanos,
+			&cost.CurrencyCode,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan order item: %w", err)
@@ -181,101 +1207,12 @@ func (odb *OrderDatabase) GetOrder(ctx context.Context, orderID string) (*pb.Ord
 
 		item.Item = &cartItem
 		item.Cost = &cost
-		items = append(items, &item)
+		items[orderID] = append(items[orderID], &item)
 	}
 
 	if err = rows.Err(); err != nil {
 		return nil, fmt.Errorf("error iterating order items: %w", err)
 	}
 
-	order.Items = items
-	return &order, nil
-}
-
-func (odb *OrderDatabase) GetUserOrders(ctx context.Context, userID string) ([]*pb.OrderResult, error) {
-	orderQuery := `
-		SELECT 
-			order_id, shipping_tracking_id,
-			shipping_cost_units, shipping_cost_nanos,
-			shipping_address_street, shipping_address_city,
-			shipping_address_state, shipping_address_country,
-			shipping_address_zip
-		FROM orders 
-		WHERE user_id = $1
-		ORDER BY created_at DESC
-	`
-
-	rows, err := odb.db.QueryContext(ctx, orderQuery, userID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to query orders: %w", err)
-	}
-	defer rows.Close()
-
-	var orders []*pb.OrderResult
-	for rows.Next() {
-		var order pb.OrderResult
-		var shippingCost pb.Money
-		var address pb.Address
-
-		err := rows.Scan(
-			&order.OrderId,
-			&order.ShippingTrackingId,
-			&shippingCost.Units,
-			&shippingCost.Nanos,
-			&address.StreetAddress,
-			&address.City,
-			&address.State,
-			&address.Country,
-			&address.ZipCode,
-		)
-		if err != nil {
-			return nil, fmt.Errorf("failed to scan order: %w", err)
-		}
-
-		order.ShippingCost = &shippingCost
-		order.ShippingAddress = &address
-
-		itemsQuery := `
-			SELECT product_id, quantity, cost_units, cost_nanos
-			FROM order_items 
-			WHERE order_id = $1
-		`
-
-		itemRows, err := odb.db.QueryContext(ctx, itemsQuery, order.OrderId)
-		if err != nil {
-			return nil, fmt.Errorf("failed to query order items: %w", err)
-		}
-
-		var items []*pb.OrderItem
-		for itemRows.Next() {
-			var item pb.OrderItem
-			var cartItem pb.CartItem
-			var cost pb.Money
-
-			err := itemRows.Scan(
-				&cartItem.ProductId,
-				&cartItem.Quantity,
-				&cost.Units,
-				&cost.Nanos,
-			)
-			if err != nil {
-				itemRows.Close()
-				return nil, fmt.Errorf("failed to scan order item: %w", err)
-			}
-
-			item.Item = &cartItem
-			item.Cost = &cost
-			items = append(items, &item)
-		}
-		itemRows.Close()
-
-		order.Items = items
-		orders = append(orders, &order)
-	}
-
-	if err = rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating orders: %w", err)
-	}
-
-	return orders, nil
+	return items, nil
 }
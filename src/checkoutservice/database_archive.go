@@ -0,0 +1,163 @@
+// Copyright 2024
+// Moving old finished orders to the archive tables
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// archivableStatuses are the statuses ArchiveOrders moves. An order in any
+// other status may still change, so it stays in the hot tables.
+var archivableStatuses = []string{string(OrderStatusShipped), string(OrderStatusCancelled)}
+
+// archivedOrderColumns are the orders columns copied to orders_archive.
+const archivedOrderColumns = `order_id, user_id, user_email, user_currency, shipping_tracking_id,
+	total_amount_units, total_amount_nanos, total_amount_currency,
+	shipping_cost_units, shipping_cost_nanos, shipping_cost_currency,
+	shipping_address_street, shipping_address_city, shipping_address_state,
+	shipping_address_country, shipping_address_zip,
+	status, cancelled_at, cancellation_reason, created_at, updated_at, version`
+
+// ArchiveOrders moves SHIPPED and CANCELLED orders created before olderThan,
+// with their items, events and payment details, from the hot tables to
+// orders_archive and its companions, and returns how many it moved. Orders
+// in any other status are never archived. The orders are moved oldest
+// first in transactions of up to batchSize orders, so a failure or
+// cancellation part way loses nothing: the batches already committed stay
+// archived, the count of them is returned with the error, and calling
+// ArchiveOrders again carries on where it stopped. The query timeout and
+// retries apply to each batch. Archived orders are no longer returned by
+// GetOrder or any other read. An order with events still waiting in
+// order_outbox is left until they have been published, since archiving
+// it would delete them.
+func (odb *OrderDatabase) ArchiveOrders(ctx context.Context, olderThan time.Time, batchSize int) (archived int, err error) {
+	ctx, span := odb.startSpan(ctx, "ArchiveOrders", attribute.Int("db.batch_size", batchSize))
+	defer func() {
+		span.SetAttributes(attribute.Int("order.archived_count", archived))
+		endSpan(span, err)
+	}()
+
+	if err = odb.beginOp(); err != nil {
+		return 0, err
+	}
+	defer odb.endOp()
+
+	if batchSize <= 0 {
+		return 0, fmt.Errorf("batch size must be positive, got %d", batchSize)
+	}
+
+	olderThan = olderThan.UTC()
+	for {
+		n, err := odb.archiveBatch(ctx, olderThan, batchSize)
+		archived += n
+		if err != nil || n < batchSize {
+			return archived, err
+		}
+	}
+}
+
+// archiveBatch archives up to batchSize orders in one transaction and
+// reports how many it archived.
+func (odb *OrderDatabase) archiveBatch(ctx context.Context, olderThan time.Time, batchSize int) (int, error) {
+	ctx, cancel := odb.withQueryTimeout(ctx)
+	defer cancel()
+
+	var orderIDs []string
+	err := odb.withRetry(ctx, "ArchiveOrders", func() error {
+		return odb.withTx(ctx, func(tx *sql.Tx) (err error) {
+			orderIDs, err = odb.archiveOrders(ctx, tx, olderThan, batchSize)
+			return err
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, orderID := range orderIDs {
+		odb.cache.invalidate(orderID)
+	}
+	return len(orderIDs), nil
+}
+
+// archiveOrders moves the oldest batchSize eligible orders in tx and
+// returns their IDs.
+func (odb *OrderDatabase) archiveOrders(ctx context.Context, tx *sql.Tx, olderThan time.Time, batchSize int) ([]string, error) {
+	// Outbox events go with their order by ON DELETE CASCADE, so an order
+	// whose events the relay hasn't published yet has to stay.
+	statusCond, statusArgs := odb.dialect.anyOf("status", 3, archivableStatuses)
+	selectQuery := `
+		SELECT order_id FROM orders
+		WHERE ` + statusCond + ` AND created_at < $1
+			AND NOT EXISTS (
+				SELECT 1 FROM order_outbox
+				WHERE order_outbox.order_id = orders.order_id AND order_outbox.published_at IS NULL)
+		ORDER BY created_at, order_id
+		LIMIT $2` + odb.dialect.lockRows()
+	rows, err := odb.queryContext(ctx, tx, selectQuery, append([]interface{}{olderThan, batchSize}, statusArgs...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select orders to archive: %w", err)
+	}
+	defer rows.Close()
+
+	var orderIDs []string
+	for rows.Next() {
+		var orderID string
+		if err := rows.Scan(&orderID); err != nil {
+			return nil, fmt.Errorf("failed to scan order to archive: %w", err)
+		}
+		orderIDs = append(orderIDs, orderID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to select orders to archive: %w", err)
+	}
+	rows.Close()
+	if len(orderIDs) == 0 {
+		return nil, nil
+	}
+
+	// The archive's foreign keys point at orders_archive, so the order is
+	// copied first and deleted last.
+	archivedAt := time.Now().UTC()
+	idCond, idArgs := odb.dialect.anyOf("order_id", 2, orderIDs)
+	copyOrders := `
+		INSERT INTO orders_archive (` + archivedOrderColumns + `, archived_at)
+		SELECT ` + archivedOrderColumns + `, $1 FROM orders WHERE ` + idCond
+	if _, err := odb.execContext(ctx, tx, copyOrders, append([]interface{}{archivedAt}, idArgs...)...); err != nil {
+		return nil, fmt.Errorf("failed to archive orders: %w", err)
+	}
+
+	idCond, idArgs = odb.dialect.anyOf("order_id", 1, orderIDs)
+	steps := []struct {
+		what, query string
+	}{
+		{"items", `
+			INSERT INTO order_items_archive (id, order_id, product_id, quantity, cost_units, cost_nanos, cost_currency, created_at)
+			SELECT id, order_id, product_id, quantity, cost_units, cost_nanos, cost_currency, created_at
+			FROM order_items WHERE ` + idCond},
+		{"events", `
+			INSERT INTO order_events_archive (id, order_id, event_type, from_status, to_status, actor, detail, created_at)
+			SELECT id, order_id, event_type, from_status, to_status, actor, detail, created_at
+			FROM order_events WHERE ` + idCond},
+		{"payments", `
+			INSERT INTO order_payments_archive (order_id, card_last_four, card_type, payment_processor_txn_id, authorized, created_at)
+			SELECT order_id, card_last_four, card_type, payment_processor_txn_id, authorized, created_at
+			FROM order_payments WHERE ` + idCond},
+	}
+	for _, step := range steps {
+		if _, err := odb.execContext(ctx, tx, step.query, idArgs...); err != nil {
+			return nil, fmt.Errorf("failed to archive %s: %w", step.what, err)
+		}
+	}
+
+	// The items, events, payments and published outbox events go with the
+	// orders by ON DELETE CASCADE.
+	if _, err := odb.execContext(ctx, tx, `DELETE FROM orders WHERE `+idCond, idArgs...); err != nil {
+		return nil, fmt.Errorf("failed to delete archived orders: %w", err)
+	}
+	return orderIDs, nil
+}
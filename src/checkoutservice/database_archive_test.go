@@ -0,0 +1,84 @@
+// Copyright 2024
+// Tests for archiving old orders
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+// expectArchiveBatch expects a batch that archives orderIDs.
+func expectArchiveBatch(mock sqlmock.Sqlmock, cutoff time.Time, batchSize int, orderIDs ...string) {
+	rows := sqlmock.NewRows([]string{"order_id"})
+	for _, orderID := range orderIDs {
+		rows.AddRow(orderID)
+	}
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT order_id FROM orders\s+WHERE status = ANY\(\$3\) AND created_at < \$1\s+AND NOT EXISTS \(\s*SELECT 1 FROM order_outbox\s+WHERE order_outbox\.order_id = orders\.order_id AND order_outbox\.published_at IS NULL\)\s+ORDER BY created_at, order_id\s+LIMIT \$2 FOR UPDATE`).
+		WithArgs(cutoff, batchSize, pq.Array(archivableStatuses)).
+		WillReturnRows(rows)
+	if len(orderIDs) > 0 {
+		mock.ExpectExec(`INSERT INTO orders_archive .+ SELECT .+, \$1 FROM orders WHERE order_id = ANY\(\$2\)`).
+			WithArgs(recentUTC{}, pq.Array(orderIDs)).
+			WillReturnResult(sqlmock.NewResult(0, int64(len(orderIDs))))
+		mock.ExpectExec(`INSERT INTO order_items_archive`).WithArgs(pq.Array(orderIDs)).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(`INSERT INTO order_events_archive`).WithArgs(pq.Array(orderIDs)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(`INSERT INTO order_payments_archive`).WithArgs(pq.Array(orderIDs)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(`DELETE FROM orders WHERE order_id = ANY\(\$1\)`).
+			WithArgs(pq.Array(orderIDs)).
+			WillReturnResult(sqlmock.NewResult(0, int64(len(orderIDs))))
+	}
+	mock.ExpectCommit()
+}
+
+func TestArchiveOrdersRunsBatchesUntilShort(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	cutoff := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	expectArchiveBatch(mock, cutoff, 2, "order-1", "order-2")
+	expectArchiveBatch(mock, cutoff, 2, "order-3")
+
+	archived, err := odb.ArchiveOrders(context.Background(), cutoff, 2)
+	if err != nil {
+		t.Fatalf("ArchiveOrders() error = %v", err)
+	}
+	if archived != 3 {
+		t.Errorf("ArchiveOrders() = %d, want 3", archived)
+	}
+}
+
+func TestArchiveOrdersKeepsCommittedBatchesOnFailure(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	cutoff := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	errBoom := errors.New("boom")
+
+	expectArchiveBatch(mock, cutoff, 1, "order-1")
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT order_id FROM orders`).
+		WillReturnRows(sqlmock.NewRows([]string{"order_id"}).AddRow("order-2"))
+	mock.ExpectExec(`INSERT INTO orders_archive`).WillReturnError(errBoom)
+	mock.ExpectRollback()
+
+	archived, err := odb.ArchiveOrders(context.Background(), cutoff, 1)
+	if !errors.Is(err, errBoom) {
+		t.Errorf("ArchiveOrders() error = %v, want %v", err, errBoom)
+	}
+	if archived != 1 {
+		t.Errorf("ArchiveOrders() = %d, want the 1 order of the committed batch", archived)
+	}
+}
+
+func TestArchiveOrdersRejectsNonPositiveBatchSize(t *testing.T) {
+	odb, _ := newMockOrderDatabase(t)
+	for _, batchSize := range []int{0, -1} {
+		if _, err := odb.ArchiveOrders(context.Background(), time.Now(), batchSize); err == nil {
+			t.Errorf("ArchiveOrders(batchSize=%d) error = nil, want an error", batchSize)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+// Copyright 2024
+// Bulk loading of orders with multi-row inserts
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// maxInsertParams caps the placeholders in one multi-row INSERT, well
+// under the 65535 Postgres and MySQL allow and SQLite's 32766: the SQLite
+// driver takes time quadratic in the number of values to bind them, and
+// past a few hundred rows bigger statements save little round-trip time.
+const maxInsertParams = 4096
+
+var (
+	bulkOrderColumns = []string{
+		"order_id", "user_id", "user_email", "user_currency", "shipping_tracking_id",
+		"total_amount_units", "total_amount_nanos", "total_amount_currency",
+		"shipping_cost_units", "shipping_cost_nanos", "shipping_cost_currency",
+		"shipping_address_street", "shipping_address_city", "shipping_address_state",
+		"shipping_address_country", "shipping_address_zip",
+		"status", "created_at", "updated_at", "cancelled_at", "cancellation_reason", "version",
+		"user_email_lookup",
+	}
+	bulkItemColumns = []string{
+		"order_id", "product_id", "quantity", "cost_units", "cost_nanos", "cost_currency", "created_at",
+	}
+	bulkPaymentColumns = []string{
+		"order_id", "card_last_four", "card_type", "payment_processor_txn_id", "authorized", "created_at",
+	}
+)
+
+// SaveOrders writes orders, with their items and payments, in a single
+// transaction using multi-row INSERTs, for loading historical orders in
+// bulk. Unlike SaveOrder it keeps each record's Status, timestamps,
+// cancellation and Version, and takes the customer from UserID, Email and
+// UserCurrency and the address from Order.ShippingAddress. A zero Status
+// means PAID, a zero CreatedAt now, a zero UpdatedAt CreatedAt and a
+// Version below 1 means 1. The orders were placed in the past, so unlike
+// SaveOrder it writes no OutboxOrderPlaced events and they are never
+// published from order_outbox.
+//
+// The batch is all or nothing: if any order is invalid or can't be
+// inserted, none are saved, and the error says which order failed by its
+// position in orders and its ID. An order ID that is already taken fails
+// with ErrOrderConflict even if the stored order is the same, so a batch
+// that failed can be fixed and saved again but one that succeeded can't.
+func (odb *OrderDatabase) SaveOrders(ctx context.Context, orders []OrderRecord) (err error) {
+	ctx, span := odb.startSpan(ctx, "SaveOrders", attribute.Int("order.count", len(orders)))
+	defer func() { endSpan(span, err) }()
+
+	if err = odb.beginOp(); err != nil {
+		return err
+	}
+	defer odb.endOp()
+
+	ctx, cancel := odb.withQueryTimeout(ctx)
+	defer cancel()
+
+	if len(orders) == 0 {
+		return nil
+	}
+	seen := make(map[string]int, len(orders))
+	for i := range orders {
+		if err = validateBulkOrder(&orders[i]); err != nil {
+			return fmt.Errorf("batch order %d: %w", i, err)
+		}
+		orderID := orders[i].Order.OrderId
+		if j, ok := seen[orderID]; ok {
+			return fmt.Errorf("batch order %d (%s): %w: same order ID as batch order %d", i, orderID, ErrOrderConflict, j)
+		}
+		seen[orderID] = i
+	}
+
+	defer func() {
+		for i := range orders {
+			odb.cache.invalidate(orders[i].Order.OrderId)
+		}
+	}()
+	return odb.withRetry(ctx, "SaveOrders", func() error {
+		return odb.saveOrders(ctx, orders)
+	})
+}
+
+// validateBulkOrder checks what SaveOrder checks, plus what SaveOrders
+// takes from the record rather than a PlaceOrderRequest.
+func validateBulkOrder(record *OrderRecord) error {
+	if record.Order == nil {
+		return fmt.Errorf("%w: order is missing", ErrInvalidItems)
+	}
+	if err := validateOrderItems(record.Order); err != nil {
+		return err
+	}
+	if err := validateOrderMoney(record.Order, record.Total); err != nil {
+		return err
+	}
+	if record.UserID == "" {
+		return fmt.Errorf("order %s: user ID is empty", record.Order.OrderId)
+	}
+	if err := validateOrderAddress(record.Order.ShippingAddress); err != nil {
+		return fmt.Errorf("order %s: %w", record.Order.OrderId, err)
+	}
+	if record.Status != "" && !record.Status.IsValid() {
+		return fmt.Errorf("order %s: unknown status %q", record.Order.OrderId, record.Status)
+	}
+	if record.Payment != nil {
+		if err := validatePayment(record.Payment); err != nil {
+			return fmt.Errorf("order %s: %w", record.Order.OrderId, err)
+		}
+	}
+	return nil
+}
+
+func (odb *OrderDatabase) saveOrders(ctx context.Context, orders []OrderRecord) error {
+	now := time.Now().UTC()
+	orderRows := make([][]interface{}, 0, len(orders))
+	var itemRows, paymentRows [][]interface{}
+	// itemOrders and paymentOrders map item and payment rows to their
+	// order's position in orders, for errors.
+	var itemOrders, paymentOrders []int
+	for i := range orders {
+		record := &orders[i]
+		row, createdAt, err := odb.bulkOrderRow(record, now)
+		if err != nil {
+			return fmt.Errorf("batch order %d (%s): %w", i, record.Order.OrderId, err)
+		}
+		orderRows = append(orderRows, row)
+
+		for _, item := range record.Order.Items {
+			itemRows = append(itemRows, []interface{}{
+				record.Order.OrderId,
+				item.Item.ProductId,
+				item.Item.Quantity,
+				item.Cost.Units,
+				item.Cost.Nanos,
+				item.Cost.CurrencyCode,
+				createdAt,
+			})
+			itemOrders = append(itemOrders, i)
+		}
+		if p := record.Payment; p != nil {
+			paymentRows = append(paymentRows, []interface{}{
+				record.Order.OrderId, p.CardLastFour, p.CardType, p.ProcessorTxnID, p.Authorized, createdAt,
+			})
+			paymentOrders = append(paymentOrders, i)
+		}
+	}
+
+	tx, err := odb.db.BeginTx(ctx, odb.opts.saveTxOptions())
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if first, last, err := odb.insertRows(ctx, tx, "orders", bulkOrderColumns, orderRows); err != nil {
+		if odb.dialect.isUniqueViolation(err) {
+			// The transaction is aborted, and on SQLite holds the only
+			// connection, so look for the taken ID after rolling back.
+			tx.Rollback()
+			return odb.findTakenOrderID(ctx, orders, first, last, err)
+		}
+		return fmt.Errorf("%s: failed to insert orders: %w", describeBatchOrders(orders, first, last), err)
+	}
+	if first, last, err := odb.insertRows(ctx, tx, "order_items", bulkItemColumns, itemRows); err != nil {
+		return fmt.Errorf("%s: failed to insert items: %w", describeBatchOrders(orders, itemOrders[first], itemOrders[last]), err)
+	}
+	if first, last, err := odb.insertRows(ctx, tx, "order_payments", bulkPaymentColumns, paymentRows); err != nil {
+		return fmt.Errorf("%s: failed to insert payments: %w", describeBatchOrders(orders, paymentOrders[first], paymentOrders[last]), err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	log.Infof("Saved %d orders to database", len(orders))
+	return nil
+}
+
+// bulkOrderRow returns the orders row for record, in bulkOrderColumns
+// order, with the defaults SaveOrders documents filled in, and the
+// creation time it stores.
+func (odb *OrderDatabase) bulkOrderRow(record *OrderRecord, now time.Time) ([]interface{}, time.Time, error) {
+	email, err := odb.encryptField(record.Email)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	address, err := odb.encryptAddress(record.Order.ShippingAddress)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	status := record.Status
+	if status == "" {
+		status = OrderStatusPaid
+	}
+	// The timestamp columns have no time zone, so always write UTC.
+	createdAt := record.CreatedAt.UTC()
+	if record.CreatedAt.IsZero() {
+		createdAt = now
+	}
+	updatedAt := record.UpdatedAt.UTC()
+	if record.UpdatedAt.IsZero() {
+		updatedAt = createdAt
+	}
+	cancelledAt := sql.NullTime{Time: record.CancelledAt.UTC(), Valid: !record.CancelledAt.IsZero()}
+	cancellationReason := sql.NullString{String: record.CancellationReason, Valid: record.CancellationReason != ""}
+	version := record.Version
+	if version < 1 {
+		version = 1
+	}
+
+	order := record.Order
+	return []interface{}{
+		order.OrderId,
+		record.UserID,
+		email,
+		record.UserCurrency,
+		order.ShippingTrackingId,
+		record.Total.Units,
+		record.Total.Nanos,
+		record.Total.CurrencyCode,
+		order.ShippingCost.Units,
+		order.ShippingCost.Nanos,
+		order.ShippingCost.CurrencyCode,
+		address.StreetAddress,
+		address.City,
+		address.State,
+		address.Country,
+		address.ZipCode,
+		status,
+		createdAt,
+		updatedAt,
+		cancelledAt,
+		cancellationReason,
+		version,
+		odb.emailLookup(record.Email),
+	}, createdAt, nil
+}
+
+// insertRows inserts rows into table with multi-row INSERTs of as many
+// rows as maxInsertParams allows. If one fails, it returns the positions in
+// rows of the first and last row of that INSERT with the error.
+func (odb *OrderDatabase) insertRows(ctx context.Context, tx *sql.Tx, table string, columns []string, rows [][]interface{}) (first, last int, err error) {
+	chunkSize := maxInsertParams / len(columns)
+	for start := 0; start < len(rows); start += chunkSize {
+		end := min(start+chunkSize, len(rows))
+
+		var query strings.Builder
+		query.WriteString("INSERT INTO " + table + " (" + strings.Join(columns, ", ") + ") VALUES ")
+		args := make([]interface{}, 0, (end-start)*len(columns))
+		placeholders := make([]string, len(columns))
+		for i, row := range rows[start:end] {
+			for j := range columns {
+				placeholders[j] = fmt.Sprintf("$%d", len(args)+j+1)
+			}
+			if i > 0 {
+				query.WriteString(", ")
+			}
+			query.WriteString("(" + strings.Join(placeholders, ", ") + ")")
+			args = append(args, row...)
+		}
+
+		if _, err := odb.execContext(ctx, tx, query.String(), args...); err != nil {
+			return start, end - 1, err
+		}
+	}
+	return 0, 0, nil
+}
+
+// findTakenOrderID is called when the INSERT of the orders at positions
+// first to last of a SaveOrders batch hit a unique violation. It returns
+// ErrOrderConflict naming the first of them whose ID is taken.
+func (odb *OrderDatabase) findTakenOrderID(ctx context.Context, orders []OrderRecord, first, last int, insertErr error) error {
+	orderIDs := make([]string, 0, last-first+1)
+	for i := first; i <= last; i++ {
+		orderIDs = append(orderIDs, orders[i].Order.OrderId)
+	}
+	idCond, args := odb.dialect.anyOf("order_id", 1, orderIDs)
+	rows, err := odb.queryContext(ctx, odb.db, `SELECT order_id FROM orders WHERE `+idCond, args...)
+	if err != nil {
+		return fmt.Errorf("%s: %w: %w", describeBatchOrders(orders, first, last), ErrOrderConflict, insertErr)
+	}
+	defer rows.Close()
+
+	taken := make(map[string]bool)
+	for rows.Next() {
+		var orderID string
+		if err := rows.Scan(&orderID); err != nil {
+			return fmt.Errorf("failed to scan existing order: %w", err)
+		}
+		taken[orderID] = true
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to query existing orders: %w", err)
+	}
+	for i, orderID := range orderIDs {
+		if taken[orderID] {
+			return fmt.Errorf("batch order %d (%s): %w: order ID is already taken", first+i, orderID, ErrOrderConflict)
+		}
+	}
+	// Taken by an order that has since been deleted.
+	return fmt.Errorf("%s: %w: %w", describeBatchOrders(orders, first, last), ErrOrderConflict, insertErr)
+}
+
+// describeBatchOrders names the orders at positions first to last of a
+// SaveOrders batch, for errors about a statement that wrote all of them.
+func describeBatchOrders(orders []OrderRecord, first, last int) string {
+	if first == last {
+		return fmt.Sprintf("batch order %d (%s)", first, orders[first].Order.OrderId)
+	}
+	return fmt.Sprintf("batch orders %d (%s) to %d (%s)", first, orders[first].Order.OrderId, last, orders[last].Order.OrderId)
+}
@@ -0,0 +1,84 @@
+// Copyright 2024
+// Tests for bulk loading orders
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// newBulkOrder returns the newTestOrder fixture as a SaveOrders record.
+func newBulkOrder(orderID string) OrderRecord {
+	req, result, total := newTestOrder(orderID)
+	return OrderRecord{Order: result, Total: total, UserID: req.UserId, Email: req.Email, UserCurrency: req.UserCurrency}
+}
+
+func TestSaveOrdersWritesMultiRowInserts(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	orders := []OrderRecord{newBulkOrder("order-1"), newBulkOrder("order-2")}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO orders \(order_id, .+\) VALUES \(\$1, .+, \$23\), \(\$24, .+, \$46\)`).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`INSERT INTO order_items \(order_id, .+\) VALUES \(\$1, .+\), \(.+\), \(.+\), \(\$22, .+, \$28\)`).
+		WillReturnResult(sqlmock.NewResult(0, 4))
+	mock.ExpectCommit()
+
+	if err := odb.SaveOrders(context.Background(), orders); err != nil {
+		t.Fatalf("SaveOrders() error = %v", err)
+	}
+}
+
+func TestSaveOrdersRejectsInvalidOrderBeforeWriting(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*OrderRecord)
+		wantErr error
+	}{
+		{"no items", func(r *OrderRecord) { r.Order.Items = nil }, ErrInvalidItems},
+		{"bad money", func(r *OrderRecord) { r.Total.Nanos = -1 }, ErrInvalidMoney},
+		{"no address", func(r *OrderRecord) { r.Order.ShippingAddress = nil }, ErrInvalidAddress},
+		{"duplicate ID", func(r *OrderRecord) { r.Order.OrderId = "order-1" }, ErrOrderConflict},
+		{"card number", func(r *OrderRecord) { r.Payment = &PaymentInfo{CardLastFour: "4432801561520454"} }, ErrInvalidPayment},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// No expectations: nothing may reach the database.
+			odb, _ := newMockOrderDatabase(t)
+			orders := []OrderRecord{newBulkOrder("order-1"), newBulkOrder("order-2"), newBulkOrder("order-3")}
+			tt.modify(&orders[1])
+
+			err := odb.SaveOrders(context.Background(), orders)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("SaveOrders() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "batch order 1") {
+				t.Errorf("SaveOrders() error = %v, want it to name batch order 1", err)
+			}
+		})
+	}
+}
+
+func TestSaveOrdersRollsBackWhenItemsFail(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	orders := []OrderRecord{newBulkOrder("order-1")}
+	errBoom := errors.New("boom")
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO orders`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO order_items`).WillReturnError(errBoom)
+	mock.ExpectRollback()
+
+	err := odb.SaveOrders(context.Background(), orders)
+	if !errors.Is(err, errBoom) {
+		t.Errorf("SaveOrders() error = %v, want %v", err, errBoom)
+	}
+	if err != nil && !strings.Contains(err.Error(), "batch order 0 (order-1)") {
+		t.Errorf("SaveOrders() error = %v, want it to name the order", err)
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2024
+// In-process cache of GetOrder results
+
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// WithOrderCache caches up to size GetOrder results for ttl, evicting the
+// least recently used order when full. Writes made through this
+// OrderDatabase drop the order from the cache, and WithTx empties it, but
+// writes from other processes are only seen once an entry expires, so keep
+// ttl short. The cache is off by default, and size or ttl of zero or less
+// leave it off.
+func WithOrderCache(size int, ttl time.Duration) Option {
+	return func(o *dbOptions) {
+		o.orderCacheSize = size
+		o.orderCacheTTL = ttl
+	}
+}
+
+// orderCache is an LRU cache of orders with a fixed time to live. A nil
+// *orderCache is a disabled cache: it never hits and ignores writes.
+type orderCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	now     func() time.Time
+	entries map[string]*list.Element
+	// lru holds *orderCacheEntry values, most recently used first.
+	lru *list.List
+	// generation increases with every invalidation, so that a read which
+	// started before a write can't cache what it read afterwards.
+	generation uint64
+}
+
+type orderCacheEntry struct {
+	orderID string
+	record  *OrderRecord
+	expires time.Time
+}
+
+// newOrderCache returns nil, a disabled cache, unless both size and ttl
+// are positive.
+func newOrderCache(size int, ttl time.Duration) *orderCache {
+	if size <= 0 || ttl <= 0 {
+		return nil
+	}
+	return &orderCache{
+		size:    size,
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[string]*list.Element, size),
+		lru:     list.New(),
+	}
+}
+
+// get returns a copy of the cached order, which the caller may modify.
+func (c *orderCache) get(orderID string) (*OrderRecord, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[orderID]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*orderCacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.removeLocked(elem)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return copyOrderRecord(entry.record), true
+}
+
+// startRead returns the generation to pass to put once the read is done.
+func (c *orderCache) startRead() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// put caches a copy of record, unless an invalidation happened since the
+// read that produced it started.
+func (c *orderCache) put(orderID string, record *OrderRecord, generation uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+	entry := &orderCacheEntry{orderID: orderID, record: copyOrderRecord(record), expires: c.now().Add(c.ttl)}
+	if elem, ok := c.entries[orderID]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[orderID] = c.lru.PushFront(entry)
+	if c.lru.Len() > c.size {
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+// invalidate drops orderID from the cache. Call it after the write that
+// changed the order has committed.
+func (c *orderCache) invalidate(orderID string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	if elem, ok := c.entries[orderID]; ok {
+		c.removeLocked(elem)
+	}
+}
+
+// invalidateAll empties the cache, for writes whose orders aren't known.
+func (c *orderCache) invalidateAll() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.entries = make(map[string]*list.Element, c.size)
+	c.lru.Init()
+}
+
+func (c *orderCache) removeLocked(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*orderCacheEntry).orderID)
+}
+
+func (c *orderCache) len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
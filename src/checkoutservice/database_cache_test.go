@@ -0,0 +1,183 @@
+// Copyright 2024
+// Tests for the GetOrder cache
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+func newMockCachedOrderDatabase(t *testing.T) (*OrderDatabase, sqlmock.Sqlmock) {
+	t.Helper()
+	odb, mock := newMockOrderDatabase(t)
+	odb.cache = newOrderCache(10, time.Minute)
+	return odb, mock
+}
+
+func TestGetOrderCacheHitSkipsDatabase(t *testing.T) {
+	odb, mock := newMockCachedOrderDatabase(t)
+	ctx := context.Background()
+
+	// Only one lookup is expected: sqlmock fails any further query.
+	expectGetOrder(mock, "order-1")
+
+	first, err := odb.GetOrder(ctx, "order-1")
+	if err != nil {
+		t.Fatalf("GetOrder() error = %v", err)
+	}
+	first.Status = OrderStatusShipped
+	first.Order.ShippingTrackingId = "changed by the caller"
+
+	for i := 0; i < 3; i++ {
+		got, err := odb.GetOrder(ctx, "order-1")
+		if err != nil {
+			t.Fatalf("cached GetOrder() error = %v", err)
+		}
+		if got.Status != OrderStatusPaid || got.Order.ShippingTrackingId != "track-order-1" {
+			t.Errorf("cached GetOrder() = %v, %v, want the order as read from the database", got.Status, got.Order.ShippingTrackingId)
+		}
+	}
+}
+
+func TestWritesInvalidateCachedOrder(t *testing.T) {
+	tests := []struct {
+		name   string
+		expect func(mock sqlmock.Sqlmock)
+		write  func(ctx context.Context, odb *OrderDatabase) error
+	}{
+		{
+			"UpdateOrderStatus",
+			func(mock sqlmock.Sqlmock) {
+				expectLockOrderStatus(mock, OrderStatusPaid, 1)
+				mock.ExpectExec(`UPDATE orders`).
+					WithArgs("SHIPPED", sqlmock.AnyArg(), "order-1", pq.Array([]string{"PAID"})).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`INSERT INTO order_events`).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			},
+			func(ctx context.Context, odb *OrderDatabase) error {
+				return odb.UpdateOrderStatus(ctx, "order-1", OrderStatusShipped)
+			},
+		},
+		{
+			"CancelOrder",
+			func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT status FROM orders`).
+					WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("PAID"))
+				mock.ExpectExec(`UPDATE orders`).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`INSERT INTO order_events`).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			},
+			func(ctx context.Context, odb *OrderDatabase) error {
+				return odb.CancelOrder(ctx, "order-1", "changed my mind")
+			},
+		},
+		{
+			"SaveOrder",
+			func(mock sqlmock.Sqlmock) {
+				_, result, _ := newTestOrder("order-1")
+				expectPrepareSaveOrder(mock)
+				expectSaveOrder(mock, result)
+			},
+			func(ctx context.Context, odb *OrderDatabase) error {
+				req, result, total := newTestOrder("order-1")
+				return odb.SaveOrder(ctx, req, result, total)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			odb, mock := newMockCachedOrderDatabase(t)
+			ctx := context.Background()
+
+			expectGetOrder(mock, "order-1")
+			tt.expect(mock)
+			// The write drops the cached order, so it is read again.
+			expectGetOrder(mock, "order-1")
+
+			if _, err := odb.GetOrder(ctx, "order-1"); err != nil {
+				t.Fatalf("GetOrder() error = %v", err)
+			}
+			if err := tt.write(ctx, odb); err != nil {
+				t.Fatalf("%s() error = %v", tt.name, err)
+			}
+			if _, err := odb.GetOrder(ctx, "order-1"); err != nil {
+				t.Fatalf("GetOrder() after %s error = %v", tt.name, err)
+			}
+		})
+	}
+}
+
+func TestGetOrderWithoutCacheAlwaysQueries(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	expectGetOrder(mock, "order-1")
+	expectGetOrder(mock, "order-1")
+
+	for i := 0; i < 2; i++ {
+		if _, err := odb.GetOrder(context.Background(), "order-1"); err != nil {
+			t.Fatalf("GetOrder() error = %v", err)
+		}
+	}
+}
+
+func TestOrderCacheExpiresAndEvicts(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	c := newOrderCache(2, time.Minute)
+	c.now = func() time.Time { return now }
+	record := func(orderID string) *OrderRecord {
+		_, result, total := newTestOrder(orderID)
+		return &OrderRecord{Order: result, Total: total}
+	}
+
+	c.put("order-1", record("order-1"), c.startRead())
+	c.put("order-2", record("order-2"), c.startRead())
+	if _, ok := c.get("order-1"); !ok {
+		t.Fatal("get(order-1) missed right after put")
+	}
+	// order-2 is now the least recently used and makes room for order-3.
+	c.put("order-3", record("order-3"), c.startRead())
+	if _, ok := c.get("order-2"); ok {
+		t.Error("get(order-2) hit, want it evicted")
+	}
+	if c.len() != 2 {
+		t.Errorf("len() = %d, want 2", c.len())
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := c.get("order-1"); ok {
+		t.Error("get(order-1) hit after the TTL, want it expired")
+	}
+}
+
+func TestOrderCacheIgnoresReadsRacingAWrite(t *testing.T) {
+	c := newOrderCache(10, time.Minute)
+	_, result, total := newTestOrder("order-1")
+
+	generation := c.startRead()
+	c.invalidate("order-1")
+	c.put("order-1", &OrderRecord{Order: result, Total: total}, generation)
+	if _, ok := c.get("order-1"); ok {
+		t.Error("get() hit an order read before it was invalidated")
+	}
+}
+
+func TestNewOrderCacheDisabled(t *testing.T) {
+	for _, tt := range []struct {
+		size int
+		ttl  time.Duration
+	}{{0, time.Minute}, {10, 0}, {-1, -time.Second}} {
+		if c := newOrderCache(tt.size, tt.ttl); c != nil {
+			t.Errorf("newOrderCache(%d, %v) = %v, want nil", tt.size, tt.ttl, c)
+		}
+	}
+	o := newDBOptions([]Option{WithOrderCache(5, time.Second)})
+	if o.orderCacheSize != 5 || o.orderCacheTTL != time.Second {
+		t.Errorf("WithOrderCache(5, 1s) = %+v, want size 5 and ttl 1s", o)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2024
+// Claims on orders by fulfilment workers
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// defaultClaimTTL is how long a claim lasts without being renewed.
+const defaultClaimTTL = 5 * time.Minute
+
+// ErrOrderNotClaimed is returned by ReleaseOrder when the worker doesn't
+// hold the claim on the order, for example because it expired and another
+// worker took it over.
+var ErrOrderNotClaimed = errors.New("order is not claimed by this worker")
+
+// WithClaimTTL sets how long a ClaimOrder claim lasts before other workers
+// may take the order over. Workers must renew their claim, by claiming the
+// order again, well within d. Expiry is judged by the clock of the worker
+// claiming, so allow for clock skew between workers. Zero or less keeps the
+// default of five minutes.
+func WithClaimTTL(d time.Duration) Option {
+	return func(o *dbOptions) {
+		if d > 0 {
+			o.claimTTL = d
+		}
+	}
+}
+
+// ClaimOrder claims the order for workerID, so that only one fulfilment
+// worker processes it at a time. It reports whether the claim succeeded:
+// it does if the order is unclaimed, its claim has expired, or workerID
+// already holds it, in which case the claim is renewed. A worker that dies
+// stops renewing, and its orders become claimable once the claim TTL set
+// by WithClaimTTL passes. Claims don't change the order's version, so they
+// don't make concurrent edits fail.
+func (odb *OrderDatabase) ClaimOrder(ctx context.Context, orderID, workerID string) (_ bool, err error) {
+	ctx, span := odb.startSpan(ctx, "ClaimOrder",
+		attribute.String("order.id", orderID),
+		attribute.String("worker.id", workerID),
+	)
+	defer func() { endSpan(span, err) }()
+
+	if err = odb.beginOp(); err != nil {
+		return false, err
+	}
+	defer odb.endOp()
+
+	ctx, cancel := odb.withQueryTimeout(ctx)
+	defer cancel()
+
+	if workerID == "" {
+		return false, errors.New("worker ID is empty")
+	}
+
+	claimQuery := `
+		UPDATE orders
+		SET claimed_by = $1, claimed_at = $2
+		WHERE order_id = $3
+			AND (claimed_by IS NULL OR claimed_by = $1 OR claimed_at < $4)
+	`
+
+	var claimed bool
+	err = odb.withRetry(ctx, "ClaimOrder", func() error {
+		now := time.Now().UTC()
+		res, err := odb.execContext(ctx, odb.db, claimQuery, workerID, now, orderID, now.Add(-odb.opts.claimTTL))
+		if err != nil {
+			return fmt.Errorf("failed to claim order: %w", err)
+		}
+		updated, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to claim order: %w", err)
+		}
+		if claimed = updated > 0; claimed {
+			return nil
+		}
+		// Either another worker holds the claim or there is no such order.
+		return odb.checkOrderExists(ctx, orderID)
+	})
+	if err != nil {
+		return false, err
+	}
+	span.SetAttributes(attribute.Bool("order.claimed", claimed))
+	return claimed, nil
+}
+
+// ReleaseOrder gives up workerID's claim on the order, typically once it
+// is fulfilled, so it doesn't linger until it expires. It fails with
+// ErrOrderNotClaimed if workerID doesn't hold the claim.
+func (odb *OrderDatabase) ReleaseOrder(ctx context.Context, orderID, workerID string) (err error) {
+	ctx, span := odb.startSpan(ctx, "ReleaseOrder",
+		attribute.String("order.id", orderID),
+		attribute.String("worker.id", workerID),
+	)
+	defer func() { endSpan(span, err) }()
+
+	if err = odb.beginOp(); err != nil {
+		return err
+	}
+	defer odb.endOp()
+
+	ctx, cancel := odb.withQueryTimeout(ctx)
+	defer cancel()
+
+	releaseQuery := `
+		UPDATE orders
+		SET claimed_by = NULL, claimed_at = NULL
+		WHERE order_id = $1 AND claimed_by = $2
+	`
+
+	return odb.withRetry(ctx, "ReleaseOrder", func() error {
+		res, err := odb.execContext(ctx, odb.db, releaseQuery, orderID, workerID)
+		if err != nil {
+			return fmt.Errorf("failed to release order: %w", err)
+		}
+		updated, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to release order: %w", err)
+		}
+		if updated > 0 {
+			return nil
+		}
+		if err := odb.checkOrderExists(ctx, orderID); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: %s", ErrOrderNotClaimed, orderID)
+	})
+}
+
+// checkOrderExists returns ErrOrderNotFound if there is no such order.
+func (odb *OrderDatabase) checkOrderExists(ctx context.Context, orderID string) error {
+	var one int
+	err := odb.queryRowContext(ctx, odb.db, `SELECT 1 FROM orders WHERE order_id = $1`, orderID).Scan(&one)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: %s", ErrOrderNotFound, orderID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to query order: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2024
+// Tests for fulfilment claims on orders
+
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestClaimOrder(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	ctx := context.Background()
+
+	mock.ExpectExec(`UPDATE orders\s+SET claimed_by = \$1, claimed_at = \$2\s+WHERE order_id = \$3\s+AND \(claimed_by IS NULL OR claimed_by = \$1 OR claimed_at < \$4\)`).
+		WithArgs("worker-1", recentUTC{}, "order-1", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	claimed, err := odb.ClaimOrder(ctx, "order-1", "worker-1")
+	if err != nil || !claimed {
+		t.Fatalf("ClaimOrder() = %v, %v, want true", claimed, err)
+	}
+
+	// Held by another worker: the order exists but the UPDATE matches nothing.
+	mock.ExpectExec(`UPDATE orders`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT 1 FROM orders WHERE order_id = \$1`).
+		WithArgs("order-1").
+		WillReturnRows(sqlmock.NewRows([]string{"1"}).AddRow(1))
+	claimed, err = odb.ClaimOrder(ctx, "order-1", "worker-2")
+	if err != nil || claimed {
+		t.Errorf("ClaimOrder() = %v, %v, want false for an order claimed by another worker", claimed, err)
+	}
+}
+
+func TestClaimOrderExpiresClaimsAfterTTL(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	odb.opts.claimTTL = time.Minute
+
+	mock.ExpectExec(`UPDATE orders`).
+		WithArgs("worker-1", recentUTC{}, "order-1", expiryArg{ttl: time.Minute}).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if _, err := odb.ClaimOrder(context.Background(), "order-1", "worker-1"); err != nil {
+		t.Fatalf("ClaimOrder() error = %v", err)
+	}
+}
+
+// expiryArg matches the claim expiry cutoff: ttl before now, in UTC.
+type expiryArg struct {
+	ttl time.Duration
+}
+
+func (a expiryArg) Match(v driver.Value) bool {
+	cutoff, ok := v.(time.Time)
+	return ok && recentUTC{}.Match(cutoff.Add(a.ttl))
+}
+
+func TestClaimOrderNotFound(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+
+	mock.ExpectExec(`UPDATE orders`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT 1 FROM orders`).WillReturnRows(sqlmock.NewRows([]string{"1"}))
+	if _, err := odb.ClaimOrder(context.Background(), "missing", "worker-1"); !errors.Is(err, ErrOrderNotFound) {
+		t.Errorf("ClaimOrder() error = %v, want ErrOrderNotFound", err)
+	}
+}
+
+func TestClaimOrderRequiresWorkerID(t *testing.T) {
+	// No expectations: the call must fail before any query.
+	odb, _ := newMockOrderDatabase(t)
+	if _, err := odb.ClaimOrder(context.Background(), "order-1", ""); err == nil {
+		t.Error("ClaimOrder() with an empty worker ID succeeded")
+	}
+}
+
+func TestReleaseOrder(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	ctx := context.Background()
+
+	mock.ExpectExec(`UPDATE orders\s+SET claimed_by = NULL, claimed_at = NULL\s+WHERE order_id = \$1 AND claimed_by = \$2`).
+		WithArgs("order-1", "worker-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := odb.ReleaseOrder(ctx, "order-1", "worker-1"); err != nil {
+		t.Fatalf("ReleaseOrder() error = %v", err)
+	}
+
+	mock.ExpectExec(`UPDATE orders`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT 1 FROM orders`).WillReturnRows(sqlmock.NewRows([]string{"1"}).AddRow(1))
+	if err := odb.ReleaseOrder(ctx, "order-1", "worker-2"); !errors.Is(err, ErrOrderNotClaimed) {
+		t.Errorf("ReleaseOrder() error = %v, want ErrOrderNotClaimed", err)
+	}
+}
+
+func TestWithClaimTTL(t *testing.T) {
+	if got := newDBOptions([]Option{WithClaimTTL(time.Second)}).claimTTL; got != time.Second {
+		t.Errorf("WithClaimTTL(1s) claimTTL = %v, want 1s", got)
+	}
+	if got := newDBOptions([]Option{WithClaimTTL(0)}).claimTTL; got != defaultClaimTTL {
+		t.Errorf("WithClaimTTL(0) claimTTL = %v, want the default %v", got, defaultClaimTTL)
+	}
+}
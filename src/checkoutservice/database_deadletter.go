@@ -0,0 +1,272 @@
+// Copyright 2024
+// Keeping orders whose save failed after payment, for replaying them later
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrOrderPersistFailed is returned by SaveOrder and SaveOrderWithPayment,
+// with WithDeadLetter, when an order ultimately couldn't be saved. By then
+// the customer has been charged, so it calls for an alert. Unless the
+// error says recording the order failed too, the order is in failed_orders
+// and ReplayFailedOrders will save it.
+var ErrOrderPersistFailed = errors.New("order could not be persisted")
+
+const (
+	// deadLetterTimeout bounds recording a failed order. It runs even if
+	// the caller's context is done, since that is a common reason the save
+	// failed.
+	deadLetterTimeout = 5 * time.Second
+	// replayBatchSize is how many failed orders ReplayFailedOrders reads at
+	// a time.
+	replayBatchSize = 100
+)
+
+// WithDeadLetter makes SaveOrder and SaveOrderWithPayment record an order
+// they couldn't save, after retries, in failed_orders and fail with
+// ErrOrderPersistFailed, so that an order that was paid for isn't lost.
+// Validation errors and ErrOrderConflict are returned as they are, since
+// saving the order again wouldn't help.
+func WithDeadLetter() Option {
+	return func(o *dbOptions) { o.deadLetter = true }
+}
+
+// failedOrder is the payload of a failed_orders row. The request is stored
+// without its credit card; the masked payment is kept instead.
+type failedOrder struct {
+	Request json.RawMessage `json:"request"`
+	Result  json.RawMessage `json:"result"`
+	Total   json.RawMessage `json:"total"`
+	Payment *PaymentInfo    `json:"payment,omitempty"`
+}
+
+// recordFailedOrder is called with the error SaveOrder or
+// SaveOrderWithPayment failed with, and returns the error they return
+// instead.
+func (odb *OrderDatabase) recordFailedOrder(ctx context.Context, req *pb.PlaceOrderRequest, orderResult *pb.OrderResult, totalAmount *pb.Money, payment *PaymentInfo, saveErr error) error {
+	if !odb.opts.deadLetter || errors.Is(saveErr, ErrOrderConflict) {
+		return saveErr
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), deadLetterTimeout)
+	defer cancel()
+
+	payload, err := odb.encodeFailedOrder(req, orderResult, totalAmount, payment)
+	if err == nil {
+		now := time.Now().UTC()
+		err = odb.withRetry(ctx, "recordFailedOrder", func() error {
+			_, err := odb.execContext(ctx, odb.db, `
+				INSERT INTO failed_orders (order_id, payload, last_error, attempts, created_at, updated_at)
+				VALUES ($1, $2, $3, 1, $4, $4)`,
+				orderResult.OrderId, payload, saveErr.Error(), now)
+			return err
+		})
+	}
+	if err != nil {
+		log.Errorf("Order %s couldn't be saved or recorded for replay: %v", orderResult.OrderId, err)
+		return fmt.Errorf("order %s: %w: %w; recording it for replay failed too: %v", orderResult.OrderId, ErrOrderPersistFailed, saveErr, err)
+	}
+	log.Errorf("Order %s couldn't be saved and was recorded for replay: %v", orderResult.OrderId, saveErr)
+	return fmt.Errorf("order %s: %w, recorded for replay: %w", orderResult.OrderId, ErrOrderPersistFailed, saveErr)
+}
+
+// encodeFailedOrder returns the failed_orders payload of an order,
+// encrypted if a cipher is configured since it holds the email and
+// address.
+func (odb *OrderDatabase) encodeFailedOrder(req *pb.PlaceOrderRequest, orderResult *pb.OrderResult, totalAmount *pb.Money, payment *PaymentInfo) (string, error) {
+	withoutCard := proto.Clone(req).(*pb.PlaceOrderRequest)
+	withoutCard.CreditCard = nil
+
+	var doc failedOrder
+	var err error
+	if doc.Request, err = protojson.Marshal(withoutCard); err != nil {
+		return "", fmt.Errorf("failed to encode request: %w", err)
+	}
+	if doc.Result, err = protojson.Marshal(orderResult); err != nil {
+		return "", fmt.Errorf("failed to encode order: %w", err)
+	}
+	if doc.Total, err = protojson.Marshal(totalAmount); err != nil {
+		return "", fmt.Errorf("failed to encode total: %w", err)
+	}
+	doc.Payment = payment
+	payload, err := json.Marshal(doc)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode failed order: %w", err)
+	}
+	return odb.encryptField(string(payload))
+}
+
+// decodeFailedOrder is the inverse of encodeFailedOrder.
+func (odb *OrderDatabase) decodeFailedOrder(payload string) (*pb.PlaceOrderRequest, *pb.OrderResult, *pb.Money, *PaymentInfo, error) {
+	plaintext, err := odb.decryptField(payload)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	var doc failedOrder
+	if err := json.Unmarshal([]byte(plaintext), &doc); err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("failed to decode failed order: %w", err)
+	}
+	req, orderResult, totalAmount := new(pb.PlaceOrderRequest), new(pb.OrderResult), new(pb.Money)
+	if err := protojson.Unmarshal(doc.Request, req); err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("failed to decode request: %w", err)
+	}
+	if err := protojson.Unmarshal(doc.Result, orderResult); err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("failed to decode order: %w", err)
+	}
+	if err := protojson.Unmarshal(doc.Total, totalAmount); err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("failed to decode total: %w", err)
+	}
+	return req, orderResult, totalAmount, doc.Payment, nil
+}
+
+// ReplayFailedOrders tries to save every order in failed_orders again,
+// oldest first, and returns how many it saved. A saved order is removed
+// from failed_orders. One that fails again is kept, with its error and
+// attempt count updated, for a later call, and the others are still
+// tried; the error then says how many failed and why the first did. An
+// order that was saved after all, e.g. by a save whose response was lost,
+// counts as saved. The query timeout and retries apply to each order.
+func (odb *OrderDatabase) ReplayFailedOrders(ctx context.Context) (replayed int, err error) {
+	ctx, span := odb.startSpan(ctx, "ReplayFailedOrders")
+	failed := 0
+	defer func() {
+		span.SetAttributes(
+			attribute.Int("order.replayed_count", replayed),
+			attribute.Int("order.failed_count", failed),
+		)
+		endSpan(span, err)
+	}()
+
+	if err = odb.beginOp(); err != nil {
+		return 0, err
+	}
+	defer odb.endOp()
+
+	var firstErr error
+	// Orders recorded while replaying have higher IDs and are picked up
+	// too; orders that fail again are behind lastID and aren't retried.
+	var lastID int64
+	for {
+		batch, err := odb.failedOrderBatch(ctx, lastID)
+		if err != nil {
+			return replayed, err
+		}
+		for _, row := range batch {
+			if err := ctx.Err(); err != nil {
+				return replayed, err
+			}
+			lastID = row.id
+			if err := odb.replayFailedOrder(ctx, row); err != nil {
+				log.Warnf("Failed to replay order %s: %v", row.orderID, err)
+				failed++
+				if firstErr == nil {
+					firstErr = fmt.Errorf("order %s: %w", row.orderID, err)
+				}
+				continue
+			}
+			replayed++
+		}
+		if len(batch) < replayBatchSize {
+			break
+		}
+	}
+	if firstErr != nil {
+		return replayed, fmt.Errorf("%d failed orders couldn't be saved, the first: %w", failed, firstErr)
+	}
+	if replayed > 0 {
+		log.Infof("Replayed %d failed orders", replayed)
+	}
+	return replayed, nil
+}
+
+type failedOrderRow struct {
+	id      int64
+	orderID string
+	payload string
+}
+
+// failedOrderBatch returns up to replayBatchSize failed orders with IDs
+// above afterID, in ID order.
+func (odb *OrderDatabase) failedOrderBatch(ctx context.Context, afterID int64) ([]failedOrderRow, error) {
+	ctx, cancel := odb.withQueryTimeout(ctx)
+	defer cancel()
+
+	var batch []failedOrderRow
+	err := odb.withRetry(ctx, "ReplayFailedOrders", func() error {
+		batch = batch[:0]
+		rows, err := odb.queryContext(ctx, odb.db, `
+			SELECT id, order_id, payload FROM failed_orders
+			WHERE id > $1
+			ORDER BY id
+			LIMIT $2`, afterID, replayBatchSize)
+		if err != nil {
+			return fmt.Errorf("failed to query failed orders: %w", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var row failedOrderRow
+			if err := rows.Scan(&row.id, &row.orderID, &row.payload); err != nil {
+				return fmt.Errorf("failed to scan failed order: %w", err)
+			}
+			batch = append(batch, row)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to query failed orders: %w", err)
+		}
+		return nil
+	})
+	return batch, err
+}
+
+// replayFailedOrder saves a failed order and removes it from
+// failed_orders, or records why it failed again.
+func (odb *OrderDatabase) replayFailedOrder(ctx context.Context, row failedOrderRow) error {
+	ctx, cancel := odb.withQueryTimeout(ctx)
+	defer cancel()
+
+	req, orderResult, totalAmount, payment, err := odb.decodeFailedOrder(row.payload)
+	if err == nil {
+		err = validateOrder(req, orderResult, totalAmount)
+	}
+	if err == nil {
+		defer odb.cache.invalidate(orderResult.OrderId)
+		// saveOrder treats an identical stored order as saved, so this is
+		// safe to repeat if removing the row below fails.
+		err = odb.withRetry(ctx, "ReplayFailedOrders", func() error {
+			return odb.saveOrder(ctx, req, orderResult, totalAmount, payment)
+		})
+	}
+	if err != nil {
+		odb.updateFailedOrder(ctx, row.id, err)
+		return err
+	}
+
+	return odb.withRetry(ctx, "ReplayFailedOrders", func() error {
+		if _, err := odb.execContext(ctx, odb.db, `DELETE FROM failed_orders WHERE id = $1`, row.id); err != nil {
+			return fmt.Errorf("failed to remove replayed order: %w", err)
+		}
+		return nil
+	})
+}
+
+// updateFailedOrder records another failed attempt at saving a failed
+// order. Failing to record it only loses the error, so it is logged.
+func (odb *OrderDatabase) updateFailedOrder(ctx context.Context, id int64, replayErr error) {
+	_, err := odb.execContext(ctx, odb.db, `
+		UPDATE failed_orders
+		SET last_error = $1, attempts = attempts + 1, updated_at = $2
+		WHERE id = $3`, replayErr.Error(), time.Now().UTC(), id)
+	if err != nil {
+		log.Warnf("Failed to record replay failure of failed order %d: %v", id, err)
+	}
+}
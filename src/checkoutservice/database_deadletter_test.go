@@ -0,0 +1,127 @@
+// Copyright 2024
+// Tests for keeping orders that fail to save
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+func TestSaveOrderRecordsFailedOrder(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	odb.opts.deadLetter = true
+	req, result, total := newTestOrder("order-1")
+	errBoom := errors.New("boom")
+
+	expectPrepareSaveOrder(mock)
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO orders`).WillReturnError(errBoom)
+	mock.ExpectRollback()
+	mock.ExpectExec(`INSERT INTO failed_orders \(order_id, payload, last_error, attempts, created_at, updated_at\)`).
+		WithArgs("order-1", sqlmock.AnyArg(), "failed to insert order: boom", recentUTC{}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	err := odb.SaveOrder(context.Background(), req, result, total)
+	if !errors.Is(err, ErrOrderPersistFailed) || !errors.Is(err, errBoom) {
+		t.Errorf("SaveOrder() error = %v, want ErrOrderPersistFailed wrapping %v", err, errBoom)
+	}
+	if strings.Contains(err.Error(), "failed too") {
+		t.Errorf("SaveOrder() error = %q, want it to say the order was recorded", err)
+	}
+}
+
+func TestSaveOrderReportsUnrecordedFailedOrder(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	odb.opts.deadLetter = true
+	req, result, total := newTestOrder("order-1")
+	errBoom := errors.New("boom")
+
+	expectPrepareSaveOrder(mock)
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO orders`).WillReturnError(errBoom)
+	mock.ExpectRollback()
+	mock.ExpectExec(`INSERT INTO failed_orders`).WillReturnError(errors.New("disk full"))
+
+	err := odb.SaveOrder(context.Background(), req, result, total)
+	if !errors.Is(err, ErrOrderPersistFailed) || !strings.Contains(err.Error(), "recording it for replay failed too: disk full") {
+		t.Errorf("SaveOrder() error = %v, want ErrOrderPersistFailed saying recording failed", err)
+	}
+}
+
+func TestSaveOrderDoesNotRecordConflicts(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	odb.opts.deadLetter = true
+	req, result, total := newTestOrder("order-1")
+	stored, _, _ := newTestOrder("order-1")
+	stored.Email = "someone-else@example.com"
+
+	expectPrepareSaveOrder(mock)
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO orders`).WillReturnError(&pq.Error{Code: pqUniqueViolation})
+	mock.ExpectRollback()
+	expectStoredOrder(mock, stored, result, total)
+
+	err := odb.SaveOrder(context.Background(), req, result, total)
+	if !errors.Is(err, ErrOrderConflict) || errors.Is(err, ErrOrderPersistFailed) {
+		t.Errorf("SaveOrder() of a conflicting order error = %v, want only ErrOrderConflict", err)
+	}
+}
+
+func TestSaveOrderWithoutDeadLetterReturnsTheError(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	req, result, total := newTestOrder("order-1")
+	errBoom := errors.New("boom")
+
+	expectPrepareSaveOrder(mock)
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO orders`).WillReturnError(errBoom)
+	mock.ExpectRollback()
+
+	if err := odb.SaveOrder(context.Background(), req, result, total); !errors.Is(err, errBoom) || errors.Is(err, ErrOrderPersistFailed) {
+		t.Errorf("SaveOrder() error = %v, want %v", err, errBoom)
+	}
+}
+
+func TestFailedOrderPayloadRoundTrip(t *testing.T) {
+	for _, withCipher := range []bool{false, true} {
+		odb := &OrderDatabase{opts: defaultDBOptions()}
+		if withCipher {
+			odb.opts.cipher = newTestCipher(t)
+		}
+		req, result, total := newTestOrder("order-1")
+		req.CreditCard = &pb.CreditCardInfo{CreditCardNumber: "4432-8015-6152-0454", CreditCardCvv: 672}
+		payment := NewPaymentInfo(req.CreditCard, "txn-1")
+
+		payload, err := odb.encodeFailedOrder(req, result, total, payment)
+		if err != nil {
+			t.Fatalf("encodeFailedOrder() error = %v", err)
+		}
+		if withCipher && strings.Contains(payload, req.Email) {
+			t.Error("encrypted payload contains the email")
+		}
+		if !withCipher && (strings.Contains(payload, req.CreditCard.CreditCardNumber) || strings.Contains(payload, "creditCard")) {
+			t.Errorf("payload %s contains the credit card", payload)
+		}
+
+		gotReq, gotResult, gotTotal, gotPayment, err := odb.decodeFailedOrder(payload)
+		if err != nil {
+			t.Fatalf("decodeFailedOrder() error = %v", err)
+		}
+		req.CreditCard = nil
+		if !proto.Equal(gotReq, req) || !proto.Equal(gotResult, result) || !proto.Equal(gotTotal, total) {
+			t.Errorf("decodeFailedOrder() = %v, %v, %v, want %v, %v, %v", gotReq, gotResult, gotTotal, req, result, total)
+		}
+		if gotPayment == nil || *gotPayment != *payment {
+			t.Errorf("decodeFailedOrder() payment = %+v, want %+v", gotPayment, payment)
+		}
+	}
+}
@@ -0,0 +1,406 @@
+// Copyright 2024
+// SQL dialects supported by the order database
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+const (
+	sqliteScheme = "sqlite://"
+	mysqlScheme  = "mysql://"
+)
+
+// dialect hides the differences between the databases OrderDatabase can
+// run on. Queries are written for Postgres, with $N placeholders, and go
+// through bind before they are sent.
+type dialect interface {
+	// driverName is the database/sql driver to open.
+	driverName() string
+	// system is the OpenTelemetry db.system attribute value.
+	system() string
+	migrations() (fs.FS, string)
+	// bind rewrites query and args into the driver's placeholder style.
+	bind(query string, args []interface{}) (string, []interface{})
+	// anyOf returns a condition matching column against any of values,
+	// numbering its placeholders from $n, and the arguments to bind.
+	anyOf(column string, n int, values []string) (string, []interface{})
+	// lockRows is appended to a SELECT to lock the rows it returns until
+	// the transaction ends.
+	lockRows() string
+	isUniqueViolation(err error) bool
+	// isConstraintViolation reports whether err is an integrity constraint
+	// violation of any kind, unique violations included.
+	isConstraintViolation(err error) bool
+	// lockSchema serializes EnsureSchema across processes sharing the
+	// database. The returned func releases the lock.
+	lockSchema(ctx context.Context, conn *sql.Conn) (func(), error)
+	// configurePool applies limits the database needs regardless of the
+	// pool options.
+	configurePool(db *sql.DB)
+	// supportsSchemas reports whether tables can be put in a schema, for
+	// WithSchema.
+	supportsSchemas() bool
+}
+
+// dialectFor picks the dialect for a connection string and returns the DSN
+// to hand to its driver. sqlite:// strings select SQLite and mysql://
+// strings MySQL; anything else is passed to Postgres unchanged.
+func dialectFor(connectionString string) (dialect, string) {
+	if path, ok := strings.CutPrefix(connectionString, sqliteScheme); ok {
+		return sqliteDialect{}, sqliteDSN(path)
+	}
+	if dsn, ok := strings.CutPrefix(connectionString, mysqlScheme); ok {
+		return mysqlDialect{}, mysqlDSN(dsn)
+	}
+	return postgresDialect{}, connectionString
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) driverName() string { return "postgres" }
+
+func (postgresDialect) system() string { return "postgresql" }
+
+func (postgresDialect) migrations() (fs.FS, string) {
+	return postgresMigrations, "migrations/postgres"
+}
+
+func (postgresDialect) bind(query string, args []interface{}) (string, []interface{}) {
+	return query, args
+}
+
+func (postgresDialect) anyOf(column string, n int, values []string) (string, []interface{}) {
+	return fmt.Sprintf("%s = ANY($%d)", column, n), []interface{}{pq.Array(values)}
+}
+
+func (postgresDialect) lockRows() string { return " FOR UPDATE" }
+
+func (postgresDialect) isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == pqUniqueViolation
+}
+
+// isConstraintViolation matches SQLSTATE class 23, "integrity constraint
+// violation".
+func (postgresDialect) isConstraintViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code.Class() == "23"
+}
+
+// lockSchema polls pg_try_advisory_lock rather than blocking in
+// pg_advisory_lock. A session blocked in pg_advisory_lock holds a snapshot
+// for as long as it waits, and CREATE INDEX CONCURRENTLY run by the lock
+// holder waits for every such snapshot to go away, so the two would
+// deadlock.
+func (postgresDialect) lockSchema(ctx context.Context, conn *sql.Conn) (func(), error) {
+	for {
+		var locked bool
+		if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, schemaLockID).Scan(&locked); err != nil {
+			return nil, err
+		}
+		if locked {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(schemaLockPollInterval):
+		}
+	}
+	return func() {
+		conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, schemaLockID)
+	}, nil
+}
+
+func (postgresDialect) configurePool(db *sql.DB) {}
+
+func (postgresDialect) supportsSchemas() bool { return true }
+
+// sqliteDialect targets SQLite through modernc.org/sqlite, which needs no
+// cgo. It is meant for local development and tests, not production.
+type sqliteDialect struct{}
+
+var postgresPlaceholder = regexp.MustCompile(`\$(\d+)`)
+
+// sqliteDSN turns the path of a sqlite:// connection string into a
+// modernc.org/sqlite DSN. Foreign keys are enforced so ON DELETE CASCADE
+// works, and times are stored in a format that sorts chronologically.
+func sqliteDSN(path string) string {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return path + sep + "_pragma=foreign_keys(1)&_time_format=sqlite"
+}
+
+func (sqliteDialect) driverName() string { return "sqlite" }
+
+func (sqliteDialect) system() string { return "sqlite" }
+
+func (sqliteDialect) migrations() (fs.FS, string) {
+	return sqliteMigrations, "migrations/sqlite"
+}
+
+// bind uses SQLite's ?N placeholders, which are positional like $N and can
+// be repeated, so args stay as they are. A query that uses $1, $2, ... once
+// each and in order gets plain ? placeholders instead: to find the value of
+// a ?N the driver formats the position of every argument as a string,
+// which makes binding the thousands of values of a multi-row INSERT slow.
+func (sqliteDialect) bind(query string, args []interface{}) (string, []interface{}) {
+	if hasSequentialPlaceholders(query) {
+		return postgresPlaceholder.ReplaceAllString(query, "?"), args
+	}
+	return postgresPlaceholder.ReplaceAllString(query, "?$1"), args
+}
+
+// hasSequentialPlaceholders reports whether query's placeholders are $1,
+// $2, ... in order, with none repeated.
+func hasSequentialPlaceholders(query string) bool {
+	for i, m := range postgresPlaceholder.FindAllStringSubmatch(query, -1) {
+		if m[1] != strconv.Itoa(i+1) {
+			return false
+		}
+	}
+	return true
+}
+
+func (sqliteDialect) anyOf(column string, n int, values []string) (string, []interface{}) {
+	return inList(column, n, values)
+}
+
+// inList is anyOf for databases without arrays: an IN list with one
+// placeholder per value.
+func inList(column string, n int, values []string) (string, []interface{}) {
+	placeholders := make([]string, len(values))
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		placeholders[i] = fmt.Sprintf("$%d", n+i)
+		args[i] = v
+	}
+	return fmt.Sprintf("%s IN (%s)", column, strings.Join(placeholders, ", ")), args
+}
+
+// lockRows is empty: SQLite has no row locks, and with a single connection
+// transactions already run one at a time.
+func (sqliteDialect) lockRows() string { return "" }
+
+func (sqliteDialect) isUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	code := sqliteErr.Code()
+	return code == sqlite3.SQLITE_CONSTRAINT_UNIQUE || code == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+}
+
+// isConstraintViolation matches every extended SQLITE_CONSTRAINT code.
+func (sqliteDialect) isConstraintViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code()&0xff == sqlite3.SQLITE_CONSTRAINT
+}
+
+func (sqliteDialect) lockSchema(ctx context.Context, conn *sql.Conn) (func(), error) {
+	return func() {}, nil
+}
+
+// configurePool limits SQLite to one connection that is never recycled.
+// Writers would otherwise fail with SQLITE_BUSY, and each connection to
+// :memory: would see its own empty database.
+func (sqliteDialect) configurePool(db *sql.DB) {
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+	db.SetConnMaxLifetime(0)
+	db.SetConnMaxIdleTime(0)
+}
+
+// supportsSchemas is false, since the only other schemas SQLite has are
+// attached database files.
+func (sqliteDialect) supportsSchemas() bool { return false }
+
+// mysqlDialect targets MySQL 8.0 or later through
+// github.com/go-sql-driver/mysql.
+type mysqlDialect struct{}
+
+// mysqlSchemaLock is the GET_LOCK name held while migrating, the MySQL
+// counterpart of schemaLockID.
+const mysqlSchemaLock = "checkoutservice.schema_migrations"
+
+// MySQL error numbers for the errors the order database tells apart.
+const (
+	mysqlDuplicateEntry  = 1062 // ER_DUP_ENTRY
+	mysqlLockDeadlock    = 1213 // ER_LOCK_DEADLOCK
+	mysqlBadNull         = 1048 // ER_BAD_NULL_ERROR
+	mysqlRowIsReferenced = 1451 // ER_ROW_IS_REFERENCED_2
+	mysqlNoReferencedRow = 1452 // ER_NO_REFERENCED_ROW_2
+	mysqlCheckViolated   = 3819 // ER_CHECK_CONSTRAINT_VIOLATED
+)
+
+// mysqlDSN turns the part of a mysql:// connection string after the scheme,
+// a go-sql-driver DSN such as user:password@tcp(host:3306)/orders, into the
+// DSN to open. DATETIME columns are scanned into time.Time in UTC, matching
+// what the other dialects return, and UPDATE reports the rows it matched
+// rather than only those it changed, as Postgres does. A DSN that doesn't
+// parse is returned as it is for the driver to reject.
+func mysqlDSN(dsn string) string {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return dsn
+	}
+	cfg.ParseTime = true
+	cfg.Loc = time.UTC
+	cfg.ClientFoundRows = true
+	return cfg.FormatDSN()
+}
+
+func (mysqlDialect) driverName() string { return "mysql" }
+
+func (mysqlDialect) system() string { return "mysql" }
+
+func (mysqlDialect) migrations() (fs.FS, string) {
+	return mysqlMigrations, "migrations/mysql"
+}
+
+// bind rewrites $N placeholders into MySQL's ?, which are matched to args
+// by position, so args are reordered, and repeated where a placeholder
+// is, to line up with them. With nil args only the query is rewritten.
+func (mysqlDialect) bind(query string, args []interface{}) (string, []interface{}) {
+	var bound []interface{}
+	query = postgresPlaceholder.ReplaceAllStringFunc(query, func(placeholder string) string {
+		if args != nil {
+			n, _ := strconv.Atoi(placeholder[1:])
+			bound = append(bound, args[n-1])
+		}
+		return "?"
+	})
+	return query, bound
+}
+
+func (mysqlDialect) anyOf(column string, n int, values []string) (string, []interface{}) {
+	return inList(column, n, values)
+}
+
+func (mysqlDialect) lockRows() string { return " FOR UPDATE" }
+
+func (mysqlDialect) isUniqueViolation(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry
+}
+
+func (mysqlDialect) isConstraintViolation(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	switch mysqlErr.Number {
+	case mysqlDuplicateEntry, mysqlBadNull, mysqlRowIsReferenced, mysqlNoReferencedRow, mysqlCheckViolated:
+		return true
+	}
+	return false
+}
+
+// lockSchema polls GET_LOCK without waiting for the same reason the
+// Postgres lockSchema polls.
+func (mysqlDialect) lockSchema(ctx context.Context, conn *sql.Conn) (func(), error) {
+	for {
+		var locked sql.NullInt64
+		if err := conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, 0)`, mysqlSchemaLock).Scan(&locked); err != nil {
+			return nil, err
+		}
+		if locked.Int64 == 1 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(schemaLockPollInterval):
+		}
+	}
+	return func() {
+		var released sql.NullInt64
+		conn.QueryRowContext(context.Background(), `SELECT RELEASE_LOCK(?)`, mysqlSchemaLock).Scan(&released)
+	}, nil
+}
+
+func (mysqlDialect) configurePool(db *sql.DB) {}
+
+// supportsSchemas is true: a MySQL schema is a database, which the
+// connection's user must be allowed to create tables in.
+func (mysqlDialect) supportsSchemas() bool { return true }
+
+// sqliteTimeFormat is how modernc.org/sqlite writes times with
+// _time_format=sqlite.
+const sqliteTimeFormat = "2006-01-02 15:04:05.999999999-07:00"
+
+// aggregateTime scans the result of MIN or MAX over a timestamp column.
+// Postgres and MySQL return a time.Time, but SQLite drops the column type from
+// aggregates and returns the stored text. NULL, for no rows, leaves Time
+// zero.
+type aggregateTime struct {
+	Time time.Time
+}
+
+func (t *aggregateTime) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		t.Time = time.Time{}
+	case time.Time:
+		t.Time = v
+	case string:
+		return t.parse(v)
+	case []byte:
+		return t.parse(string(v))
+	default:
+		return fmt.Errorf("cannot scan %T into a timestamp", src)
+	}
+	return nil
+}
+
+func (t *aggregateTime) parse(s string) error {
+	parsed, err := time.Parse(sqliteTimeFormat, s)
+	if err != nil {
+		return fmt.Errorf("failed to parse timestamp: %w", err)
+	}
+	t.Time = parsed.UTC()
+	return nil
+}
+
+// execer is satisfied by *sql.DB, *sql.Tx and *sql.Conn.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func (odb *OrderDatabase) execContext(ctx context.Context, e execer, query string, args ...interface{}) (sql.Result, error) {
+	query, args = odb.bind(query, args)
+	return e.ExecContext(ctx, query, args...)
+}
+
+func (odb *OrderDatabase) queryContext(ctx context.Context, q queryer, query string, args ...interface{}) (*sql.Rows, error) {
+	query, args = odb.bind(query, args)
+	return q.QueryContext(ctx, query, args...)
+}
+
+func (odb *OrderDatabase) queryRowContext(ctx context.Context, q queryer, query string, args ...interface{}) *sql.Row {
+	query, args = odb.bind(query, args)
+	return q.QueryRowContext(ctx, query, args...)
+}
+
+// bind rewrites query, written for Postgres with the default table names,
+// for the configured tables and the dialect.
+func (odb *OrderDatabase) bind(query string, args []interface{}) (string, []interface{}) {
+	return odb.dialect.bind(odb.opts.tables.qualify(query), args)
+}
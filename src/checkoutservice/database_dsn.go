@@ -0,0 +1,109 @@
+// Copyright 2024
+// Building Postgres connection strings from their parts
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// defaultPostgresPort is the port BuildConnectionString uses when none is
+// given.
+const defaultPostgresPort = 5432
+
+// SSLMode is the sslmode of a Postgres connection.
+type SSLMode string
+
+const (
+	// SSLModeDisable connects without TLS.
+	SSLModeDisable SSLMode = "disable"
+	// SSLModeRequire connects with TLS but doesn't verify the server's
+	// certificate.
+	SSLModeRequire SSLMode = "require"
+	// SSLModeVerifyCA connects with TLS and checks that the server's
+	// certificate is signed by a trusted CA.
+	SSLModeVerifyCA SSLMode = "verify-ca"
+	// SSLModeVerifyFull is SSLModeVerifyCA that also checks the certificate
+	// is for Host.
+	SSLModeVerifyFull SSLMode = "verify-full"
+)
+
+func (m SSLMode) isValid() bool {
+	switch m {
+	case SSLModeDisable, SSLModeRequire, SSLModeVerifyCA, SSLModeVerifyFull:
+		return true
+	}
+	return false
+}
+
+// ErrInvalidConnConfig is returned by BuildConnectionString for a
+// ConnConfig that can't describe a connection.
+var ErrInvalidConnConfig = errors.New("invalid database connection config")
+
+// ConnConfig holds the parts of a Postgres connection string.
+type ConnConfig struct {
+	Host string
+	// Port is 5432 if zero.
+	Port     int
+	User     string
+	Password string
+	DBName   string
+	// SSLMode is SSLModeRequire if empty, so leaving it out never falls
+	// back to an unencrypted connection.
+	SSLMode SSLMode
+}
+
+// BuildConnectionString returns the postgres:// URL for cfg, for
+// DATABASE_URL or NewOrderDatabase. The user, password and database name
+// are escaped, so they may contain any character. It fails with
+// ErrInvalidConnConfig if the host is empty or not a bare host name or
+// address, the port is out of range or the SSL mode is unknown. Errors
+// never include the password.
+func BuildConnectionString(cfg ConnConfig) (string, error) {
+	host := strings.TrimSpace(cfg.Host)
+	if host == "" {
+		return "", fmt.Errorf("%w: host is empty", ErrInvalidConnConfig)
+	}
+	// A literal IPv6 address has colons but no brackets; JoinHostPort adds
+	// them.
+	if strings.ContainsAny(host, "/?#@[] ") || (strings.Contains(host, ":") && net.ParseIP(host) == nil) {
+		return "", fmt.Errorf("%w: host %q is not a host name or IP address", ErrInvalidConnConfig, host)
+	}
+	port := cfg.Port
+	if port == 0 {
+		port = defaultPostgresPort
+	}
+	if port < 1 || port > 65535 {
+		return "", fmt.Errorf("%w: port %d is outside [1, 65535]", ErrInvalidConnConfig, cfg.Port)
+	}
+	sslMode := cfg.SSLMode
+	if sslMode == "" {
+		sslMode = SSLModeRequire
+	}
+	if !sslMode.isValid() {
+		return "", fmt.Errorf("%w: unknown SSL mode %q", ErrInvalidConnConfig, sslMode)
+	}
+
+	u := url.URL{
+		Scheme:   "postgres",
+		Host:     net.JoinHostPort(host, strconv.Itoa(port)),
+		RawQuery: url.Values{"sslmode": {string(sslMode)}}.Encode(),
+	}
+	switch {
+	case cfg.Password != "":
+		u.User = url.UserPassword(cfg.User, cfg.Password)
+	case cfg.User != "":
+		u.User = url.User(cfg.User)
+	}
+	if cfg.DBName != "" {
+		u.Path = "/" + cfg.DBName
+		// Without RawPath a "/" in the name would be left as is and end it.
+		u.RawPath = "/" + url.PathEscape(cfg.DBName)
+	}
+	return u.String(), nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2024
+// Tests for building Postgres connection strings
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestBuildConnectionStringEscapesCredentials(t *testing.T) {
+	cfg := ConnConfig{
+		Host:     "postgres",
+		User:     "order@service",
+		Password: "p@ss:w/rd?#%&=",
+		DBName:   "orders/prod db",
+		SSLMode:  SSLModeVerifyFull,
+	}
+	got, err := BuildConnectionString(cfg)
+	if err != nil {
+		t.Fatalf("BuildConnectionString() error = %v", err)
+	}
+
+	// pq must read back exactly what went in.
+	parsed, err := pq.ParseURL(got)
+	if err != nil {
+		t.Fatalf("pq.ParseURL(%q) error = %v", got, err)
+	}
+	want := `dbname='orders/prod db' host='postgres' password='p@ss:w/rd?#%&=' port='5432' sslmode='verify-full' user='order@service'`
+	if parsed != want {
+		t.Errorf("pq.ParseURL(%q) = %q, want %q", got, parsed, want)
+	}
+}
+
+func TestBuildConnectionStringDefaults(t *testing.T) {
+	got, err := BuildConnectionString(ConnConfig{Host: "db.internal", User: "checkout", DBName: "orders"})
+	if err != nil {
+		t.Fatalf("BuildConnectionString() error = %v", err)
+	}
+	if want := "postgres://checkout@db.internal:5432/orders?sslmode=require"; got != want {
+		t.Errorf("BuildConnectionString() = %q, want %q", got, want)
+	}
+
+	got, err = BuildConnectionString(ConnConfig{Host: "::1", Port: 6432, SSLMode: SSLModeDisable})
+	if err != nil {
+		t.Fatalf("BuildConnectionString() error = %v", err)
+	}
+	if want := "postgres://[::1]:6432?sslmode=disable"; got != want {
+		t.Errorf("BuildConnectionString() = %q, want %q", got, want)
+	}
+}
+
+func TestBuildConnectionStringRejectsInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  ConnConfig
+	}{
+		{"empty host", ConnConfig{Host: " "}},
+		{"host with a path", ConnConfig{Host: "postgres/orders"}},
+		{"host with a port", ConnConfig{Host: "postgres:5432"}},
+		{"negative port", ConnConfig{Host: "postgres", Port: -1}},
+		{"port too large", ConnConfig{Host: "postgres", Port: 65536}},
+		{"unknown SSL mode", ConnConfig{Host: "postgres", SSLMode: "prefer"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Password = "secret-password"
+			_, err := BuildConnectionString(tt.cfg)
+			if !errors.Is(err, ErrInvalidConnConfig) {
+				t.Fatalf("BuildConnectionString() error = %v, want ErrInvalidConnConfig", err)
+			}
+			if strings.Contains(err.Error(), tt.cfg.Password) {
+				t.Errorf("BuildConnectionString() error %q contains the password", err)
+			}
+		})
+	}
+}
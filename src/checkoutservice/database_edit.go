@@ -0,0 +1,178 @@
+// Copyright 2024
+// Corrections to an order's shipping address and contact email
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// UpdateOrderShipping replaces the order's shipping address. It fails with
+// ErrInvalidAddress if a field is empty and with ErrOrderNotEditable once
+// the order has shipped or been cancelled.
+func (odb *OrderDatabase) UpdateOrderShipping(ctx context.Context, orderID string, address *pb.Address) (err error) {
+	ctx, span := odb.startSpan(ctx, "UpdateOrderShipping", attribute.String("order.id", orderID))
+	defer func() { endSpan(span, err) }()
+
+	if err = odb.beginOp(); err != nil {
+		return err
+	}
+	defer odb.endOp()
+
+	ctx, cancel := odb.withQueryTimeout(ctx)
+	defer cancel()
+
+	defer odb.cache.invalidate(orderID)
+	return odb.updateOrderShipping(ctx, "UpdateOrderShipping", orderID, anyVersion, address)
+}
+
+// UpdateOrderShippingAtVersion is UpdateOrderShipping that only applies if
+// the order is still at version, and fails with ErrConcurrentModification
+// otherwise.
+func (odb *OrderDatabase) UpdateOrderShippingAtVersion(ctx context.Context, orderID string, version int64, address *pb.Address) (err error) {
+	ctx, span := odb.startSpan(ctx, "UpdateOrderShippingAtVersion",
+		attribute.String("order.id", orderID),
+		attribute.Int64("order.version", version),
+	)
+	defer func() { endSpan(span, err) }()
+
+	if err = odb.beginOp(); err != nil {
+		return err
+	}
+	defer odb.endOp()
+
+	ctx, cancel := odb.withQueryTimeout(ctx)
+	defer cancel()
+
+	defer odb.cache.invalidate(orderID)
+	return odb.updateOrderShipping(ctx, "UpdateOrderShippingAtVersion", orderID, version, address)
+}
+
+func (odb *OrderDatabase) updateOrderShipping(ctx context.Context, name, orderID string, version int64, address *pb.Address) error {
+	if err := validateAddress(address); err != nil {
+		return err
+	}
+
+	stored, err := odb.encryptAddress(address)
+	if err != nil {
+		return err
+	}
+
+	set := `
+		shipping_address_street = $1, shipping_address_city = $2,
+		shipping_address_state = $3, shipping_address_country = $4,
+		shipping_address_zip = $5`
+	return odb.updateEditableOrder(ctx, name, orderID, version, OrderEventShippingUpdated, set,
+		stored.StreetAddress, stored.City, stored.State, stored.Country, stored.ZipCode)
+}
+
+// UpdateOrderEmail replaces the email address order updates are sent to. It
+// fails with ErrInvalidEmail for a malformed address and with
+// ErrOrderNotEditable once the order has shipped or been cancelled.
+func (odb *OrderDatabase) UpdateOrderEmail(ctx context.Context, orderID, email string) (err error) {
+	ctx, span := odb.startSpan(ctx, "UpdateOrderEmail", attribute.String("order.id", orderID))
+	defer func() { endSpan(span, err) }()
+
+	if err = odb.beginOp(); err != nil {
+		return err
+	}
+	defer odb.endOp()
+
+	ctx, cancel := odb.withQueryTimeout(ctx)
+	defer cancel()
+
+	defer odb.cache.invalidate(orderID)
+	return odb.updateOrderEmail(ctx, "UpdateOrderEmail", orderID, anyVersion, email)
+}
+
+// UpdateOrderEmailAtVersion is UpdateOrderEmail that only applies if the
+// order is still at version, and fails with ErrConcurrentModification
+// otherwise.
+func (odb *OrderDatabase) UpdateOrderEmailAtVersion(ctx context.Context, orderID string, version int64, email string) (err error) {
+	ctx, span := odb.startSpan(ctx, "UpdateOrderEmailAtVersion",
+		attribute.String("order.id", orderID),
+		attribute.Int64("order.version", version),
+	)
+	defer func() { endSpan(span, err) }()
+
+	if err = odb.beginOp(); err != nil {
+		return err
+	}
+	defer odb.endOp()
+
+	ctx, cancel := odb.withQueryTimeout(ctx)
+	defer cancel()
+
+	defer odb.cache.invalidate(orderID)
+	return odb.updateOrderEmail(ctx, "UpdateOrderEmailAtVersion", orderID, version, email)
+}
+
+func (odb *OrderDatabase) updateOrderEmail(ctx context.Context, name, orderID string, version int64, email string) error {
+	if err := validateEmail(email); err != nil {
+		return err
+	}
+
+	stored, err := odb.encryptField(email)
+	if err != nil {
+		return err
+	}
+
+	return odb.updateEditableOrder(ctx, name, orderID, version, OrderEventEmailUpdated,
+		`user_email = $1, user_email_lookup = $2`, stored, odb.emailLookup(email))
+}
+
+// updateEditableOrder applies set, an assignment list using placeholders
+// $1 to $len(args), to an order that has not reached a terminal status, and
+// records event in its audit trail. The status check and the write happen
+// under a row lock in one transaction. Unless version is anyVersion, the
+// write only applies at that version. Event details are left empty since
+// the changed values are customer PII.
+func (odb *OrderDatabase) updateEditableOrder(ctx context.Context, name, orderID string, version int64, event OrderEventType, set string, args ...interface{}) error {
+	return odb.withRetry(ctx, name, func() error {
+		return odb.withTx(ctx, func(tx *sql.Tx) error {
+			var current OrderStatus
+			statusQuery := `SELECT status FROM orders WHERE order_id = $1` + odb.dialect.lockRows()
+			err := odb.queryRowContext(ctx, tx, statusQuery, orderID).Scan(&current)
+			if err != nil {
+				if err == sql.ErrNoRows {
+					return fmt.Errorf("%w: %s", ErrOrderNotFound, orderID)
+				}
+				return fmt.Errorf("failed to query order status: %w", err)
+			}
+			if current.IsTerminal() {
+				return fmt.Errorf("%w: order %s is %s", ErrOrderNotEditable, orderID, current)
+			}
+
+			now := time.Now().UTC()
+			updateQuery := fmt.Sprintf(`
+				UPDATE orders
+				SET %s, updated_at = $%d, version = version + 1
+				WHERE order_id = $%d`, set, len(args)+1, len(args)+2)
+			updateArgs := append(args, now, orderID)
+			if version != anyVersion {
+				updateQuery += fmt.Sprintf(" AND version = $%d", len(updateArgs)+1)
+				updateArgs = append(updateArgs, version)
+			}
+			result, err := odb.execContext(ctx, tx, updateQuery, updateArgs...)
+			if err != nil {
+				return fmt.Errorf("failed to update order: %w", err)
+			}
+			updated, err := result.RowsAffected()
+			if err != nil {
+				return fmt.Errorf("failed to update order: %w", err)
+			}
+			if updated == 0 {
+				// The row exists, it was locked above, so only the version
+				// can have failed to match.
+				return fmt.Errorf("%w: order %s is no longer at version %d", ErrConcurrentModification, orderID, version)
+			}
+			return odb.recordOrderEvent(ctx, tx, orderID, event, current, current, "", now)
+		})
+	})
+}
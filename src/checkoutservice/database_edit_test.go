@@ -0,0 +1,160 @@
+// Copyright 2024
+// Tests for shipping address and email corrections
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+func newCorrectedAddress() *pb.Address {
+	return &pb.Address{
+		StreetAddress: "1 Hacker Way",
+		City:          "Menlo Park",
+		State:         "CA",
+		Country:       "USA",
+		ZipCode:       94025,
+	}
+}
+
+func TestUpdateOrderShipping(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	address := newCorrectedAddress()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT status FROM orders WHERE order_id = \$1 FOR UPDATE`).
+		WithArgs("order-1").
+		WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("PAID"))
+	mock.ExpectExec(`UPDATE orders\s+SET\s+shipping_address_street = \$1.*updated_at = \$6, version = version \+ 1\s+WHERE order_id = \$7$`).
+		WithArgs("1 Hacker Way", "Menlo Park", "CA", "USA", int32(94025), recentUTC{}, "order-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO order_events`).
+		WithArgs("order-1", "SHIPPING_UPDATED", "PAID", "PAID", "", recentUTC{}, nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if err := odb.UpdateOrderShipping(context.Background(), "order-1", address); err != nil {
+		t.Fatalf("UpdateOrderShipping() error = %v", err)
+	}
+}
+
+func TestUpdateOrderEmail(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT status FROM orders WHERE order_id = \$1 FOR UPDATE`).
+		WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("PENDING"))
+	mock.ExpectExec(`UPDATE orders\s+SET user_email = \$1, user_email_lookup = \$2, updated_at = \$3, version = version \+ 1\s+WHERE order_id = \$4$`).
+		WithArgs("fixed@example.com", "fixed@example.com", recentUTC{}, "order-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO order_events`).
+		WithArgs("order-1", "EMAIL_UPDATED", "PENDING", "PENDING", "", recentUTC{}, nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if err := odb.UpdateOrderEmail(context.Background(), "order-1", "fixed@example.com"); err != nil {
+		t.Fatalf("UpdateOrderEmail() error = %v", err)
+	}
+}
+
+func TestUpdateShippedOrderFails(t *testing.T) {
+	for _, status := range []OrderStatus{OrderStatusShipped, OrderStatusCancelled} {
+		t.Run(string(status), func(t *testing.T) {
+			odb, mock := newMockOrderDatabase(t)
+
+			for i := 0; i < 2; i++ {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT status FROM orders WHERE order_id = \$1 FOR UPDATE`).
+					WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(string(status)))
+				mock.ExpectRollback()
+			}
+
+			ctx := context.Background()
+			if err := odb.UpdateOrderShipping(ctx, "order-1", newCorrectedAddress()); !errors.Is(err, ErrOrderNotEditable) {
+				t.Errorf("UpdateOrderShipping() error = %v, want ErrOrderNotEditable", err)
+			}
+			if err := odb.UpdateOrderEmail(ctx, "order-1", "fixed@example.com"); !errors.Is(err, ErrOrderNotEditable) {
+				t.Errorf("UpdateOrderEmail() error = %v, want ErrOrderNotEditable", err)
+			}
+		})
+	}
+}
+
+func TestUpdateOrderRejectsInvalidValues(t *testing.T) {
+	// No expectations: invalid values must be rejected before any query.
+	odb, _ := newMockOrderDatabase(t)
+	ctx := context.Background()
+
+	address := newCorrectedAddress()
+	address.City = " "
+	if err := odb.UpdateOrderShipping(ctx, "order-1", address); !errors.Is(err, ErrInvalidAddress) {
+		t.Errorf("UpdateOrderShipping() with an empty city error = %v, want ErrInvalidAddress", err)
+	}
+	if err := odb.UpdateOrderShipping(ctx, "order-1", nil); !errors.Is(err, ErrInvalidAddress) {
+		t.Errorf("UpdateOrderShipping(nil) error = %v, want ErrInvalidAddress", err)
+	}
+	for _, email := range []string{"", "not-an-email", "Someone <someone@example.com>"} {
+		if err := odb.UpdateOrderEmail(ctx, "order-1", email); !errors.Is(err, ErrInvalidEmail) {
+			t.Errorf("UpdateOrderEmail(%q) error = %v, want ErrInvalidEmail", email, err)
+		}
+	}
+}
+
+func TestUpdateOrderShippingAtStaleVersionFails(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT status FROM orders WHERE order_id = \$1 FOR UPDATE`).
+		WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("PAID"))
+	mock.ExpectExec(`WHERE order_id = \$7 AND version = \$8`).
+		WithArgs("1 Hacker Way", "Menlo Park", "CA", "USA", int32(94025), recentUTC{}, "order-1", int64(4)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	err := odb.UpdateOrderShippingAtVersion(context.Background(), "order-1", 4, newCorrectedAddress())
+	if !errors.Is(err, ErrConcurrentModification) {
+		t.Errorf("UpdateOrderShippingAtVersion() error = %v, want ErrConcurrentModification", err)
+	}
+}
+
+func TestUpdateOrderEmailAtVersion(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT status FROM orders WHERE order_id = \$1 FOR UPDATE`).
+		WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("PAID"))
+	mock.ExpectExec(`SET user_email = \$1, user_email_lookup = \$2, updated_at = \$3, version = version \+ 1\s+WHERE order_id = \$4 AND version = \$5$`).
+		WithArgs("fixed@example.com", "fixed@example.com", recentUTC{}, "order-1", int64(3)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO order_events`).
+		WithArgs("order-1", "EMAIL_UPDATED", "PAID", "PAID", "", recentUTC{}, nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if err := odb.UpdateOrderEmailAtVersion(context.Background(), "order-1", 3, "fixed@example.com"); err != nil {
+		t.Fatalf("UpdateOrderEmailAtVersion() error = %v", err)
+	}
+}
+
+func TestUpdateOrderEmailAtStaleVersionFails(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT status FROM orders WHERE order_id = \$1 FOR UPDATE`).
+		WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("PAID"))
+	mock.ExpectExec(`WHERE order_id = \$4 AND version = \$5`).
+		WithArgs("fixed@example.com", "fixed@example.com", recentUTC{}, "order-1", int64(4)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	err := odb.UpdateOrderEmailAtVersion(context.Background(), "order-1", 4, "fixed@example.com")
+	if !errors.Is(err, ErrConcurrentModification) {
+		t.Errorf("UpdateOrderEmailAtVersion() error = %v, want ErrConcurrentModification", err)
+	}
+}
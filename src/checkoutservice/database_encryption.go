@@ -0,0 +1,167 @@
+// Copyright 2024
+// Application-layer encryption of customer PII columns
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+// encryptedPrefix marks a column value as ciphertext. Values without it are
+// plaintext written before a cipher was configured and are read as they are.
+const encryptedPrefix = "enc:v1:"
+
+// ErrDecryptionFailed is returned when a stored value is marked as
+// encrypted but can't be decrypted, either because no cipher is configured
+// or because the key is wrong or the value was tampered with.
+var ErrDecryptionFailed = errors.New("failed to decrypt order data")
+
+// Cipher encrypts the customer's email and shipping address before they are
+// written to the orders table. Encrypt must be non-deterministic and
+// authenticated, so that Decrypt fails instead of returning garbage when the
+// ciphertext or key is wrong.
+type Cipher interface {
+	Encrypt(plaintext []byte) ([]byte, error)
+	Decrypt(ciphertext []byte) ([]byte, error)
+}
+
+// BlindIndexer is implemented by a Cipher that can also derive a keyed,
+// deterministic digest of a value, so that an encrypted column can still be
+// matched by equality without storing the value. GetOrdersByEmail needs it
+// when a cipher is configured.
+type BlindIndexer interface {
+	BlindIndex(value []byte) []byte
+}
+
+// WithCipher encrypts user_email and the shipping address text columns with
+// c. Without it they are stored in plaintext. The zip code is an integer
+// column and stays in plaintext.
+func WithCipher(c Cipher) Option {
+	return func(o *dbOptions) { o.cipher = c }
+}
+
+type aesGCMCipher struct {
+	aead cipher.AEAD
+	// indexKey keys BlindIndex. It is derived from the encryption key
+	// rather than being the key itself.
+	indexKey []byte
+}
+
+// NewAESGCMCipher returns a Cipher using AES-GCM with a random nonce per
+// value. key must be 16, 24 or 32 bytes long. The Cipher is also a
+// BlindIndexer, using HMAC-SHA256 with a key derived from key.
+func NewAESGCMCipher(key []byte) (Cipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES-GCM cipher: %w", err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("checkoutservice blind index v1"))
+	return aesGCMCipher{aead: aead, indexKey: mac.Sum(nil)}, nil
+}
+
+// Encrypt returns the nonce followed by the sealed plaintext.
+func (c aesGCMCipher) Encrypt(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(plaintext)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return c.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (c aesGCMCipher) Decrypt(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < c.aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:c.aead.NonceSize()], ciphertext[c.aead.NonceSize():]
+	return c.aead.Open(nil, nonce, sealed, nil)
+}
+
+func (c aesGCMCipher) BlindIndex(value []byte) []byte {
+	mac := hmac.New(sha256.New, c.indexKey)
+	mac.Write(value)
+	return mac.Sum(nil)
+}
+
+// encryptField returns the value to store for a PII column: value itself
+// when no cipher is configured, otherwise its base64 ciphertext behind
+// encryptedPrefix.
+func (odb *OrderDatabase) encryptField(value string) (string, error) {
+	if odb.opts.cipher == nil {
+		return value, nil
+	}
+	ciphertext, err := odb.opts.cipher.Encrypt([]byte(value))
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt order data: %w", err)
+	}
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// decryptField reverses encryptField. Plaintext values are returned as they
+// are, so orders saved before a cipher was configured stay readable. The
+// error never includes the value.
+func (odb *OrderDatabase) decryptField(stored string) (string, error) {
+	encoded, ok := strings.CutPrefix(stored, encryptedPrefix)
+	if !ok {
+		return stored, nil
+	}
+	if odb.opts.cipher == nil {
+		return "", fmt.Errorf("%w: value is encrypted but no cipher is configured", ErrDecryptionFailed)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrDecryptionFailed, err)
+	}
+	plaintext, err := odb.opts.cipher.Decrypt(ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrDecryptionFailed, err)
+	}
+	return string(plaintext), nil
+}
+
+// encryptAddress returns a copy of address with its text fields encrypted.
+func (odb *OrderDatabase) encryptAddress(address *pb.Address) (*pb.Address, error) {
+	encrypted := &pb.Address{
+		StreetAddress: address.StreetAddress,
+		City:          address.City,
+		State:         address.State,
+		Country:       address.Country,
+		ZipCode:       address.ZipCode,
+	}
+	for _, field := range addressTextFields(encrypted) {
+		var err error
+		if *field, err = odb.encryptField(*field); err != nil {
+			return nil, err
+		}
+	}
+	return encrypted, nil
+}
+
+// decryptAddress decrypts the text fields of a stored address in place.
+func (odb *OrderDatabase) decryptAddress(address *pb.Address) error {
+	for _, field := range addressTextFields(address) {
+		var err error
+		if *field, err = odb.decryptField(*field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addressTextFields(address *pb.Address) []*string {
+	return []*string{&address.StreetAddress, &address.City, &address.State, &address.Country}
+}
@@ -0,0 +1,93 @@
+// Copyright 2024
+// Tests for PII column encryption
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func newTestCipher(t *testing.T) Cipher {
+	t.Helper()
+	c, err := NewAESGCMCipher(bytes.Repeat([]byte{0x42}, 32))
+	if err != nil {
+		t.Fatalf("NewAESGCMCipher() error = %v", err)
+	}
+	return c
+}
+
+func TestAESGCMCipher(t *testing.T) {
+	c := newTestCipher(t)
+	plaintext := []byte("someone@example.com")
+
+	first, err := c.Encrypt(plaintext)
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+	second, err := c.Encrypt(plaintext)
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+	if bytes.Equal(first, second) {
+		t.Error("Encrypt() returned the same ciphertext twice, want a fresh nonce per call")
+	}
+
+	got, err := c.Decrypt(first)
+	if err != nil {
+		t.Fatalf("Decrypt() error = %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("Decrypt() = %q, want %q", got, plaintext)
+	}
+
+	tampered := bytes.Clone(first)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := c.Decrypt(tampered); err == nil {
+		t.Error("Decrypt() of tampered ciphertext succeeded, want an error")
+	}
+	if _, err := c.Decrypt(first[:4]); err == nil {
+		t.Error("Decrypt() of truncated ciphertext succeeded, want an error")
+	}
+
+	other, err := NewAESGCMCipher(bytes.Repeat([]byte{0x24}, 32))
+	if err != nil {
+		t.Fatalf("NewAESGCMCipher() error = %v", err)
+	}
+	if _, err := other.Decrypt(first); err == nil {
+		t.Error("Decrypt() with the wrong key succeeded, want an error")
+	}
+}
+
+func TestNewAESGCMCipherRejectsBadKey(t *testing.T) {
+	if _, err := NewAESGCMCipher([]byte("too short")); err == nil {
+		t.Error("NewAESGCMCipher() with a 9 byte key succeeded, want an error")
+	}
+}
+
+func TestDecryptField(t *testing.T) {
+	plain := &OrderDatabase{opts: defaultDBOptions()}
+	encrypted := &OrderDatabase{opts: defaultDBOptions()}
+	encrypted.opts.cipher = newTestCipher(t)
+
+	stored, err := encrypted.encryptField("someone@example.com")
+	if err != nil {
+		t.Fatalf("encryptField() error = %v", err)
+	}
+	if got, err := encrypted.decryptField(stored); err != nil || got != "someone@example.com" {
+		t.Errorf("decryptField() = %q, %v, want someone@example.com", got, err)
+	}
+
+	// Rows written before the cipher was configured are still readable.
+	if got, err := encrypted.decryptField("legacy@example.com"); err != nil || got != "legacy@example.com" {
+		t.Errorf("decryptField(plaintext) = %q, %v, want it unchanged", got, err)
+	}
+
+	if _, err := plain.decryptField(stored); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("decryptField() without a cipher error = %v, want ErrDecryptionFailed", err)
+	}
+	if _, err := encrypted.decryptField(encryptedPrefix + "not base64!"); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("decryptField(bad base64) error = %v, want ErrDecryptionFailed", err)
+	}
+}
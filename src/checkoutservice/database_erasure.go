@@ -0,0 +1,206 @@
+// Copyright 2024
+// Erasing a user's personal data on request
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// ErasureMode is how EraseUserData removes a user's personal data.
+type ErasureMode int
+
+const (
+	// ErasureAnonymize overwrites the personal data of the user's orders
+	// and keeps the orders, with their items, amounts, statuses and
+	// timestamps, for accounting. It is the default.
+	ErasureAnonymize ErasureMode = iota
+	// ErasureDelete deletes the user's orders and everything stored with
+	// them.
+	ErasureDelete
+)
+
+func (m ErasureMode) String() string {
+	switch m {
+	case ErasureAnonymize:
+		return "anonymize"
+	case ErasureDelete:
+		return "delete"
+	default:
+		return fmt.Sprintf("ErasureMode(%d)", int(m))
+	}
+}
+
+// WithErasureMode sets how EraseUserData erases a user's data.
+func WithErasureMode(mode ErasureMode) Option {
+	return func(o *dbOptions) { o.erasureMode = mode }
+}
+
+const (
+	// redactedValue replaces the shipping address text of anonymized orders.
+	redactedValue = "REDACTED"
+	// redactedCardLastFour replaces the card digits of anonymized payments.
+	// The column must hold exactly four characters.
+	redactedCardLastFour = "****"
+)
+
+// erasedEmail returns the placeholder that replaces the email of an
+// anonymized order of userID. It is derived from the user ID, which the
+// order keeps, so it reveals nothing the order doesn't already and the
+// user's orders still share an email.
+func erasedEmail(userID string) string {
+	sum := sha256.Sum256([]byte(userID))
+	return "erased-" + hex.EncodeToString(sum[:8]) + "@erased.invalid"
+}
+
+// EraseUserData erases the personal data of every order of userID, for a
+// right-to-erasure request, in one transaction, and returns how many
+// orders it erased. Archived orders are erased too.
+//
+// By default, or with ErasureAnonymize, the email becomes a placeholder,
+// the shipping address text becomes "REDACTED" and the zip code 0, the
+// cancellation reason, event details and outbox events are removed and
+// the card's last four digits become "****"; the user ID, items, amounts, statuses,
+// timestamps and payment processor transaction ID are kept, so the orders
+// still add up for accounting. Anonymized orders are no longer found by
+// GetOrdersByEmail. With ErasureDelete the orders are deleted outright.
+// Erasing a user without orders erases nothing and isn't an error. Orders
+// waiting in failed_orders aren't erased; replay them first.
+func (odb *OrderDatabase) EraseUserData(ctx context.Context, userID string) (erased int, err error) {
+	mode := odb.opts.erasureMode
+	ctx, span := odb.startSpan(ctx, "EraseUserData",
+		attribute.String("user.id", userID),
+		attribute.String("erasure.mode", mode.String()),
+	)
+	defer func() {
+		span.SetAttributes(attribute.Int("order.erased_count", erased))
+		endSpan(span, err)
+	}()
+
+	if err = odb.beginOp(); err != nil {
+		return 0, err
+	}
+	defer odb.endOp()
+
+	ctx, cancel := odb.withQueryTimeout(ctx)
+	defer cancel()
+
+	if userID == "" {
+		return 0, errors.New("user ID is empty")
+	}
+	if mode != ErasureAnonymize && mode != ErasureDelete {
+		return 0, fmt.Errorf("unknown erasure mode %v", mode)
+	}
+
+	// The erased orders aren't known ahead, so drop them all.
+	defer odb.cache.invalidateAll()
+	err = odb.withRetry(ctx, "EraseUserData", func() error {
+		return odb.withTx(ctx, func(tx *sql.Tx) (err error) {
+			if mode == ErasureDelete {
+				erased, err = odb.deleteUserOrders(ctx, tx, userID)
+			} else {
+				erased, err = odb.anonymizeUserOrders(ctx, tx, userID)
+			}
+			return err
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	log.Infof("Erased the data of %d orders (%s)", erased, mode)
+	return erased, nil
+}
+
+// deleteUserOrders deletes the user's orders and archived orders. Their
+// items, events and payments go with them by ON DELETE CASCADE.
+func (odb *OrderDatabase) deleteUserOrders(ctx context.Context, tx *sql.Tx, userID string) (int, error) {
+	deleted := 0
+	for _, table := range []string{"orders", "orders_archive"} {
+		result, err := odb.execContext(ctx, tx, `DELETE FROM `+table+` WHERE user_id = $1`, userID)
+		if err != nil {
+			return 0, fmt.Errorf("failed to delete %s: %w", table, err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, fmt.Errorf("failed to delete %s: %w", table, err)
+		}
+		deleted += int(n)
+	}
+	return deleted, nil
+}
+
+// anonymizeUserOrders overwrites the personal data of the user's orders
+// and archived orders as EraseUserData documents, and returns how many
+// orders it changed.
+func (odb *OrderDatabase) anonymizeUserOrders(ctx context.Context, tx *sql.Tx, userID string) (int, error) {
+	// Events, payments and outbox events are matched through their order's
+	// user_id, which anonymizing keeps, so the order in which the tables are
+	// done doesn't matter.
+	related := []struct {
+		what, query string
+		args        []interface{}
+	}{
+		{"events", `
+			UPDATE order_events SET detail = NULL
+			WHERE order_id IN (SELECT order_id FROM orders WHERE user_id = $1)`, []interface{}{userID}},
+		{"archived events", `
+			UPDATE order_events_archive SET detail = NULL
+			WHERE order_id IN (SELECT order_id FROM orders_archive WHERE user_id = $1)`, []interface{}{userID}},
+		{"payments", `
+			UPDATE order_payments SET card_last_four = $2
+			WHERE order_id IN (SELECT order_id FROM orders WHERE user_id = $1)`, []interface{}{userID, redactedCardLastFour}},
+		{"archived payments", `
+			UPDATE order_payments_archive SET card_last_four = $2
+			WHERE order_id IN (SELECT order_id FROM orders_archive WHERE user_id = $1)`, []interface{}{userID, redactedCardLastFour}},
+		// Published or not, the events carry the email and address.
+		{"outbox events", `
+			DELETE FROM order_outbox
+			WHERE order_id IN (SELECT order_id FROM orders WHERE user_id = $1)`, []interface{}{userID}},
+	}
+	for _, step := range related {
+		if _, err := odb.execContext(ctx, tx, step.query, step.args...); err != nil {
+			return 0, fmt.Errorf("failed to anonymize %s: %w", step.what, err)
+		}
+	}
+
+	const scrubPII = `
+		user_email = $2,
+		shipping_address_street = $3, shipping_address_city = $3,
+		shipping_address_state = $3, shipping_address_country = $3,
+		shipping_address_zip = 0, cancellation_reason = NULL`
+	now := time.Now().UTC()
+	orders := []struct {
+		table, query string
+		args         []interface{}
+	}{
+		{"orders", `
+			UPDATE orders
+			SET ` + scrubPII + `, user_email_lookup = NULL, updated_at = $4, version = version + 1
+			WHERE user_id = $1`, []interface{}{userID, erasedEmail(userID), redactedValue, now}},
+		{"orders_archive", `
+			UPDATE orders_archive
+			SET ` + scrubPII + `
+			WHERE user_id = $1`, []interface{}{userID, erasedEmail(userID), redactedValue}},
+	}
+	anonymized := 0
+	for _, o := range orders {
+		result, err := odb.execContext(ctx, tx, o.query, o.args...)
+		if err != nil {
+			return 0, fmt.Errorf("failed to anonymize %s: %w", o.table, err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, fmt.Errorf("failed to anonymize %s: %w", o.table, err)
+		}
+		anonymized += int(n)
+	}
+	return anonymized, nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2024
+// Tests for erasing a user's personal data
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestEraseUserDataAnonymizesByDefault(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	placeholder := erasedEmail("user-1")
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE order_events SET detail = NULL`).
+		WithArgs("user-1").WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec(`UPDATE order_events_archive SET detail = NULL`).
+		WithArgs("user-1").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`UPDATE order_payments SET card_last_four = \$2`).
+		WithArgs("user-1", "****").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`UPDATE order_payments_archive SET card_last_four = \$2`).
+		WithArgs("user-1", "****").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`DELETE FROM order_outbox`).
+		WithArgs("user-1").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`UPDATE orders\s+SET\s+user_email = \$2,.*user_email_lookup = NULL, updated_at = \$4, version = version \+ 1\s+WHERE user_id = \$1$`).
+		WithArgs("user-1", placeholder, "REDACTED", recentUTC{}).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`UPDATE orders_archive\s+SET\s+user_email = \$2,.*cancellation_reason = NULL\s+WHERE user_id = \$1$`).
+		WithArgs("user-1", placeholder, "REDACTED").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	erased, err := odb.EraseUserData(context.Background(), "user-1")
+	if err != nil {
+		t.Fatalf("EraseUserData() error = %v", err)
+	}
+	if erased != 3 {
+		t.Errorf("EraseUserData() = %d, want the 3 orders and archived orders", erased)
+	}
+}
+
+func TestEraseUserDataDeletes(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	odb.opts.erasureMode = ErasureDelete
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM orders WHERE user_id = \$1`).
+		WithArgs("user-1").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`DELETE FROM orders_archive WHERE user_id = \$1`).
+		WithArgs("user-1").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	erased, err := odb.EraseUserData(context.Background(), "user-1")
+	if err != nil {
+		t.Fatalf("EraseUserData() error = %v", err)
+	}
+	if erased != 2 {
+		t.Errorf("EraseUserData() = %d, want 2", erased)
+	}
+}
+
+func TestEraseUserDataRollsBackOnFailure(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	odb.opts.erasureMode = ErasureDelete
+	errBoom := errors.New("boom")
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM orders WHERE`).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`DELETE FROM orders_archive WHERE`).WillReturnError(errBoom)
+	mock.ExpectRollback()
+
+	erased, err := odb.EraseUserData(context.Background(), "user-1")
+	if !errors.Is(err, errBoom) {
+		t.Fatalf("EraseUserData() error = %v, want %v", err, errBoom)
+	}
+	if erased != 0 {
+		t.Errorf("EraseUserData() = %d after a rollback, want 0", erased)
+	}
+}
+
+func TestEraseUserDataRejectsInvalidInput(t *testing.T) {
+	odb, _ := newMockOrderDatabase(t)
+	ctx := context.Background()
+
+	if _, err := odb.EraseUserData(ctx, ""); err == nil {
+		t.Error("EraseUserData() of an empty user ID error = nil")
+	}
+	odb.opts.erasureMode = ErasureMode(7)
+	if _, err := odb.EraseUserData(ctx, "user-1"); err == nil || !strings.Contains(err.Error(), "ErasureMode(7)") {
+		t.Errorf("EraseUserData() with an unknown mode error = %v, want one naming the mode", err)
+	}
+}
+
+func TestErasedEmail(t *testing.T) {
+	email := erasedEmail("user-1")
+	if !strings.HasSuffix(email, "@erased.invalid") || strings.Contains(email, "user-1") {
+		t.Errorf("erasedEmail() = %q, want a placeholder that doesn't contain the user ID", email)
+	}
+	if email != erasedEmail("user-1") || email == erasedEmail("user-2") {
+		t.Error("erasedEmail() isn't a stable function of the user ID")
+	}
+}
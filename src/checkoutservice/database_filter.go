@@ -0,0 +1,122 @@
+// Copyright 2024
+// Filtered order queries for support and reporting
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var ErrEmptyOrderFilter = errors.New("order filter must set at least one of UserID, Status, CreatedAfter or CreatedBefore")
+
+// OrderFilter selects orders for QueryOrders. Zero-valued fields are
+// ignored; at least one of UserID, Status, CreatedAfter and CreatedBefore
+// must be set. The time range is half-open: CreatedAfter is inclusive and
+// CreatedBefore exclusive.
+type OrderFilter struct {
+	UserID        string
+	Status        OrderStatus
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+
+	// Limit defaults to, and is capped at, maxOrdersPageSize.
+	Limit  int
+	Offset int
+}
+
+func (f OrderFilter) isEmpty() bool {
+	return f.UserID == "" && f.Status == "" && f.CreatedAfter.IsZero() && f.CreatedBefore.IsZero()
+}
+
+// whereClause builds the WHERE clause for f and its positional arguments.
+// Filter values only ever travel as arguments, never as SQL text.
+func (f OrderFilter) whereClause() (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+
+	if f.UserID != "" {
+		add("user_id = $%d", f.UserID)
+	}
+	if f.Status != "" {
+		add("status = $%d", string(f.Status))
+	}
+	if !f.CreatedAfter.IsZero() {
+		add("created_at >= $%d", f.CreatedAfter.UTC())
+	}
+	if !f.CreatedBefore.IsZero() {
+		add("created_at < $%d", f.CreatedBefore.UTC())
+	}
+	return "WHERE " + strings.Join(conds, " AND "), args
+}
+
+// QueryOrders returns the orders matching filter, newest first, with ties
+// broken by order ID so that pages neither repeat nor skip orders. An empty
+// filter is rejected with ErrEmptyOrderFilter so a mistake can't turn into
+// a scan of the whole table.
+func (odb *OrderDatabase) QueryOrders(ctx context.Context, filter OrderFilter) (_ []*OrderRecord, err error) {
+	ctx, span := odb.startSpan(ctx, "QueryOrders",
+		attribute.Bool("filter.user_id", filter.UserID != ""),
+		attribute.String("filter.status", string(filter.Status)),
+		attribute.Int("page.limit", filter.Limit),
+		attribute.Int("page.offset", filter.Offset),
+	)
+	defer func() { endSpan(span, err) }()
+
+	if err = odb.beginOp(); err != nil {
+		return nil, err
+	}
+	defer odb.endOp()
+
+	ctx, cancel := odb.withQueryTimeout(ctx)
+	defer cancel()
+
+	if filter.isEmpty() {
+		return nil, ErrEmptyOrderFilter
+	}
+	if filter.Status != "" && !filter.Status.IsValid() {
+		return nil, fmt.Errorf("unknown order status %q", filter.Status)
+	}
+	if !filter.CreatedAfter.IsZero() && !filter.CreatedBefore.IsZero() && !filter.CreatedAfter.Before(filter.CreatedBefore) {
+		return nil, fmt.Errorf("invalid time range: CreatedAfter %v is not before CreatedBefore %v", filter.CreatedAfter, filter.CreatedBefore)
+	}
+	if filter.Limit < 0 {
+		return nil, fmt.Errorf("invalid page limit %d: must not be negative", filter.Limit)
+	}
+	if filter.Offset < 0 {
+		return nil, fmt.Errorf("invalid page offset %d: must not be negative", filter.Offset)
+	}
+	limit := filter.Limit
+	if limit == 0 || limit > maxOrdersPageSize {
+		limit = maxOrdersPageSize
+	}
+
+	where, args := filter.whereClause()
+	args = append(args, limit, filter.Offset)
+	orderQuery := selectOrdersQuery + `
+		` + where + fmt.Sprintf(`
+		ORDER BY created_at DESC, order_id DESC
+		LIMIT $%d OFFSET $%d
+	`, len(args)-1, len(args))
+
+	var orders []*OrderRecord
+	err = odb.withReadRetry(ctx, "QueryOrders", func(q *sql.DB) (err error) {
+		orders, err = odb.queryOrders(ctx, q, orderQuery, args...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("db.rows_returned", len(orders)))
+	return orders, nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2024
+// Tests for filtered order queries
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestQueryOrdersByStatus(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+
+	mock.ExpectQuery(`FROM orders\s+WHERE status = \$1\s+ORDER BY created_at DESC, order_id DESC\s+LIMIT \$2 OFFSET \$3`).
+		WithArgs("SHIPPED", maxOrdersPageSize, 0).
+		WillReturnRows(sqlmock.NewRows(orderColumns).AddRow(orderRow("order-1")...))
+	mock.ExpectQuery(`FROM order_items`).WillReturnRows(sqlmock.NewRows(orderItemColumns))
+
+	orders, err := odb.QueryOrders(context.Background(), OrderFilter{Status: OrderStatusShipped})
+	if err != nil {
+		t.Fatalf("QueryOrders() error = %v", err)
+	}
+	if len(orders) != 1 {
+		t.Errorf("QueryOrders() returned %d orders, want 1", len(orders))
+	}
+}
+
+func TestQueryOrdersCombinesFilters(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+
+	after := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	before := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(`FROM orders\s+WHERE user_id = \$1 AND status = \$2 AND created_at >= \$3 AND created_at < \$4\s+ORDER BY created_at DESC, order_id DESC\s+LIMIT \$5 OFFSET \$6`).
+		WithArgs("user-1", "PAID", after, before, 10, 20).
+		WillReturnRows(sqlmock.NewRows(orderColumns))
+
+	_, err := odb.QueryOrders(context.Background(), OrderFilter{
+		UserID:        "user-1",
+		Status:        OrderStatusPaid,
+		CreatedAfter:  after,
+		CreatedBefore: before,
+		Limit:         10,
+		Offset:        20,
+	})
+	if err != nil {
+		t.Fatalf("QueryOrders() error = %v", err)
+	}
+}
+
+func TestQueryOrdersTimeRange(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+
+	after := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	before := time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(`FROM orders\s+WHERE created_at >= \$1 AND created_at < \$2\s+ORDER BY`).
+		WithArgs(after, before, maxOrdersPageSize, 0).
+		WillReturnRows(sqlmock.NewRows(orderColumns))
+
+	if _, err := odb.QueryOrders(context.Background(), OrderFilter{CreatedAfter: after, CreatedBefore: before}); err != nil {
+		t.Fatalf("QueryOrders() error = %v", err)
+	}
+}
+
+func TestQueryOrdersRejectsInvalidFilters(t *testing.T) {
+	odb, _ := newMockOrderDatabase(t)
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		filter OrderFilter
+	}{
+		{"empty", OrderFilter{}},
+		{"pagination only", OrderFilter{Limit: 10, Offset: 5}},
+		{"unknown status", OrderFilter{Status: "LOST"}},
+		{"inverted range", OrderFilter{CreatedAfter: now, CreatedBefore: now.Add(-time.Hour)}},
+		{"negative offset", OrderFilter{UserID: "user-1", Offset: -1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := odb.QueryOrders(context.Background(), tt.filter); err == nil {
+				t.Error("QueryOrders() error = nil, want an error")
+			}
+		})
+	}
+
+	if _, err := odb.QueryOrders(context.Background(), OrderFilter{}); !errors.Is(err, ErrEmptyOrderFilter) {
+		t.Errorf("QueryOrders() with an empty filter error = %v, want ErrEmptyOrderFilter", err)
+	}
+}
@@ -0,0 +1,1648 @@
+// Copyright 2024
+// Tests that need a real database, run against SQLite and, when
+// TEST_DATABASE_URL is set, Postgres
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+// forEachBackend runs test once per supported database. SQLite always runs,
+// on a fresh file per test; Postgres runs against the database named by
+// TEST_DATABASE_URL and MySQL against the one named by TEST_MYSQL_URL, a
+// mysql:// connection string, and each is skipped when its variable is
+// unset. Either way the database is migrated to the current schema first.
+func forEachBackend(t *testing.T, test func(t *testing.T, odb *OrderDatabase)) {
+	t.Helper()
+	t.Run("sqlite", func(t *testing.T) {
+		test(t, openIntegrationOrderDatabase(t, sqliteScheme+filepath.Join(t.TempDir(), "orders.db")))
+	})
+	t.Run("postgres", func(t *testing.T) {
+		dsn := os.Getenv("TEST_DATABASE_URL")
+		if dsn == "" {
+			t.Skip("TEST_DATABASE_URL not set, skipping Postgres integration test")
+		}
+		test(t, openIntegrationOrderDatabase(t, dsn))
+	})
+	t.Run("mysql", func(t *testing.T) {
+		dsn := os.Getenv("TEST_MYSQL_URL")
+		if dsn == "" {
+			t.Skip("TEST_MYSQL_URL not set, skipping MySQL integration test")
+		}
+		test(t, openIntegrationOrderDatabase(t, dsn))
+	})
+}
+
+func openIntegrationOrderDatabase(t testing.TB, dsn string) *OrderDatabase {
+	t.Helper()
+	odb, err := NewOrderDatabase(dsn)
+	if err != nil {
+		t.Fatalf("NewOrderDatabase() error = %v", err)
+	}
+	t.Cleanup(func() { odb.Close() })
+	if err := odb.EnsureSchema(context.Background()); err != nil {
+		t.Fatalf("EnsureSchema() error = %v", err)
+	}
+	return odb
+}
+
+// newIntegrationOrder returns a test order with fresh order and user IDs,
+// so tests sharing a Postgres database don't see each other's orders.
+func newIntegrationOrder(userID string) (*pb.PlaceOrderRequest, *pb.OrderResult, *pb.Money) {
+	req, result, total := newTestOrder(uuid.NewString())
+	req.UserId = userID
+	return req, result, total
+}
+
+func TestOrderRoundTrip(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, odb *OrderDatabase) {
+		ctx := context.Background()
+		userID := uuid.NewString()
+
+		var placed []*pb.OrderResult
+		for i := 0; i < 3; i++ {
+			req, result, total := newIntegrationOrder(userID)
+			if err := odb.SaveOrder(ctx, req, result, total); err != nil {
+				t.Fatalf("SaveOrder() error = %v", err)
+			}
+			// Saving the same order again is a no-op.
+			if err := odb.SaveOrder(ctx, req, result, total); err != nil {
+				t.Fatalf("repeated SaveOrder() error = %v", err)
+			}
+			placed = append(placed, result)
+		}
+
+		req, result, total := newIntegrationOrder(userID)
+		result.OrderId = placed[0].OrderId
+		result.ShippingTrackingId = "different"
+		if err := odb.SaveOrder(ctx, req, result, total); !errors.Is(err, ErrOrderConflict) {
+			t.Errorf("conflicting SaveOrder() error = %v, want ErrOrderConflict", err)
+		}
+
+		got, err := odb.GetOrder(ctx, placed[0].OrderId)
+		if err != nil {
+			t.Fatalf("GetOrder() error = %v", err)
+		}
+		if !proto.Equal(got.Order, placed[0]) {
+			t.Errorf("GetOrder() = %v, want %v", got.Order, placed[0])
+		}
+		if got.Status != OrderStatusPaid {
+			t.Errorf("GetOrder() status = %s, want %s", got.Status, OrderStatusPaid)
+		}
+		if _, err := odb.GetOrder(ctx, uuid.NewString()); !errors.Is(err, ErrOrderNotFound) {
+			t.Errorf("GetOrder() for a missing order error = %v, want ErrOrderNotFound", err)
+		}
+
+		orders, err := odb.GetUserOrders(ctx, userID)
+		if err != nil {
+			t.Fatalf("GetUserOrders() error = %v", err)
+		}
+		if len(orders) != len(placed) {
+			t.Errorf("GetUserOrders() returned %d orders, want %d", len(orders), len(placed))
+		}
+		if count, err := odb.CountUserOrders(ctx, userID); err != nil || count != int64(len(placed)) {
+			t.Errorf("CountUserOrders() = %d, %v, want %d", count, err, len(placed))
+		}
+		page, pageTotal, err := odb.GetUserOrdersPaged(ctx, userID, 2, 0)
+		if err != nil || len(page) != 2 || pageTotal != len(placed) {
+			t.Errorf("GetUserOrdersPaged() = %d orders, total %d, %v; want 2 of %d", len(page), pageTotal, err, len(placed))
+		}
+
+		batch, err := odb.BatchGetOrders(ctx, []string{placed[1].OrderId, uuid.NewString()})
+		if err != nil {
+			t.Fatalf("BatchGetOrders() error = %v", err)
+		}
+		if len(batch) != 1 || !proto.Equal(batch[placed[1].OrderId].Order, placed[1]) {
+			t.Errorf("BatchGetOrders() = %v, want only %s", batch, placed[1].OrderId)
+		}
+
+		if err := odb.UpdateOrderStatus(ctx, placed[1].OrderId, OrderStatusShipped); err != nil {
+			t.Fatalf("UpdateOrderStatus() error = %v", err)
+		}
+		if err := odb.UpdateOrderStatus(ctx, placed[1].OrderId, OrderStatusPaid); !errors.Is(err, ErrInvalidStatusTransition) {
+			t.Errorf("UpdateOrderStatus() back to PAID error = %v, want ErrInvalidStatusTransition", err)
+		}
+		if err := odb.CancelOrder(ctx, placed[1].OrderId, "too late"); !errors.Is(err, ErrOrderNotCancellable) {
+			t.Errorf("CancelOrder() of a shipped order error = %v, want ErrOrderNotCancellable", err)
+		}
+		if err := odb.CancelOrder(ctx, placed[2].OrderId, "changed my mind"); err != nil {
+			t.Fatalf("CancelOrder() error = %v", err)
+		}
+		cancelled, err := odb.GetOrder(ctx, placed[2].OrderId)
+		if err != nil {
+			t.Fatalf("GetOrder() error = %v", err)
+		}
+		if cancelled.Status != OrderStatusCancelled || cancelled.CancellationReason != "changed my mind" || cancelled.CancelledAt.IsZero() {
+			t.Errorf("GetOrder() after cancelling = %+v, want the cancellation recorded", cancelled)
+		}
+
+		shipped, err := odb.QueryOrders(ctx, OrderFilter{
+			UserID:        userID,
+			Status:        OrderStatusShipped,
+			CreatedAfter:  time.Now().Add(-time.Hour),
+			CreatedBefore: time.Now().Add(time.Hour),
+		})
+		if err != nil {
+			t.Fatalf("QueryOrders() error = %v", err)
+		}
+		if len(shipped) != 1 || shipped[0].Order.OrderId != placed[1].OrderId {
+			t.Errorf("QueryOrders() returned %d orders, want only %s", len(shipped), placed[1].OrderId)
+		}
+		if old, err := odb.QueryOrders(ctx, OrderFilter{UserID: userID, CreatedBefore: time.Now().Add(-time.Hour)}); err != nil || len(old) != 0 {
+			t.Errorf("QueryOrders() before the orders were placed = %d orders, %v; want none", len(old), err)
+		}
+	})
+}
+
+func TestOrderCorrectionsRoundTrip(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, odb *OrderDatabase) {
+		ctx := context.Background()
+		req, result, total := newIntegrationOrder(uuid.NewString())
+		if err := odb.SaveOrder(ctx, req, result, total); err != nil {
+			t.Fatalf("SaveOrder() error = %v", err)
+		}
+
+		address := newCorrectedAddress()
+		if err := odb.UpdateOrderShipping(ctx, result.OrderId, address); err != nil {
+			t.Fatalf("UpdateOrderShipping() error = %v", err)
+		}
+		if err := odb.UpdateOrderEmail(ctx, result.OrderId, "fixed@example.com"); err != nil {
+			t.Fatalf("UpdateOrderEmail() error = %v", err)
+		}
+
+		got, err := odb.GetOrder(ctx, result.OrderId)
+		if err != nil {
+			t.Fatalf("GetOrder() error = %v", err)
+		}
+		if !proto.Equal(got.Order.ShippingAddress, address) {
+			t.Errorf("GetOrder() address = %v, want %v", got.Order.ShippingAddress, address)
+		}
+		if !got.UpdatedAt.After(got.CreatedAt) {
+			t.Errorf("GetOrder() UpdatedAt = %v, want later than CreatedAt %v", got.UpdatedAt, got.CreatedAt)
+		}
+		var email string
+		if err := odb.queryRowContext(ctx, odb.db, `SELECT user_email FROM orders WHERE order_id = $1`, result.OrderId).Scan(&email); err != nil {
+			t.Fatalf("failed to read user_email: %v", err)
+		}
+		if email != "fixed@example.com" {
+			t.Errorf("user_email = %q, want fixed@example.com", email)
+		}
+
+		if err := odb.UpdateOrderStatus(ctx, result.OrderId, OrderStatusShipped); err != nil {
+			t.Fatalf("UpdateOrderStatus() error = %v", err)
+		}
+		if err := odb.UpdateOrderShipping(ctx, result.OrderId, address); !errors.Is(err, ErrOrderNotEditable) {
+			t.Errorf("UpdateOrderShipping() of a shipped order error = %v, want ErrOrderNotEditable", err)
+		}
+	})
+}
+
+func TestOrderVersioning(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, odb *OrderDatabase) {
+		ctx := context.Background()
+		req, result, total := newIntegrationOrder(uuid.NewString())
+		if err := odb.SaveOrder(ctx, req, result, total); err != nil {
+			t.Fatalf("SaveOrder() error = %v", err)
+		}
+		version := func() int64 {
+			t.Helper()
+			got, err := odb.GetOrder(ctx, result.OrderId)
+			if err != nil {
+				t.Fatalf("GetOrder() error = %v", err)
+			}
+			return got.Version
+		}
+
+		read := version()
+		if read != 1 {
+			t.Fatalf("new order version = %d, want 1", read)
+		}
+
+		// Another writer gets in between our read and our write.
+		if err := odb.UpdateOrderShipping(ctx, result.OrderId, newCorrectedAddress()); err != nil {
+			t.Fatalf("UpdateOrderShipping() error = %v", err)
+		}
+		if err := odb.UpdateOrderStatusAtVersion(ctx, result.OrderId, read, OrderStatusShipped); !errors.Is(err, ErrConcurrentModification) {
+			t.Errorf("UpdateOrderStatusAtVersion() with a stale version error = %v, want ErrConcurrentModification", err)
+		}
+		if err := odb.UpdateOrderShippingAtVersion(ctx, result.OrderId, read, req.Address); !errors.Is(err, ErrConcurrentModification) {
+			t.Errorf("UpdateOrderShippingAtVersion() with a stale version error = %v, want ErrConcurrentModification", err)
+		}
+		if err := odb.UpdateOrderEmailAtVersion(ctx, result.OrderId, read, "fixed@example.com"); !errors.Is(err, ErrConcurrentModification) {
+			t.Errorf("UpdateOrderEmailAtVersion() with a stale version error = %v, want ErrConcurrentModification", err)
+		}
+
+		// Re-reading and retrying succeeds.
+		read = version()
+		if read != 2 {
+			t.Fatalf("version after one update = %d, want 2", read)
+		}
+		if err := odb.UpdateOrderShippingAtVersion(ctx, result.OrderId, read, req.Address); err != nil {
+			t.Fatalf("UpdateOrderShippingAtVersion() error = %v", err)
+		}
+		if err := odb.UpdateOrderStatusAtVersion(ctx, result.OrderId, read+1, OrderStatusShipped); err != nil {
+			t.Fatalf("UpdateOrderStatusAtVersion() error = %v", err)
+		}
+		if got := version(); got != 4 {
+			t.Errorf("version after three updates = %d, want 4", got)
+		}
+	})
+}
+
+func TestEncryptedOrderRoundTrip(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, plain *OrderDatabase) {
+		ctx := context.Background()
+		// Same pool and schema, but with PII encryption enabled.
+		encrypted := newOrderDatabase(plain.db, plain.dialect, newDBOptions([]Option{WithCipher(newTestCipher(t))}))
+
+		req, result, total := newIntegrationOrder(uuid.NewString())
+		if err := encrypted.SaveOrder(ctx, req, result, total); err != nil {
+			t.Fatalf("SaveOrder() error = %v", err)
+		}
+		// The duplicate check compares decrypted values.
+		if err := encrypted.SaveOrder(ctx, req, result, total); err != nil {
+			t.Fatalf("repeated SaveOrder() error = %v", err)
+		}
+
+		var email, street string
+		rawQuery := `SELECT user_email, shipping_address_street FROM orders WHERE order_id = $1`
+		if err := plain.queryRowContext(ctx, plain.db, rawQuery, result.OrderId).Scan(&email, &street); err != nil {
+			t.Fatalf("failed to read stored PII: %v", err)
+		}
+		if email == req.Email || street == req.Address.StreetAddress {
+			t.Errorf("stored user_email = %q, street = %q, want ciphertext", email, street)
+		}
+
+		got, err := encrypted.GetOrder(ctx, result.OrderId)
+		if err != nil {
+			t.Fatalf("GetOrder() error = %v", err)
+		}
+		if !proto.Equal(got.Order.ShippingAddress, req.Address) {
+			t.Errorf("GetOrder() address = %v, want %v", got.Order.ShippingAddress, req.Address)
+		}
+		orders, err := encrypted.GetUserOrders(ctx, req.UserId)
+		if err != nil || len(orders) != 1 || !proto.Equal(orders[0].Order.ShippingAddress, req.Address) {
+			t.Errorf("GetUserOrders() = %v, %v, want the decrypted order", orders, err)
+		}
+
+		if _, err := plain.GetOrder(ctx, result.OrderId); !errors.Is(err, ErrDecryptionFailed) {
+			t.Errorf("GetOrder() without the cipher error = %v, want ErrDecryptionFailed", err)
+		}
+
+		// Orders saved before encryption was enabled stay readable.
+		legacyReq, legacyResult, legacyTotal := newIntegrationOrder(uuid.NewString())
+		if err := plain.SaveOrder(ctx, legacyReq, legacyResult, legacyTotal); err != nil {
+			t.Fatalf("SaveOrder() without the cipher error = %v", err)
+		}
+		legacy, err := encrypted.GetOrder(ctx, legacyResult.OrderId)
+		if err != nil {
+			t.Fatalf("GetOrder() of a plaintext order error = %v", err)
+		}
+		if !proto.Equal(legacy.Order.ShippingAddress, legacyReq.Address) {
+			t.Errorf("GetOrder() address = %v, want %v", legacy.Order.ShippingAddress, legacyReq.Address)
+		}
+
+		if err := encrypted.UpdateOrderEmail(ctx, result.OrderId, "fixed@example.com"); err != nil {
+			t.Fatalf("UpdateOrderEmail() error = %v", err)
+		}
+		if err := plain.queryRowContext(ctx, plain.db, rawQuery, result.OrderId).Scan(&email, &street); err != nil {
+			t.Fatalf("failed to read stored PII: %v", err)
+		}
+		if decrypted, err := encrypted.decryptField(email); err != nil || decrypted != "fixed@example.com" {
+			t.Errorf("stored user_email decrypts to %q, %v, want fixed@example.com", decrypted, err)
+		}
+	})
+}
+
+func TestUserSpendSummary(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, odb *OrderDatabase) {
+		ctx := context.Background()
+		userID := uuid.NewString()
+
+		totals := []*pb.Money{
+			{CurrencyCode: "EUR", Units: 10, Nanos: 600000000},
+			{CurrencyCode: "USD", Units: 5, Nanos: 500000000},
+			{CurrencyCode: "EUR", Units: 10, Nanos: 600000000},
+			{CurrencyCode: "USD", Units: 100},
+		}
+		var orderIDs []string
+		start := time.Now().UTC()
+		for _, total := range totals {
+			req, result, _ := newIntegrationOrder(userID)
+			if err := odb.SaveOrder(ctx, req, result, total); err != nil {
+				t.Fatalf("SaveOrder() error = %v", err)
+			}
+			orderIDs = append(orderIDs, result.OrderId)
+		}
+		// Cancelled orders don't count towards spend, but are still orders.
+		if err := odb.CancelOrder(ctx, orderIDs[3], "changed my mind"); err != nil {
+			t.Fatalf("CancelOrder() error = %v", err)
+		}
+
+		got, err := odb.GetUserSpendSummary(ctx, userID)
+		if err != nil {
+			t.Fatalf("GetUserSpendSummary() error = %v", err)
+		}
+		if got.OrderCount != 4 || got.CancelledCount != 1 {
+			t.Errorf("OrderCount, CancelledCount = %d, %d, want 4, 1", got.OrderCount, got.CancelledCount)
+		}
+		wantTotals := map[string]*pb.Money{
+			"EUR": {CurrencyCode: "EUR", Units: 21, Nanos: 200000000},
+			"USD": {CurrencyCode: "USD", Units: 5, Nanos: 500000000},
+		}
+		for currency, want := range wantTotals {
+			if !proto.Equal(got.Totals[currency], want) {
+				t.Errorf("Totals[%s] = %v, want %v", currency, got.Totals[currency], want)
+			}
+		}
+		if len(got.Totals) != len(wantTotals) {
+			t.Errorf("Totals = %v, want only EUR and USD", got.Totals)
+		}
+		if got.FirstOrderAt.Before(start.Add(-time.Second)) || got.LastOrderAt.Before(got.FirstOrderAt) {
+			t.Errorf("first/last order = %v/%v, want recent and in order", got.FirstOrderAt, got.LastOrderAt)
+		}
+
+		empty, err := odb.GetUserSpendSummary(ctx, uuid.NewString())
+		if err != nil {
+			t.Fatalf("GetUserSpendSummary() for a new user error = %v", err)
+		}
+		if empty.OrderCount != 0 || len(empty.Totals) != 0 || !empty.FirstOrderAt.IsZero() {
+			t.Errorf("GetUserSpendSummary() for a new user = %+v, want an empty summary", empty)
+		}
+
+		// A user whose only order was cancelled still has it counted and
+		// dated, with nothing spent.
+		cancelledUser := uuid.NewString()
+		req, result, total := newIntegrationOrder(cancelledUser)
+		if err := odb.SaveOrder(ctx, req, result, total); err != nil {
+			t.Fatalf("SaveOrder() error = %v", err)
+		}
+		if err := odb.CancelOrder(ctx, result.OrderId, "changed my mind"); err != nil {
+			t.Fatalf("CancelOrder() error = %v", err)
+		}
+		cancelled, err := odb.GetUserSpendSummary(ctx, cancelledUser)
+		if err != nil {
+			t.Fatalf("GetUserSpendSummary() for a cancelled user error = %v", err)
+		}
+		if cancelled.OrderCount != 1 || cancelled.CancelledCount != 1 || len(cancelled.Totals) != 0 || cancelled.FirstOrderAt.IsZero() {
+			t.Errorf("GetUserSpendSummary() for a cancelled user = %+v, want one cancelled, dated order and no totals", cancelled)
+		}
+	})
+}
+
+func TestStreamUserOrders(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, odb *OrderDatabase) {
+		ctx := context.Background()
+		userID := uuid.NewString()
+
+		want := make(map[string]bool)
+		for i := 0; i < 5; i++ {
+			req, result, total := newIntegrationOrder(userID)
+			if err := odb.SaveOrder(ctx, req, result, total); err != nil {
+				t.Fatalf("SaveOrder() error = %v", err)
+			}
+			want[result.OrderId] = true
+		}
+
+		// A batch size of 2 makes the stream cross two batch boundaries.
+		seen := make(map[string]int)
+		streamed, err := odb.streamUserOrders(ctx, userID, 2, func(order *pb.OrderResult) error {
+			seen[order.OrderId]++
+			if len(order.Items) == 0 {
+				t.Errorf("order %s streamed without items", order.OrderId)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("streamUserOrders() error = %v", err)
+		}
+		if streamed != len(want) || len(seen) != len(want) {
+			t.Errorf("streamUserOrders() streamed %d orders, %d distinct, want %d", streamed, len(seen), len(want))
+		}
+		for orderID, n := range seen {
+			if !want[orderID] || n != 1 {
+				t.Errorf("order %s streamed %d times, want once", orderID, n)
+			}
+		}
+
+		errStop := errors.New("stop")
+		calls := 0
+		err = odb.StreamUserOrders(ctx, userID, func(*pb.OrderResult) error {
+			calls++
+			if calls == 3 {
+				return errStop
+			}
+			return nil
+		})
+		if !errors.Is(err, errStop) || calls != 3 {
+			t.Errorf("StreamUserOrders() = %v after %d calls, want errStop after 3", err, calls)
+		}
+	})
+}
+
+func TestPreparedStatementsSurviveReconnects(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, odb *OrderDatabase) {
+		ctx := context.Background()
+		// Without idle connections every call runs on a fresh connection,
+		// which the cached statements have to be prepared on again.
+		odb.db.SetMaxIdleConns(0)
+		for i := 0; i < 3; i++ {
+			req, result, total := newIntegrationOrder(uuid.NewString())
+			if err := odb.SaveOrder(ctx, req, result, total); err != nil {
+				t.Fatalf("SaveOrder() #%d error = %v", i+1, err)
+			}
+			if _, err := odb.GetOrder(ctx, result.OrderId); err != nil {
+				t.Fatalf("GetOrder() #%d error = %v", i+1, err)
+			}
+		}
+		if closed := odb.Stats().MaxIdleClosed; closed == 0 {
+			t.Error("no connections were closed between calls, want a fresh connection per call")
+		}
+	})
+}
+
+func TestSaveOrderWithSerializableIsolation(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, odb *OrderDatabase) {
+		ctx := context.Background()
+		serializable := newOrderDatabase(odb.db, odb.dialect, newDBOptions([]Option{WithTxIsolation(sql.LevelSerializable)}))
+
+		req, result, total := newIntegrationOrder(uuid.NewString())
+		if err := serializable.SaveOrder(ctx, req, result, total); err != nil {
+			t.Fatalf("SaveOrder() error = %v", err)
+		}
+		if err := serializable.SaveOrder(ctx, req, result, total); err != nil {
+			t.Fatalf("repeated SaveOrder() error = %v", err)
+		}
+		if _, err := odb.GetOrder(ctx, result.OrderId); err != nil {
+			t.Fatalf("GetOrder() error = %v", err)
+		}
+	})
+}
+
+func TestOrderPaymentRoundTrip(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, odb *OrderDatabase) {
+		ctx := context.Background()
+		userID := uuid.NewString()
+
+		req, result, total := newIntegrationOrder(userID)
+		payment := NewPaymentInfo(&pb.CreditCardInfo{CreditCardNumber: "4432-8015-6152-0454"}, uuid.NewString())
+		if err := odb.SaveOrderWithPayment(ctx, req, result, total, payment); err != nil {
+			t.Fatalf("SaveOrderWithPayment() error = %v", err)
+		}
+		got, err := odb.GetOrder(ctx, result.OrderId)
+		if err != nil {
+			t.Fatalf("GetOrder() error = %v", err)
+		}
+		if got.Payment == nil || *got.Payment != *payment {
+			t.Errorf("GetOrder() payment = %+v, want %+v", got.Payment, payment)
+		}
+
+		req, result, total = newIntegrationOrder(userID)
+		if err := odb.SaveOrder(ctx, req, result, total); err != nil {
+			t.Fatalf("SaveOrder() error = %v", err)
+		}
+		got, err = odb.GetOrder(ctx, result.OrderId)
+		if err != nil {
+			t.Fatalf("GetOrder() error = %v", err)
+		}
+		if got.Payment != nil {
+			t.Errorf("GetOrder() payment = %+v, want nil for an order saved without one", got.Payment)
+		}
+	})
+}
+
+func TestClaimOrderRace(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, odb *OrderDatabase) {
+		ctx := context.Background()
+		req, result, total := newIntegrationOrder(uuid.NewString())
+		if err := odb.SaveOrder(ctx, req, result, total); err != nil {
+			t.Fatalf("SaveOrder() error = %v", err)
+		}
+
+		const workers = 8
+		var wg sync.WaitGroup
+		winners := make(chan string, workers)
+		for i := 0; i < workers; i++ {
+			workerID := fmt.Sprintf("worker-%d", i)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				claimed, err := odb.ClaimOrder(ctx, result.OrderId, workerID)
+				if err != nil {
+					t.Errorf("ClaimOrder(%s) error = %v", workerID, err)
+				}
+				if claimed {
+					winners <- workerID
+				}
+			}()
+		}
+		wg.Wait()
+		close(winners)
+
+		var won []string
+		for workerID := range winners {
+			won = append(won, workerID)
+		}
+		if len(won) != 1 {
+			t.Fatalf("claims won by %v, want exactly one worker", won)
+		}
+		winner := won[0]
+
+		// The winner renews its claim; nobody else can take it until it
+		// releases the order.
+		if claimed, err := odb.ClaimOrder(ctx, result.OrderId, winner); err != nil || !claimed {
+			t.Errorf("renewing ClaimOrder() = %v, %v, want true", claimed, err)
+		}
+		if err := odb.ReleaseOrder(ctx, result.OrderId, "someone-else"); !errors.Is(err, ErrOrderNotClaimed) {
+			t.Errorf("ReleaseOrder() by another worker error = %v, want ErrOrderNotClaimed", err)
+		}
+		if err := odb.ReleaseOrder(ctx, result.OrderId, winner); err != nil {
+			t.Fatalf("ReleaseOrder() error = %v", err)
+		}
+		if claimed, err := odb.ClaimOrder(ctx, result.OrderId, "someone-else"); err != nil || !claimed {
+			t.Errorf("ClaimOrder() after release = %v, %v, want true", claimed, err)
+		}
+
+		// An expired claim can be taken over.
+		shortClaims := newOrderDatabase(odb.db, odb.dialect, newDBOptions([]Option{WithClaimTTL(50 * time.Millisecond)}))
+		time.Sleep(100 * time.Millisecond)
+		if claimed, err := shortClaims.ClaimOrder(ctx, result.OrderId, winner); err != nil || !claimed {
+			t.Errorf("ClaimOrder() of an expired claim = %v, %v, want true", claimed, err)
+		}
+
+		if _, err := odb.ClaimOrder(ctx, uuid.NewString(), winner); !errors.Is(err, ErrOrderNotFound) {
+			t.Errorf("ClaimOrder() of a missing order error = %v, want ErrOrderNotFound", err)
+		}
+	})
+}
+
+// newIntegrationBulkOrder is newIntegrationOrder as a SaveOrders record.
+func newIntegrationBulkOrder(userID string) OrderRecord {
+	req, result, total := newIntegrationOrder(userID)
+	return OrderRecord{Order: result, Total: total, UserID: req.UserId, Email: req.Email, UserCurrency: req.UserCurrency}
+}
+
+func TestPagingOrdersWithTheSameTimestamp(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, odb *OrderDatabase) {
+		ctx := context.Background()
+		userID := uuid.NewString()
+		createdAt := time.Now().UTC().Truncate(time.Second)
+		orders := make([]OrderRecord, 5)
+		for i := range orders {
+			orders[i] = newIntegrationBulkOrder(userID)
+			orders[i].CreatedAt = createdAt
+		}
+		// Inserted in ascending ID order, so that insertion order isn't
+		// the order the pages should come in.
+		sort.Slice(orders, func(i, j int) bool { return orders[i].Order.OrderId < orders[j].Order.OrderId })
+		if err := odb.SaveOrders(ctx, orders); err != nil {
+			t.Fatalf("SaveOrders() error = %v", err)
+		}
+
+		var want []string
+		for i := len(orders) - 1; i >= 0; i-- {
+			want = append(want, orders[i].Order.OrderId)
+		}
+		var got, gotPaged []string
+		for offset := 0; offset < len(orders)+2; offset += 2 {
+			page, err := odb.QueryOrders(ctx, OrderFilter{UserID: userID, Limit: 2, Offset: offset})
+			if err != nil {
+				t.Fatalf("QueryOrders(offset %d) error = %v", offset, err)
+			}
+			for _, record := range page {
+				got = append(got, record.Order.OrderId)
+			}
+			page, _, err = odb.GetUserOrdersPaged(ctx, userID, 2, offset)
+			if err != nil {
+				t.Fatalf("GetUserOrdersPaged(offset %d) error = %v", offset, err)
+			}
+			for _, record := range page {
+				gotPaged = append(gotPaged, record.Order.OrderId)
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("QueryOrders() pages = %v, want each order once in %v", got, want)
+		}
+		if strings.Join(gotPaged, ",") != strings.Join(want, ",") {
+			t.Errorf("GetUserOrdersPaged() pages = %v, want each order once in %v", gotPaged, want)
+		}
+	})
+}
+
+func TestSaveOrdersIsAllOrNothing(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, odb *OrderDatabase) {
+		ctx := context.Background()
+		userID := uuid.NewString()
+
+		existing := newIntegrationBulkOrder(userID)
+		if err := odb.SaveOrders(ctx, []OrderRecord{existing}); err != nil {
+			t.Fatalf("SaveOrders() error = %v", err)
+		}
+
+		// Enough orders to take two INSERTs, with an order ID that is
+		// already taken in the second.
+		orders := make([]OrderRecord, maxInsertParams/len(bulkOrderColumns)+10)
+		for i := range orders {
+			orders[i] = newIntegrationBulkOrder(userID)
+		}
+		last := len(orders) - 1
+		orders[last].Order.OrderId = existing.Order.OrderId
+
+		err := odb.SaveOrders(ctx, orders)
+		if !errors.Is(err, ErrOrderConflict) {
+			t.Fatalf("SaveOrders() error = %v, want ErrOrderConflict", err)
+		}
+		if want := fmt.Sprintf("batch order %d (%s)", last, existing.Order.OrderId); !strings.Contains(err.Error(), want) {
+			t.Errorf("SaveOrders() error = %v, want it to name %s", err, want)
+		}
+		if n, err := odb.CountUserOrders(ctx, userID); err != nil || n != 1 {
+			t.Fatalf("CountUserOrders() after the failed batch = %d, %v, want only the existing order", n, err)
+		}
+
+		// Fixed, the batch saves every order with what it was given.
+		orders[last] = newIntegrationBulkOrder(userID)
+		shippedAt := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+		orders[0].Status = OrderStatusShipped
+		orders[0].CreatedAt = shippedAt.Add(-time.Hour)
+		orders[0].UpdatedAt = shippedAt
+		orders[0].Version = 3
+		orders[0].Payment = NewPaymentInfo(&pb.CreditCardInfo{CreditCardNumber: "4432-8015-6152-0454"}, uuid.NewString())
+		if err := odb.SaveOrders(ctx, orders); err != nil {
+			t.Fatalf("SaveOrders() error = %v", err)
+		}
+		if n, err := odb.CountUserOrders(ctx, userID); err != nil || n != int64(len(orders)+1) {
+			t.Errorf("CountUserOrders() = %d, %v, want %d", n, err, len(orders)+1)
+		}
+
+		got, err := odb.GetOrder(ctx, orders[0].Order.OrderId)
+		if err != nil {
+			t.Fatalf("GetOrder() error = %v", err)
+		}
+		if got.Status != OrderStatusShipped || !got.CreatedAt.Equal(orders[0].CreatedAt) || !got.UpdatedAt.Equal(shippedAt) || got.Version != 3 {
+			t.Errorf("GetOrder() = status %s, created %v, updated %v, version %d, want the record's", got.Status, got.CreatedAt, got.UpdatedAt, got.Version)
+		}
+		if !proto.Equal(got.Order, orders[0].Order) {
+			t.Errorf("GetOrder() order = %v, want %v", got.Order, orders[0].Order)
+		}
+		if got.Payment == nil || *got.Payment != *orders[0].Payment {
+			t.Errorf("GetOrder() payment = %+v, want %+v", got.Payment, orders[0].Payment)
+		}
+	})
+}
+
+// BenchmarkSaveOrder measures the SaveOrder hot path: one orders insert and
+// an order_items insert per item in a single transaction.
+func BenchmarkSaveOrder(b *testing.B) {
+	run := func(b *testing.B, dsn string) {
+		odb := openIntegrationOrderDatabase(b, dsn)
+		ctx := context.Background()
+		userID := uuid.NewString()
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			req, result, total := newIntegrationOrder(userID)
+			if err := odb.SaveOrder(ctx, req, result, total); err != nil {
+				b.Fatalf("SaveOrder() error = %v", err)
+			}
+		}
+	}
+	b.Run("sqlite", func(b *testing.B) {
+		run(b, sqliteScheme+filepath.Join(b.TempDir(), "orders.db"))
+	})
+	b.Run("postgres", func(b *testing.B) {
+		dsn := os.Getenv("TEST_DATABASE_URL")
+		if dsn == "" {
+			b.Skip("TEST_DATABASE_URL not set, skipping Postgres benchmark")
+		}
+		run(b, dsn)
+	})
+}
+
+// BenchmarkSaveOrders compares loading 100 orders with SaveOrders against
+// calling SaveOrder for each of them.
+func BenchmarkSaveOrders(b *testing.B) {
+	const batchSize = 100
+	run := func(b *testing.B, dsn string) {
+		odb := openIntegrationOrderDatabase(b, dsn)
+		ctx := context.Background()
+		userID := uuid.NewString()
+		b.Run("SaveOrder", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < batchSize; j++ {
+					req, result, total := newIntegrationOrder(userID)
+					if err := odb.SaveOrder(ctx, req, result, total); err != nil {
+						b.Fatalf("SaveOrder() error = %v", err)
+					}
+				}
+			}
+		})
+		b.Run("SaveOrders", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				orders := make([]OrderRecord, batchSize)
+				for j := range orders {
+					orders[j] = newIntegrationBulkOrder(userID)
+				}
+				b.StartTimer()
+				if err := odb.SaveOrders(ctx, orders); err != nil {
+					b.Fatalf("SaveOrders() error = %v", err)
+				}
+			}
+		})
+	}
+	b.Run("sqlite", func(b *testing.B) {
+		run(b, sqliteScheme+filepath.Join(b.TempDir(), "orders.db"))
+	})
+	b.Run("postgres", func(b *testing.B) {
+		dsn := os.Getenv("TEST_DATABASE_URL")
+		if dsn == "" {
+			b.Skip("TEST_DATABASE_URL not set, skipping Postgres benchmark")
+		}
+		run(b, dsn)
+	})
+}
+
+// BenchmarkGetUserOrders measures GetUserOrders for one user among a few
+// thousand orders. On SQLite it also runs without idx_orders_user_created,
+// which turns the index lookup into a scan of every order plus a sort.
+func BenchmarkGetUserOrders(b *testing.B) {
+	const users, ordersPerUser = 100, 30
+	run := func(b *testing.B, odb *OrderDatabase) {
+		ctx := context.Background()
+		userIDs := make([]string, users)
+		for i := range userIDs {
+			userIDs[i] = uuid.NewString()
+		}
+		for i := 0; i < users*ordersPerUser; i++ {
+			req, result, total := newIntegrationOrder(userIDs[i%users])
+			if err := odb.SaveOrder(ctx, req, result, total); err != nil {
+				b.Fatalf("SaveOrder() error = %v", err)
+			}
+		}
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			orders, err := odb.GetUserOrders(ctx, userIDs[i%users])
+			if err != nil {
+				b.Fatalf("GetUserOrders() error = %v", err)
+			}
+			if len(orders) != ordersPerUser {
+				b.Fatalf("GetUserOrders() returned %d orders, want %d", len(orders), ordersPerUser)
+			}
+		}
+	}
+	b.Run("sqlite", func(b *testing.B) {
+		run(b, openIntegrationOrderDatabase(b, sqliteScheme+filepath.Join(b.TempDir(), "orders.db")))
+	})
+	b.Run("sqlite_without_index", func(b *testing.B) {
+		odb := openIntegrationOrderDatabase(b, sqliteScheme+filepath.Join(b.TempDir(), "orders.db"))
+		if _, err := odb.db.Exec(`DROP INDEX idx_orders_user_created`); err != nil {
+			b.Fatalf("failed to drop index: %v", err)
+		}
+		run(b, odb)
+	})
+	b.Run("postgres", func(b *testing.B) {
+		dsn := os.Getenv("TEST_DATABASE_URL")
+		if dsn == "" {
+			b.Skip("TEST_DATABASE_URL not set, skipping Postgres benchmark")
+		}
+		run(b, openIntegrationOrderDatabase(b, dsn))
+	})
+}
+
+// TestGetUserOrdersUsesIndex guards the query plan of GetUserOrders on
+// SQLite: it must look the user's orders up in idx_orders_user_created,
+// already sorted, rather than scan the table or sort in a temporary B-tree.
+func TestGetUserOrdersUsesIndex(t *testing.T) {
+	odb := openIntegrationOrderDatabase(t, sqliteScheme+filepath.Join(t.TempDir(), "orders.db"))
+	query := `EXPLAIN QUERY PLAN ` + selectOrdersQuery + ` WHERE user_id = $1 ORDER BY created_at DESC`
+	rows, err := odb.queryContext(context.Background(), odb.db, query, "user-1")
+	if err != nil {
+		t.Fatalf("EXPLAIN QUERY PLAN error = %v", err)
+	}
+	defer rows.Close()
+
+	var plan []string
+	for rows.Next() {
+		var id, parent, notUsed int
+		var detail string
+		if err := rows.Scan(&id, &parent, &notUsed, &detail); err != nil {
+			t.Fatalf("failed to scan query plan: %v", err)
+		}
+		plan = append(plan, detail)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("error reading query plan: %v", err)
+	}
+	got := strings.Join(plan, "; ")
+	if !strings.Contains(got, "USING INDEX idx_orders_user_created") || strings.Contains(got, "TEMP B-TREE") {
+		t.Errorf("query plan = %q, want an idx_orders_user_created search without a sort", got)
+	}
+}
+
+func TestSavedOrderTimestampsAreRecent(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, odb *OrderDatabase) {
+		ctx := context.Background()
+
+		orderID := uuid.NewString()
+		req, result, total := newTestOrder(orderID)
+		if err := odb.SaveOrder(ctx, req, result, total); err != nil {
+			t.Fatalf("SaveOrder() error = %v", err)
+		}
+
+		record, err := odb.GetOrder(ctx, orderID)
+		if err != nil {
+			t.Fatalf("GetOrder() error = %v", err)
+		}
+		const tolerance = time.Minute
+		if d := time.Since(record.CreatedAt); d < -tolerance || d > tolerance {
+			t.Errorf("GetOrder() CreatedAt = %v, want within %v of now", record.CreatedAt, tolerance)
+		}
+		if !record.UpdatedAt.Equal(record.CreatedAt) {
+			t.Errorf("GetOrder() UpdatedAt = %v, want %v for a new order", record.UpdatedAt, record.CreatedAt)
+		}
+	})
+}
+
+func TestGetOrderForUpdateSerializesConcurrentTransactions(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, odb *OrderDatabase) {
+		ctx := context.Background()
+
+		orderID := uuid.NewString()
+		req, result, total := newTestOrder(orderID)
+		if err := odb.SaveOrder(ctx, req, result, total); err != nil {
+			t.Fatalf("SaveOrder() error = %v", err)
+		}
+
+		// Both workers read the order and ship it if it is still PAID. Without
+		// the row lock both would see PAID and both would ship it.
+		var shipped int32
+		var wg sync.WaitGroup
+		errs := make(chan error, 2)
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- odb.WithTx(ctx, func(tx *sql.Tx) error {
+					record, err := odb.GetOrderForUpdate(ctx, tx, orderID)
+					if err != nil {
+						return err
+					}
+					if record.Status != OrderStatusPaid {
+						return nil
+					}
+					time.Sleep(200 * time.Millisecond)
+					_, err = odb.execContext(ctx, tx, `UPDATE orders SET status = $1 WHERE order_id = $2`, OrderStatusShipped, orderID)
+					if err == nil {
+						atomic.AddInt32(&shipped, 1)
+					}
+					return err
+				})
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			if err != nil {
+				t.Errorf("WithTx() error = %v", err)
+			}
+		}
+		if shipped != 1 {
+			t.Errorf("order was shipped %d times, want exactly once", shipped)
+		}
+	})
+}
+
+func TestEnsureSchemaIsIdempotent(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, odb *OrderDatabase) {
+
+		// forEachBackend already migrated once.
+		if err := odb.EnsureSchema(context.Background()); err != nil {
+			t.Fatalf("second EnsureSchema() error = %v", err)
+		}
+
+		var applied int
+		if err := odb.db.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&applied); err != nil {
+			t.Fatalf("failed to count applied migrations: %v", err)
+		}
+		migrations, err := loadMigrations(odb.dialect.migrations())
+		if err != nil {
+			t.Fatalf("loadMigrations() error = %v", err)
+		}
+		if applied != len(migrations) {
+			t.Errorf("schema_migrations has %d rows, want %d", applied, len(migrations))
+		}
+	})
+}
+
+func TestArchiveOrders(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, odb *OrderDatabase) {
+		ctx := context.Background()
+		userID := uuid.NewString()
+		old := time.Now().UTC().Add(-48 * time.Hour)
+
+		place := func(status OrderStatus, createdAt time.Time) *pb.OrderResult {
+			t.Helper()
+			req, result, total := newIntegrationOrder(userID)
+			payment := NewPaymentInfo(&pb.CreditCardInfo{CreditCardNumber: "4432-8015-6152-0454"}, uuid.NewString())
+			if err := odb.SaveOrderWithPayment(ctx, req, result, total, payment); err != nil {
+				t.Fatalf("SaveOrderWithPayment() error = %v", err)
+			}
+			switch status {
+			case OrderStatusShipped:
+				if err := odb.UpdateOrderStatus(ctx, result.OrderId, status); err != nil {
+					t.Fatalf("UpdateOrderStatus() error = %v", err)
+				}
+			case OrderStatusCancelled:
+				if err := odb.CancelOrder(WithActor(ctx, "agent-7"), result.OrderId, "changed my mind"); err != nil {
+					t.Fatalf("CancelOrder() error = %v", err)
+				}
+			}
+			if _, err := odb.execContext(ctx, odb.db, `UPDATE orders SET created_at = $1 WHERE order_id = $2`, createdAt, result.OrderId); err != nil {
+				t.Fatalf("failed to backdate order: %v", err)
+			}
+			// Orders with unpublished outbox events aren't archived.
+			if _, err := odb.execContext(ctx, odb.db, `UPDATE order_outbox SET published_at = $1 WHERE order_id = $2`, time.Now().UTC(), result.OrderId); err != nil {
+				t.Fatalf("failed to publish the order's outbox events: %v", err)
+			}
+			return result
+		}
+		oldShipped := place(OrderStatusShipped, old)
+		oldCancelled := place(OrderStatusCancelled, old)
+		oldPaid := place(OrderStatusPaid, old)
+		recentShipped := place(OrderStatusShipped, time.Now().UTC())
+
+		// A batch size of one takes a batch per order, plus an empty one.
+		archived, err := odb.ArchiveOrders(ctx, time.Now().Add(-24*time.Hour), 1)
+		if err != nil {
+			t.Fatalf("ArchiveOrders() error = %v", err)
+		}
+		if archived != 2 {
+			t.Errorf("ArchiveOrders() = %d, want 2", archived)
+		}
+		if again, err := odb.ArchiveOrders(ctx, time.Now().Add(-24*time.Hour), 1); err != nil || again != 0 {
+			t.Errorf("repeated ArchiveOrders() = %d, %v, want 0", again, err)
+		}
+
+		count := func(table, orderID string) int {
+			t.Helper()
+			var n int
+			if err := odb.queryRowContext(ctx, odb.db, `SELECT COUNT(*) FROM `+table+` WHERE order_id = $1`, orderID).Scan(&n); err != nil {
+				t.Fatalf("failed to count %s rows: %v", table, err)
+			}
+			return n
+		}
+		for _, result := range []*pb.OrderResult{oldShipped, oldCancelled} {
+			orderID := result.OrderId
+			if _, err := odb.GetOrder(ctx, orderID); !errors.Is(err, ErrOrderNotFound) {
+				t.Errorf("GetOrder(%s) after archiving error = %v, want ErrOrderNotFound", orderID, err)
+			}
+			if n := count("orders_archive", orderID); n != 1 {
+				t.Errorf("orders_archive has %d rows for order %s, want 1", n, orderID)
+			}
+			if n := count("order_items_archive", orderID); n != len(result.Items) {
+				t.Errorf("order_items_archive has %d rows for order %s, want %d", n, orderID, len(result.Items))
+			}
+			if n := count("order_payments_archive", orderID); n != 1 {
+				t.Errorf("order_payments_archive has %d rows for order %s, want 1", n, orderID)
+			}
+		}
+		if count("order_events_archive", oldCancelled.OrderId) == 0 {
+			t.Error("the cancelled order's events were not archived")
+		}
+		var actor sql.NullString
+		actorQuery := `SELECT actor FROM order_events_archive WHERE order_id = $1 AND event_type = $2`
+		if err := odb.queryRowContext(ctx, odb.db, actorQuery, oldCancelled.OrderId, OrderEventCancelled).Scan(&actor); err != nil || actor.String != "agent-7" {
+			t.Errorf("archived cancellation actor = %v, %v, want agent-7", actor, err)
+		}
+
+		for _, result := range []*pb.OrderResult{oldPaid, recentShipped} {
+			if _, err := odb.GetOrder(ctx, result.OrderId); err != nil {
+				t.Errorf("GetOrder(%s) error = %v, want the order kept", result.OrderId, err)
+			}
+			if n := count("orders_archive", result.OrderId); n != 0 {
+				t.Errorf("orders_archive has %d rows for order %s, want it left alone", n, result.OrderId)
+			}
+		}
+	})
+}
+
+func TestArchiveOrdersKeepsUnpublishedOutboxEvents(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, odb *OrderDatabase) {
+		ctx := context.Background()
+		// Earlier tests on a shared database leave events behind; publish
+		// them so the batch has room for this test's.
+		for {
+			events, err := odb.FetchOutboxBatch(ctx, maxOutboxBatch)
+			if err != nil {
+				t.Fatalf("FetchOutboxBatch() error = %v", err)
+			}
+			if len(events) == 0 {
+				break
+			}
+			ids := make([]int64, len(events))
+			for i, event := range events {
+				ids[i] = event.ID
+			}
+			if err := odb.MarkOutboxPublished(ctx, ids); err != nil {
+				t.Fatalf("MarkOutboxPublished() error = %v", err)
+			}
+		}
+
+		req, result, total := newIntegrationOrder(uuid.NewString())
+		if err := odb.SaveOrder(ctx, req, result, total); err != nil {
+			t.Fatalf("SaveOrder() error = %v", err)
+		}
+		if err := odb.CancelOrder(ctx, result.OrderId, "changed my mind"); err != nil {
+			t.Fatalf("CancelOrder() error = %v", err)
+		}
+		if _, err := odb.execContext(ctx, odb.db, `UPDATE orders SET created_at = $1 WHERE order_id = $2`, time.Now().UTC().Add(-48*time.Hour), result.OrderId); err != nil {
+			t.Fatalf("failed to backdate order: %v", err)
+		}
+		cutoff := time.Now().Add(-24 * time.Hour)
+
+		if archived, err := odb.ArchiveOrders(ctx, cutoff, 10); err != nil || archived != 0 {
+			t.Errorf("ArchiveOrders() = %d, %v, want the order with an unpublished event left alone", archived, err)
+		}
+		events, err := odb.FetchOutboxBatch(ctx, maxOutboxBatch)
+		if err != nil {
+			t.Fatalf("FetchOutboxBatch() error = %v", err)
+		}
+		if len(events) != 1 || events[0].OrderID != result.OrderId || events[0].Type != OutboxOrderPlaced {
+			t.Fatalf("outbox events after archiving = %+v, want the order's %s event", events, OutboxOrderPlaced)
+		}
+
+		// Once the event is published the order is archived.
+		if err := odb.MarkOutboxPublished(ctx, []int64{events[0].ID}); err != nil {
+			t.Fatalf("MarkOutboxPublished() error = %v", err)
+		}
+		if archived, err := odb.ArchiveOrders(ctx, cutoff, 10); err != nil || archived != 1 {
+			t.Errorf("ArchiveOrders() after publishing = %d, %v, want 1", archived, err)
+		}
+		if _, err := odb.GetOrder(ctx, result.OrderId); !errors.Is(err, ErrOrderNotFound) {
+			t.Errorf("GetOrder() after archiving error = %v, want ErrOrderNotFound", err)
+		}
+	})
+}
+
+func TestGetOrdersByEmail(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, odb *OrderDatabase) {
+		ctx := context.Background()
+		email := "Jane." + uuid.NewString() + "@Example.com"
+		// How a support agent might type it in.
+		typed := "  " + strings.ToUpper(email) + " "
+
+		place := func(odb *OrderDatabase, email string) *pb.OrderResult {
+			t.Helper()
+			req, result, total := newIntegrationOrder(uuid.NewString())
+			req.Email = email
+			if err := odb.SaveOrder(ctx, req, result, total); err != nil {
+				t.Fatalf("SaveOrder() error = %v", err)
+			}
+			return result
+		}
+		orderIDs := func(orders []*pb.OrderResult) map[string]bool {
+			ids := make(map[string]bool)
+			for _, order := range orders {
+				ids[order.OrderId] = true
+			}
+			return ids
+		}
+
+		first := place(odb, email)
+		second := place(odb, strings.ToLower(email))
+		place(odb, "someone-else."+uuid.NewString()+"@example.com")
+		bulk := newIntegrationBulkOrder(uuid.NewString())
+		bulk.Email = email
+		if err := odb.SaveOrders(ctx, []OrderRecord{bulk}); err != nil {
+			t.Fatalf("SaveOrders() error = %v", err)
+		}
+
+		orders, err := odb.GetOrdersByEmail(ctx, typed, 10)
+		if err != nil {
+			t.Fatalf("GetOrdersByEmail() error = %v", err)
+		}
+		want := []string{first.OrderId, second.OrderId, bulk.Order.OrderId}
+		got := orderIDs(orders)
+		if len(orders) != len(want) {
+			t.Errorf("GetOrdersByEmail() returned %d orders, want %d", len(orders), len(want))
+		}
+		for _, orderID := range want {
+			if !got[orderID] {
+				t.Errorf("GetOrdersByEmail() is missing order %s", orderID)
+			}
+		}
+		if limited, err := odb.GetOrdersByEmail(ctx, typed, 2); err != nil || len(limited) != 2 {
+			t.Errorf("GetOrdersByEmail(limit=2) = %d orders, %v, want 2", len(limited), err)
+		}
+
+		// Correcting the email moves the order to the new address.
+		corrected := "jane.corrected." + uuid.NewString() + "@example.com"
+		if err := odb.UpdateOrderEmail(ctx, first.OrderId, corrected); err != nil {
+			t.Fatalf("UpdateOrderEmail() error = %v", err)
+		}
+		if orders, err := odb.GetOrdersByEmail(ctx, typed, 10); err != nil || orderIDs(orders)[first.OrderId] {
+			t.Errorf("GetOrdersByEmail() of the old email = %v, %v, want the corrected order gone", orders, err)
+		}
+		if orders, err := odb.GetOrdersByEmail(ctx, strings.ToUpper(corrected), 10); err != nil || !orderIDs(orders)[first.OrderId] {
+			t.Errorf("GetOrdersByEmail() of the corrected email = %v, %v, want the corrected order", orders, err)
+		}
+
+		// With encryption the lookup is by blind index, which still ignores
+		// case.
+		encrypted := newOrderDatabase(odb.db, odb.dialect, newDBOptions([]Option{WithCipher(newTestCipher(t))}))
+		secret := place(encrypted, email)
+		orders, err = encrypted.GetOrdersByEmail(ctx, typed, 10)
+		if err != nil {
+			t.Fatalf("encrypted GetOrdersByEmail() error = %v", err)
+		}
+		if len(orders) != 1 || orders[0].OrderId != secret.OrderId {
+			t.Errorf("encrypted GetOrdersByEmail() = %v, want only order %s", orders, secret.OrderId)
+		}
+	})
+}
+
+func TestOrderEventsTimeline(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, odb *OrderDatabase) {
+		ctx := context.Background()
+		agent := WithActor(ctx, "agent-7")
+
+		req, result, total := newIntegrationOrder(uuid.NewString())
+		if err := odb.SaveOrder(ctx, req, result, total); err != nil {
+			t.Fatalf("SaveOrder() error = %v", err)
+		}
+		if err := odb.UpdateOrderEmail(agent, result.OrderId, "fixed@example.com"); err != nil {
+			t.Fatalf("UpdateOrderEmail() error = %v", err)
+		}
+		if err := odb.UpdateOrderShipping(agent, result.OrderId, newCorrectedAddress()); err != nil {
+			t.Fatalf("UpdateOrderShipping() error = %v", err)
+		}
+		// A rejected change leaves no event.
+		if err := odb.UpdateOrderStatus(ctx, result.OrderId, OrderStatusPending); !errors.Is(err, ErrInvalidStatusTransition) {
+			t.Fatalf("UpdateOrderStatus() back to PENDING error = %v, want ErrInvalidStatusTransition", err)
+		}
+		if err := odb.UpdateOrderStatus(WithActor(ctx, "fulfilment"), result.OrderId, OrderStatusShipped); err != nil {
+			t.Fatalf("UpdateOrderStatus() error = %v", err)
+		}
+
+		cancelled, cancelledResult, cancelledTotal := newIntegrationOrder(uuid.NewString())
+		if err := odb.SaveOrder(ctx, cancelled, cancelledResult, cancelledTotal); err != nil {
+			t.Fatalf("SaveOrder() error = %v", err)
+		}
+		if err := odb.CancelOrder(ctx, cancelledResult.OrderId, "changed my mind"); err != nil {
+			t.Fatalf("CancelOrder() error = %v", err)
+		}
+
+		events, err := odb.GetOrderEvents(ctx, result.OrderId)
+		if err != nil {
+			t.Fatalf("GetOrderEvents() error = %v", err)
+		}
+		want := []OrderEvent{
+			{Type: OrderEventEmailUpdated, FromStatus: OrderStatusPaid, ToStatus: OrderStatusPaid, Actor: "agent-7"},
+			{Type: OrderEventShippingUpdated, FromStatus: OrderStatusPaid, ToStatus: OrderStatusPaid, Actor: "agent-7"},
+			{Type: OrderEventStatusChanged, FromStatus: OrderStatusPaid, ToStatus: OrderStatusShipped, Actor: "fulfilment"},
+		}
+		if len(events) != len(want) {
+			t.Fatalf("GetOrderEvents() = %+v, want %d events", events, len(want))
+		}
+		for i, event := range events {
+			created := event.CreatedAt
+			event.CreatedAt = time.Time{}
+			if event != want[i] {
+				t.Errorf("event %d = %+v, want %+v", i, event, want[i])
+			}
+			if i > 0 && created.Before(events[i-1].CreatedAt) {
+				t.Errorf("event %d at %v is before event %d at %v", i, created, i-1, events[i-1].CreatedAt)
+			}
+		}
+
+		events, err = odb.GetOrderEvents(ctx, cancelledResult.OrderId)
+		if err != nil || len(events) != 1 || events[0].Type != OrderEventCancelled || events[0].Detail != "changed my mind" || events[0].Actor != "" {
+			t.Errorf("GetOrderEvents() of the cancelled order = %+v, %v, want its cancellation without an actor", events, err)
+		}
+
+		events, err = odb.GetOrderEvents(ctx, uuid.NewString())
+		if err != nil || events == nil || len(events) != 0 {
+			t.Errorf("GetOrderEvents() of a missing order = %#v, %v, want an empty slice", events, err)
+		}
+	})
+}
+
+func TestEraseUserData(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, odb *OrderDatabase) {
+		ctx := context.Background()
+
+		// place saves an order of userID paid with a card, with its own
+		// email so GetOrdersByEmail finds only it.
+		place := func(userID string) (*pb.PlaceOrderRequest, *pb.OrderResult, *pb.Money) {
+			t.Helper()
+			req, result, total := newIntegrationOrder(userID)
+			req.Email = "erase." + uuid.NewString() + "@example.com"
+			payment := NewPaymentInfo(&pb.CreditCardInfo{CreditCardNumber: "4432-8015-6152-0454"}, uuid.NewString())
+			if err := odb.SaveOrderWithPayment(ctx, req, result, total, payment); err != nil {
+				t.Fatalf("SaveOrderWithPayment() error = %v", err)
+			}
+			return req, result, total
+		}
+		count := func(table, orderID string) int {
+			t.Helper()
+			var n int
+			if err := odb.queryRowContext(ctx, odb.db, `SELECT COUNT(*) FROM `+table+` WHERE order_id = $1`, orderID).Scan(&n); err != nil {
+				t.Fatalf("failed to count %s rows: %v", table, err)
+			}
+			return n
+		}
+
+		t.Run("anonymize", func(t *testing.T) {
+			userID := uuid.NewString()
+			req, result, total := place(userID)
+			before, err := odb.GetOrder(ctx, result.OrderId)
+			if err != nil {
+				t.Fatalf("GetOrder() error = %v", err)
+			}
+			_, archived, _ := place(userID)
+			if _, err := odb.execContext(ctx, odb.db, `UPDATE orders SET status = $1, created_at = $2 WHERE order_id = $3`,
+				OrderStatusShipped, time.Now().UTC().Add(-48*time.Hour), archived.OrderId); err != nil {
+				t.Fatalf("failed to age order: %v", err)
+			}
+			if _, err := odb.execContext(ctx, odb.db, `UPDATE order_outbox SET published_at = $1 WHERE order_id = $2`, time.Now().UTC(), archived.OrderId); err != nil {
+				t.Fatalf("failed to publish the order's outbox events: %v", err)
+			}
+			if n, err := odb.ArchiveOrders(ctx, time.Now().Add(-24*time.Hour), 10); err != nil || n < 1 {
+				t.Fatalf("ArchiveOrders() = %d, %v, want the aged order archived", n, err)
+			}
+			_, other, _ := place(uuid.NewString())
+
+			erased, err := odb.EraseUserData(ctx, userID)
+			if err != nil {
+				t.Fatalf("EraseUserData() error = %v", err)
+			}
+			if erased != 2 {
+				t.Errorf("EraseUserData() = %d, want 2", erased)
+			}
+
+			after, err := odb.GetOrder(ctx, result.OrderId)
+			if err != nil {
+				t.Fatalf("GetOrder() after erasing error = %v", err)
+			}
+			if !proto.Equal(after.Total, total) || !proto.Equal(after.Order.ShippingCost, before.Order.ShippingCost) {
+				t.Errorf("erased order amounts = %v, %v, want %v, %v", after.Total, after.Order.ShippingCost, total, before.Order.ShippingCost)
+			}
+			if len(after.Order.Items) != len(before.Order.Items) || !proto.Equal(after.Order.Items[0], before.Order.Items[0]) {
+				t.Errorf("erased order items = %v, want %v", after.Order.Items, before.Order.Items)
+			}
+			if after.Status != before.Status || !after.CreatedAt.Equal(before.CreatedAt) {
+				t.Errorf("erased order status and creation = %s, %v, want %s, %v", after.Status, after.CreatedAt, before.Status, before.CreatedAt)
+			}
+			if after.Payment == nil || after.Payment.ProcessorTxnID != before.Payment.ProcessorTxnID || after.Payment.CardLastFour != "****" {
+				t.Errorf("erased order payment = %+v, want the transaction ID kept and the card redacted", after.Payment)
+			}
+			if addr := after.Order.ShippingAddress; addr.StreetAddress != "REDACTED" || addr.City != "REDACTED" || addr.ZipCode != 0 {
+				t.Errorf("erased order address = %v, want it redacted", addr)
+			}
+			if after.Version != before.Version+1 {
+				t.Errorf("erased order version = %d, want %d", after.Version, before.Version+1)
+			}
+
+			for _, table := range []string{"orders", "orders_archive"} {
+				var email, street string
+				if err := odb.queryRowContext(ctx, odb.db, `SELECT user_email, shipping_address_street FROM `+table+` WHERE user_id = $1 LIMIT 1`, userID).
+					Scan(&email, &street); err != nil {
+					t.Fatalf("failed to read %s: %v", table, err)
+				}
+				if email != erasedEmail(userID) || street != "REDACTED" {
+					t.Errorf("%s email and street = %q, %q, want them scrubbed", table, email, street)
+				}
+			}
+			if n := count("order_items_archive", archived.OrderId); n != len(archived.Items) {
+				t.Errorf("order_items_archive has %d rows for the erased order, want %d", n, len(archived.Items))
+			}
+			if n := count("order_outbox", result.OrderId); n != 0 {
+				t.Errorf("order_outbox has %d rows for the erased order, want none", n)
+			}
+			if n := count("order_outbox", other.OrderId); n != 1 {
+				t.Errorf("order_outbox has %d rows for another user's order, want 1", n)
+			}
+			if orders, err := odb.GetOrdersByEmail(ctx, req.Email, 10); err != nil || len(orders) != 0 {
+				t.Errorf("GetOrdersByEmail() of the erased email = %v, %v, want none", orders, err)
+			}
+
+			// Other users' orders are untouched.
+			if got, err := odb.GetOrder(ctx, other.OrderId); err != nil || got.Order.ShippingAddress.StreetAddress == "REDACTED" {
+				t.Errorf("GetOrder() of another user's order = %v, %v, want it unchanged", got, err)
+			}
+		})
+
+		t.Run("delete", func(t *testing.T) {
+			deleting := newOrderDatabase(odb.db, odb.dialect, newDBOptions([]Option{WithErasureMode(ErasureDelete)}))
+			userID := uuid.NewString()
+			_, first, _ := place(userID)
+			_, second, _ := place(userID)
+			_, other, _ := place(uuid.NewString())
+
+			erased, err := deleting.EraseUserData(ctx, userID)
+			if err != nil {
+				t.Fatalf("EraseUserData() error = %v", err)
+			}
+			if erased != 2 {
+				t.Errorf("EraseUserData() = %d, want 2", erased)
+			}
+			for _, result := range []*pb.OrderResult{first, second} {
+				if _, err := deleting.GetOrder(ctx, result.OrderId); !errors.Is(err, ErrOrderNotFound) {
+					t.Errorf("GetOrder(%s) after erasing error = %v, want ErrOrderNotFound", result.OrderId, err)
+				}
+				for _, table := range []string{"order_items", "order_payments", "order_events"} {
+					if n := count(table, result.OrderId); n != 0 {
+						t.Errorf("%s has %d rows for erased order %s, want 0", table, n, result.OrderId)
+					}
+				}
+			}
+			if _, err := deleting.GetOrder(ctx, other.OrderId); err != nil {
+				t.Errorf("GetOrder() of another user's order error = %v", err)
+			}
+
+			if again, err := deleting.EraseUserData(ctx, userID); err != nil || again != 0 {
+				t.Errorf("repeated EraseUserData() = %d, %v, want 0", again, err)
+			}
+		})
+	})
+}
+
+func TestGetLatestOrder(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, odb *OrderDatabase) {
+		ctx := context.Background()
+		userID := uuid.NewString()
+		now := time.Now().UTC().Truncate(time.Second)
+
+		// The newest order is saved in the middle, so only created_at can
+		// put it first.
+		older, newest, oldest := newIntegrationBulkOrder(userID), newIntegrationBulkOrder(userID), newIntegrationBulkOrder(userID)
+		older.CreatedAt = now.Add(-time.Hour)
+		newest.CreatedAt = now
+		newest.Order.Items = newest.Order.Items[:1]
+		oldest.CreatedAt = now.Add(-48 * time.Hour)
+		if err := odb.SaveOrders(ctx, []OrderRecord{older, newest, oldest}); err != nil {
+			t.Fatalf("SaveOrders() error = %v", err)
+		}
+		other := newIntegrationBulkOrder(uuid.NewString())
+		other.CreatedAt = now.Add(time.Hour)
+		if err := odb.SaveOrders(ctx, []OrderRecord{other}); err != nil {
+			t.Fatalf("SaveOrders() error = %v", err)
+		}
+
+		order, err := odb.GetLatestOrder(ctx, userID)
+		if err != nil {
+			t.Fatalf("GetLatestOrder() error = %v", err)
+		}
+		if !proto.Equal(order, newest.Order) {
+			t.Errorf("GetLatestOrder() = %v, want %v", order, newest.Order)
+		}
+
+		if _, err := odb.GetLatestOrder(ctx, uuid.NewString()); !errors.Is(err, ErrOrderNotFound) {
+			t.Errorf("GetLatestOrder() of a user without orders error = %v, want ErrOrderNotFound", err)
+		}
+	})
+}
+
+func TestReplayFailedOrders(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, odb *OrderDatabase) {
+		ctx := context.Background()
+		deadLetter := newOrderDatabase(odb.db, odb.dialect, newDBOptions([]Option{WithDeadLetter()}))
+
+		countFailed := func(orderID string) (n, attempts int) {
+			t.Helper()
+			if err := odb.queryRowContext(ctx, odb.db, `SELECT COUNT(*), COALESCE(MAX(attempts), 0) FROM failed_orders WHERE order_id = $1`, orderID).
+				Scan(&n, &attempts); err != nil {
+				t.Fatalf("failed to count failed orders: %v", err)
+			}
+			return n, attempts
+		}
+
+		// A checkout whose context ran out before the save: the order still
+		// gets recorded.
+		req, result, total := newIntegrationOrder(uuid.NewString())
+		req.CreditCard = &pb.CreditCardInfo{CreditCardNumber: "4432-8015-6152-0454"}
+		payment := NewPaymentInfo(req.CreditCard, uuid.NewString())
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		err := deadLetter.SaveOrderWithPayment(cancelled, req, result, total, payment)
+		if !errors.Is(err, ErrOrderPersistFailed) || !errors.Is(err, context.Canceled) {
+			t.Fatalf("SaveOrderWithPayment() error = %v, want ErrOrderPersistFailed wrapping context.Canceled", err)
+		}
+		if n, _ := countFailed(result.OrderId); n != 1 {
+			t.Fatalf("failed_orders has %d rows for the order, want 1", n)
+		}
+		if _, err := odb.GetOrder(ctx, result.OrderId); !errors.Is(err, ErrOrderNotFound) {
+			t.Fatalf("GetOrder() before replaying error = %v, want ErrOrderNotFound", err)
+		}
+
+		// A row that can never be saved is kept, and doesn't stop the others.
+		broken := uuid.NewString()
+		now := time.Now().UTC()
+		if _, err := odb.execContext(ctx, odb.db, `
+			INSERT INTO failed_orders (order_id, payload, last_error, attempts, created_at, updated_at)
+			VALUES ($1, 'not json', 'boom', 1, $2, $2)`, broken, now); err != nil {
+			t.Fatalf("failed to insert a broken failed order: %v", err)
+		}
+
+		replayed, err := deadLetter.ReplayFailedOrders(ctx)
+		if replayed < 1 {
+			t.Errorf("ReplayFailedOrders() = %d, want at least the recorded order", replayed)
+		}
+		if err == nil || !strings.Contains(err.Error(), broken) {
+			t.Errorf("ReplayFailedOrders() error = %v, want one naming order %s", err, broken)
+		}
+
+		record, err := odb.GetOrder(ctx, result.OrderId)
+		if err != nil {
+			t.Fatalf("GetOrder() after replaying error = %v", err)
+		}
+		if !proto.Equal(record.Total, total) || len(record.Order.Items) != len(result.Items) {
+			t.Errorf("replayed order = %v, total %v, want %v, total %v", record.Order, record.Total, result, total)
+		}
+		if record.Payment == nil || *record.Payment != *payment {
+			t.Errorf("replayed order payment = %+v, want %+v", record.Payment, payment)
+		}
+		if n, _ := countFailed(result.OrderId); n != 0 {
+			t.Errorf("failed_orders has %d rows for the replayed order, want 0", n)
+		}
+		if n, attempts := countFailed(broken); n != 1 || attempts != 2 {
+			t.Errorf("failed_orders has %d rows with %d attempts for the broken order, want 1 with 2", n, attempts)
+		}
+
+		// Replaying again only retries the broken row.
+		if again, err := deadLetter.ReplayFailedOrders(ctx); again != 0 || err == nil {
+			t.Errorf("repeated ReplayFailedOrders() = %d, %v, want 0 and the broken order's error", again, err)
+		}
+		if _, err := odb.execContext(ctx, odb.db, `DELETE FROM failed_orders WHERE order_id = $1`, broken); err != nil {
+			t.Fatalf("failed to remove the broken failed order: %v", err)
+		}
+	})
+}
+
+func TestOrderOutbox(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, odb *OrderDatabase) {
+		ctx := context.Background()
+
+		// fetchEvents drains the outbox the way a relay would, without
+		// marking anything, and returns the events of orderID.
+		fetchEvents := func(orderID string) []OutboxEvent {
+			t.Helper()
+			events, err := odb.FetchOutboxBatch(ctx, maxOutboxBatch)
+			if err != nil {
+				t.Fatalf("FetchOutboxBatch() error = %v", err)
+			}
+			var found []OutboxEvent
+			for _, event := range events {
+				if event.OrderID == orderID {
+					found = append(found, event)
+				}
+			}
+			return found
+		}
+		// Earlier tests on a shared database leave events behind; publish
+		// them so the batch has room for this test's.
+		for {
+			events, err := odb.FetchOutboxBatch(ctx, maxOutboxBatch)
+			if err != nil {
+				t.Fatalf("FetchOutboxBatch() error = %v", err)
+			}
+			if len(events) == 0 {
+				break
+			}
+			ids := make([]int64, len(events))
+			for i, event := range events {
+				ids[i] = event.ID
+			}
+			if err := odb.MarkOutboxPublished(ctx, ids); err != nil {
+				t.Fatalf("MarkOutboxPublished() error = %v", err)
+			}
+		}
+
+		req, result, total := newIntegrationOrder(uuid.NewString())
+		if err := odb.SaveOrder(ctx, req, result, total); err != nil {
+			t.Fatalf("SaveOrder() error = %v", err)
+		}
+		// Saving it again is a no-op, and so writes no second event.
+		if err := odb.SaveOrder(ctx, req, result, total); err != nil {
+			t.Fatalf("second SaveOrder() error = %v", err)
+		}
+
+		events := fetchEvents(result.OrderId)
+		if len(events) != 1 || events[0].Type != OutboxOrderPlaced {
+			t.Fatalf("outbox events of the order = %+v, want one %s event", events, OutboxOrderPlaced)
+		}
+		var placed OrderPlacedEvent
+		if err := json.Unmarshal(events[0].Payload, &placed); err != nil {
+			t.Fatalf("outbox payload %s isn't an OrderPlacedEvent: %v", events[0].Payload, err)
+		}
+		if placed.UserID != req.UserId || placed.Email != req.Email {
+			t.Errorf("outbox event = %+v, want user %s and email %s", placed, req.UserId, req.Email)
+		}
+
+		// An event written in a transaction that rolls back is never seen,
+		// while the transaction itself sees it before it ends.
+		errRollback := errors.New("roll back")
+		err := odb.WithTx(ctx, func(tx *sql.Tx) error {
+			if err := odb.insertOutboxEvent(ctx, tx, result.OrderId, "ORDER_TEST", "{}", time.Now().UTC()); err != nil {
+				return err
+			}
+			var n int
+			if err := odb.queryRowContext(ctx, tx, `SELECT COUNT(*) FROM order_outbox WHERE order_id = $1`, result.OrderId).Scan(&n); err != nil {
+				return err
+			}
+			if n != 2 {
+				t.Errorf("outbox events of the order inside the transaction = %d, want 2", n)
+			}
+			return errRollback
+		})
+		if !errors.Is(err, errRollback) {
+			t.Fatalf("WithTx() error = %v, want %v", err, errRollback)
+		}
+		if events := fetchEvents(result.OrderId); len(events) != 1 {
+			t.Errorf("outbox events of the order after a rollback = %+v, want only the committed one", events)
+		}
+
+		if err := odb.MarkOutboxPublished(ctx, []int64{events[0].ID}); err != nil {
+			t.Fatalf("MarkOutboxPublished() error = %v", err)
+		}
+		if events := fetchEvents(result.OrderId); len(events) != 0 {
+			t.Errorf("outbox events of the order after publishing = %+v, want none", events)
+		}
+		// Marking again is harmless.
+		if err := odb.MarkOutboxPublished(ctx, []int64{events[0].ID}); err != nil {
+			t.Errorf("second MarkOutboxPublished() error = %v", err)
+		}
+	})
+}
+
+func TestTablePrefixIsolatesTenants(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, odb *OrderDatabase) {
+		ctx := context.Background()
+		tenants := []Option{WithTablePrefix("test_tenant_")}
+		if odb.dialect.supportsSchemas() {
+			tenants = append(tenants, WithSchema("checkout_test"))
+		}
+
+		for _, opt := range tenants {
+			tenant := newOrderDatabase(odb.db, odb.dialect, newDBOptions([]Option{opt}))
+			if err := tenant.EnsureSchema(ctx); err != nil {
+				t.Fatalf("EnsureSchema() error = %v", err)
+			}
+			// Running it again finds every migration applied.
+			if err := tenant.EnsureSchema(ctx); err != nil {
+				t.Fatalf("second EnsureSchema() error = %v", err)
+			}
+
+			userID := uuid.NewString()
+			req, result, total := newIntegrationOrder(userID)
+			if err := tenant.SaveOrder(ctx, req, result, total); err != nil {
+				t.Fatalf("SaveOrder() error = %v", err)
+			}
+			record, err := tenant.GetOrder(ctx, result.OrderId)
+			if err != nil {
+				t.Fatalf("GetOrder() error = %v", err)
+			}
+			if !proto.Equal(record.Order, result) {
+				t.Errorf("GetOrder() = %v, want %v", record.Order, result)
+			}
+			if orders, err := tenant.GetUserOrders(ctx, userID); err != nil || len(orders) != 1 {
+				t.Errorf("GetUserOrders() = %v, %v, want the order", orders, err)
+			}
+
+			// The default tables are another tenant's, and don't have it.
+			if _, err := odb.GetOrder(ctx, result.OrderId); !errors.Is(err, ErrOrderNotFound) {
+				t.Errorf("GetOrder() from the default tables error = %v, want ErrOrderNotFound", err)
+			}
+			_, other, otherTotal := newIntegrationOrder(userID)
+			if err := odb.SaveOrder(ctx, req, other, otherTotal); err != nil {
+				t.Fatalf("SaveOrder() to the default tables error = %v", err)
+			}
+			if orders, err := tenant.GetUserOrders(ctx, userID); err != nil || len(orders) != 1 || orders[0].Order.OrderId != result.OrderId {
+				t.Errorf("GetUserOrders() = %v, %v, want only the tenant's order", orders, err)
+			}
+		}
+	})
+}
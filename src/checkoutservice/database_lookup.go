@@ -0,0 +1,107 @@
+// Copyright 2024
+// Finding orders by the customer's email
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// blindIndexPrefix marks a user_email_lookup value as a BlindIndex digest
+// rather than a normalized email.
+const blindIndexPrefix = "hmac:v1:"
+
+// errNoBlindIndex is returned by GetOrdersByEmail when the configured
+// cipher can't produce the lookup values it matches on.
+var errNoBlindIndex = errors.New("email lookup needs a cipher that implements BlindIndexer")
+
+// normalizeEmail returns email the way it is compared: without surrounding
+// whitespace and lowercased.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// emailLookup returns the user_email_lookup value stored with email, which
+// GetOrdersByEmail matches on because an encrypted user_email can't be
+// compared: the normalized email when no cipher is configured, its blind
+// index when the cipher is a BlindIndexer, and otherwise NULL, as it is for
+// an empty email.
+func (odb *OrderDatabase) emailLookup(email string) sql.NullString {
+	normalized := normalizeEmail(email)
+	if normalized == "" {
+		return sql.NullString{}
+	}
+	if odb.opts.cipher == nil {
+		return sql.NullString{String: normalized, Valid: true}
+	}
+	indexer, ok := odb.opts.cipher.(BlindIndexer)
+	if !ok {
+		return sql.NullString{}
+	}
+	digest := indexer.BlindIndex([]byte(normalized))
+	return sql.NullString{String: blindIndexPrefix + base64.StdEncoding.EncodeToString(digest), Valid: true}
+}
+
+// GetOrdersByEmail returns up to limit of the orders placed with email,
+// newest first, for support agents who have only the customer's email.
+// Emails match regardless of case and surrounding whitespace. limit is
+// capped at maxOrdersPageSize. With a cipher configured, the cipher must be
+// a BlindIndexer, and orders whose email was already encrypted when the
+// lookup column was added are never found. Archived orders aren't searched.
+func (odb *OrderDatabase) GetOrdersByEmail(ctx context.Context, email string, limit int) (_ []*pb.OrderResult, err error) {
+	// The email is PII, so it stays out of the span.
+	ctx, span := odb.startSpan(ctx, "GetOrdersByEmail", attribute.Int("page.limit", limit))
+	defer func() { endSpan(span, err) }()
+
+	if err = odb.beginOp(); err != nil {
+		return nil, err
+	}
+	defer odb.endOp()
+
+	ctx, cancel := odb.withQueryTimeout(ctx)
+	defer cancel()
+
+	if normalizeEmail(email) == "" {
+		return nil, fmt.Errorf("%w: email is empty", ErrInvalidEmail)
+	}
+	if limit <= 0 {
+		return nil, fmt.Errorf("invalid limit %d: must be positive", limit)
+	}
+	if limit > maxOrdersPageSize {
+		limit = maxOrdersPageSize
+	}
+	lookup := odb.emailLookup(email)
+	if !lookup.Valid {
+		return nil, errNoBlindIndex
+	}
+
+	orderQuery := selectOrdersQuery + `
+		WHERE user_email_lookup = $1
+		ORDER BY created_at DESC, order_id DESC
+		LIMIT $2
+	`
+
+	var records []*OrderRecord
+	err = odb.withReadRetry(ctx, "GetOrdersByEmail", func(q *sql.DB) (err error) {
+		records, err = odb.queryOrders(ctx, q, orderQuery, lookup.String, limit)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("db.rows_returned", len(records)))
+
+	orders := make([]*pb.OrderResult, len(records))
+	for i, record := range records {
+		orders[i] = record.Order
+	}
+	return orders, nil
+}
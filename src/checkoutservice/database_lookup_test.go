@@ -0,0 +1,79 @@
+// Copyright 2024
+// Tests for finding orders by email
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+func TestGetOrdersByEmailNormalizesEmail(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+
+	mock.ExpectQuery(`FROM orders\s+WHERE user_email_lookup = \$1\s+ORDER BY created_at DESC, order_id DESC\s+LIMIT \$2`).
+		WithArgs("someone@example.com", maxOrdersPageSize).
+		WillReturnRows(sqlmock.NewRows(orderColumns).AddRow(orderRow("order-1")...))
+	mock.ExpectQuery(`FROM order_items`).
+		WithArgs(pq.Array([]string{"order-1"})).
+		WillReturnRows(sqlmock.NewRows(orderItemColumns))
+
+	orders, err := odb.GetOrdersByEmail(context.Background(), "  SomeOne@Example.COM\n", 1000)
+	if err != nil {
+		t.Fatalf("GetOrdersByEmail() error = %v", err)
+	}
+	if len(orders) != 1 || orders[0].OrderId != "order-1" {
+		t.Errorf("GetOrdersByEmail() = %v, want order-1", orders)
+	}
+}
+
+func TestGetOrdersByEmailRejectsInvalidInput(t *testing.T) {
+	odb, _ := newMockOrderDatabase(t)
+	ctx := context.Background()
+
+	if _, err := odb.GetOrdersByEmail(ctx, "  ", 10); !errors.Is(err, ErrInvalidEmail) {
+		t.Errorf("GetOrdersByEmail() of a blank email error = %v, want ErrInvalidEmail", err)
+	}
+	for _, limit := range []int{0, -1} {
+		if _, err := odb.GetOrdersByEmail(ctx, "someone@example.com", limit); err == nil {
+			t.Errorf("GetOrdersByEmail(limit=%d) error = nil, want an error", limit)
+		}
+	}
+
+	// A cipher that can't produce blind indexes leaves nothing to match on.
+	odb.opts.cipher = struct{ Cipher }{newTestCipher(t)}
+	if _, err := odb.GetOrdersByEmail(ctx, "someone@example.com", 10); !errors.Is(err, errNoBlindIndex) {
+		t.Errorf("GetOrdersByEmail() without a BlindIndexer error = %v, want errNoBlindIndex", err)
+	}
+}
+
+func TestEmailLookupWithCipher(t *testing.T) {
+	odb := &OrderDatabase{opts: defaultDBOptions()}
+	odb.opts.cipher = newTestCipher(t)
+
+	lookup := odb.emailLookup("Someone@Example.com")
+	if !lookup.Valid || !strings.HasPrefix(lookup.String, blindIndexPrefix) || strings.Contains(lookup.String, "someone") {
+		t.Fatalf("emailLookup() = %v, want a blind index", lookup)
+	}
+	if again := odb.emailLookup(" someone@example.COM "); again != lookup {
+		t.Errorf("emailLookup() of the same email = %v, want %v", again, lookup)
+	}
+	if other := odb.emailLookup("other@example.com"); other == lookup {
+		t.Error("emailLookup() of a different email returned the same index")
+	}
+
+	otherKey, err := NewAESGCMCipher(bytes.Repeat([]byte{0x24}, 32))
+	if err != nil {
+		t.Fatalf("NewAESGCMCipher() error = %v", err)
+	}
+	odb.opts.cipher = otherKey
+	if got := odb.emailLookup("someone@example.com"); got == lookup {
+		t.Error("emailLookup() with a different key returned the same index")
+	}
+}
@@ -0,0 +1,22 @@
+// Copyright 2024
+// Prometheus metrics for the order database connection pool.
+//
+// Built only with -tags prometheus, so the default build doesn't pull in
+// the Prometheus client.
+
+//go:build prometheus
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// RegisterMetrics publishes the connection pool stats as go_sql_* metrics
+// labelled db_name="orders": open, in-use and idle connections, the number
+// of waits for a free connection and the total time spent waiting. The
+// stats are read from the pool on every scrape.
+func (odb *OrderDatabase) RegisterMetrics(reg prometheus.Registerer) error {
+	return reg.Register(collectors.NewDBStatsCollector(odb.db, "orders"))
+}
@@ -0,0 +1,41 @@
+// Copyright 2024
+// Tests for the order database pool metrics
+
+//go:build prometheus
+
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRegisterMetricsPublishesPoolStats(t *testing.T) {
+	odb, _ := newMockOrderDatabase(t)
+	reg := prometheus.NewPedanticRegistry()
+
+	if err := odb.RegisterMetrics(reg); err != nil {
+		t.Fatalf("RegisterMetrics() error = %v", err)
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error = %v", err)
+	}
+	got := make(map[string]bool)
+	for _, family := range families {
+		got[family.GetName()] = true
+	}
+	for _, name := range []string{
+		"go_sql_open_connections",
+		"go_sql_in_use_connections",
+		"go_sql_idle_connections",
+		"go_sql_wait_count_total",
+		"go_sql_wait_duration_seconds_total",
+	} {
+		if !got[name] {
+			t.Errorf("metric %s not registered", name)
+		}
+	}
+}
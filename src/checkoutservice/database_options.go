@@ -0,0 +1,136 @@
+// Copyright 2024
+// Functional options for configuring OrderDatabase
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// defaultQueryTimeout bounds an operation whose context has no deadline.
+const defaultQueryTimeout = 30 * time.Second
+
+// Option configures an OrderDatabase at construction time.
+type Option func(*dbOptions)
+
+type dbOptions struct {
+	maxOpenConns    int
+	maxIdleConns    int
+	connMaxLifetime time.Duration
+	connMaxIdleTime time.Duration
+	retry           RetryPolicy
+	txIsolation     sql.IsolationLevel
+	orderCacheSize  int
+	orderCacheTTL   time.Duration
+	claimTTL        time.Duration
+	queryTimeout    time.Duration
+	tracerProvider  trace.TracerProvider
+	// queryLogging logs every operation; see WithQueryLogging.
+	queryLogging       bool
+	slowQueryThreshold time.Duration
+	// cipher encrypts PII columns; nil stores them in plaintext.
+	cipher      Cipher
+	erasureMode ErasureMode
+	// verifyTotals checks orders GetOrder reads; see
+	// WithTotalsVerification.
+	verifyTotals bool
+	// deadLetter keeps orders SaveOrder couldn't save; see WithDeadLetter.
+	deadLetter bool
+	// tables are the schema and prefix of WithSchema and WithTablePrefix.
+	tables tableNames
+}
+
+func defaultDBOptions() dbOptions {
+	return dbOptions{
+		maxOpenConns:    25,
+		maxIdleConns:    5,
+		connMaxLifetime: 5 * time.Minute,
+		connMaxIdleTime: 2 * time.Minute,
+		retry:           defaultRetryPolicy(),
+		claimTTL:        defaultClaimTTL,
+		queryTimeout:    defaultQueryTimeout,
+		tracerProvider:  defaultTracerProvider(),
+	}
+}
+
+func newDBOptions(opts []Option) dbOptions {
+	o := defaultDBOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithMaxOpenConns caps the number of open connections to the database.
+// Zero or less means no limit.
+func WithMaxOpenConns(n int) Option {
+	return func(o *dbOptions) { o.maxOpenConns = n }
+}
+
+// WithMaxIdleConns sets how many idle connections the pool keeps around.
+func WithMaxIdleConns(n int) Option {
+	return func(o *dbOptions) { o.maxIdleConns = n }
+}
+
+// WithConnMaxLifetime sets how long a connection may be reused before it is
+// closed, so that connections are moved over after a failover. It defaults
+// to five minutes; zero or less means connections are reused forever.
+func WithConnMaxLifetime(d time.Duration) Option {
+	return func(o *dbOptions) { o.connMaxLifetime = d }
+}
+
+// WithConnMaxIdleTime sets how long a connection may sit idle before it is
+// closed, before a firewall or the server drops it unnoticed. It defaults
+// to two minutes; zero or less means idle connections are never closed for
+// age.
+func WithConnMaxIdleTime(d time.Duration) Option {
+	return func(o *dbOptions) { o.connMaxIdleTime = d }
+}
+
+// WithTxIsolation sets the isolation level of the transaction SaveOrder
+// writes an order in. It defaults to sql.LevelDefault, the server's own
+// default (READ COMMITTED on Postgres). Stricter levels make serialization
+// failures more likely; SaveOrder retries those under the retry policy, so
+// consider raising MaxAttempts along with it. SQLite transactions are
+// always serializable and ignore the level.
+func WithTxIsolation(level sql.IsolationLevel) Option {
+	return func(o *dbOptions) { o.txIsolation = level }
+}
+
+// WithQueryTimeout sets how long an operation may run, retries included,
+// when the caller's context has no deadline, so that a hung query can't
+// hold a pool connection forever. A context that already has a deadline is
+// used as it is, whether it is shorter or longer than d. It defaults to 30
+// seconds; zero or less disables it.
+func WithQueryTimeout(d time.Duration) Option {
+	return func(o *dbOptions) { o.queryTimeout = d }
+}
+
+// withQueryTimeout returns ctx bounded by the query timeout, unless the
+// timeout is disabled or ctx already has a deadline. The caller must call
+// the returned cancel function.
+func (odb *OrderDatabase) withQueryTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if odb.opts.queryTimeout <= 0 {
+		return ctx, func() {}
+	}
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, odb.opts.queryTimeout)
+}
+
+// saveTxOptions are the options SaveOrder begins its transaction with.
+func (o dbOptions) saveTxOptions() *sql.TxOptions {
+	return &sql.TxOptions{Isolation: o.txIsolation}
+}
+
+func (o dbOptions) configurePool(db *sql.DB) {
+	db.SetMaxOpenConns(o.maxOpenConns)
+	db.SetMaxIdleConns(o.maxIdleConns)
+	db.SetConnMaxLifetime(o.connMaxLifetime)
+	db.SetConnMaxIdleTime(o.connMaxIdleTime)
+}
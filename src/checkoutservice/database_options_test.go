@@ -0,0 +1,210 @@
+// Copyright 2024
+// Tests for OrderDatabase options
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+func TestNewDBOptionsDefaults(t *testing.T) {
+	o := newDBOptions(nil)
+	if o != defaultDBOptions() {
+		t.Errorf("newDBOptions(nil) = %+v, want defaults %+v", o, defaultDBOptions())
+	}
+	if o.maxOpenConns != 25 || o.maxIdleConns != 5 || o.connMaxLifetime != 5*time.Minute {
+		t.Errorf("defaultDBOptions() = %+v, want 25 open, 5 idle, 5m lifetime", o)
+	}
+}
+
+func TestPoolOptionsAreApplied(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	o := newDBOptions([]Option{
+		WithMaxOpenConns(4),
+		WithMaxIdleConns(2),
+		WithConnMaxLifetime(time.Minute),
+		WithConnMaxIdleTime(30 * time.Second),
+	})
+	if o.maxOpenConns != 4 || o.maxIdleConns != 2 || o.connMaxLifetime != time.Minute || o.connMaxIdleTime != 30*time.Second {
+		t.Fatalf("newDBOptions() = %+v, want options applied", o)
+	}
+
+	o.configurePool(db)
+	if got := db.Stats().MaxOpenConnections; got != 4 {
+		t.Errorf("MaxOpenConnections = %d, want 4", got)
+	}
+}
+
+// sqlmockConn is the set of driver interfaces sqlmock's connection
+// implements.
+type sqlmockConn interface {
+	driver.Conn
+	driver.ConnBeginTx
+	driver.ConnPrepareContext
+	driver.ExecerContext
+	driver.QueryerContext
+}
+
+// txOptionsRecorder wraps a sqlmock connection and records the options of
+// every transaction begun on it, which sqlmock itself ignores.
+type txOptionsRecorder struct {
+	sqlmockConn
+	driver driver.Driver
+	mu     sync.Mutex
+	opts   []driver.TxOptions
+}
+
+func (r *txOptionsRecorder) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	r.mu.Lock()
+	r.opts = append(r.opts, opts)
+	r.mu.Unlock()
+	return r.sqlmockConn.BeginTx(ctx, opts)
+}
+
+func (r *txOptionsRecorder) Connect(context.Context) (driver.Conn, error) { return r, nil }
+
+func (r *txOptionsRecorder) Driver() driver.Driver { return r.driver }
+
+func TestSaveOrderUsesTxIsolation(t *testing.T) {
+	mockDB, mock, err := sqlmock.NewWithDSN("TestSaveOrderUsesTxIsolation")
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer mockDB.Close()
+	conn, err := mockDB.Driver().Open("TestSaveOrderUsesTxIsolation")
+	if err != nil {
+		t.Fatalf("failed to open sqlmock connection: %v", err)
+	}
+	recorder := &txOptionsRecorder{sqlmockConn: conn.(sqlmockConn), driver: mockDB.Driver()}
+	db := sql.OpenDB(recorder)
+	defer db.Close()
+
+	o := newDBOptions([]Option{WithTxIsolation(sql.LevelSerializable), WithRetryPolicy(fastRetryPolicy(2))})
+	odb := newOrderDatabase(db, postgresDialect{}, o)
+	req, result, total := newTestOrder("order-1")
+
+	// A serialization failure, which SERIALIZABLE makes more likely, is
+	// retried in a new transaction with the same isolation.
+	expectPrepareSaveOrder(mock)
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO orders`).WillReturnError(&pq.Error{Code: pqSerializationFailure})
+	mock.ExpectRollback()
+	expectSaveOrder(mock, result)
+
+	if err := odb.SaveOrder(context.Background(), req, result, total); err != nil {
+		t.Fatalf("SaveOrder() error = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+
+	if len(recorder.opts) != 2 {
+		t.Fatalf("began %d transactions, want 2", len(recorder.opts))
+	}
+	for i, opts := range recorder.opts {
+		if sql.IsolationLevel(opts.Isolation) != sql.LevelSerializable {
+			t.Errorf("transaction %d isolation = %v, want %v", i+1, sql.IsolationLevel(opts.Isolation), sql.LevelSerializable)
+		}
+	}
+}
+
+func TestSaveOrderDefaultTxIsolation(t *testing.T) {
+	if got := defaultDBOptions().saveTxOptions(); got.Isolation != sql.LevelDefault || got.ReadOnly {
+		t.Errorf("default saveTxOptions() = %+v, want the server default", got)
+	}
+}
+
+func TestQueryTimeoutCancelsSlowQuery(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	odb.opts.queryTimeout = 20 * time.Millisecond
+
+	mock.ExpectQuery(`FROM orders\s+WHERE order_id = \$1`).
+		WillDelayFor(time.Minute).
+		WillReturnRows(sqlmock.NewRows(orderColumns).AddRow(orderRow("order-1")...))
+
+	start := time.Now()
+	_, err := odb.GetOrder(context.Background(), "order-1")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("GetOrder() error = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("GetOrder() took %v, want it cut short by the query timeout", elapsed)
+	}
+}
+
+func TestQueryTimeoutKeepsCallerDeadline(t *testing.T) {
+	tests := []struct {
+		name           string
+		queryTimeout   time.Duration
+		callerDeadline time.Duration
+		wantErr        bool
+	}{
+		{"tighter caller deadline fires first", time.Hour, 20 * time.Millisecond, true},
+		{"longer caller deadline replaces the timeout", 20 * time.Millisecond, time.Minute, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			odb, mock := newMockOrderDatabase(t)
+			odb.opts.queryTimeout = tt.queryTimeout
+
+			mock.ExpectQuery(`FROM orders\s+WHERE order_id = \$1`).
+				WillDelayFor(100 * time.Millisecond).
+				WillReturnRows(sqlmock.NewRows(orderColumns).AddRow(orderRow("order-1")...))
+			if !tt.wantErr {
+				mock.ExpectQuery(`FROM order_items`).WillReturnRows(sqlmock.NewRows(orderItemColumns))
+				expectNoPayment(mock)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.callerDeadline)
+			defer cancel()
+			_, err := odb.GetOrder(ctx, "order-1")
+			if tt.wantErr && !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("GetOrder() error = %v, want context.DeadlineExceeded", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("GetOrder() error = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestWithQueryTimeout(t *testing.T) {
+	tests := []struct {
+		name         string
+		timeout      time.Duration
+		wantDeadline bool
+	}{
+		{"default", defaultQueryTimeout, true},
+		{"disabled", 0, false},
+		{"negative disables", -time.Second, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			odb := newOrderDatabase(nil, postgresDialect{}, newDBOptions([]Option{WithQueryTimeout(tt.timeout)}))
+			ctx, cancel := odb.withQueryTimeout(context.Background())
+			defer cancel()
+
+			deadline, ok := ctx.Deadline()
+			if ok != tt.wantDeadline {
+				t.Fatalf("withQueryTimeout() has deadline = %v, want %v", ok, tt.wantDeadline)
+			}
+			if ok && time.Until(deadline) > tt.timeout {
+				t.Errorf("withQueryTimeout() deadline in %v, want at most %v", time.Until(deadline), tt.timeout)
+			}
+		})
+	}
+}
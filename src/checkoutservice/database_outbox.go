@@ -0,0 +1,191 @@
+// Copyright 2024
+// Transactional outbox of order events for downstream services
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// OutboxOrderPlaced is the type of the event SaveOrder writes, with an
+// OrderPlacedEvent as its payload.
+const OutboxOrderPlaced = "ORDER_PLACED"
+
+// maxOutboxBatch caps how many events FetchOutboxBatch returns and
+// MarkOutboxPublished takes at once.
+const maxOutboxBatch = 500
+
+const outboxInsertQuery = `
+		INSERT INTO order_outbox (order_id, event_type, payload, created_at)
+		VALUES ($1, $2, $3, $4)`
+
+// OutboxEvent is an event waiting in the outbox.
+type OutboxEvent struct {
+	ID      int64
+	OrderID string
+	Type    string
+	// Payload is the event as JSON, decrypted if a cipher is configured.
+	Payload   []byte
+	CreatedAt time.Time
+}
+
+// OrderPlacedEvent is the payload of an OutboxOrderPlaced event: what the
+// email, shipping and analytics services need about a new order.
+type OrderPlacedEvent struct {
+	UserID       string `json:"user_id"`
+	Email        string `json:"email"`
+	UserCurrency string `json:"user_currency"`
+	// Order is the order as rendered by OrderToJSON.
+	Order    json.RawMessage `json:"order"`
+	PlacedAt time.Time       `json:"placed_at"`
+}
+
+// orderPlacedPayload returns the stored payload of the OutboxOrderPlaced
+// event of an order placed at placedAt, encrypted if a cipher is
+// configured since it holds the email and address.
+func (odb *OrderDatabase) orderPlacedPayload(req *pb.PlaceOrderRequest, orderResult *pb.OrderResult, placedAt time.Time) (string, error) {
+	order, err := OrderToJSON(orderResult)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode order placed event: %w", err)
+	}
+	payload, err := json.Marshal(OrderPlacedEvent{
+		UserID:       req.UserId,
+		Email:        req.Email,
+		UserCurrency: req.UserCurrency,
+		Order:        order,
+		PlacedAt:     placedAt,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode order placed event: %w", err)
+	}
+	return odb.encryptField(string(payload))
+}
+
+// FetchOutboxBatch returns up to limit of the events that haven't been
+// marked published, oldest first, for a relay to publish and then pass to
+// MarkOutboxPublished. limit is capped at maxOutboxBatch. Events are
+// delivered at least once: if the relay stops between publishing and
+// marking, the next fetch returns the same events again, so consumers
+// should ignore IDs they have seen. Run a single relay, or relays will
+// publish the same events concurrently. Events are read from the primary,
+// so one just marked published isn't returned again.
+func (odb *OrderDatabase) FetchOutboxBatch(ctx context.Context, limit int) (_ []OutboxEvent, err error) {
+	ctx, span := odb.startSpan(ctx, "FetchOutboxBatch", attribute.Int("page.limit", limit))
+	defer func() { endSpan(span, err) }()
+
+	if err = odb.beginOp(); err != nil {
+		return nil, err
+	}
+	defer odb.endOp()
+
+	ctx, cancel := odb.withQueryTimeout(ctx)
+	defer cancel()
+
+	if limit <= 0 {
+		return nil, fmt.Errorf("invalid limit %d: must be positive", limit)
+	}
+	if limit > maxOutboxBatch {
+		limit = maxOutboxBatch
+	}
+
+	var events []OutboxEvent
+	err = odb.withRetry(ctx, "FetchOutboxBatch", func() (err error) {
+		events, err = odb.fetchOutboxBatch(ctx, limit)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("db.rows_returned", len(events)))
+	return events, nil
+}
+
+func (odb *OrderDatabase) fetchOutboxBatch(ctx context.Context, limit int) ([]OutboxEvent, error) {
+	rows, err := odb.queryContext(ctx, odb.db, `
+		SELECT id, order_id, event_type, payload, created_at
+		FROM order_outbox
+		WHERE published_at IS NULL
+		ORDER BY id
+		LIMIT $1`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query outbox: %w", err)
+	}
+	defer rows.Close()
+
+	events := []OutboxEvent{}
+	for rows.Next() {
+		var event OutboxEvent
+		var payload string
+		if err := rows.Scan(&event.ID, &event.OrderID, &event.Type, &payload, &event.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan outbox event: %w", err)
+		}
+		plaintext, err := odb.decryptField(payload)
+		if err != nil {
+			return nil, fmt.Errorf("outbox event %d: %w", event.ID, err)
+		}
+		event.Payload = []byte(plaintext)
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query outbox: %w", err)
+	}
+	return events, nil
+}
+
+// MarkOutboxPublished marks the events with the given IDs published, so
+// FetchOutboxBatch no longer returns them. IDs that are unknown or already
+// published are ignored, so a relay can safely mark a batch again.
+func (odb *OrderDatabase) MarkOutboxPublished(ctx context.Context, ids []int64) (err error) {
+	ctx, span := odb.startSpan(ctx, "MarkOutboxPublished", attribute.Int("outbox.id_count", len(ids)))
+	defer func() { endSpan(span, err) }()
+
+	if err = odb.beginOp(); err != nil {
+		return err
+	}
+	defer odb.endOp()
+
+	ctx, cancel := odb.withQueryTimeout(ctx)
+	defer cancel()
+
+	if len(ids) > maxOutboxBatch {
+		return fmt.Errorf("too many outbox IDs: %d, at most %d per call", len(ids), maxOutboxBatch)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	placeholders := make([]string, len(ids))
+	args := make([]interface{}, 0, len(ids)+1)
+	args = append(args, time.Now().UTC())
+	for i, id := range ids {
+		placeholders[i] = fmt.Sprintf("$%d", i+2)
+		args = append(args, id)
+	}
+	query := `
+		UPDATE order_outbox SET published_at = $1
+		WHERE id IN (` + strings.Join(placeholders, ", ") + `) AND published_at IS NULL`
+
+	return odb.withRetry(ctx, "MarkOutboxPublished", func() error {
+		if _, err := odb.execContext(ctx, odb.db, query, args...); err != nil {
+			return fmt.Errorf("failed to mark outbox events published: %w", err)
+		}
+		return nil
+	})
+}
+
+// insertOutboxEvent writes an event for an order in tx, so it commits or
+// rolls back with the order.
+func (odb *OrderDatabase) insertOutboxEvent(ctx context.Context, tx *sql.Tx, orderID, eventType, payload string, createdAt time.Time) error {
+	if _, err := odb.execContext(ctx, tx, outboxInsertQuery, orderID, eventType, payload, createdAt); err != nil {
+		return fmt.Errorf("failed to insert outbox event: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+// Copyright 2024
+// Tests for the order outbox
+
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// capturedArg is a sqlmock argument matcher that accepts any value and
+// keeps it.
+type capturedArg struct{ value *driver.Value }
+
+func (a capturedArg) Match(v driver.Value) bool {
+	*a.value = v
+	return true
+}
+
+func TestSaveOrderWritesOutboxEventInItsTransaction(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	req, result, total := newTestOrder("order-1")
+	var payload driver.Value
+
+	expectPrepareSaveOrder(mock)
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO orders`).WillReturnResult(sqlmock.NewResult(1, 1))
+	for range result.Items {
+		mock.ExpectExec(`INSERT INTO order_items`).WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectExec(`INSERT INTO order_outbox`).
+		WithArgs("order-1", OutboxOrderPlaced, capturedArg{&payload}, recentUTC{}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if err := odb.SaveOrder(context.Background(), req, result, total); err != nil {
+		t.Fatalf("SaveOrder() error = %v", err)
+	}
+
+	var event OrderPlacedEvent
+	if err := json.Unmarshal([]byte(payload.(string)), &event); err != nil {
+		t.Fatalf("outbox payload %v isn't an OrderPlacedEvent: %v", payload, err)
+	}
+	if event.UserID != req.UserId || event.Email != req.Email || event.UserCurrency != req.UserCurrency {
+		t.Errorf("outbox event = %+v, want the request's user, email and currency", event)
+	}
+	if !strings.Contains(string(event.Order), `"order_id":"order-1"`) {
+		t.Errorf("outbox event order = %s, want order-1", event.Order)
+	}
+	if time.Since(event.PlacedAt) > time.Minute {
+		t.Errorf("outbox event placed_at = %v, want about now", event.PlacedAt)
+	}
+}
+
+func TestSaveOrderRollsBackWhenOutboxInsertFails(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	req, result, total := newTestOrder("order-1")
+	errBoom := errors.New("boom")
+
+	expectPrepareSaveOrder(mock)
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO orders`).WillReturnResult(sqlmock.NewResult(1, 1))
+	for range result.Items {
+		mock.ExpectExec(`INSERT INTO order_items`).WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectExec(`INSERT INTO order_outbox`).WillReturnError(errBoom)
+	mock.ExpectRollback()
+
+	if err := odb.SaveOrder(context.Background(), req, result, total); !errors.Is(err, errBoom) {
+		t.Errorf("SaveOrder() error = %v, want %v", err, errBoom)
+	}
+}
+
+func TestSaveOrdersWritesNoOutboxEvents(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	orders := []OrderRecord{newBulkOrder("order-1"), newBulkOrder("order-2")}
+
+	// Any INSERT INTO order_outbox would fail as unexpected.
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO orders \(`).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`INSERT INTO order_items \(`).WillReturnResult(sqlmock.NewResult(0, 4))
+	mock.ExpectCommit()
+
+	if err := odb.SaveOrders(context.Background(), orders); err != nil {
+		t.Fatalf("SaveOrders() error = %v", err)
+	}
+}
+
+func TestSaveOrderOutboxPayloadIsEncrypted(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	odb.opts.cipher = newTestCipher(t)
+	req, result, total := newTestOrder("order-1")
+	var payload driver.Value
+
+	expectPrepareSaveOrder(mock)
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO orders`).WillReturnResult(sqlmock.NewResult(1, 1))
+	for range result.Items {
+		mock.ExpectExec(`INSERT INTO order_items`).WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectExec(`INSERT INTO order_outbox`).
+		WithArgs("order-1", OutboxOrderPlaced, capturedArg{&payload}, recentUTC{}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if err := odb.SaveOrder(context.Background(), req, result, total); err != nil {
+		t.Fatalf("SaveOrder() error = %v", err)
+	}
+	if strings.Contains(payload.(string), req.Email) {
+		t.Error("encrypted outbox payload contains the email")
+	}
+	plaintext, err := odb.decryptField(payload.(string))
+	if err != nil || !strings.Contains(plaintext, req.Email) {
+		t.Errorf("decryptField() of the outbox payload = %q, %v, want it to contain the email", plaintext, err)
+	}
+}
+
+func TestFetchOutboxBatch(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	created := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery(`FROM order_outbox\s+WHERE published_at IS NULL\s+ORDER BY id\s+LIMIT \$1`).
+		WithArgs(maxOutboxBatch).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "order_id", "event_type", "payload", "created_at"}).
+			AddRow(int64(7), "order-1", OutboxOrderPlaced, `{"user_id":"user-1"}`, created).
+			AddRow(int64(9), "order-2", OutboxOrderPlaced, `{"user_id":"user-2"}`, created))
+
+	events, err := odb.FetchOutboxBatch(context.Background(), maxOutboxBatch+1)
+	if err != nil {
+		t.Fatalf("FetchOutboxBatch() error = %v", err)
+	}
+	if len(events) != 2 || events[0].ID != 7 || events[1].ID != 9 {
+		t.Fatalf("FetchOutboxBatch() = %+v, want events 7 and 9", events)
+	}
+	if events[0].OrderID != "order-1" || string(events[0].Payload) != `{"user_id":"user-1"}` || !events[0].CreatedAt.Equal(created) {
+		t.Errorf("FetchOutboxBatch()[0] = %+v", events[0])
+	}
+}
+
+func TestFetchOutboxBatchRejectsInvalidLimit(t *testing.T) {
+	odb, _ := newMockOrderDatabase(t)
+	if _, err := odb.FetchOutboxBatch(context.Background(), 0); err == nil {
+		t.Error("FetchOutboxBatch(0) error = nil, want an error")
+	}
+}
+
+func TestMarkOutboxPublished(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+
+	mock.ExpectExec(`UPDATE order_outbox SET published_at = \$1\s+WHERE id IN \(\$2, \$3\) AND published_at IS NULL`).
+		WithArgs(recentUTC{}, int64(7), int64(9)).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	if err := odb.MarkOutboxPublished(context.Background(), []int64{7, 9}); err != nil {
+		t.Fatalf("MarkOutboxPublished() error = %v", err)
+	}
+	// Nothing to mark isn't a query.
+	if err := odb.MarkOutboxPublished(context.Background(), nil); err != nil {
+		t.Errorf("MarkOutboxPublished(nil) error = %v", err)
+	}
+	if err := odb.MarkOutboxPublished(context.Background(), make([]int64, maxOutboxBatch+1)); err == nil {
+		t.Error("MarkOutboxPublished() of too many IDs error = nil, want an error")
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2024
+// Masked payment details in the order_payments table
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+const paymentInsertQuery = `
+		INSERT INTO order_payments (
+			order_id, card_last_four, card_type, payment_processor_txn_id,
+			authorized, created_at
+		) VALUES ($1, $2, $3, $4, $5, $6)`
+
+// getOrderPayment returns the payment saved with an order, or nil if it was
+// saved without one.
+func (odb *OrderDatabase) getOrderPayment(ctx context.Context, q queryer, orderID string) (*PaymentInfo, error) {
+	paymentQuery := `
+		SELECT card_last_four, card_type, payment_processor_txn_id, authorized
+		FROM order_payments
+		WHERE order_id = $1
+	`
+
+	var payment PaymentInfo
+	var cardType, txnID sql.NullString
+	err := odb.queryRowContext(ctx, q, paymentQuery, orderID).Scan(
+		&payment.CardLastFour,
+		&cardType,
+		&txnID,
+		&payment.Authorized,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query order payment: %w", err)
+	}
+	payment.CardType = cardType.String
+	payment.ProcessorTxnID = txnID.String
+	return &payment, nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2024
+// Logging of database operations and slow-operation warnings
+
+package main
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// WithQueryLogging logs every OrderDatabase operation at debug level with
+// its name, how long it took, how many rows it returned if it reports that,
+// and its error, and logs it as a warning instead if it took longer than
+// slowThreshold. Zero or less turns the warnings off but keeps the debug
+// logs. The time covers the whole operation, retries and waits for a
+// connection included. Only the operation name and numbers are logged;
+// SQL, parameter values and span attributes never are, and OrderDatabase
+// errors name orders by ID rather than quoting what was stored, so no PII
+// reaches the logs. Logging is off by default.
+func WithQueryLogging(slowThreshold time.Duration) Option {
+	return func(o *dbOptions) {
+		o.queryLogging = true
+		o.slowQueryThreshold = slowThreshold
+	}
+}
+
+// loggedSpan is the span of an operation that is logged when the span
+// ends. It picks up the row count and error from what the operation
+// records on its span, so operations need no logging code of their own.
+type loggedSpan struct {
+	trace.Span
+	operation     string
+	start         time.Time
+	slowThreshold time.Duration
+	rows          int64
+	hasRows       bool
+	err           error
+}
+
+func (s *loggedSpan) SetAttributes(kv ...attribute.KeyValue) {
+	for _, attr := range kv {
+		if attr.Key == "db.rows_returned" {
+			s.rows, s.hasRows = attr.Value.AsInt64(), true
+		}
+	}
+	s.Span.SetAttributes(kv...)
+}
+
+func (s *loggedSpan) RecordError(err error, options ...trace.EventOption) {
+	s.err = err
+	s.Span.RecordError(err, options...)
+}
+
+func (s *loggedSpan) End(options ...trace.SpanEndOption) {
+	s.Span.End(options...)
+
+	elapsed := time.Since(s.start)
+	entry := log.WithFields(logrus.Fields{
+		"db.operation":   s.operation,
+		"db.duration_ms": float64(elapsed.Microseconds()) / 1000,
+	})
+	if s.hasRows {
+		entry = entry.WithField("db.rows_returned", s.rows)
+	}
+	if s.err != nil {
+		entry = entry.WithError(s.err)
+	}
+	if s.slowThreshold > 0 && elapsed > s.slowThreshold {
+		entry.Warnf("slow database operation %s took %v, over the %v threshold", s.operation, elapsed, s.slowThreshold)
+		return
+	}
+	entry.Debugf("database operation %s took %v", s.operation, elapsed)
+}
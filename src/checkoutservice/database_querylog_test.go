@@ -0,0 +1,116 @@
+// Copyright 2024
+// Tests for database operation logging
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// captureLogs records what is logged through log until the test ends.
+func captureLogs(t *testing.T) *logtest.Hook {
+	t.Helper()
+	saved := log.ReplaceHooks(make(logrus.LevelHooks))
+	t.Cleanup(func() { log.ReplaceHooks(saved) })
+	return logtest.NewLocal(log)
+}
+
+// operationEntries returns the entries logged for operation.
+func operationEntries(hook *logtest.Hook, operation string) []*logrus.Entry {
+	var entries []*logrus.Entry
+	for _, entry := range hook.AllEntries() {
+		if entry.Data["db.operation"] == operation {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func TestQueryLoggingWarnsAboutSlowOperations(t *testing.T) {
+	hook := captureLogs(t)
+	odb, mock := newMockOrderDatabase(t)
+	odb.opts.queryLogging = true
+	odb.opts.slowQueryThreshold = 20 * time.Millisecond
+
+	mock.ExpectQuery(`FROM orders\s+WHERE user_id = \$1`).
+		WillDelayFor(50 * time.Millisecond).
+		WillReturnRows(sqlmock.NewRows(orderColumns).AddRow(orderRow("order-1")...))
+	mock.ExpectQuery(`FROM order_items`).WillReturnRows(sqlmock.NewRows(orderItemColumns))
+
+	if _, err := odb.GetUserOrders(context.Background(), "user-1"); err != nil {
+		t.Fatalf("GetUserOrders() error = %v", err)
+	}
+
+	entries := operationEntries(hook, "GetUserOrders")
+	if len(entries) != 1 {
+		t.Fatalf("logged %d entries for GetUserOrders, want 1", len(entries))
+	}
+	entry := entries[0]
+	if entry.Level != logrus.WarnLevel {
+		t.Errorf("slow GetUserOrders logged at %s, want %s", entry.Level, logrus.WarnLevel)
+	}
+	if got := entry.Data["db.rows_returned"]; got != int64(1) {
+		t.Errorf("db.rows_returned = %v, want 1", got)
+	}
+	if got, _ := entry.Data["db.duration_ms"].(float64); got < 50 {
+		t.Errorf("db.duration_ms = %v, want at least the 50ms the query took", got)
+	}
+}
+
+func TestQueryLoggingLogsFastOperationsAtDebugWithoutPII(t *testing.T) {
+	hook := captureLogs(t)
+	odb, mock := newMockOrderDatabase(t)
+	odb.opts.queryLogging = true
+	odb.opts.slowQueryThreshold = time.Hour
+	req, result, total := newTestOrder("order-1")
+
+	expectPrepareSaveOrder(mock)
+	expectSaveOrder(mock, result)
+	if err := odb.SaveOrder(context.Background(), req, result, total); err != nil {
+		t.Fatalf("SaveOrder() error = %v", err)
+	}
+	// A failed operation is logged with its error.
+	mock.ExpectQuery(`FROM orders\s+WHERE order_id = \$1`).WillReturnRows(sqlmock.NewRows(orderColumns))
+	if _, err := odb.GetOrder(context.Background(), "order-2"); err == nil {
+		t.Fatal("GetOrder() of a missing order error = nil")
+	}
+
+	saves := operationEntries(hook, "SaveOrder")
+	if len(saves) != 1 || saves[0].Level != logrus.DebugLevel {
+		t.Fatalf("SaveOrder log entries = %v, want one at debug level", saves)
+	}
+	gets := operationEntries(hook, "GetOrder")
+	if len(gets) != 1 || gets[0].Data[logrus.ErrorKey] == nil {
+		t.Errorf("GetOrder log entries = %v, want one with the error", gets)
+	}
+
+	for _, entry := range hook.AllEntries() {
+		text := entry.Message + fmt.Sprint(entry.Data)
+		for _, pii := range []string{req.Email, req.Address.StreetAddress, req.Address.City} {
+			if strings.Contains(text, pii) {
+				t.Errorf("log entry %q contains PII %q", text, pii)
+			}
+		}
+	}
+}
+
+func TestQueryLoggingIsOffByDefault(t *testing.T) {
+	hook := captureLogs(t)
+	odb, mock := newMockOrderDatabase(t)
+
+	mock.ExpectQuery(`FROM orders\s+WHERE user_id = \$1`).WillReturnRows(sqlmock.NewRows(orderColumns))
+	if _, err := odb.GetUserOrders(context.Background(), "user-1"); err != nil {
+		t.Fatalf("GetUserOrders() error = %v", err)
+	}
+	if entries := operationEntries(hook, "GetUserOrders"); len(entries) != 0 {
+		t.Errorf("logged %d entries with query logging off, want none", len(entries))
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2024
+// Reconnecting after an operation fails on a stale pooled connection
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"syscall"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+// pqAdminShutdown is the SQLSTATE Postgres closes connections with when
+// the server shuts down, as it does on failover.
+const pqAdminShutdown = "57P01"
+
+// isStaleConnError reports whether err means the pooled connection the
+// operation ran on was already dead, e.g. closed by the server after a
+// failover or by a firewall while idle: the driver reported a bad
+// connection, or the connection was reset, hung up or reached EOF. Unlike
+// isConnectionError it doesn't match failures to reach the database at
+// all, such as timeouts or refused connections, which a new connection
+// wouldn't fix.
+func isStaleConnError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == pqAdminShutdown
+	}
+	if errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	// Some drivers report the socket error as text only. A database error
+	// is never one, whatever its message says.
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "connection reset") || strings.Contains(msg, "broken pipe")
+}
+
+// reconnect is called once an operation on pool has failed with a stale
+// connection error, and reports whether to retry it. It pings pool, which
+// replaces connections the driver finds broken with new ones, so the retry
+// runs on a live connection. The connection that failed
+// has been marked bad by the driver and isn't reused. If the ping fails
+// the database itself is unreachable, and the operation's error is
+// returned as it is.
+func (odb *OrderDatabase) reconnect(ctx context.Context, name string, pool *sql.DB, opErr error) bool {
+	if err := pool.PingContext(ctx); err != nil {
+		log.Warnf("%s failed on a stale connection and the database didn't answer a ping: %v: %v", name, opErr, err)
+		return false
+	}
+	log.Warnf("%s failed on a stale connection, retrying on a new one: %v", name, opErr)
+	return true
+}
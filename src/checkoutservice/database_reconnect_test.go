@@ -0,0 +1,197 @@
+// Copyright 2024
+// Tests for reconnecting after a stale connection error
+
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+// newPingingMockOrderDatabase is newMockOrderDatabase with pings checked
+// against expectations, and retries disabled so that only the reconnect
+// retry runs.
+func newPingingMockOrderDatabase(t *testing.T) (*OrderDatabase, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("unmet sqlmock expectations: %v", err)
+		}
+		db.Close()
+	})
+	odb := newOrderDatabase(db, postgresDialect{}, defaultDBOptions())
+	odb.opts.retry = fastRetryPolicy(1)
+	return odb, mock
+}
+
+// connReset is the error reading from a connection the server has closed.
+func connReset() error {
+	return &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+}
+
+func TestIsStaleConnError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"connection reset", fmt.Errorf("failed to query order: %w", connReset()), true},
+		{"broken pipe", &net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)}, true},
+		{"EOF", io.EOF, true},
+		{"unexpected EOF", io.ErrUnexpectedEOF, true},
+		{"bad conn", driver.ErrBadConn, true},
+		{"mysql invalid connection", mysql.ErrInvalidConn, true},
+		{"postgres shutting down", &pq.Error{Code: pqAdminShutdown}, true},
+		{"reset as text", errors.New("read tcp 10.0.0.1:5432: connection reset by peer"), true},
+		{"postgres error mentioning a reset", &pq.Error{Code: "P0001", Message: "connection reset by peer"}, false},
+		{"mysql error mentioning a broken pipe", &mysql.MySQLError{Number: 1644, Message: "broken pipe"}, false},
+		{"postgres connection failure", &pq.Error{Code: "08006"}, false},
+		{"connection refused", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, false},
+		{"serialization failure", &pq.Error{Code: pqSerializationFailure}, false},
+		{"context canceled", fmt.Errorf("%w: %w", context.Canceled, io.ErrUnexpectedEOF), false},
+		{"plain error", errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isStaleConnError(tt.err); got != tt.want {
+				t.Errorf("isStaleConnError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetOrderReconnectsAfterConnectionReset(t *testing.T) {
+	odb, mock := newPingingMockOrderDatabase(t)
+
+	mock.ExpectQuery(`FROM orders\s+WHERE order_id = \$1`).WillReturnError(connReset())
+	mock.ExpectPing()
+	mock.ExpectQuery(`FROM orders\s+WHERE order_id = \$1`).
+		WillReturnRows(sqlmock.NewRows(orderColumns).AddRow(orderRow("order-1")...))
+	mock.ExpectQuery(`FROM order_items`).WillReturnRows(sqlmock.NewRows(orderItemColumns))
+	expectNoPayment(mock)
+
+	if _, err := odb.GetOrder(context.Background(), "order-1"); err != nil {
+		t.Errorf("GetOrder() error = %v, want success on a new connection", err)
+	}
+}
+
+func TestSaveOrderReconnectsAfterBrokenPipe(t *testing.T) {
+	odb, mock := newPingingMockOrderDatabase(t)
+	req, result, total := newTestOrder("order-1")
+
+	expectPrepareSaveOrder(mock)
+	mock.ExpectBegin().WillReturnError(&net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)})
+	mock.ExpectPing()
+	expectSaveOrder(mock, result)
+
+	if err := odb.SaveOrder(context.Background(), req, result, total); err != nil {
+		t.Errorf("SaveOrder() error = %v, want success on a new connection", err)
+	}
+}
+
+// newPingingMockReplica gives odb a replica whose pings are checked
+// against expectations, so that a test can tell which pool was pinged.
+func newPingingMockReplica(t *testing.T, odb *OrderDatabase) sqlmock.Sqlmock {
+	t.Helper()
+	replica, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("unmet replica expectations: %v", err)
+		}
+		replica.Close()
+	})
+	odb.replica = replica
+	return mock
+}
+
+func TestReplicaReadReconnectsOnReplica(t *testing.T) {
+	odb, _ := newPingingMockOrderDatabase(t)
+	replica := newPingingMockReplica(t, odb)
+
+	replica.ExpectQuery(`FROM orders\s+WHERE order_id = \$1`).WillReturnError(connReset())
+	replica.ExpectPing()
+	expectGetOrder(replica, "order-1")
+
+	if _, err := odb.GetOrder(context.Background(), "order-1"); err != nil {
+		t.Errorf("GetOrder() error = %v, want success on a new replica connection", err)
+	}
+}
+
+func TestReplicaReadGivesUpWhenReplicaPingFails(t *testing.T) {
+	odb, _ := newPingingMockOrderDatabase(t)
+	replica := newPingingMockReplica(t, odb)
+
+	replica.ExpectQuery(`FROM orders\s+WHERE order_id = \$1`).WillReturnError(connReset())
+	replica.ExpectPing().WillReturnError(errors.New("connection refused"))
+
+	_, err := odb.GetOrder(context.Background(), "order-1")
+	if !errors.Is(err, ErrDatabaseUnavailable) || !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("GetOrder() error = %v, want ErrDatabaseUnavailable wrapping the reset", err)
+	}
+}
+
+func TestPrimaryReadReconnectsOnPrimary(t *testing.T) {
+	odb, primary := newPingingMockOrderDatabase(t)
+	newPingingMockReplica(t, odb)
+
+	primary.ExpectQuery(`FROM orders\s+WHERE order_id = \$1`).WillReturnError(connReset())
+	primary.ExpectPing()
+	expectGetOrder(primary, "order-1")
+
+	if _, err := odb.GetOrder(WithPrimaryRead(context.Background()), "order-1"); err != nil {
+		t.Errorf("GetOrder() error = %v, want success on a new primary connection", err)
+	}
+}
+
+func TestReconnectGivesUpWhenPingFails(t *testing.T) {
+	odb, mock := newPingingMockOrderDatabase(t)
+
+	mock.ExpectQuery(`FROM orders\s+WHERE order_id = \$1`).WillReturnError(connReset())
+	mock.ExpectPing().WillReturnError(errors.New("connection refused"))
+
+	_, err := odb.GetOrder(context.Background(), "order-1")
+	if !errors.Is(err, ErrDatabaseUnavailable) || !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("GetOrder() error = %v, want ErrDatabaseUnavailable wrapping the reset", err)
+	}
+}
+
+func TestReconnectRetriesOnlyOnce(t *testing.T) {
+	odb, mock := newPingingMockOrderDatabase(t)
+
+	mock.ExpectQuery(`FROM orders\s+WHERE order_id = \$1`).WillReturnError(connReset())
+	mock.ExpectPing()
+	mock.ExpectQuery(`FROM orders\s+WHERE order_id = \$1`).WillReturnError(connReset())
+
+	if _, err := odb.GetOrder(context.Background(), "order-1"); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("GetOrder() error = %v, want the second reset", err)
+	}
+}
+
+func TestReconnectIgnoresQueryErrors(t *testing.T) {
+	odb, mock := newPingingMockOrderDatabase(t)
+
+	mock.ExpectQuery(`FROM orders\s+WHERE order_id = \$1`).WillReturnError(&pq.Error{Code: "42P01"})
+
+	if _, err := odb.GetOrder(context.Background(), "order-1"); err == nil {
+		t.Error("GetOrder() error = nil, want the query error")
+	}
+}
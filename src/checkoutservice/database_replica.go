@@ -0,0 +1,61 @@
+// Copyright 2024
+// Read replica routing for the order database
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+type primaryReadKey struct{}
+
+// NewOrderDatabaseWithReplica opens a pool to the primary for writes and a
+// second pool to a read replica for every read: GetOrder, BatchGetOrders,
+// GetUserOrders, GetUserOrdersPartial, GetUserOrdersPaged, GetLatestOrder,
+// CountUserOrders, QueryOrders, StreamUserOrders, GetUserSpendSummary,
+// GetOrdersByEmail and GetOrderEvents, unless the context is wrapped with
+// WithPrimaryRead. GetOrderForUpdate, queries in WithTx and
+// FetchOutboxBatch always use the primary. Both pools get the same
+// options. An unreachable replica is not fatal: a warning is logged and
+// reads go to the primary.
+func NewOrderDatabaseWithReplica(primaryDSN, replicaDSN string, opts ...Option) (*OrderDatabase, error) {
+	odb, err := NewOrderDatabase(primaryDSN, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	d, dsn := dialectFor(replicaDSN)
+	if d.system() != odb.dialect.system() {
+		odb.Close()
+		return nil, fmt.Errorf("replica is %s but primary is %s", d.system(), odb.dialect.system())
+	}
+	replica, err := openDB(d, dsn, odb.opts)
+	if err != nil {
+		log.Warnf("read replica unavailable, serving reads from the primary: %v", err)
+		return odb, nil
+	}
+
+	log.Infof("Successfully connected to %s read replica", d.system())
+	odb.replica = replica
+	return odb, nil
+}
+
+// WithPrimaryRead returns a context that sends OrderDatabase reads to the
+// primary even when a replica is configured. Use it to read an order back
+// right after saving it, before replication has caught up.
+func WithPrimaryRead(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryReadKey{}, true)
+}
+
+// reader returns the pool a read-only query should run on.
+func (odb *OrderDatabase) reader(ctx context.Context) *sql.DB {
+	if odb.replica == nil {
+		return odb.db
+	}
+	if primary, _ := ctx.Value(primaryReadKey{}).(bool); primary {
+		return odb.db
+	}
+	return odb.replica
+}
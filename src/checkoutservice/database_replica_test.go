@@ -0,0 +1,93 @@
+// Copyright 2024
+// Tests for read replica routing
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+// newMockReplicaOrderDatabase returns an OrderDatabase whose primary and
+// replica are separate sqlmock connections, so a test can tell which pool
+// each query ran on.
+func newMockReplicaOrderDatabase(t *testing.T) (*OrderDatabase, sqlmock.Sqlmock, sqlmock.Sqlmock) {
+	t.Helper()
+	odb, primary := newMockOrderDatabase(t)
+
+	replica, replicaMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := replicaMock.ExpectationsWereMet(); err != nil {
+			t.Errorf("unmet replica expectations: %v", err)
+		}
+		replica.Close()
+	})
+	odb.replica = replica
+	return odb, primary, replicaMock
+}
+
+func expectGetOrder(mock sqlmock.Sqlmock, orderID string) {
+	mock.ExpectQuery(`FROM orders\s+WHERE order_id = \$1`).
+		WithArgs(orderID).
+		WillReturnRows(sqlmock.NewRows(orderColumns).AddRow(orderRow(orderID)...))
+	mock.ExpectQuery(`FROM order_items`).
+		WithArgs(pq.Array([]string{orderID})).
+		WillReturnRows(sqlmock.NewRows(orderItemColumns))
+	expectNoPayment(mock)
+}
+
+func TestReadsGoToReplicaAndWritesToPrimary(t *testing.T) {
+	odb, primary, replica := newMockReplicaOrderDatabase(t)
+	req, result, total := newTestOrder("order-1")
+
+	expectPrepareSaveOrder(primary)
+	expectSaveOrder(primary, result)
+	expectGetOrder(replica, "order-1")
+	replica.ExpectQuery(`FROM orders\s+WHERE user_id = \$1`).
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows(orderColumns))
+
+	ctx := context.Background()
+	if err := odb.SaveOrder(ctx, req, result, total); err != nil {
+		t.Fatalf("SaveOrder() error = %v", err)
+	}
+	if _, err := odb.GetOrder(ctx, "order-1"); err != nil {
+		t.Fatalf("GetOrder() error = %v", err)
+	}
+	if _, err := odb.GetUserOrders(ctx, "user-1"); err != nil {
+		t.Fatalf("GetUserOrders() error = %v", err)
+	}
+}
+
+func TestWithPrimaryReadBypassesReplica(t *testing.T) {
+	odb, primary, _ := newMockReplicaOrderDatabase(t)
+	req, result, total := newTestOrder("order-1")
+
+	expectPrepareSaveOrder(primary)
+	expectSaveOrder(primary, result)
+	expectGetOrder(primary, "order-1")
+
+	ctx := context.Background()
+	if err := odb.SaveOrder(ctx, req, result, total); err != nil {
+		t.Fatalf("SaveOrder() error = %v", err)
+	}
+	if _, err := odb.GetOrder(WithPrimaryRead(ctx), "order-1"); err != nil {
+		t.Fatalf("GetOrder() error = %v", err)
+	}
+}
+
+func TestReadsUsePrimaryWithoutReplica(t *testing.T) {
+	odb, primary := newMockOrderDatabase(t)
+
+	expectGetOrder(primary, "order-1")
+
+	if _, err := odb.GetOrder(context.Background(), "order-1"); err != nil {
+		t.Fatalf("GetOrder() error = %v", err)
+	}
+}
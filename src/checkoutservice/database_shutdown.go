@@ -0,0 +1,62 @@
+// Copyright 2024
+// Graceful shutdown that lets in-flight database operations finish
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var ErrShuttingDown = errors.New("order database is shutting down")
+
+// opTracker counts the operations running against an OrderDatabase and
+// refuses new ones once shutdown has started.
+type opTracker struct {
+	mu       sync.Mutex
+	closing  bool
+	inFlight sync.WaitGroup
+}
+
+// beginOp registers a new operation, failing with ErrShuttingDown once
+// Shutdown has been called. Every successful call must be paired with
+// endOp.
+func (odb *OrderDatabase) beginOp() error {
+	odb.ops.mu.Lock()
+	defer odb.ops.mu.Unlock()
+	if odb.ops.closing {
+		return ErrShuttingDown
+	}
+	odb.ops.inFlight.Add(1)
+	return nil
+}
+
+func (odb *OrderDatabase) endOp() {
+	odb.ops.inFlight.Done()
+}
+
+// Shutdown stops accepting new operations, waits for the ones already
+// running to finish and then closes the connection pools. If ctx ends
+// first the pools are closed anyway, which aborts whatever is still
+// running, and the context error is returned.
+func (odb *OrderDatabase) Shutdown(ctx context.Context) error {
+	odb.ops.mu.Lock()
+	odb.ops.closing = true
+	odb.ops.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		odb.ops.inFlight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return odb.Close()
+	case <-ctx.Done():
+		odb.Close()
+		return fmt.Errorf("gave up waiting for in-flight database operations: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2024
+// Tests for graceful shutdown
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestShutdownWaitsForInFlightSaveOrder(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	req, result, total := newTestOrder("order-1")
+
+	expectPrepareSaveOrder(mock)
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO orders`).
+		WillDelayFor(200 * time.Millisecond).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	for range result.Items {
+		mock.ExpectExec(`INSERT INTO order_items`).WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	expectOutboxEvent(mock, result.OrderId)
+	mock.ExpectCommit()
+	mock.ExpectClose()
+
+	saved := make(chan error, 1)
+	go func() { saved <- odb.SaveOrder(context.Background(), req, result, total) }()
+
+	// Give SaveOrder time to register before shutting down.
+	time.Sleep(50 * time.Millisecond)
+	if err := odb.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+
+	select {
+	case err := <-saved:
+		if err != nil {
+			t.Errorf("SaveOrder() error = %v, want it to finish before Shutdown returns", err)
+		}
+	default:
+		t.Fatal("Shutdown() returned while SaveOrder was still running")
+	}
+}
+
+func TestOperationsAfterShutdownFail(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	mock.ExpectClose()
+
+	if err := odb.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+
+	req, result, total := newTestOrder("order-1")
+	if err := odb.SaveOrder(context.Background(), req, result, total); !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("SaveOrder() error = %v, want ErrShuttingDown", err)
+	}
+	if _, err := odb.GetOrder(context.Background(), "order-1"); !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("GetOrder() error = %v, want ErrShuttingDown", err)
+	}
+}
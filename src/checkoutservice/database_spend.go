@@ -0,0 +1,118 @@
+// Copyright 2024
+// Per-customer spend reporting
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// SpendSummary is what a customer has spent across all their orders.
+type SpendSummary struct {
+	// OrderCount counts every order, cancelled ones included;
+	// CancelledCount says how many of them were cancelled.
+	OrderCount     int64
+	CancelledCount int64
+	// Totals holds the summed totals of the orders that weren't cancelled,
+	// keyed by currency code, since amounts in different currencies can't
+	// be added up. A currency whose orders were all cancelled is left out.
+	Totals map[string]*pb.Money
+	// FirstOrderAt and LastOrderAt span every order, cancelled ones
+	// included, and are zero when the user has no orders.
+	FirstOrderAt time.Time
+	LastOrderAt  time.Time
+}
+
+// GetUserSpendSummary aggregates the user's orders in the database rather
+// than loading them. A user without orders gets an empty summary, not an
+// error.
+func (odb *OrderDatabase) GetUserSpendSummary(ctx context.Context, userID string) (_ *SpendSummary, err error) {
+	ctx, span := odb.startSpan(ctx, "GetUserSpendSummary", attribute.String("user.id", userID))
+	defer func() { endSpan(span, err) }()
+
+	if err = odb.beginOp(); err != nil {
+		return nil, err
+	}
+	defer odb.endOp()
+
+	ctx, cancel := odb.withQueryTimeout(ctx)
+	defer cancel()
+
+	var summary *SpendSummary
+	err = odb.withReadRetry(ctx, "GetUserSpendSummary", func(q *sql.DB) (err error) {
+		summary, err = odb.getUserSpendSummary(ctx, q, userID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+func (odb *OrderDatabase) getUserSpendSummary(ctx context.Context, q queryer, userID string) (*SpendSummary, error) {
+	spendQuery := `
+		SELECT
+			COALESCE(total_amount_currency, ''), COUNT(*),
+			COALESCE(SUM(CASE WHEN status = $2 THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN status <> $2 THEN total_amount_units ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN status <> $2 THEN total_amount_nanos ELSE 0 END), 0),
+			MIN(created_at), MAX(created_at)
+		FROM orders
+		WHERE user_id = $1
+		GROUP BY total_amount_currency
+	`
+
+	rows, err := odb.queryContext(ctx, q, spendQuery, userID, OrderStatusCancelled)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query user spend: %w", err)
+	}
+	defer rows.Close()
+
+	summary := &SpendSummary{Totals: make(map[string]*pb.Money)}
+	for rows.Next() {
+		var currency string
+		var count, cancelled, units, nanos int64
+		var first, last aggregateTime
+		if err := rows.Scan(&currency, &count, &cancelled, &units, &nanos, &first, &last); err != nil {
+			return nil, fmt.Errorf("failed to scan user spend: %w", err)
+		}
+
+		summary.OrderCount += count
+		summary.CancelledCount += cancelled
+		if count > cancelled {
+			summary.Totals[currency] = sumToMoney(currency, units, nanos)
+		}
+		if summary.FirstOrderAt.IsZero() || first.Time.Before(summary.FirstOrderAt) {
+			summary.FirstOrderAt = first.Time
+		}
+		if last.Time.After(summary.LastOrderAt) {
+			summary.LastOrderAt = last.Time
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating user spend: %w", err)
+	}
+	return summary, nil
+}
+
+// sumToMoney turns separately summed units and nanos into a valid Money,
+// carrying whole units out of nanos and giving both the same sign.
+func sumToMoney(currency string, units, nanos int64) *pb.Money {
+	units += nanos / 1e9
+	nanos %= 1e9
+	switch {
+	case units > 0 && nanos < 0:
+		units--
+		nanos += 1e9
+	case units < 0 && nanos > 0:
+		units++
+		nanos -= 1e9
+	}
+	return &pb.Money{CurrencyCode: currency, Units: units, Nanos: int32(nanos)}
+}
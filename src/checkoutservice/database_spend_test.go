@@ -0,0 +1,93 @@
+// Copyright 2024
+// Tests for per-customer spend reporting
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+func TestSumToMoney(t *testing.T) {
+	tests := []struct {
+		name         string
+		units, nanos int64
+		want         *pb.Money
+	}{
+		{"no carry", 12, 500000000, &pb.Money{CurrencyCode: "USD", Units: 12, Nanos: 500000000}},
+		{"carry", 3, 2750000000, &pb.Money{CurrencyCode: "USD", Units: 5, Nanos: 750000000}},
+		{"exact carry", 1, 3000000000, &pb.Money{CurrencyCode: "USD", Units: 4}},
+		{"zero", 0, 0, &pb.Money{CurrencyCode: "USD"}},
+		{"negative", -3, -2750000000, &pb.Money{CurrencyCode: "USD", Units: -5, Nanos: -750000000}},
+		{"mixed signs", 5, -250000000, &pb.Money{CurrencyCode: "USD", Units: 4, Nanos: 750000000}},
+		{"mixed signs, negative", -5, 250000000, &pb.Money{CurrencyCode: "USD", Units: -4, Nanos: -750000000}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sumToMoney("USD", tt.units, tt.nanos); !proto.Equal(got, tt.want) {
+				t.Errorf("sumToMoney(%d, %d) = %v, want %v", tt.units, tt.nanos, got, tt.want)
+			}
+		})
+	}
+}
+
+var spendColumns = []string{"currency", "count", "cancelled", "units", "nanos", "first", "last"}
+
+func TestGetUserSpendSummary(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	first := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	last := first.Add(72 * time.Hour)
+
+	mock.ExpectQuery(`SUM\(CASE WHEN status <> \$2 THEN total_amount_units ELSE 0 END\).*FROM orders\s+WHERE user_id = \$1\s+GROUP BY total_amount_currency`).
+		WithArgs("user-1", "CANCELLED").
+		WillReturnRows(sqlmock.NewRows(spendColumns).
+			AddRow("EUR", 3, 1, 20, 1200000000, first.Add(time.Hour), last).
+			AddRow("USD", 1, 0, 5, 500000000, first, first).
+			// Only cancelled orders in GBP: counted and dated, but no total.
+			AddRow("GBP", 1, 1, 0, 0, first.Add(-time.Hour), first.Add(-time.Hour)))
+
+	got, err := odb.GetUserSpendSummary(context.Background(), "user-1")
+	if err != nil {
+		t.Fatalf("GetUserSpendSummary() error = %v", err)
+	}
+	if got.OrderCount != 5 || got.CancelledCount != 2 {
+		t.Errorf("OrderCount, CancelledCount = %d, %d, want 5, 2", got.OrderCount, got.CancelledCount)
+	}
+	wantTotals := map[string]*pb.Money{
+		"EUR": {CurrencyCode: "EUR", Units: 21, Nanos: 200000000},
+		"USD": {CurrencyCode: "USD", Units: 5, Nanos: 500000000},
+	}
+	if len(got.Totals) != len(wantTotals) {
+		t.Errorf("Totals = %v, want %v", got.Totals, wantTotals)
+	}
+	for currency, want := range wantTotals {
+		if !proto.Equal(got.Totals[currency], want) {
+			t.Errorf("Totals[%s] = %v, want %v", currency, got.Totals[currency], want)
+		}
+	}
+	if !got.FirstOrderAt.Equal(first.Add(-time.Hour)) || !got.LastOrderAt.Equal(last) {
+		t.Errorf("first/last order = %v/%v, want %v/%v", got.FirstOrderAt, got.LastOrderAt, first.Add(-time.Hour), last)
+	}
+}
+
+func TestGetUserSpendSummaryWithoutOrders(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+
+	mock.ExpectQuery(`GROUP BY total_amount_currency`).
+		WithArgs("user-1", "CANCELLED").
+		WillReturnRows(sqlmock.NewRows(spendColumns))
+
+	got, err := odb.GetUserSpendSummary(context.Background(), "user-1")
+	if err != nil {
+		t.Fatalf("GetUserSpendSummary() error = %v", err)
+	}
+	if got.OrderCount != 0 || got.CancelledCount != 0 || len(got.Totals) != 0 || !got.FirstOrderAt.IsZero() || !got.LastOrderAt.IsZero() {
+		t.Errorf("GetUserSpendSummary() = %+v, want an empty summary", got)
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2024
+// Prepared statement cache for the hot write path
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// stmtCache holds statements prepared on the primary pool, keyed by their
+// bound query text. A *sql.Stmt is prepared again on every pool connection
+// it runs on, including ones opened after a reconnect, so each statement is
+// parsed once per connection rather than once per call.
+type stmtCache struct {
+	mu    sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+// prepare returns query, bound to the dialect, prepared on the primary
+// pool. Arguments are passed to the statement as they are, so query must
+// use each placeholder once and in order. Call it before starting the
+// transaction the statement will run in: on SQLite the pool has a single
+// connection, which the transaction would be holding.
+func (odb *OrderDatabase) prepare(ctx context.Context, query string) (*sql.Stmt, error) {
+	query, _ = odb.bind(query, nil)
+
+	odb.stmts.mu.Lock()
+	defer odb.stmts.mu.Unlock()
+	if stmt, ok := odb.stmts.stmts[query]; ok {
+		return stmt, nil
+	}
+
+	stmt, err := odb.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	if odb.stmts.stmts == nil {
+		odb.stmts.stmts = make(map[string]*sql.Stmt)
+	}
+	odb.stmts.stmts[query] = stmt
+	return stmt, nil
+}
+
+// closeStmts closes every cached statement. Later calls to prepare start
+// over with an empty cache.
+func (odb *OrderDatabase) closeStmts() error {
+	odb.stmts.mu.Lock()
+	defer odb.stmts.mu.Unlock()
+
+	var errs []error
+	for _, stmt := range odb.stmts.stmts {
+		errs = append(errs, stmt.Close())
+	}
+	odb.stmts.stmts = nil
+	return errors.Join(errs...)
+}
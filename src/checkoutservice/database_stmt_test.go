@@ -0,0 +1,36 @@
+// Copyright 2024
+// Tests for the prepared statement cache
+
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSaveOrderPreparesStatementsOnce(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	ctx := context.Background()
+
+	mock.ExpectPrepare(`INSERT INTO orders`).WillBeClosed()
+	mock.ExpectPrepare(`INSERT INTO order_items`).WillBeClosed()
+	for _, orderID := range []string{"order-1", "order-2"} {
+		_, result, _ := newTestOrder(orderID)
+		expectSaveOrder(mock, result)
+	}
+	mock.ExpectClose()
+
+	for _, orderID := range []string{"order-1", "order-2"} {
+		req, result, total := newTestOrder(orderID)
+		if err := odb.SaveOrder(ctx, req, result, total); err != nil {
+			t.Fatalf("SaveOrder(%s) error = %v", orderID, err)
+		}
+	}
+
+	if err := odb.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if len(odb.stmts.stmts) != 0 {
+		t.Errorf("Close() left %d cached statements, want none", len(odb.stmts.stmts))
+	}
+}
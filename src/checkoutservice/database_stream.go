@@ -0,0 +1,90 @@
+// Copyright 2024
+// Streaming a user's orders without loading them all into memory
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// streamBatchSize is how many orders StreamUserOrders holds in memory at a
+// time.
+const streamBatchSize = 100
+
+// StreamUserOrders calls fn for each of the user's orders, newest first,
+// and stops at the first error fn returns, which is returned as is.
+//
+// Orders are read in keyset-paginated batches of streamBatchSize, with the
+// items of a whole batch loaded in one query, so memory stays flat and a
+// batch costs two queries rather than one per order. Batches are separate
+// queries, not one snapshot: an order saved mid-stream that sorts before
+// the current position is not returned. Only the batch queries are retried;
+// fn is never called twice for the same order. The query timeout applies
+// to each batch rather than the whole stream, which may run as long as fn
+// takes.
+func (odb *OrderDatabase) StreamUserOrders(ctx context.Context, userID string, fn func(*pb.OrderResult) error) (err error) {
+	ctx, span := odb.startSpan(ctx, "StreamUserOrders", attribute.String("user.id", userID))
+	defer func() { endSpan(span, err) }()
+
+	if err = odb.beginOp(); err != nil {
+		return err
+	}
+	defer odb.endOp()
+
+	streamed, err := odb.streamUserOrders(ctx, userID, streamBatchSize, fn)
+	span.SetAttributes(attribute.Int("db.rows_returned", streamed))
+	return err
+}
+
+// streamUserOrders does the work of StreamUserOrders in batches of
+// batchSize and reports how many orders were passed to fn.
+func (odb *OrderDatabase) streamUserOrders(ctx context.Context, userID string, batchSize int, fn func(*pb.OrderResult) error) (int, error) {
+	firstQuery := selectOrdersQuery + `
+		WHERE user_id = $1
+		ORDER BY created_at DESC, order_id DESC
+		LIMIT $2
+	`
+	nextQuery := selectOrdersQuery + `
+		WHERE user_id = $1
+			AND (created_at < $3 OR (created_at = $3 AND order_id < $4))
+		ORDER BY created_at DESC, order_id DESC
+		LIMIT $2
+	`
+
+	streamed := 0
+	var lastCreatedAt time.Time
+	var lastOrderID string
+	for {
+		var batch []*OrderRecord
+		batchCtx, cancel := odb.withQueryTimeout(ctx)
+		err := odb.withReadRetry(batchCtx, "StreamUserOrders", func(q *sql.DB) (err error) {
+			if lastOrderID == "" {
+				batch, err = odb.queryOrders(batchCtx, q, firstQuery, userID, batchSize)
+			} else {
+				batch, err = odb.queryOrders(batchCtx, q, nextQuery, userID, batchSize, lastCreatedAt, lastOrderID)
+			}
+			return err
+		})
+		cancel()
+		if err != nil {
+			return streamed, err
+		}
+
+		for _, record := range batch {
+			if err := fn(record.Order); err != nil {
+				return streamed, err
+			}
+			streamed++
+		}
+		if len(batch) < batchSize {
+			return streamed, nil
+		}
+		last := batch[len(batch)-1]
+		lastCreatedAt, lastOrderID = last.CreatedAt, last.Order.OrderId
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2024
+// Tests for streaming a user's orders
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+func TestStreamUserOrdersPaginatesByKeyset(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+
+	mock.ExpectQuery(`FROM orders\s+WHERE user_id = \$1\s+ORDER BY created_at DESC, order_id DESC\s+LIMIT \$2`).
+		WithArgs("user-1", 2).
+		WillReturnRows(sqlmock.NewRows(orderColumns).
+			AddRow(orderRow("order-3")...).
+			AddRow(orderRow("order-2")...))
+	mock.ExpectQuery(`FROM order_items`).
+		WithArgs(pq.Array([]string{"order-3", "order-2"})).
+		WillReturnRows(sqlmock.NewRows(orderItemColumns).
+			AddRow("order-3", "OLJCESPC7Z", 1, 19, 990000000, "USD"))
+	mock.ExpectQuery(`WHERE user_id = \$1\s+AND \(created_at < \$3 OR \(created_at = \$3 AND order_id < \$4\)\)`).
+		WithArgs("user-1", 2, testOrderTime, "order-2").
+		WillReturnRows(sqlmock.NewRows(orderColumns).
+			AddRow(orderRow("order-1")...))
+	mock.ExpectQuery(`FROM order_items`).
+		WithArgs(pq.Array([]string{"order-1"})).
+		WillReturnRows(sqlmock.NewRows(orderItemColumns))
+
+	var got []string
+	streamed, err := odb.streamUserOrders(context.Background(), "user-1", 2, func(order *pb.OrderResult) error {
+		got = append(got, order.OrderId)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("streamUserOrders() error = %v", err)
+	}
+	if streamed != 3 || len(got) != 3 || got[0] != "order-3" || got[1] != "order-2" || got[2] != "order-1" {
+		t.Errorf("streamUserOrders() streamed %d orders %v, want order-3, order-2, order-1", streamed, got)
+	}
+}
+
+func TestStreamUserOrdersStopsOnCallbackError(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	errStop := errors.New("export aborted")
+
+	mock.ExpectQuery(`FROM orders\s+WHERE user_id = \$1`).
+		WithArgs("user-1", streamBatchSize).
+		WillReturnRows(sqlmock.NewRows(orderColumns).
+			AddRow(orderRow("order-2")...).
+			AddRow(orderRow("order-1")...))
+	mock.ExpectQuery(`FROM order_items`).
+		WillReturnRows(sqlmock.NewRows(orderItemColumns))
+
+	calls := 0
+	err := odb.StreamUserOrders(context.Background(), "user-1", func(*pb.OrderResult) error {
+		calls++
+		return errStop
+	})
+	if !errors.Is(err, errStop) {
+		t.Errorf("StreamUserOrders() error = %v, want the callback's error", err)
+	}
+	if calls != 1 {
+		t.Errorf("callback called %d times, want 1", calls)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2024
+// Schema-qualified and prefixed table names for sharing a database
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// orderTables are the tables queries and migrations use, by their default
+// names. A migration that adds a table must add it here, or WithSchema and
+// WithTablePrefix won't apply to it.
+var orderTables = []string{
+	"orders",
+	"order_items",
+	"order_events",
+	"order_payments",
+	"orders_archive",
+	"order_items_archive",
+	"order_events_archive",
+	"order_payments_archive",
+	"failed_orders",
+	"order_outbox",
+	"schema_migrations",
+}
+
+// maxTablePrefixLength keeps the longest prefixed name, that of an index,
+// within the 63 bytes Postgres allows.
+const maxTablePrefixLength = 24
+
+// maxSchemaLength is the longest identifier Postgres and MySQL allow.
+const maxSchemaLength = 63
+
+var (
+	// identifierPattern is what a schema name or table prefix may be: only
+	// characters that never need quoting, and lowercase since Postgres
+	// folds unquoted names to lowercase.
+	identifierPattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+	// tableNamePattern matches a table name as a whole word, so neither
+	// order_id nor idx_orders_user_id contains "orders".
+	tableNamePattern = regexp.MustCompile(`\b(` + strings.Join(orderTables, "|") + `)\b`)
+	// indexNamePattern matches the name of an index the migrations create.
+	indexNamePattern = regexp.MustCompile(`\bidx_\w+`)
+	// dropIndexPattern matches a Postgres DROP INDEX up to the index name,
+	// which unlike the name in CREATE INDEX has to be schema-qualified.
+	dropIndexPattern = regexp.MustCompile(`(?i)\bDROP INDEX(\s+CONCURRENTLY)?(\s+IF EXISTS)?\s+`)
+)
+
+// tableNames says where the order tables are: in schema, or the default
+// schema if it is empty, with prefix in front of each table and index
+// name.
+type tableNames struct {
+	schema string
+	prefix string
+}
+
+// WithSchema puts the order tables in the named Postgres schema or MySQL
+// database, which EnsureSchema creates if needed, rather than the
+// connection's default, so that tenants sharing a database each get their
+// own. The name must be lowercase letters, digits and underscores, not
+// starting with a digit; NewOrderDatabase rejects an invalid name, and any
+// name on SQLite, which has no schemas.
+func WithSchema(name string) Option {
+	return func(o *dbOptions) { o.tables.schema = name }
+}
+
+// WithTablePrefix prepends prefix to the name of every order table and
+// index, e.g. "tenant_a_" for tenant_a_orders, so that tenants can share a
+// schema. The prefix must be at most 24 lowercase letters, digits and
+// underscores, not starting with a digit; NewOrderDatabase rejects an
+// invalid one. It can be combined with WithSchema.
+func WithTablePrefix(prefix string) Option {
+	return func(o *dbOptions) { o.tables.prefix = prefix }
+}
+
+// validate checks that the schema and prefix are safe to splice into SQL
+// and usable on d.
+func (n tableNames) validate(d dialect) error {
+	if n.schema != "" {
+		if !identifierPattern.MatchString(n.schema) || len(n.schema) > maxSchemaLength {
+			return fmt.Errorf("invalid schema name %q: want at most %d lowercase letters, digits and underscores, not starting with a digit", n.schema, maxSchemaLength)
+		}
+		if !d.supportsSchemas() {
+			return fmt.Errorf("schema %q: %s has no schemas, use a table prefix instead", n.schema, d.system())
+		}
+	}
+	if n.prefix != "" && (!identifierPattern.MatchString(n.prefix) || len(n.prefix) > maxTablePrefixLength) {
+		return fmt.Errorf("invalid table prefix %q: want at most %d lowercase letters, digits and underscores, not starting with a digit", n.prefix, maxTablePrefixLength)
+	}
+	return nil
+}
+
+// table returns the configured name of the table named name by default.
+func (n tableNames) table(name string) string {
+	if n.schema == "" {
+		return n.prefix + name
+	}
+	return n.schema + "." + n.prefix + name
+}
+
+// qualify rewrites the table and index names in query, written with the
+// default names, to the configured ones.
+func (n tableNames) qualify(query string) string {
+	if n.schema == "" && n.prefix == "" {
+		return query
+	}
+	if n.prefix != "" {
+		query = indexNamePattern.ReplaceAllStringFunc(query, func(name string) string { return n.prefix + name })
+	}
+	if n.schema != "" {
+		query = dropIndexPattern.ReplaceAllString(query, "${0}"+n.schema+".")
+	}
+	return tableNamePattern.ReplaceAllStringFunc(query, n.table)
+}
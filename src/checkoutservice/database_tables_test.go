@@ -0,0 +1,208 @@
+// Copyright 2024
+// Tests for schema-qualified and prefixed table names
+
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+func TestTableNamesQualify(t *testing.T) {
+	query := `SELECT o.order_id FROM orders o JOIN order_items i ON i.order_id = o.order_id WHERE o.order_id IN (SELECT order_id FROM orders_archive)`
+	tests := []struct {
+		name   string
+		tables tableNames
+		query  string
+		want   string
+	}{
+		{"default", tableNames{}, query, query},
+		{"prefix", tableNames{prefix: "tenant_a_"}, query,
+			`SELECT o.order_id FROM tenant_a_orders o JOIN tenant_a_order_items i ON i.order_id = o.order_id WHERE o.order_id IN (SELECT order_id FROM tenant_a_orders_archive)`},
+		{"schema", tableNames{schema: "checkout"}, query,
+			`SELECT o.order_id FROM checkout.orders o JOIN checkout.order_items i ON i.order_id = o.order_id WHERE o.order_id IN (SELECT order_id FROM checkout.orders_archive)`},
+		{"index with prefix", tableNames{prefix: "tenant_a_"},
+			`CREATE INDEX IF NOT EXISTS idx_orders_user_id ON orders(user_id)`,
+			`CREATE INDEX IF NOT EXISTS tenant_a_idx_orders_user_id ON tenant_a_orders(user_id)`},
+		{"index with schema", tableNames{schema: "checkout", prefix: "tenant_a_"},
+			`CREATE INDEX IF NOT EXISTS idx_orders_user_id ON orders(user_id)`,
+			`CREATE INDEX IF NOT EXISTS tenant_a_idx_orders_user_id ON checkout.tenant_a_orders(user_id)`},
+		{"drop index with schema", tableNames{schema: "checkout", prefix: "tenant_a_"},
+			`DROP INDEX CONCURRENTLY IF EXISTS idx_orders_user_id`,
+			`DROP INDEX CONCURRENTLY IF EXISTS checkout.tenant_a_idx_orders_user_id`},
+		{"foreign key", tableNames{schema: "checkout"},
+			`order_id VARCHAR(255) NOT NULL REFERENCES orders(order_id) ON DELETE CASCADE`,
+			`order_id VARCHAR(255) NOT NULL REFERENCES checkout.orders(order_id) ON DELETE CASCADE`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.tables.qualify(tt.query); got != tt.want {
+				t.Errorf("qualify() = %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTableNamesValidate(t *testing.T) {
+	valid := []tableNames{
+		{},
+		{prefix: "tenant_a_"},
+		{schema: "checkout"},
+		{schema: "checkout", prefix: "_t1_"},
+	}
+	for _, tables := range valid {
+		if err := tables.validate(postgresDialect{}); err != nil {
+			t.Errorf("validate(%+v) error = %v", tables, err)
+		}
+	}
+
+	invalid := []tableNames{
+		{prefix: "tenant_a; DROP TABLE orders; --"},
+		{prefix: `tenant"_`},
+		{prefix: "tenant-a_"},
+		{prefix: "checkout.tenant_"},
+		{prefix: "TenantA_"},
+		{prefix: "1tenant_"},
+		{prefix: "tenant_a_ "},
+		{prefix: strings.Repeat("t", maxTablePrefixLength+1)},
+		{schema: "checkout; DROP SCHEMA public CASCADE"},
+		{schema: "check out"},
+		{schema: strings.Repeat("s", maxSchemaLength+1)},
+	}
+	for _, tables := range invalid {
+		if err := tables.validate(postgresDialect{}); err == nil {
+			t.Errorf("validate(%+v) error = nil, want the name rejected", tables)
+		}
+	}
+
+	if err := (tableNames{schema: "checkout"}).validate(sqliteDialect{}); err == nil {
+		t.Error("validate() of a schema on SQLite error = nil, want an error")
+	}
+	if err := (tableNames{schema: "checkout"}).validate(mysqlDialect{}); err != nil {
+		t.Errorf("validate() of a schema on MySQL error = %v", err)
+	}
+}
+
+func TestNewOrderDatabaseRejectsMaliciousTablePrefix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "orders.db")
+	odb, err := NewOrderDatabase(sqliteScheme+path, WithTablePrefix("x; DROP TABLE orders; --"))
+	if err == nil {
+		odb.Close()
+		t.Fatal("NewOrderDatabase() error = nil, want the prefix rejected")
+	}
+	if !strings.Contains(err.Error(), "invalid table prefix") {
+		t.Errorf("NewOrderDatabase() error = %v, want it to name the prefix", err)
+	}
+}
+
+// TestMigrationTablesAreKnown checks that every table the migrations create
+// is in orderTables, so that WithSchema and WithTablePrefix rename it, and
+// that a qualified migration mentions no default name.
+func TestMigrationTablesAreKnown(t *testing.T) {
+	known := make(map[string]bool, len(orderTables))
+	for _, table := range orderTables {
+		known[table] = true
+	}
+	createTable := regexp.MustCompile(`(?i)CREATE TABLE IF NOT EXISTS (\w+)`)
+	tables := tableNames{schema: "checkout", prefix: "tenant_a_"}
+
+	for _, d := range []dialect{postgresDialect{}, sqliteDialect{}, mysqlDialect{}} {
+		migrations, err := loadMigrations(d.migrations())
+		if err != nil {
+			t.Fatalf("loadMigrations(%s) error = %v", d.system(), err)
+		}
+		for _, m := range migrations {
+			for _, stmt := range splitStatements(m.sql) {
+				for _, match := range createTable.FindAllStringSubmatch(stmt, -1) {
+					if !known[match[1]] {
+						t.Errorf("%s migration %s creates table %s, which orderTables is missing", d.system(), m.version, match[1])
+					}
+				}
+				qualified := tables.qualify(stmt)
+				if name := tableNamePattern.FindString(qualified); name != "" {
+					t.Errorf("%s migration %s still mentions %s once qualified: %s", d.system(), m.version, name, qualified)
+				}
+				if name := indexNamePattern.FindString(qualified); name != "" {
+					t.Errorf("%s migration %s still mentions index %s once qualified: %s", d.system(), m.version, name, qualified)
+				}
+			}
+		}
+	}
+}
+
+func TestQueriesUseQualifiedTables(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	odb.opts.tables = tableNames{schema: "checkout", prefix: "tenant_a_"}
+	req, result, total := newTestOrder("order-1")
+
+	mock.ExpectPrepare(`INSERT INTO checkout\.tenant_a_orders \(`)
+	mock.ExpectPrepare(`INSERT INTO checkout\.tenant_a_order_items \(`)
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO checkout\.tenant_a_orders \(`).WillReturnResult(sqlmock.NewResult(1, 1))
+	for range result.Items {
+		mock.ExpectExec(`INSERT INTO checkout\.tenant_a_order_items \(`).WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectExec(`INSERT INTO checkout\.tenant_a_order_outbox \(`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	if err := odb.SaveOrder(context.Background(), req, result, total); err != nil {
+		t.Fatalf("SaveOrder() error = %v", err)
+	}
+
+	mock.ExpectQuery(`FROM checkout\.tenant_a_orders\s+WHERE order_id = \$1`).
+		WillReturnRows(sqlmock.NewRows(orderColumns).AddRow(orderRow("order-1")...))
+	mock.ExpectQuery(`FROM checkout\.tenant_a_order_items`).WillReturnRows(sqlmock.NewRows(orderItemColumns))
+	mock.ExpectQuery(`FROM checkout\.tenant_a_order_payments\s+WHERE order_id = \$1`).WillReturnRows(sqlmock.NewRows(paymentColumns))
+	if _, err := odb.GetOrder(context.Background(), "order-1"); err != nil {
+		t.Fatalf("GetOrder() error = %v", err)
+	}
+
+	mock.ExpectQuery(`FROM checkout\.tenant_a_orders\s+WHERE user_id = \$1`).
+		WillReturnRows(sqlmock.NewRows(orderColumns).AddRow(orderRow("order-1")...))
+	mock.ExpectQuery(`FROM checkout\.tenant_a_order_items`).
+		WithArgs(pq.Array([]string{"order-1"})).
+		WillReturnRows(sqlmock.NewRows(orderItemColumns))
+	if _, err := odb.GetUserOrders(context.Background(), "user-1"); err != nil {
+		t.Fatalf("GetUserOrders() error = %v", err)
+	}
+}
+
+func TestEnsureSchemaCreatesQualifiedTables(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	odb.opts.tables = tableNames{schema: "checkout", prefix: "tenant_a_"}
+	migrations, err := loadMigrations(postgresMigrations, "migrations/postgres")
+	if err != nil {
+		t.Fatalf("loadMigrations() error = %v", err)
+	}
+
+	applied := sqlmock.NewRows([]string{"version"})
+	for _, m := range migrations {
+		if m.version != "0016_add_order_outbox" {
+			applied.AddRow(m.version)
+		}
+	}
+
+	mock.ExpectQuery(`SELECT pg_try_advisory_lock\(\$1\)`).WithArgs(schemaLockID).
+		WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_lock"}).AddRow(true))
+	mock.ExpectExec(`CREATE SCHEMA IF NOT EXISTS checkout$`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS checkout\.tenant_a_schema_migrations \(`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT version FROM checkout\.tenant_a_schema_migrations`).WillReturnRows(applied)
+	mock.ExpectBegin()
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS checkout\.tenant_a_order_outbox \(.*REFERENCES checkout\.tenant_a_orders\(order_id\)`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`CREATE INDEX IF NOT EXISTS tenant_a_idx_order_outbox_unpublished\s+ON checkout\.tenant_a_order_outbox`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO checkout\.tenant_a_schema_migrations \(version\) VALUES \(\$1\)`).
+		WithArgs("0016_add_order_outbox").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(`SELECT pg_advisory_unlock\(\$1\)`).WithArgs(schemaLockID).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := odb.EnsureSchema(context.Background()); err != nil {
+		t.Errorf("EnsureSchema() error = %v", err)
+	}
+}
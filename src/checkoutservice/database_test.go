@@ -0,0 +1,889 @@
+// Copyright 2024
+// Tests for the order persistence layer
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+var orderColumns = []string{
+	"order_id", "shipping_tracking_id",
+	"total_amount_units", "total_amount_nanos", "total_amount_currency",
+	"shipping_cost_units", "shipping_cost_nanos", "shipping_cost_currency",
+	"shipping_address_street", "shipping_address_city",
+	"shipping_address_state", "shipping_address_country",
+	"shipping_address_zip", "status", "created_at", "updated_at",
+	"cancelled_at", "cancellation_reason", "version",
+}
+
+// orderColumn returns the index of name in orderColumns.
+func orderColumn(name string) int {
+	for i, column := range orderColumns {
+		if column == name {
+			return i
+		}
+	}
+	panic("unknown order column " + name)
+}
+
+// testOrderTime is the created_at and updated_at of orders in fixture rows.
+var testOrderTime = time.Date(2024, 3, 14, 15, 9, 26, 0, time.UTC)
+
+var orderItemColumns = []string{"order_id", "product_id", "quantity", "cost_units", "cost_nanos", "cost_currency"}
+
+func newTestOrder(orderID string) (*pb.PlaceOrderRequest, *pb.OrderResult, *pb.Money) {
+	address := &pb.Address{
+		StreetAddress: "1600 Amphitheatre Pkwy",
+		City:          "Mountain View",
+		State:         "CA",
+		Country:       "USA",
+		ZipCode:       94043,
+	}
+	req := &pb.PlaceOrderRequest{
+		UserId:       "user-1",
+		UserCurrency: "USD",
+		Email:        "someone@example.com",
+		Address:      address,
+	}
+	result := &pb.OrderResult{
+		OrderId:            orderID,
+		ShippingTrackingId: "track-" + orderID,
+		ShippingCost:       &pb.Money{CurrencyCode: "USD", Units: 8, Nanos: 990000000},
+		ShippingAddress:    address,
+		Items: []*pb.OrderItem{
+			{
+				Item: &pb.CartItem{ProductId: "OLJCESPC7Z", Quantity: 1},
+				Cost: &pb.Money{CurrencyCode: "USD", Units: 19, Nanos: 990000000},
+			},
+			{
+				Item: &pb.CartItem{ProductId: "66VCHSJNUP", Quantity: 2},
+				Cost: &pb.Money{CurrencyCode: "USD", Units: 34, Nanos: 990000000},
+			},
+		},
+	}
+	total := &pb.Money{CurrencyCode: "USD", Units: 98, Nanos: 960000000}
+	return req, result, total
+}
+
+// orderRow is the orders row of the newTestOrder fixture with the given ID.
+func orderRow(orderID string) []driver.Value {
+	req, result, total := newTestOrder(orderID)
+	return []driver.Value{
+		result.OrderId, result.ShippingTrackingId,
+		total.Units, total.Nanos, total.CurrencyCode,
+		result.ShippingCost.Units, result.ShippingCost.Nanos, result.ShippingCost.CurrencyCode,
+		req.Address.StreetAddress, req.Address.City,
+		req.Address.State, req.Address.Country,
+		req.Address.ZipCode, string(OrderStatusPaid),
+		testOrderTime, testOrderTime,
+		nil, nil, int64(1),
+	}
+}
+
+// expectPrepareSaveOrder registers the statements the first SaveOrder call
+// on an OrderDatabase prepares. Later calls reuse them.
+func expectPrepareSaveOrder(mock sqlmock.Sqlmock) {
+	mock.ExpectPrepare(`INSERT INTO orders`)
+	mock.ExpectPrepare(`INSERT INTO order_items`)
+}
+
+// expectSaveOrder registers the statements of a successful SaveOrder call.
+func expectSaveOrder(mock sqlmock.Sqlmock, result *pb.OrderResult) {
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO orders`).WillReturnResult(sqlmock.NewResult(1, 1))
+	for range result.Items {
+		mock.ExpectExec(`INSERT INTO order_items`).WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	expectOutboxEvent(mock, result.OrderId)
+	mock.ExpectCommit()
+}
+
+// expectOutboxEvent registers the OutboxOrderPlaced event SaveOrder writes
+// before committing.
+func expectOutboxEvent(mock sqlmock.Sqlmock, orderID string) {
+	mock.ExpectExec(`INSERT INTO order_outbox \(order_id, event_type, payload, created_at\)`).
+		WithArgs(orderID, OutboxOrderPlaced, sqlmock.AnyArg(), recentUTC{}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+// expectStoredOrder registers the lookup SaveOrder does after a duplicate
+// order ID, returning the given order as the stored one.
+func expectStoredOrder(mock sqlmock.Sqlmock, req *pb.PlaceOrderRequest, result *pb.OrderResult, total *pb.Money) {
+	mock.ExpectQuery(`SELECT\s+user_id, user_email.*FROM orders\s+WHERE order_id = \$1`).
+		WithArgs(result.OrderId).
+		WillReturnRows(sqlmock.NewRows([]string{
+			"user_id", "user_email", "user_currency", "shipping_tracking_id",
+			"total_amount_units", "total_amount_nanos", "total_amount_currency",
+			"shipping_cost_units", "shipping_cost_nanos", "shipping_cost_currency",
+			"shipping_address_street", "shipping_address_city",
+			"shipping_address_state", "shipping_address_country",
+			"shipping_address_zip",
+		}).AddRow(
+			req.UserId, req.Email, req.UserCurrency, result.ShippingTrackingId,
+			total.Units, total.Nanos, total.CurrencyCode,
+			result.ShippingCost.Units, result.ShippingCost.Nanos, result.ShippingCost.CurrencyCode,
+			req.Address.StreetAddress, req.Address.City,
+			req.Address.State, req.Address.Country,
+			req.Address.ZipCode,
+		))
+	items := sqlmock.NewRows(orderItemColumns)
+	for _, item := range result.Items {
+		items.AddRow(result.OrderId, item.Item.ProductId, item.Item.Quantity, item.Cost.Units, item.Cost.Nanos, item.Cost.CurrencyCode)
+	}
+	mock.ExpectQuery(`FROM order_items`).WithArgs(pq.Array([]string{result.OrderId})).WillReturnRows(items)
+}
+
+var paymentColumns = []string{"card_last_four", "card_type", "payment_processor_txn_id", "authorized"}
+
+// expectNoPayment registers the order_payments lookup of GetOrder for an
+// order saved without a payment.
+func expectNoPayment(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(`FROM order_payments\s+WHERE order_id = \$1`).WillReturnRows(sqlmock.NewRows(paymentColumns))
+}
+
+func newMockOrderDatabase(t *testing.T) (*OrderDatabase, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("unmet sqlmock expectations: %v", err)
+		}
+		db.Close()
+	})
+	return newOrderDatabase(db, postgresDialect{}, defaultDBOptions()), mock
+}
+
+func TestGetUserOrdersGroupsItemsByOrder(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+
+	mock.ExpectQuery(`FROM orders\s+WHERE user_id = \$1\s+ORDER BY created_at DESC`).
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows(orderColumns).
+			AddRow(orderRow("order-3")...).
+			AddRow(orderRow("order-2")...).
+			AddRow(orderRow("order-1")...))
+
+	// order-2 has no items and must still be returned.
+	mock.ExpectQuery(`FROM order_items\s+WHERE order_id = ANY\(\$1\)`).
+		WithArgs(pq.Array([]string{"order-3", "order-2", "order-1"})).
+		WillReturnRows(sqlmock.NewRows(orderItemColumns).
+			AddRow("order-1", "OLJCESPC7Z", 1, 19, 990000000, "USD").
+			AddRow("order-1", "66VCHSJNUP", 2, 34, 990000000, "USD").
+			AddRow("order-3", "1YMWWN1N4O", 1, 109, 990000000, "USD").
+			AddRow("order-3", "L9ECAV7KIM", 3, 89, 990000000, "USD").
+			AddRow("order-3", "2ZYFJ3GM2N", 2, 24, 990000000, "USD"))
+
+	orders, err := odb.GetUserOrders(context.Background(), "user-1")
+	if err != nil {
+		t.Fatalf("GetUserOrders() error = %v", err)
+	}
+
+	want := []struct {
+		orderID    string
+		productIDs []string
+	}{
+		{"order-3", []string{"1YMWWN1N4O", "L9ECAV7KIM", "2ZYFJ3GM2N"}},
+		{"order-2", nil},
+		{"order-1", []string{"OLJCESPC7Z", "66VCHSJNUP"}},
+	}
+	if len(orders) != len(want) {
+		t.Fatalf("GetUserOrders() returned %d orders, want %d", len(orders), len(want))
+	}
+	for i, w := range want {
+		order := orders[i].Order
+		if order.OrderId != w.orderID {
+			t.Errorf("orders[%d].OrderId = %q, want %q", i, order.OrderId, w.orderID)
+		}
+		if len(order.Items) != len(w.productIDs) {
+			t.Errorf("order %s has %d items, want %d", order.OrderId, len(order.Items), len(w.productIDs))
+			continue
+		}
+		for j, productID := range w.productIDs {
+			if got := order.Items[j].GetItem().GetProductId(); got != productID {
+				t.Errorf("order %s item %d product = %q, want %q", order.OrderId, j, got, productID)
+			}
+		}
+	}
+}
+
+func TestGetUserOrdersWithoutOrdersSkipsItemQuery(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+
+	mock.ExpectQuery(`FROM orders\s+WHERE user_id = \$1`).
+		WithArgs("user-without-orders").
+		WillReturnRows(sqlmock.NewRows(orderColumns))
+
+	orders, err := odb.GetUserOrders(context.Background(), "user-without-orders")
+	if err != nil {
+		t.Fatalf("GetUserOrders() error = %v", err)
+	}
+	if len(orders) != 0 {
+		t.Errorf("GetUserOrders() returned %d orders, want 0", len(orders))
+	}
+}
+
+func TestGetUserOrdersFailsIfItemsCantBeLoaded(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	errBoom := errors.New("boom")
+
+	mock.ExpectQuery(`FROM orders\s+WHERE user_id = \$1`).
+		WillReturnRows(sqlmock.NewRows(orderColumns).AddRow(orderRow("order-1")...))
+	mock.ExpectQuery(`FROM order_items`).WillReturnError(errBoom)
+
+	if orders, err := odb.GetUserOrders(context.Background(), "user-1"); !errors.Is(err, errBoom) {
+		t.Errorf("GetUserOrders() = %v, %v, want error %v", orders, err, errBoom)
+	}
+}
+
+func TestGetUserOrdersPartialKeepsOrdersWhoseItemsFailed(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	errBoom := errors.New("boom")
+
+	mock.ExpectQuery(`FROM orders\s+WHERE user_id = \$1\s+ORDER BY created_at DESC`).
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows(orderColumns).
+			AddRow(orderRow("order-3")...).
+			AddRow(orderRow("order-2")...).
+			AddRow(orderRow("order-1")...))
+	// The single query for all the items fails, so they are loaded order by
+	// order, and only order-2's fail.
+	mock.ExpectQuery(`FROM order_items`).
+		WithArgs(pq.Array([]string{"order-3", "order-2", "order-1"})).
+		WillReturnError(errBoom)
+	mock.ExpectQuery(`FROM order_items`).
+		WithArgs(pq.Array([]string{"order-3"})).
+		WillReturnRows(sqlmock.NewRows(orderItemColumns).AddRow("order-3", "1YMWWN1N4O", 1, 109, 990000000, "USD"))
+	mock.ExpectQuery(`FROM order_items`).
+		WithArgs(pq.Array([]string{"order-2"})).
+		WillReturnError(errBoom)
+	mock.ExpectQuery(`FROM order_items`).
+		WithArgs(pq.Array([]string{"order-1"})).
+		WillReturnRows(sqlmock.NewRows(orderItemColumns).AddRow("order-1", "OLJCESPC7Z", 1, 19, 990000000, "USD"))
+
+	orders, err := odb.GetUserOrdersPartial(context.Background(), "user-1")
+	if err != nil {
+		t.Fatalf("GetUserOrdersPartial() error = %v", err)
+	}
+	if len(orders) != 3 {
+		t.Fatalf("GetUserOrdersPartial() returned %d orders, want 3", len(orders))
+	}
+	for _, record := range []*OrderRecord{orders[0], orders[2]} {
+		if record.ItemsError != nil || len(record.Order.Items) != 1 {
+			t.Errorf("order %s items = %v, ItemsError = %v, want its item", record.Order.OrderId, record.Order.Items, record.ItemsError)
+		}
+	}
+	if failed := orders[1]; !errors.Is(failed.ItemsError, errBoom) || len(failed.Order.Items) != 0 {
+		t.Errorf("order %s items = %v, ItemsError = %v, want no items and %v", failed.Order.OrderId, failed.Order.Items, failed.ItemsError, errBoom)
+	}
+}
+
+func TestGetUserOrdersPartialFailsIfOrdersCantBeRead(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	errBoom := errors.New("boom")
+
+	mock.ExpectQuery(`FROM orders\s+WHERE user_id = \$1`).WillReturnError(errBoom)
+
+	if _, err := odb.GetUserOrdersPartial(context.Background(), "user-1"); !errors.Is(err, errBoom) {
+		t.Errorf("GetUserOrdersPartial() error = %v, want %v", err, errBoom)
+	}
+}
+
+func TestGetLatestOrderLoadsOnlyTheNewestOrder(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+
+	mock.ExpectQuery(`FROM orders\s+WHERE user_id = \$1\s+ORDER BY created_at DESC, order_id DESC\s+LIMIT 1`).
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows(orderColumns).AddRow(orderRow("order-3")...))
+	mock.ExpectQuery(`FROM order_items`).
+		WithArgs(pq.Array([]string{"order-3"})).
+		WillReturnRows(sqlmock.NewRows(orderItemColumns).
+			AddRow("order-3", "1YMWWN1N4O", 1, 109, 990000000, "USD").
+			AddRow("order-3", "L9ECAV7KIM", 3, 89, 990000000, "USD"))
+
+	order, err := odb.GetLatestOrder(context.Background(), "user-1")
+	if err != nil {
+		t.Fatalf("GetLatestOrder() error = %v", err)
+	}
+	if order.OrderId != "order-3" || len(order.Items) != 2 {
+		t.Errorf("GetLatestOrder() = %v, want order-3 with 2 items", order)
+	}
+}
+
+func TestGetLatestOrderWithoutOrders(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+
+	mock.ExpectQuery(`FROM orders\s+WHERE user_id = \$1`).
+		WithArgs("user-without-orders").
+		WillReturnRows(sqlmock.NewRows(orderColumns))
+
+	if order, err := odb.GetLatestOrder(context.Background(), "user-without-orders"); !errors.Is(err, ErrOrderNotFound) {
+		t.Errorf("GetLatestOrder() = %v, %v, want ErrOrderNotFound", order, err)
+	}
+}
+
+func TestGetUserOrdersPaged(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM orders WHERE user_id = \$1`).
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(250))
+	mock.ExpectQuery(`FROM orders\s+WHERE user_id = \$1\s+ORDER BY created_at DESC, order_id DESC\s+LIMIT \$2 OFFSET \$3`).
+		WithArgs("user-1", maxOrdersPageSize, 200).
+		WillReturnRows(sqlmock.NewRows(orderColumns).
+			AddRow(orderRow("order-50")...))
+	mock.ExpectQuery(`FROM order_items`).
+		WithArgs(pq.Array([]string{"order-50"})).
+		WillReturnRows(sqlmock.NewRows(orderItemColumns).
+			AddRow("order-50", "OLJCESPC7Z", 1, 19, 990000000, "USD"))
+	mock.ExpectCommit()
+
+	orders, total, err := odb.GetUserOrdersPaged(context.Background(), "user-1", 1000, 200)
+	if err != nil {
+		t.Fatalf("GetUserOrdersPaged() error = %v", err)
+	}
+	if total != 250 {
+		t.Errorf("GetUserOrdersPaged() total = %d, want 250", total)
+	}
+	if len(orders) != 1 || orders[0].Order.OrderId != "order-50" || len(orders[0].Order.Items) != 1 {
+		t.Errorf("GetUserOrdersPaged() orders = %v, want order-50 with one item", orders)
+	}
+}
+
+func TestCountUserOrders(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM orders WHERE user_id = \$1`).
+		WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(12))
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM orders WHERE user_id = \$1`).
+		WithArgs("user-2").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+	ctx := context.Background()
+	if got, err := odb.CountUserOrders(ctx, "user-1"); err != nil || got != 12 {
+		t.Errorf("CountUserOrders(user-1) = %d, %v, want 12, nil", got, err)
+	}
+	if got, err := odb.CountUserOrders(ctx, "user-2"); err != nil || got != 0 {
+		t.Errorf("CountUserOrders(user-2) = %d, %v, want 0, nil", got, err)
+	}
+}
+
+func TestGetUserOrdersPagedRejectsInvalidBounds(t *testing.T) {
+	tests := []struct {
+		name          string
+		limit, offset int
+	}{
+		{"zero limit", 0, 0},
+		{"negative limit", -5, 0},
+		{"negative offset", 10, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			odb, _ := newMockOrderDatabase(t)
+			if _, _, err := odb.GetUserOrdersPaged(context.Background(), "user-1", tt.limit, tt.offset); err == nil {
+				t.Errorf("GetUserOrdersPaged(limit=%d, offset=%d) error = nil, want error", tt.limit, tt.offset)
+			}
+		})
+	}
+}
+
+func TestBatchGetOrdersSkipsMissingIDs(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+
+	ids := []string{"order-1", "missing", "order-2"}
+	mock.ExpectQuery(`FROM orders\s+WHERE order_id = ANY\(\$1\)`).
+		WithArgs(pq.Array(ids)).
+		WillReturnRows(sqlmock.NewRows(orderColumns).
+			AddRow(orderRow("order-1")...).
+			AddRow(orderRow("order-2")...))
+	mock.ExpectQuery(`FROM order_items`).
+		WithArgs(pq.Array([]string{"order-1", "order-2"})).
+		WillReturnRows(sqlmock.NewRows(orderItemColumns).
+			AddRow("order-1", "OLJCESPC7Z", 2, 19, 990000000, "USD").
+			AddRow("order-2", "66VCHSJNUP", 1, 349, 950000000, "USD").
+			AddRow("order-2", "1YMWWN1N4O", 3, 109, 990000000, "USD"))
+
+	orders, err := odb.BatchGetOrders(context.Background(), ids)
+	if err != nil {
+		t.Fatalf("BatchGetOrders() error = %v", err)
+	}
+	if len(orders) != 2 {
+		t.Fatalf("BatchGetOrders() returned %d orders, want 2", len(orders))
+	}
+	if _, ok := orders["missing"]; ok {
+		t.Error("BatchGetOrders() returned an entry for a missing ID")
+	}
+	if got := len(orders["order-1"].Order.Items); got != 1 {
+		t.Errorf("order-1 has %d items, want 1", got)
+	}
+	if got := len(orders["order-2"].Order.Items); got != 2 {
+		t.Errorf("order-2 has %d items, want 2", got)
+	}
+}
+
+func TestBatchGetOrdersWithoutIDsSkipsQuery(t *testing.T) {
+	odb, _ := newMockOrderDatabase(t)
+
+	orders, err := odb.BatchGetOrders(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("BatchGetOrders() error = %v", err)
+	}
+	if len(orders) != 0 {
+		t.Errorf("BatchGetOrders() returned %d orders, want none", len(orders))
+	}
+}
+
+func TestGetOrderNotFound(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+
+	mock.ExpectQuery(`FROM orders\s+WHERE order_id = \$1`).
+		WithArgs("missing").
+		WillReturnRows(sqlmock.NewRows(orderColumns))
+
+	_, err := odb.GetOrder(context.Background(), "missing")
+	if !errors.Is(err, ErrOrderNotFound) {
+		t.Errorf("GetOrder() error = %v, want ErrOrderNotFound", err)
+	}
+	if errors.Is(err, ErrDatabaseUnavailable) {
+		t.Errorf("GetOrder() error = %v, should not report the database as unavailable", err)
+	}
+}
+
+// expectLockOrderStatus expects the status and version of order-1 to be
+// read under a row lock, at the start of a transaction.
+func expectLockOrderStatus(mock sqlmock.Sqlmock, status OrderStatus, version int64) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT status, version FROM orders WHERE order_id = \$1 FOR UPDATE`).
+		WithArgs("order-1").
+		WillReturnRows(sqlmock.NewRows([]string{"status", "version"}).AddRow(string(status), version))
+}
+
+func TestUpdateOrderStatusNotFound(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT status, version FROM orders`).
+		WithArgs("missing").
+		WillReturnRows(sqlmock.NewRows([]string{"status", "version"}))
+	mock.ExpectRollback()
+
+	err := odb.UpdateOrderStatus(context.Background(), "missing", OrderStatusShipped)
+	if !errors.Is(err, ErrOrderNotFound) {
+		t.Errorf("UpdateOrderStatus() error = %v, want ErrOrderNotFound", err)
+	}
+}
+
+func TestUpdateOrderStatus(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+
+	expectLockOrderStatus(mock, OrderStatusPaid, 1)
+	mock.ExpectExec(`UPDATE orders\s+SET status = \$1, updated_at = \$2, version = version \+ 1\s+WHERE order_id = \$3 AND status = ANY\(\$4\)$`).
+		WithArgs("SHIPPED", recentUTC{}, "order-1", pq.Array([]string{"PAID"})).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO order_events`).
+		WithArgs("order-1", "STATUS_CHANGED", "PAID", "SHIPPED", "", recentUTC{}, "fulfilment").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	ctx := WithActor(context.Background(), "fulfilment")
+	if err := odb.UpdateOrderStatus(ctx, "order-1", OrderStatusShipped); err != nil {
+		t.Errorf("UpdateOrderStatus() error = %v", err)
+	}
+}
+
+func TestUpdateOrderStatusRejectsInvalidTransition(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+
+	expectLockOrderStatus(mock, OrderStatusCancelled, 3)
+	mock.ExpectExec(`UPDATE orders`).
+		WithArgs("PENDING", sqlmock.AnyArg(), "order-1", pq.Array([]string(nil))).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	err := odb.UpdateOrderStatus(context.Background(), "order-1", OrderStatusPending)
+	if !errors.Is(err, ErrInvalidStatusTransition) {
+		t.Errorf("UpdateOrderStatus() error = %v, want ErrInvalidStatusTransition", err)
+	}
+}
+
+func TestUpdateOrderStatusAtVersion(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+
+	expectLockOrderStatus(mock, OrderStatusPaid, 2)
+	mock.ExpectExec(`WHERE order_id = \$3 AND status = ANY\(\$4\) AND version = \$5`).
+		WithArgs("SHIPPED", sqlmock.AnyArg(), "order-1", pq.Array([]string{"PAID"}), int64(2)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO order_events`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if err := odb.UpdateOrderStatusAtVersion(context.Background(), "order-1", 2, OrderStatusShipped); err != nil {
+		t.Errorf("UpdateOrderStatusAtVersion() error = %v", err)
+	}
+}
+
+func TestUpdateOrderStatusAtStaleVersionFails(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+
+	expectLockOrderStatus(mock, OrderStatusPaid, 3)
+	mock.ExpectExec(`AND version = \$5`).
+		WithArgs("SHIPPED", sqlmock.AnyArg(), "order-1", pq.Array([]string{"PAID"}), int64(2)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	err := odb.UpdateOrderStatusAtVersion(context.Background(), "order-1", 2, OrderStatusShipped)
+	if !errors.Is(err, ErrConcurrentModification) {
+		t.Errorf("UpdateOrderStatusAtVersion() error = %v, want ErrConcurrentModification", err)
+	}
+}
+
+func TestUpdateOrderStatusRejectsUnknownStatus(t *testing.T) {
+	odb, _ := newMockOrderDatabase(t)
+
+	if err := odb.UpdateOrderStatus(context.Background(), "order-1", OrderStatus("LOST")); err == nil {
+		t.Error("UpdateOrderStatus() error = nil, want error for unknown status")
+	}
+}
+
+func TestCancelOrder(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT status FROM orders WHERE order_id = \$1 FOR UPDATE`).
+		WithArgs("order-1").
+		WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("PAID"))
+	mock.ExpectExec(`UPDATE orders\s+SET status = \$1, cancelled_at = \$2, cancellation_reason = \$3`).
+		WithArgs("CANCELLED", recentUTC{}, "changed my mind", "order-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO order_events`).
+		WithArgs("order-1", "CANCELLED", "PAID", "CANCELLED", "changed my mind", recentUTC{}, nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if err := odb.CancelOrder(context.Background(), "order-1", "changed my mind"); err != nil {
+		t.Fatalf("CancelOrder() error = %v", err)
+	}
+
+	cancelledAt := testOrderTime.Add(time.Minute)
+	row := orderRow("order-1")
+	row[orderColumn("status")] = "CANCELLED"
+	row[orderColumn("cancelled_at")] = cancelledAt
+	row[orderColumn("cancellation_reason")] = "changed my mind"
+	mock.ExpectQuery(`FROM orders\s+WHERE order_id = \$1`).
+		WillReturnRows(sqlmock.NewRows(orderColumns).AddRow(row...))
+	mock.ExpectQuery(`FROM order_items`).WillReturnRows(sqlmock.NewRows(orderItemColumns))
+	expectNoPayment(mock)
+
+	got, err := odb.GetOrder(context.Background(), "order-1")
+	if err != nil {
+		t.Fatalf("GetOrder() error = %v", err)
+	}
+	if got.Status != OrderStatusCancelled || !got.CancelledAt.Equal(cancelledAt) || got.CancellationReason != "changed my mind" {
+		t.Errorf("GetOrder() = status %s, cancelled at %v, reason %q; want the cancellation", got.Status, got.CancelledAt, got.CancellationReason)
+	}
+}
+
+func TestCancelOrderRejectsShippedOrder(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT status FROM orders WHERE order_id = \$1 FOR UPDATE`).
+		WithArgs("order-1").
+		WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("SHIPPED"))
+	mock.ExpectRollback()
+
+	err := odb.CancelOrder(context.Background(), "order-1", "too late")
+	if !errors.Is(err, ErrOrderNotCancellable) {
+		t.Errorf("CancelOrder() error = %v, want ErrOrderNotCancellable", err)
+	}
+}
+
+func TestCancelOrderNotFound(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT status FROM orders WHERE order_id = \$1 FOR UPDATE`).
+		WithArgs("missing").
+		WillReturnRows(sqlmock.NewRows([]string{"status"}))
+	mock.ExpectRollback()
+
+	err := odb.CancelOrder(context.Background(), "missing", "")
+	if !errors.Is(err, ErrOrderNotFound) {
+		t.Errorf("CancelOrder() error = %v, want ErrOrderNotFound", err)
+	}
+}
+
+func TestSaveOrderTwiceWithIdenticalPayloadSucceeds(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	req, result, total := newTestOrder("order-1")
+
+	expectPrepareSaveOrder(mock)
+	expectSaveOrder(mock, result)
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO orders`).WillReturnError(&pq.Error{Code: pqUniqueViolation})
+	mock.ExpectRollback()
+	expectStoredOrder(mock, req, result, total)
+
+	ctx := context.Background()
+	if err := odb.SaveOrder(ctx, req, result, total); err != nil {
+		t.Fatalf("first SaveOrder() error = %v", err)
+	}
+	if err := odb.SaveOrder(ctx, req, result, total); err != nil {
+		t.Errorf("second SaveOrder() error = %v, want nil for an identical retry", err)
+	}
+}
+
+func TestSaveOrderTwiceWithConflictingPayloadFails(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	req, result, total := newTestOrder("order-1")
+
+	expectPrepareSaveOrder(mock)
+	expectSaveOrder(mock, result)
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO orders`).WillReturnError(&pq.Error{Code: pqUniqueViolation})
+	mock.ExpectRollback()
+	expectStoredOrder(mock, req, result, total)
+
+	ctx := context.Background()
+	if err := odb.SaveOrder(ctx, req, result, total); err != nil {
+		t.Fatalf("first SaveOrder() error = %v", err)
+	}
+
+	conflicting := &pb.Money{CurrencyCode: "USD", Units: 1, Nanos: 0}
+	err := odb.SaveOrder(ctx, req, result, conflicting)
+	if !errors.Is(err, ErrOrderConflict) {
+		t.Errorf("second SaveOrder() error = %v, want ErrOrderConflict", err)
+	}
+}
+
+func TestSaveOrderItemInsertFailureNamesTheItem(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantText string
+	}{
+		{"duplicate", &pq.Error{Code: pqUniqueViolation}, "order order-1 item 1 (product 66VCHSJNUP) is a duplicate"},
+		{"constraint", &pq.Error{Code: "23503"}, "order order-1 item 1 (product 66VCHSJNUP) violates a constraint"},
+		{"other", errors.New("disk full"), "failed to insert order order-1 item 1 (product 66VCHSJNUP)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			odb, mock := newMockOrderDatabase(t)
+			req, result, total := newTestOrder("order-1")
+
+			expectPrepareSaveOrder(mock)
+			mock.ExpectBegin()
+			mock.ExpectExec(`INSERT INTO orders`).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec(`INSERT INTO order_items`).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec(`INSERT INTO order_items`).WillReturnError(tt.err)
+			mock.ExpectRollback()
+
+			err := odb.SaveOrder(context.Background(), req, result, total)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("SaveOrder() error = %v, want it to wrap %v", err, tt.err)
+			}
+			if !strings.Contains(err.Error(), tt.wantText) {
+				t.Errorf("SaveOrder() error = %q, want it to contain %q", err, tt.wantText)
+			}
+		})
+	}
+}
+
+func TestOrderCurrencyRoundTrips(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	req, result, total := newTestOrder("order-1")
+	req.UserCurrency = "EUR"
+	total.CurrencyCode = "EUR"
+	result.ShippingCost.CurrencyCode = "EUR"
+	for _, item := range result.Items {
+		item.Cost.CurrencyCode = "EUR"
+	}
+
+	expectPrepareSaveOrder(mock)
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO orders`).
+		WithArgs(
+			result.OrderId, req.UserId, req.Email, "EUR", result.ShippingTrackingId,
+			total.Units, total.Nanos, "EUR",
+			result.ShippingCost.Units, result.ShippingCost.Nanos, "EUR",
+			req.Address.StreetAddress, req.Address.City, req.Address.State,
+			req.Address.Country, req.Address.ZipCode,
+			string(OrderStatusPaid), sqlmock.AnyArg(), sqlmock.AnyArg(),
+			req.Email,
+		).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	for _, item := range result.Items {
+		mock.ExpectExec(`INSERT INTO order_items`).
+			WithArgs(result.OrderId, item.Item.ProductId, item.Item.Quantity,
+				item.Cost.Units, item.Cost.Nanos, "EUR", sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	expectOutboxEvent(mock, result.OrderId)
+	mock.ExpectCommit()
+
+	ctx := context.Background()
+	if err := odb.SaveOrder(ctx, req, result, total); err != nil {
+		t.Fatalf("SaveOrder() error = %v", err)
+	}
+
+	row := orderRow("order-1")
+	row[4], row[7] = "EUR", "EUR"
+	mock.ExpectQuery(`FROM orders\s+WHERE order_id = \$1`).
+		WithArgs("order-1").
+		WillReturnRows(sqlmock.NewRows(orderColumns).AddRow(row...))
+	items := sqlmock.NewRows(orderItemColumns)
+	for _, item := range result.Items {
+		items.AddRow(result.OrderId, item.Item.ProductId, item.Item.Quantity, item.Cost.Units, item.Cost.Nanos, "EUR")
+	}
+	mock.ExpectQuery(`FROM order_items`).WillReturnRows(items)
+	expectNoPayment(mock)
+
+	got, err := odb.GetOrder(ctx, "order-1")
+	if err != nil {
+		t.Fatalf("GetOrder() error = %v", err)
+	}
+	if !proto.Equal(got.Order, result) {
+		t.Errorf("GetOrder() order = %v, want %v", got.Order, result)
+	}
+	if !proto.Equal(got.Total, total) {
+		t.Errorf("GetOrder() total = %v, want %v", got.Total, total)
+	}
+}
+
+// recentUTC matches a time.Time argument in UTC that is close to now.
+type recentUTC struct{}
+
+func (recentUTC) Match(v driver.Value) bool {
+	ts, ok := v.(time.Time)
+	return ok && ts.Location() == time.UTC && time.Since(ts) < time.Minute
+}
+
+func TestOrderTimestampsRoundTrip(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	req, result, total := newTestOrder("order-1")
+
+	expectPrepareSaveOrder(mock)
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO orders`).
+		WithArgs(
+			sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+			sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+			sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+			sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+			sqlmock.AnyArg(), sqlmock.AnyArg(),
+			sqlmock.AnyArg(), recentUTC{}, recentUTC{},
+			sqlmock.AnyArg(),
+		).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	for range result.Items {
+		mock.ExpectExec(`INSERT INTO order_items`).WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	expectOutboxEvent(mock, result.OrderId)
+	mock.ExpectCommit()
+
+	ctx := context.Background()
+	if err := odb.SaveOrder(ctx, req, result, total); err != nil {
+		t.Fatalf("SaveOrder() error = %v", err)
+	}
+
+	updated := testOrderTime.Add(time.Hour)
+	row := orderRow("order-1")
+	row[orderColumn("updated_at")] = updated
+	mock.ExpectQuery(`SELECT\s+order_id.*created_at, updated_at,.*FROM orders\s+WHERE order_id = \$1`).
+		WithArgs("order-1").
+		WillReturnRows(sqlmock.NewRows(orderColumns).AddRow(row...))
+	mock.ExpectQuery(`FROM order_items`).WillReturnRows(sqlmock.NewRows(orderItemColumns))
+	expectNoPayment(mock)
+
+	got, err := odb.GetOrder(ctx, "order-1")
+	if err != nil {
+		t.Fatalf("GetOrder() error = %v", err)
+	}
+	if !got.CreatedAt.Equal(testOrderTime) {
+		t.Errorf("GetOrder() CreatedAt = %v, want %v", got.CreatedAt, testOrderTime)
+	}
+	if !got.UpdatedAt.Equal(updated) {
+		t.Errorf("GetOrder() UpdatedAt = %v, want %v", got.UpdatedAt, updated)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	odb := newOrderDatabase(db, postgresDialect{}, defaultDBOptions())
+
+	mock.ExpectPing()
+	if err := odb.HealthCheck(context.Background()); err != nil {
+		t.Errorf("HealthCheck() error = %v, want nil", err)
+	}
+
+	mock.ExpectClose()
+	db.Close()
+	err = odb.HealthCheck(context.Background())
+	if !errors.Is(err, ErrDatabaseUnavailable) {
+		t.Errorf("HealthCheck() on a closed database error = %v, want ErrDatabaseUnavailable", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet sqlmock expectations: %v", err)
+	}
+}
+
+func TestWithTxCommitsOnSuccess(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`FROM orders\s+WHERE order_id = \$1\s+FOR UPDATE`).
+		WithArgs("order-1").
+		WillReturnRows(sqlmock.NewRows(orderColumns).AddRow(orderRow("order-1")...))
+	mock.ExpectQuery(`FROM order_items`).WillReturnRows(sqlmock.NewRows(orderItemColumns))
+	expectNoPayment(mock)
+	mock.ExpectCommit()
+
+	err := odb.WithTx(context.Background(), func(tx *sql.Tx) error {
+		record, err := odb.GetOrderForUpdate(context.Background(), tx, "order-1")
+		if err != nil {
+			return err
+		}
+		if record.Status != OrderStatusPaid {
+			t.Errorf("GetOrderForUpdate() status = %s, want %s", record.Status, OrderStatusPaid)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("WithTx() error = %v", err)
+	}
+}
+
+func TestWithTxRollsBackOnError(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	errAbort := errors.New("abort")
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	err := odb.WithTx(context.Background(), func(tx *sql.Tx) error {
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Errorf("WithTx() error = %v, want %v", err, errAbort)
+	}
+}
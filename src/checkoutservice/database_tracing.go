@@ -0,0 +1,50 @@
+// Copyright 2024
+// OpenTelemetry spans for database operations
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const databaseTracerName = "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/database"
+
+// WithTracerProvider sets where database spans are reported. It defaults to
+// the global provider installed by initTracing.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(o *dbOptions) { o.tracerProvider = tp }
+}
+
+func defaultTracerProvider() trace.TracerProvider {
+	return otel.GetTracerProvider()
+}
+
+// startSpan starts a client span for a database operation as a child of the
+// span in ctx. Callers must only pass identifiers as attributes, never
+// customer PII such as email or address. With WithQueryLogging the span
+// also logs the operation when it ends.
+func (odb *OrderDatabase) startSpan(ctx context.Context, operation string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	ctx, span := odb.tracer.Start(ctx, "OrderDatabase."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.system", odb.dialect.system())),
+		trace.WithAttributes(attrs...),
+	)
+	if odb.opts.queryLogging {
+		span = &loggedSpan{Span: span, operation: operation, start: time.Now(), slowThreshold: odb.opts.slowQueryThreshold}
+	}
+	return ctx, span
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,82 @@
+// Copyright 2024
+// Tests for database tracing
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func newTracedMockOrderDatabase(t *testing.T) (*OrderDatabase, sqlmock.Sqlmock, *tracetest.SpanRecorder) {
+	t.Helper()
+	odb, mock := newMockOrderDatabase(t)
+	recorder := tracetest.NewSpanRecorder()
+	odb.tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer(databaseTracerName)
+	return odb, mock, recorder
+}
+
+func TestDatabaseSpans(t *testing.T) {
+	odb, mock, recorder := newTracedMockOrderDatabase(t)
+	ctx := context.Background()
+	req, result, total := newTestOrder("order-1")
+
+	expectPrepareSaveOrder(mock)
+	expectSaveOrder(mock, result)
+	if err := odb.SaveOrder(ctx, req, result, total); err != nil {
+		t.Fatalf("SaveOrder() error = %v", err)
+	}
+
+	mock.ExpectQuery(`FROM orders\s+WHERE order_id = \$1`).WillReturnRows(sqlmock.NewRows(orderColumns))
+	if _, err := odb.GetOrder(ctx, "missing"); err == nil {
+		t.Fatal("GetOrder() error = nil, want not found")
+	}
+
+	mock.ExpectQuery(`FROM orders\s+WHERE user_id = \$1`).
+		WillReturnRows(sqlmock.NewRows(orderColumns).AddRow(orderRow("order-1")...))
+	mock.ExpectQuery(`FROM order_items`).WillReturnRows(sqlmock.NewRows(orderItemColumns))
+	if _, err := odb.GetUserOrders(ctx, "user-1"); err != nil {
+		t.Fatalf("GetUserOrders() error = %v", err)
+	}
+
+	spans := recorder.Ended()
+	want := []struct {
+		name    string
+		isError bool
+	}{
+		{"OrderDatabase.SaveOrder", false},
+		{"OrderDatabase.GetOrder", true},
+		{"OrderDatabase.GetUserOrders", false},
+	}
+	if len(spans) != len(want) {
+		t.Fatalf("recorded %d spans, want %d", len(spans), len(want))
+	}
+	for i, w := range want {
+		span := spans[i]
+		if span.Name() != w.name {
+			t.Errorf("span %d name = %q, want %q", i, span.Name(), w.name)
+		}
+		if isError := span.Status().Code == codes.Error; isError != w.isError {
+			t.Errorf("span %s error status = %v, want %v", span.Name(), isError, w.isError)
+		}
+		for _, attr := range span.Attributes() {
+			if strings.Contains(attr.Value.Emit(), req.Email) {
+				t.Errorf("span %s attribute %s contains the customer email", span.Name(), attr.Key)
+			}
+		}
+	}
+
+	attrs := make(map[string]string)
+	for _, attr := range spans[2].Attributes() {
+		attrs[string(attr.Key)] = attr.Value.Emit()
+	}
+	if attrs["user.id"] != "user-1" || attrs["db.rows_returned"] != "1" {
+		t.Errorf("GetUserOrders span attributes = %v, want user.id=user-1 and db.rows_returned=1", attrs)
+	}
+}
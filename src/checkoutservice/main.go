@@ -16,9 +16,13 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
 	"net"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
 	"cloud.google.com/go/profiler"
@@ -43,6 +47,10 @@ import (
 const (
 	listenPort  = "5050"
 	usdCurrency = "USD"
+
+	// shutdownTimeout bounds draining on SIGTERM; it must stay below the
+	// pod's terminationGracePeriodSeconds (30s by default).
+	shutdownTimeout = 20 * time.Second
 )
 
 var log *logrus.Logger
@@ -82,7 +90,7 @@ type checkoutService struct {
 	paymentSvcAddr string
 	paymentSvcConn *grpc.ClientConn
 
-	orderDB *OrderDatabase
+	orderDB OrderStore
 }
 
 func main() {
@@ -122,19 +130,29 @@ func main() {
 	mustConnGRPC(ctx, &svc.emailSvcConn, svc.emailSvcAddr)
 	mustConnGRPC(ctx, &svc.paymentSvcConn, svc.paymentSvcAddr)
 
-	dbConnStr := os.Getenv("DATABASE_URL")
-	if dbConnStr != "" {
+	dbConnStr, err := databaseURLFromEnv()
+	if err != nil {
+		log.Warnf("Invalid database settings: %v. Orders will not be persisted.", err)
+	} else if dbConnStr != "" {
 		log.Info("Database URL provided, initializing database connection")
-		orderDB, err := NewOrderDatabase(dbConnStr)
+		var orderDB *OrderDatabase
+		var err error
+		if replicaConnStr := os.Getenv("DATABASE_REPLICA_URL"); replicaConnStr != "" {
+			orderDB, err = NewOrderDatabaseWithReplica(dbConnStr, replicaConnStr, orderDatabaseOptionsFromEnv()...)
+		} else {
+			orderDB, err = NewOrderDatabase(dbConnStr, orderDatabaseOptionsFromEnv()...)
+		}
 		if err != nil {
 			log.Warnf("Failed to connect to database: %v. Orders will not be persisted.", err)
+		} else if err := orderDB.EnsureSchema(ctx); err != nil {
+			log.Warnf("Failed to prepare database schema: %v. Orders will not be persisted.", err)
+			orderDB.Close()
 		} else {
 			svc.orderDB = orderDB
-			defer svc.orderDB.Close()
 			log.Info("Database connection established successfully")
 		}
 	} else {
-		log.Warn("DATABASE_URL not set. Orders will not be persisted to database.")
+		log.Warn("Neither DATABASE_URL nor DB_HOST set. Orders will not be persisted to database.")
 	}
 
 	log.Infof("service config: %+v", svc)
@@ -158,8 +176,43 @@ func main() {
 	pb.RegisterCheckoutServiceServer(srv, svc)
 	healthpb.RegisterHealthServer(srv, svc)
 	log.Infof("starting to listen on tcp: %q", lis.Addr().String())
-	err = srv.Serve(lis)
-	log.Fatal(err)
+	go func() {
+		if err := srv.Serve(lis); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigs
+	log.Infof("received %v, shutting down", sig)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	svc.shutdown(shutdownCtx, srv)
+}
+
+// shutdown stops accepting RPCs, lets in-flight ones finish and then drains
+// the order store, so a routine deploy doesn't fail checkouts midway. Both
+// steps share ctx's deadline.
+func (cs *checkoutService) shutdown(ctx context.Context, srv *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		log.Warn("timed out draining gRPC requests, closing remaining connections")
+		srv.Stop()
+	}
+
+	if cs.orderDB != nil {
+		if err := cs.orderDB.Shutdown(ctx); err != nil {
+			log.Warnf("failed to shut down order store cleanly: %v", err)
+		}
+	}
 }
 
 func initStats() {
@@ -222,6 +275,122 @@ func mustMapEnv(target *string, envKey string) {
 	*target = v
 }
 
+// databaseURLFromEnv returns DATABASE_URL or, if that isn't set but DB_HOST
+// is, a Postgres URL built from DB_HOST, DB_PORT, DB_USER, DB_PASSWORD,
+// DB_NAME and DB_SSLMODE. It returns "" if neither is set.
+func databaseURLFromEnv() (string, error) {
+	if v := os.Getenv("DATABASE_URL"); v != "" {
+		return v, nil
+	}
+	if os.Getenv("DB_HOST") == "" {
+		return "", nil
+	}
+	cfg := ConnConfig{
+		Host:     os.Getenv("DB_HOST"),
+		User:     os.Getenv("DB_USER"),
+		Password: os.Getenv("DB_PASSWORD"),
+		DBName:   os.Getenv("DB_NAME"),
+		SSLMode:  SSLMode(os.Getenv("DB_SSLMODE")),
+	}
+	if v := os.Getenv("DB_PORT"); v != "" {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return "", fmt.Errorf("%w: DB_PORT %q is not a number", ErrInvalidConnConfig, v)
+		}
+		cfg.Port = port
+	}
+	return BuildConnectionString(cfg)
+}
+
+// orderDatabaseOptionsFromEnv sizes the database connection pool and sets
+// the query timeout from the DB_* environment variables, leaving the
+// defaults for any that are unset. It turns on query logging when
+// DB_SLOW_QUERY_THRESHOLD is set and PII encryption when DB_ENCRYPTION_KEY
+// is. DB_DEAD_LETTER=1 keeps orders that fail to save for replay,
+// DB_ERASURE_MODE picks how EraseUserData erases, and DB_SCHEMA and
+// DB_TABLE_PREFIX say where the tables are.
+func orderDatabaseOptionsFromEnv() []Option {
+	var opts []Option
+	if n, ok := intFromEnv("DB_MAX_OPEN_CONNS"); ok {
+		opts = append(opts, WithMaxOpenConns(n))
+	}
+	if n, ok := intFromEnv("DB_MAX_IDLE_CONNS"); ok {
+		opts = append(opts, WithMaxIdleConns(n))
+	}
+	if d, ok := durationFromEnv("DB_CONN_MAX_LIFETIME"); ok {
+		opts = append(opts, WithConnMaxLifetime(d))
+	}
+	if d, ok := durationFromEnv("DB_CONN_MAX_IDLE_TIME"); ok {
+		opts = append(opts, WithConnMaxIdleTime(d))
+	}
+	if d, ok := durationFromEnv("DB_QUERY_TIMEOUT"); ok {
+		opts = append(opts, WithQueryTimeout(d))
+	}
+	if d, ok := durationFromEnv("DB_SLOW_QUERY_THRESHOLD"); ok {
+		opts = append(opts, WithQueryLogging(d))
+	}
+	if v := os.Getenv("DB_ENCRYPTION_KEY"); v != "" {
+		// Unlike the pool settings, a bad key can't be ignored: orders
+		// would silently be written in plaintext.
+		key, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			log.Fatalf("DB_ENCRYPTION_KEY is not valid base64: %v", err)
+		}
+		c, err := NewAESGCMCipher(key)
+		if err != nil {
+			log.Fatalf("invalid DB_ENCRYPTION_KEY: %v", err)
+		}
+		opts = append(opts, WithCipher(c))
+	}
+	if os.Getenv("DB_DEAD_LETTER") == "1" {
+		opts = append(opts, WithDeadLetter())
+	}
+	// An invalid schema or prefix isn't ignored, since the orders would
+	// land in another tenant's tables; NewOrderDatabase rejects it.
+	if v := os.Getenv("DB_SCHEMA"); v != "" {
+		opts = append(opts, WithSchema(v))
+	}
+	if v := os.Getenv("DB_TABLE_PREFIX"); v != "" {
+		opts = append(opts, WithTablePrefix(v))
+	}
+	switch v := os.Getenv("DB_ERASURE_MODE"); v {
+	case "":
+	case "anonymize":
+		opts = append(opts, WithErasureMode(ErasureAnonymize))
+	case "delete":
+		opts = append(opts, WithErasureMode(ErasureDelete))
+	default:
+		log.Warnf("ignoring invalid DB_ERASURE_MODE=%q: want anonymize or delete", v)
+	}
+	return opts
+}
+
+func intFromEnv(envKey string) (int, bool) {
+	v := os.Getenv(envKey)
+	if v == "" {
+		return 0, false
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Warnf("ignoring invalid %s=%q: %v", envKey, v, err)
+		return 0, false
+	}
+	return n, true
+}
+
+func durationFromEnv(envKey string) (time.Duration, bool) {
+	v := os.Getenv(envKey)
+	if v == "" {
+		return 0, false
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Warnf("ignoring invalid %s=%q: %v", envKey, v, err)
+		return 0, false
+	}
+	return d, true
+}
+
 func mustConnGRPC(ctx context.Context, conn **grpc.ClientConn, addr string) {
 	var err error
 	ctx, cancel := context.WithTimeout(ctx, time.Second*3)
@@ -236,6 +405,12 @@ func mustConnGRPC(ctx context.Context, conn **grpc.ClientConn, addr string) {
 }
 
 func (cs *checkoutService) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	if cs.orderDB != nil {
+		if err := cs.orderDB.HealthCheck(ctx); err != nil {
+			log.Warnf("order store health check failed: %v", err)
+			return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_NOT_SERVING}, nil
+		}
+	}
 	return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}, nil
 }
 
@@ -293,7 +468,10 @@ func (cs *checkoutService) PlaceOrder(ctx context.Context, req *pb.PlaceOrderReq
 	}
 
 	if cs.orderDB != nil {
-		if err := cs.orderDB.SaveOrder(ctx, req, orderResult, &total); err != nil {
+		payment := NewPaymentInfo(req.CreditCard, txID)
+		if err := cs.orderDB.SaveOrderWithPayment(ctx, req, orderResult, &total, payment); errors.Is(err, ErrOrderPersistFailed) {
+			log.Errorf("order %s was paid for but not saved to database: %+v", orderResult.OrderId, err)
+		} else if err != nil {
 			log.Errorf("failed to save order to database: %+v", err)
 		} else {
 			log.Infof("order %s saved to database successfully", orderResult.OrderId)
@@ -0,0 +1,145 @@
+// Copyright 2024
+// In-memory OrderStore for tests and local development
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+// MemoryOrderStore keeps orders in process memory. It follows the same
+// semantics as OrderDatabase, including idempotent saves, and hands out
+// copies so callers can't mutate stored orders.
+type MemoryOrderStore struct {
+	mu     sync.RWMutex
+	orders map[string]*memoryOrder
+	// userOrders holds each user's order IDs in the order they were saved.
+	userOrders map[string][]string
+}
+
+type memoryOrder struct {
+	req    *pb.PlaceOrderRequest
+	total  *pb.Money
+	record *OrderRecord
+}
+
+func NewMemoryOrderStore() *MemoryOrderStore {
+	return &MemoryOrderStore{
+		orders:     make(map[string]*memoryOrder),
+		userOrders: make(map[string][]string),
+	}
+}
+
+func (s *MemoryOrderStore) SaveOrder(ctx context.Context, req *pb.PlaceOrderRequest, orderResult *pb.OrderResult, totalAmount *pb.Money) error {
+	return s.saveOrder(req, orderResult, totalAmount, nil)
+}
+
+func (s *MemoryOrderStore) SaveOrderWithPayment(ctx context.Context, req *pb.PlaceOrderRequest, orderResult *pb.OrderResult, totalAmount *pb.Money, payment *PaymentInfo) error {
+	if err := validatePayment(payment); err != nil {
+		return fmt.Errorf("order %s: %w", orderResult.GetOrderId(), err)
+	}
+	return s.saveOrder(req, orderResult, totalAmount, payment)
+}
+
+func (s *MemoryOrderStore) saveOrder(req *pb.PlaceOrderRequest, orderResult *pb.OrderResult, totalAmount *pb.Money, payment *PaymentInfo) error {
+	if err := validateOrder(req, orderResult, totalAmount); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	// Only keep the fields OrderDatabase persists; the card details in
+	// particular must never be stored.
+	stored := &memoryOrder{
+		req: &pb.PlaceOrderRequest{
+			UserId:       req.UserId,
+			UserCurrency: req.UserCurrency,
+			Email:        req.Email,
+			Address:      proto.Clone(req.Address).(*pb.Address),
+		},
+		total: proto.Clone(totalAmount).(*pb.Money),
+		record: &OrderRecord{
+			Order:     proto.Clone(orderResult).(*pb.OrderResult),
+			Total:     proto.Clone(totalAmount).(*pb.Money),
+			Status:    OrderStatusPaid,
+			CreatedAt: now,
+			UpdatedAt: now,
+			Payment:   copyPayment(payment),
+		},
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.orders[orderResult.OrderId]; ok {
+		if proto.Equal(existing.req, stored.req) &&
+			proto.Equal(existing.total, stored.total) &&
+			proto.Equal(existing.record.Order, stored.record.Order) {
+			return nil
+		}
+		return fmt.Errorf("%w: %s", ErrOrderConflict, orderResult.OrderId)
+	}
+
+	s.orders[orderResult.OrderId] = stored
+	s.userOrders[req.UserId] = append(s.userOrders[req.UserId], orderResult.OrderId)
+	return nil
+}
+
+func (s *MemoryOrderStore) GetOrder(ctx context.Context, orderID string) (*OrderRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stored, ok := s.orders[orderID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrOrderNotFound, orderID)
+	}
+	return copyOrderRecord(stored.record), nil
+}
+
+func (s *MemoryOrderStore) GetUserOrders(ctx context.Context, userID string) ([]*OrderRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	orderIDs := s.userOrders[userID]
+	orders := make([]*OrderRecord, 0, len(orderIDs))
+	for i := len(orderIDs) - 1; i >= 0; i-- {
+		orders = append(orders, copyOrderRecord(s.orders[orderIDs[i]].record))
+	}
+	return orders, nil
+}
+
+func (s *MemoryOrderStore) HealthCheck(ctx context.Context) error {
+	return nil
+}
+
+// Shutdown is the same as Close: every operation completes under the lock,
+// so there is nothing in flight to wait for.
+func (s *MemoryOrderStore) Shutdown(ctx context.Context) error {
+	return s.Close()
+}
+
+func (s *MemoryOrderStore) Close() error {
+	return nil
+}
+
+func copyOrderRecord(record *OrderRecord) *OrderRecord {
+	copied := *record
+	copied.Order = proto.Clone(record.Order).(*pb.OrderResult)
+	copied.Total = proto.Clone(record.Total).(*pb.Money)
+	copied.Payment = copyPayment(record.Payment)
+	return &copied
+}
+
+func copyPayment(payment *PaymentInfo) *PaymentInfo {
+	if payment == nil {
+		return nil
+	}
+	copied := *payment
+	return &copied
+}
@@ -0,0 +1,97 @@
+// Copyright 2024
+// Tests for the in-memory order store
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+func TestMemoryOrderStoreRoundTrip(t *testing.T) {
+	store := NewMemoryOrderStore()
+	ctx := context.Background()
+	req, result, total := newTestOrder("order-1")
+
+	if err := store.SaveOrder(ctx, req, result, total); err != nil {
+		t.Fatalf("SaveOrder() error = %v", err)
+	}
+
+	got, err := store.GetOrder(ctx, "order-1")
+	if err != nil {
+		t.Fatalf("GetOrder() error = %v", err)
+	}
+	if !proto.Equal(got.Order, result) {
+		t.Errorf("GetOrder() = %v, want %v", got.Order, result)
+	}
+	if got.Status != OrderStatusPaid {
+		t.Errorf("GetOrder() status = %s, want %s", got.Status, OrderStatusPaid)
+	}
+
+	// Mutating a returned order must not change the stored one.
+	got.Order.Items[0].Item.Quantity = 100
+	again, _ := store.GetOrder(ctx, "order-1")
+	if again.Order.Items[0].Item.Quantity != result.Items[0].Item.Quantity {
+		t.Error("GetOrder() returned an order that aliases the stored one")
+	}
+
+	if d := time.Since(got.CreatedAt); d < 0 || d > time.Minute {
+		t.Errorf("GetOrder() CreatedAt = %v, want close to now", got.CreatedAt)
+	}
+
+	if _, err := store.GetOrder(ctx, "missing"); !errors.Is(err, ErrOrderNotFound) {
+		t.Errorf("GetOrder() for a missing order error = %v, want ErrOrderNotFound", err)
+	}
+}
+
+func TestMemoryOrderStoreGetUserOrdersNewestFirst(t *testing.T) {
+	store := NewMemoryOrderStore()
+	ctx := context.Background()
+	for _, id := range []string{"order-1", "order-2", "order-3"} {
+		req, result, total := newTestOrder(id)
+		if err := store.SaveOrder(ctx, req, result, total); err != nil {
+			t.Fatalf("SaveOrder(%s) error = %v", id, err)
+		}
+	}
+
+	orders, err := store.GetUserOrders(ctx, "user-1")
+	if err != nil {
+		t.Fatalf("GetUserOrders() error = %v", err)
+	}
+	want := []string{"order-3", "order-2", "order-1"}
+	if len(orders) != len(want) {
+		t.Fatalf("GetUserOrders() returned %d orders, want %d", len(orders), len(want))
+	}
+	for i, id := range want {
+		if orders[i].Order.OrderId != id {
+			t.Errorf("orders[%d] = %s, want %s", i, orders[i].Order.OrderId, id)
+		}
+	}
+
+	if orders, _ := store.GetUserOrders(ctx, "someone-else"); len(orders) != 0 {
+		t.Errorf("GetUserOrders() for another user returned %d orders, want 0", len(orders))
+	}
+}
+
+func TestMemoryOrderStoreDuplicateSave(t *testing.T) {
+	store := NewMemoryOrderStore()
+	ctx := context.Background()
+	req, result, total := newTestOrder("order-1")
+
+	if err := store.SaveOrder(ctx, req, result, total); err != nil {
+		t.Fatalf("SaveOrder() error = %v", err)
+	}
+	if err := store.SaveOrder(ctx, req, result, total); err != nil {
+		t.Errorf("identical SaveOrder() error = %v, want nil", err)
+	}
+	err := store.SaveOrder(ctx, req, result, &pb.Money{CurrencyCode: "USD", Units: 1})
+	if !errors.Is(err, ErrOrderConflict) {
+		t.Errorf("conflicting SaveOrder() error = %v, want ErrOrderConflict", err)
+	}
+}
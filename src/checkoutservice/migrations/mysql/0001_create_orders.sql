@@ -0,0 +1,66 @@
+-- The MySQL schema starts out equivalent to migrations/postgres up to and
+-- including 0008. Later changes get a file here with the same number as
+-- their Postgres counterpart.
+--
+-- MySQL has no CREATE INDEX IF NOT EXISTS and ignores REFERENCES on a column
+-- definition, so indexes and foreign keys are declared in CREATE TABLE.
+-- DDL commits implicitly: a migration that fails part way is not rolled
+-- back, which is one more reason every statement must be idempotent.
+-- Timestamps are DATETIME(6), which holds UTC with the microsecond
+-- precision Postgres TIMESTAMP has, without TIMESTAMP's time zone
+-- conversion and 2038 limit.
+
+CREATE TABLE IF NOT EXISTS orders (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    order_id VARCHAR(255) NOT NULL,
+    user_id VARCHAR(255) NOT NULL,
+    user_email TEXT,
+    user_currency VARCHAR(10),
+    shipping_tracking_id VARCHAR(255),
+    total_amount_units BIGINT,
+    total_amount_nanos INTEGER,
+    total_amount_currency VARCHAR(10),
+    shipping_cost_units BIGINT,
+    shipping_cost_nanos INTEGER,
+    shipping_cost_currency VARCHAR(10),
+    shipping_address_street TEXT,
+    shipping_address_city TEXT,
+    shipping_address_state TEXT,
+    shipping_address_country TEXT,
+    shipping_address_zip INTEGER,
+    status VARCHAR(32) NOT NULL DEFAULT 'PENDING',
+    cancelled_at DATETIME(6),
+    cancellation_reason TEXT,
+    created_at DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+    updated_at DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+    version BIGINT NOT NULL DEFAULT 1,
+    UNIQUE KEY uq_orders_order_id (order_id),
+    INDEX idx_orders_user_created (user_id, created_at DESC),
+    INDEX idx_orders_created_at (created_at),
+    INDEX idx_orders_status_created (status, created_at DESC)
+);
+
+CREATE TABLE IF NOT EXISTS order_items (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    order_id VARCHAR(255),
+    product_id VARCHAR(255) NOT NULL,
+    quantity INTEGER NOT NULL,
+    cost_units BIGINT,
+    cost_nanos INTEGER,
+    cost_currency VARCHAR(10),
+    created_at DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+    INDEX idx_order_items_order_id (order_id),
+    FOREIGN KEY (order_id) REFERENCES orders(order_id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS order_events (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    order_id VARCHAR(255) NOT NULL,
+    event_type VARCHAR(64) NOT NULL,
+    from_status VARCHAR(32),
+    to_status VARCHAR(32),
+    detail TEXT,
+    created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    INDEX idx_order_events_order_created (order_id, created_at),
+    FOREIGN KEY (order_id) REFERENCES orders(order_id) ON DELETE CASCADE
+);
@@ -0,0 +1,5 @@
+-- Fulfilment workers claim an order with ClaimOrder before processing it.
+-- MySQL has no ADD COLUMN IF NOT EXISTS; a single ALTER TABLE adds both
+-- columns or neither.
+
+ALTER TABLE orders ADD COLUMN claimed_by VARCHAR(255), ADD COLUMN claimed_at DATETIME(6);
@@ -0,0 +1,64 @@
+-- ArchiveOrders moves old shipped and cancelled orders out of the hot
+-- tables into these. Indexes and foreign keys are declared in CREATE
+-- TABLE; see 0001.
+
+CREATE TABLE IF NOT EXISTS orders_archive (
+    order_id VARCHAR(255) PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL,
+    user_email TEXT,
+    user_currency VARCHAR(10),
+    shipping_tracking_id VARCHAR(255),
+    total_amount_units BIGINT,
+    total_amount_nanos INTEGER,
+    total_amount_currency VARCHAR(10),
+    shipping_cost_units BIGINT,
+    shipping_cost_nanos INTEGER,
+    shipping_cost_currency VARCHAR(10),
+    shipping_address_street TEXT,
+    shipping_address_city TEXT,
+    shipping_address_state TEXT,
+    shipping_address_country TEXT,
+    shipping_address_zip INTEGER,
+    status VARCHAR(32) NOT NULL,
+    cancelled_at DATETIME(6),
+    cancellation_reason TEXT,
+    created_at DATETIME(6),
+    updated_at DATETIME(6),
+    version BIGINT NOT NULL,
+    archived_at DATETIME(6) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS order_items_archive (
+    id BIGINT PRIMARY KEY,
+    order_id VARCHAR(255) NOT NULL,
+    product_id VARCHAR(255) NOT NULL,
+    quantity INTEGER NOT NULL,
+    cost_units BIGINT,
+    cost_nanos INTEGER,
+    cost_currency VARCHAR(10),
+    created_at DATETIME(6),
+    INDEX idx_order_items_archive_order_id (order_id),
+    FOREIGN KEY (order_id) REFERENCES orders_archive(order_id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS order_events_archive (
+    id BIGINT PRIMARY KEY,
+    order_id VARCHAR(255) NOT NULL,
+    event_type VARCHAR(64) NOT NULL,
+    from_status VARCHAR(32),
+    to_status VARCHAR(32),
+    detail TEXT,
+    created_at DATETIME(6) NOT NULL,
+    INDEX idx_order_events_archive_order_id (order_id),
+    FOREIGN KEY (order_id) REFERENCES orders_archive(order_id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS order_payments_archive (
+    order_id VARCHAR(255) PRIMARY KEY,
+    card_last_four CHAR(4) NOT NULL,
+    card_type VARCHAR(32),
+    payment_processor_txn_id VARCHAR(255),
+    authorized BOOLEAN NOT NULL,
+    created_at DATETIME(6) NOT NULL,
+    FOREIGN KEY (order_id) REFERENCES orders_archive(order_id) ON DELETE CASCADE
+);
@@ -0,0 +1,10 @@
+-- GetOrdersByEmail looks orders up by user_email_lookup. Orders whose email
+-- was already encrypted get no lookup value and aren't found by email.
+-- MySQL has no ADD COLUMN or CREATE INDEX IF NOT EXISTS; a single ALTER
+-- TABLE adds both or neither.
+
+ALTER TABLE orders
+    ADD COLUMN user_email_lookup VARCHAR(255),
+    ADD INDEX idx_orders_email_lookup (user_email_lookup, created_at DESC);
+UPDATE orders SET user_email_lookup = LOWER(TRIM(user_email))
+WHERE user_email IS NOT NULL AND user_email NOT LIKE 'enc:v1:%';
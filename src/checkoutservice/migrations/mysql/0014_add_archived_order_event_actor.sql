@@ -0,0 +1,4 @@
+-- ArchiveOrders keeps the actor of the events it archives. See the
+-- Postgres migration for why this isn't part of 0013.
+
+ALTER TABLE order_events_archive ADD COLUMN actor VARCHAR(255);
@@ -0,0 +1,14 @@
+-- Orders that couldn't be saved after the customer was charged, kept for
+-- ReplayFailedOrders when WithDeadLetter is on. payload is the order as
+-- JSON, encrypted like user_email when a key is set. There is no foreign
+-- key to orders: the order isn't there, or it wouldn't be here.
+
+CREATE TABLE IF NOT EXISTS failed_orders (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    order_id VARCHAR(255) NOT NULL,
+    payload MEDIUMTEXT NOT NULL,
+    last_error TEXT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 1,
+    created_at DATETIME(6) NOT NULL,
+    updated_at DATETIME(6) NOT NULL
+);
@@ -0,0 +1,17 @@
+-- Events about orders waiting to be published downstream, written in the
+-- transaction that saves the order so that one is never committed without
+-- the other. A relay reads them with FetchOutboxBatch and sets
+-- published_at with MarkOutboxPublished. payload is the event as JSON,
+-- encrypted like user_email when a key is set. Indexes and foreign keys
+-- are declared in CREATE TABLE; see 0001.
+
+CREATE TABLE IF NOT EXISTS order_outbox (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    order_id VARCHAR(255) NOT NULL,
+    event_type VARCHAR(64) NOT NULL,
+    payload MEDIUMTEXT NOT NULL,
+    created_at DATETIME(6) NOT NULL,
+    published_at DATETIME(6),
+    INDEX idx_order_outbox_unpublished (published_at, id),
+    FOREIGN KEY (order_id) REFERENCES orders(order_id) ON DELETE CASCADE
+);
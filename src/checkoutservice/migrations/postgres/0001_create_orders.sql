@@ -0,0 +1,36 @@
+-- Orders and their line items, as first deployed by the postgres-init-script
+-- ConfigMap.
+
+CREATE TABLE IF NOT EXISTS orders (
+    id SERIAL PRIMARY KEY,
+    order_id VARCHAR(255) UNIQUE NOT NULL,
+    user_id VARCHAR(255) NOT NULL,
+    user_email VARCHAR(255),
+    user_currency VARCHAR(10),
+    shipping_tracking_id VARCHAR(255),
+    total_amount_units BIGINT,
+    total_amount_nanos INTEGER,
+    shipping_cost_units BIGINT,
+    shipping_cost_nanos INTEGER,
+    shipping_address_street TEXT,
+    shipping_address_city VARCHAR(255),
+    shipping_address_state VARCHAR(255),
+    shipping_address_country VARCHAR(255),
+    shipping_address_zip INTEGER,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS order_items (
+    id SERIAL PRIMARY KEY,
+    order_id VARCHAR(255) REFERENCES orders(order_id) ON DELETE CASCADE,
+    product_id VARCHAR(255) NOT NULL,
+    quantity INTEGER NOT NULL,
+    cost_units BIGINT,
+    cost_nanos INTEGER,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_orders_user_id ON orders(user_id);
+CREATE INDEX IF NOT EXISTS idx_orders_created_at ON orders(created_at);
+CREATE INDEX IF NOT EXISTS idx_order_items_order_id ON order_items(order_id);
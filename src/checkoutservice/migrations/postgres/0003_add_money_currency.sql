@@ -0,0 +1,17 @@
+-- Currency codes for every stored amount. Existing rows are backfilled with
+-- the order's user_currency, which every amount was converted to at
+-- checkout.
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS total_amount_currency VARCHAR(10);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS shipping_cost_currency VARCHAR(10);
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS cost_currency VARCHAR(10);
+
+UPDATE orders
+SET total_amount_currency = user_currency,
+    shipping_cost_currency = user_currency
+WHERE total_amount_currency IS NULL;
+
+UPDATE order_items i
+SET cost_currency = o.user_currency
+FROM orders o
+WHERE i.order_id = o.order_id AND i.cost_currency IS NULL;
@@ -0,0 +1,14 @@
+-- migrate: no-transaction
+-- GetUserOrders filters on user_id and sorts on created_at DESC; this index
+-- serves both, and makes the single-column user_id index redundant.
+--
+-- The index is built CONCURRENTLY so that upgrading a database with many
+-- orders doesn't block checkouts while it builds. A concurrent build that
+-- fails leaves an INVALID index behind, which IF NOT EXISTS would then
+-- accept, so any leftover is dropped first; a valid index left by a run
+-- that failed later on is rebuilt, and idx_orders_user_id serves reads
+-- meanwhile. order_items(order_id) is indexed by 0001.
+
+DROP INDEX CONCURRENTLY IF EXISTS idx_orders_user_created;
+CREATE INDEX CONCURRENTLY IF NOT EXISTS idx_orders_user_created ON orders(user_id, created_at DESC);
+DROP INDEX CONCURRENTLY IF EXISTS idx_orders_user_id;
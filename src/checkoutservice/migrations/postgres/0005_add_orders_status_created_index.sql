@@ -0,0 +1,4 @@
+-- QueryOrders lets support tools list orders by status within a time range,
+-- newest first.
+
+CREATE INDEX IF NOT EXISTS idx_orders_status_created ON orders(status, created_at DESC);
@@ -0,0 +1,8 @@
+-- With an order database cipher configured, user_email and the shipping
+-- address columns hold base64 ciphertext, which is longer than the
+-- plaintext and can exceed VARCHAR(255).
+
+ALTER TABLE orders ALTER COLUMN user_email TYPE TEXT;
+ALTER TABLE orders ALTER COLUMN shipping_address_city TYPE TEXT;
+ALTER TABLE orders ALTER COLUMN shipping_address_state TYPE TEXT;
+ALTER TABLE orders ALTER COLUMN shipping_address_country TYPE TEXT;
@@ -0,0 +1,5 @@
+-- Optimistic concurrency: every update to an order increments version, so a
+-- writer holding an older version can tell that the order changed since it
+-- was read.
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
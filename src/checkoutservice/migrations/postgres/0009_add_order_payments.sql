@@ -0,0 +1,12 @@
+-- The masked payment details of an order, for receipts and disputes. The
+-- card number is never stored; the CHECK backs up the validation
+-- SaveOrderWithPayment does before writing.
+
+CREATE TABLE IF NOT EXISTS order_payments (
+    order_id VARCHAR(255) PRIMARY KEY REFERENCES orders(order_id) ON DELETE CASCADE,
+    card_last_four CHAR(4) NOT NULL CHECK (length(card_last_four) = 4),
+    card_type VARCHAR(32),
+    payment_processor_txn_id VARCHAR(255),
+    authorized BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
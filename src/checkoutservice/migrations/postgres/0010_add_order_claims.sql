@@ -0,0 +1,6 @@
+-- Fulfilment workers claim an order with ClaimOrder before processing it.
+-- A claim whose claimed_at is older than the claim TTL has expired and can
+-- be taken over.
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS claimed_by VARCHAR(255);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS claimed_at TIMESTAMP;
@@ -0,0 +1,14 @@
+-- migrate: no-transaction
+-- GetOrdersByEmail looks orders up by user_email_lookup, the normalized
+-- email or, with a cipher configured, a keyed digest of it, since
+-- encrypted user_email values can't be compared. Plaintext emails are
+-- backfilled here; orders whose email was already encrypted get no lookup
+-- value and aren't found by email.
+--
+-- The index is built CONCURRENTLY, as in 0004.
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS user_email_lookup VARCHAR(255);
+UPDATE orders SET user_email_lookup = LOWER(TRIM(user_email))
+WHERE user_email_lookup IS NULL AND user_email IS NOT NULL AND user_email NOT LIKE 'enc:v1:%';
+DROP INDEX CONCURRENTLY IF EXISTS idx_orders_email_lookup;
+CREATE INDEX CONCURRENTLY IF NOT EXISTS idx_orders_email_lookup ON orders(user_email_lookup, created_at DESC);
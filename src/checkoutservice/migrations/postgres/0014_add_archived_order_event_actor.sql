@@ -0,0 +1,6 @@
+-- ArchiveOrders keeps the actor of the events it archives. This is its
+-- own migration so that on MySQL, which can't add a column if it is
+-- missing, each migration is a single ALTER TABLE that applies in full or
+-- not at all.
+
+ALTER TABLE order_events_archive ADD COLUMN IF NOT EXISTS actor VARCHAR(255);
@@ -0,0 +1,55 @@
+-- The SQLite schema starts out equivalent to migrations/postgres up to and
+-- including 0006. Later changes get a file here with the same number as
+-- their Postgres counterpart.
+
+CREATE TABLE IF NOT EXISTS orders (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    order_id VARCHAR(255) UNIQUE NOT NULL,
+    user_id VARCHAR(255) NOT NULL,
+    user_email VARCHAR(255),
+    user_currency VARCHAR(10),
+    shipping_tracking_id VARCHAR(255),
+    total_amount_units BIGINT,
+    total_amount_nanos INTEGER,
+    total_amount_currency VARCHAR(10),
+    shipping_cost_units BIGINT,
+    shipping_cost_nanos INTEGER,
+    shipping_cost_currency VARCHAR(10),
+    shipping_address_street TEXT,
+    shipping_address_city VARCHAR(255),
+    shipping_address_state VARCHAR(255),
+    shipping_address_country VARCHAR(255),
+    shipping_address_zip INTEGER,
+    status VARCHAR(32) NOT NULL DEFAULT 'PENDING',
+    cancelled_at TIMESTAMP,
+    cancellation_reason TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS order_items (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    order_id VARCHAR(255) REFERENCES orders(order_id) ON DELETE CASCADE,
+    product_id VARCHAR(255) NOT NULL,
+    quantity INTEGER NOT NULL,
+    cost_units BIGINT,
+    cost_nanos INTEGER,
+    cost_currency VARCHAR(10),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS order_events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    order_id VARCHAR(255) NOT NULL REFERENCES orders(order_id) ON DELETE CASCADE,
+    event_type VARCHAR(64) NOT NULL,
+    from_status VARCHAR(32),
+    to_status VARCHAR(32),
+    detail TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_orders_user_created ON orders(user_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_orders_created_at ON orders(created_at);
+CREATE INDEX IF NOT EXISTS idx_orders_status_created ON orders(status, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_order_items_order_id ON order_items(order_id);
+CREATE INDEX IF NOT EXISTS idx_order_events_order_created ON order_events(order_id, created_at);
@@ -0,0 +1,3 @@
+-- SQLite doesn't enforce VARCHAR lengths, so the ciphertext stored by an
+-- order database cipher already fits. This file keeps the versions in step
+-- with migrations/postgres.
@@ -0,0 +1,3 @@
+-- Optimistic concurrency: every update to an order increments version.
+
+ALTER TABLE orders ADD COLUMN version BIGINT NOT NULL DEFAULT 1;
@@ -0,0 +1,4 @@
+-- Fulfilment workers claim an order with ClaimOrder before processing it.
+
+ALTER TABLE orders ADD COLUMN claimed_by VARCHAR(255);
+ALTER TABLE orders ADD COLUMN claimed_at TIMESTAMP;
@@ -0,0 +1,7 @@
+-- GetOrdersByEmail looks orders up by user_email_lookup. Orders whose email
+-- was already encrypted get no lookup value and aren't found by email.
+
+ALTER TABLE orders ADD COLUMN user_email_lookup VARCHAR(255);
+UPDATE orders SET user_email_lookup = LOWER(TRIM(user_email))
+WHERE user_email IS NOT NULL AND user_email NOT LIKE 'enc:v1:%';
+CREATE INDEX IF NOT EXISTS idx_orders_email_lookup ON orders(user_email_lookup, created_at DESC);
@@ -0,0 +1,4 @@
+-- Who made a change, as given to WithActor, for GetOrderEvents. Events
+-- recorded before this have no actor.
+
+ALTER TABLE order_events ADD COLUMN actor VARCHAR(255);
@@ -0,0 +1,3 @@
+-- ArchiveOrders keeps the actor of the events it archives.
+
+ALTER TABLE order_events_archive ADD COLUMN actor VARCHAR(255);
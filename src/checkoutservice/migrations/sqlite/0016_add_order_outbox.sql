@@ -0,0 +1,16 @@
+-- Events about orders waiting to be published downstream, written in the
+-- transaction that saves the order so that one is never committed without
+-- the other. A relay reads them with FetchOutboxBatch and sets
+-- published_at with MarkOutboxPublished. payload is the event as JSON,
+-- encrypted like user_email when a key is set.
+
+CREATE TABLE IF NOT EXISTS order_outbox (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    order_id VARCHAR(255) NOT NULL REFERENCES orders(order_id) ON DELETE CASCADE,
+    event_type VARCHAR(64) NOT NULL,
+    payload TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    published_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_order_outbox_unpublished ON order_outbox(published_at, id);
@@ -0,0 +1,128 @@
+// Copyright 2024
+// Audit trail of changes made to orders
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// OrderEventType names the kind of change an order_events row records.
+type OrderEventType string
+
+const (
+	OrderEventStatusChanged   OrderEventType = "STATUS_CHANGED"
+	OrderEventCancelled       OrderEventType = "CANCELLED"
+	OrderEventShippingUpdated OrderEventType = "SHIPPING_UPDATED"
+	OrderEventEmailUpdated    OrderEventType = "EMAIL_UPDATED"
+)
+
+// OrderEvent is one entry of an order's audit trail.
+type OrderEvent struct {
+	Type OrderEventType
+	// FromStatus and ToStatus are the order's status before and after the
+	// change. They are the same for edits that don't move the status.
+	FromStatus, ToStatus OrderStatus
+	// Actor is who made the change, as given to WithActor, or empty if the
+	// change was made without one.
+	Actor string
+	// Detail is free text about the change, such as the cancellation
+	// reason. It is empty for edits, since the changed values are PII.
+	Detail    string
+	CreatedAt time.Time
+}
+
+type actorKey struct{}
+
+// WithActor returns a context that records actor, such as a support
+// agent's ID or the name of a service, as who made the changes written
+// with it in the orders' audit trail.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// actorFrom returns the actor set by WithActor, or NULL.
+func actorFrom(ctx context.Context) sql.NullString {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return sql.NullString{String: actor, Valid: actor != ""}
+}
+
+// recordOrderEvent appends an entry to the order's audit trail. It runs on
+// the caller's transaction so the event is only kept if the change it
+// describes is committed.
+func (odb *OrderDatabase) recordOrderEvent(ctx context.Context, tx *sql.Tx, orderID string, eventType OrderEventType, from, to OrderStatus, detail string, at time.Time) error {
+	eventQuery := `
+		INSERT INTO order_events (order_id, event_type, from_status, to_status, detail, created_at, actor)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+	if _, err := odb.execContext(ctx, tx, eventQuery, orderID, eventType, from, to, detail, at, actorFrom(ctx)); err != nil {
+		return fmt.Errorf("failed to record order event: %w", err)
+	}
+	return nil
+}
+
+// GetOrderEvents returns the order's audit trail, oldest first. An order
+// that doesn't exist, or has no events, has an empty trail rather than an
+// error. Archived orders have an empty trail.
+func (odb *OrderDatabase) GetOrderEvents(ctx context.Context, orderID string) (_ []OrderEvent, err error) {
+	ctx, span := odb.startSpan(ctx, "GetOrderEvents", attribute.String("order.id", orderID))
+	defer func() { endSpan(span, err) }()
+
+	if err = odb.beginOp(); err != nil {
+		return nil, err
+	}
+	defer odb.endOp()
+
+	ctx, cancel := odb.withQueryTimeout(ctx)
+	defer cancel()
+
+	var events []OrderEvent
+	err = odb.withReadRetry(ctx, "GetOrderEvents", func(q *sql.DB) (err error) {
+		events, err = odb.getOrderEvents(ctx, q, orderID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("db.rows_returned", len(events)))
+	return events, nil
+}
+
+func (odb *OrderDatabase) getOrderEvents(ctx context.Context, q queryer, orderID string) ([]OrderEvent, error) {
+	// Events written in the same instant keep the order they were written
+	// in by id.
+	eventQuery := `
+		SELECT event_type, from_status, to_status, actor, detail, created_at
+		FROM order_events
+		WHERE order_id = $1
+		ORDER BY created_at, id
+	`
+	rows, err := odb.queryContext(ctx, q, eventQuery, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query order events: %w", err)
+	}
+	defer rows.Close()
+
+	events := []OrderEvent{}
+	for rows.Next() {
+		var event OrderEvent
+		var from, to, actor, detail sql.NullString
+		if err := rows.Scan(&event.Type, &from, &to, &actor, &detail, &event.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan order event: %w", err)
+		}
+		event.FromStatus = OrderStatus(from.String)
+		event.ToStatus = OrderStatus(to.String)
+		event.Actor = actor.String
+		event.Detail = detail.String
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query order events: %w", err)
+	}
+	return events, nil
+}
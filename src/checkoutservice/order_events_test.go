@@ -0,0 +1,56 @@
+// Copyright 2024
+// Tests for the order audit trail
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var orderEventColumns = []string{"event_type", "from_status", "to_status", "actor", "detail", "created_at"}
+
+func TestGetOrderEvents(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery(`FROM order_events\s+WHERE order_id = \$1\s+ORDER BY created_at, id`).
+		WithArgs("order-1").
+		WillReturnRows(sqlmock.NewRows(orderEventColumns).
+			AddRow("EMAIL_UPDATED", "PAID", "PAID", nil, nil, at).
+			AddRow("CANCELLED", "PAID", "CANCELLED", "agent-7", "changed my mind", at.Add(time.Minute)))
+
+	events, err := odb.GetOrderEvents(context.Background(), "order-1")
+	if err != nil {
+		t.Fatalf("GetOrderEvents() error = %v", err)
+	}
+	want := []OrderEvent{
+		{Type: OrderEventEmailUpdated, FromStatus: OrderStatusPaid, ToStatus: OrderStatusPaid, CreatedAt: at},
+		{Type: OrderEventCancelled, FromStatus: OrderStatusPaid, ToStatus: OrderStatusCancelled, Actor: "agent-7", Detail: "changed my mind", CreatedAt: at.Add(time.Minute)},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("GetOrderEvents() = %v, want %v", events, want)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Errorf("event %d = %+v, want %+v", i, events[i], want[i])
+		}
+	}
+}
+
+func TestGetOrderEventsOfMissingOrderIsEmpty(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+
+	mock.ExpectQuery(`FROM order_events`).WithArgs("missing").WillReturnRows(sqlmock.NewRows(orderEventColumns))
+
+	events, err := odb.GetOrderEvents(context.Background(), "missing")
+	if err != nil {
+		t.Fatalf("GetOrderEvents() error = %v", err)
+	}
+	if events == nil || len(events) != 0 {
+		t.Errorf("GetOrderEvents() = %#v, want an empty slice", events)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2024
+// Canonical JSON rendering of orders
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+// zeroDecimalCurrencies are the supported currencies without minor units,
+// whose amounts are written without decimals unless they have a fraction.
+var zeroDecimalCurrencies = map[string]bool{
+	"ISK": true,
+	"JPY": true,
+	"KRW": true,
+}
+
+type moneyJSON struct {
+	// Amount is a decimal string such as "12.99" or "-0.50", so that
+	// clients don't have to combine units and nanos or parse a float.
+	Amount       string `json:"amount"`
+	CurrencyCode string `json:"currency_code"`
+}
+
+type addressJSON struct {
+	StreetAddress string `json:"street_address"`
+	City          string `json:"city"`
+	State         string `json:"state"`
+	Country       string `json:"country"`
+	ZipCode       int32  `json:"zip_code"`
+}
+
+type orderItemJSON struct {
+	ProductID string    `json:"product_id"`
+	Quantity  int32     `json:"quantity"`
+	UnitCost  moneyJSON `json:"unit_cost"`
+	// Cost is UnitCost times Quantity.
+	Cost moneyJSON `json:"cost"`
+}
+
+type orderJSON struct {
+	OrderID            string          `json:"order_id"`
+	ShippingTrackingID string          `json:"shipping_tracking_id"`
+	ShippingAddress    *addressJSON    `json:"shipping_address"`
+	ShippingCost       moneyJSON       `json:"shipping_cost"`
+	Items              []orderItemJSON `json:"items"`
+	// Total is the shipping cost plus the cost of every item, which is what
+	// the customer was charged.
+	Total moneyJSON `json:"total"`
+}
+
+// OrderToJSON renders order in the one JSON shape integrations should
+// consume. Every amount is a decimal string with its currency code, and the
+// document includes the total the customer was charged. It fails with
+// ErrInvalidMoney for a malformed amount or items priced in a currency other
+// than the shipping cost's.
+func OrderToJSON(order *pb.OrderResult) ([]byte, error) {
+	if order == nil {
+		return nil, errors.New("order is nil")
+	}
+	if err := validateMoney(order.ShippingCost); err != nil {
+		return nil, fmt.Errorf("order %s shipping cost: %w", order.OrderId, err)
+	}
+
+	currency := order.ShippingCost.CurrencyCode
+	totalUnits, totalNanos := order.ShippingCost.Units, int64(order.ShippingCost.Nanos)
+	items := make([]orderItemJSON, 0, len(order.Items))
+	for i, item := range order.Items {
+		if err := validateMoney(item.GetCost()); err != nil {
+			return nil, fmt.Errorf("order %s item %d cost: %w", order.OrderId, i, err)
+		}
+		if item.Cost.CurrencyCode != currency {
+			return nil, fmt.Errorf("order %s item %d cost: %w: currency %s differs from the shipping cost's %s",
+				order.OrderId, i, ErrInvalidMoney, item.Cost.CurrencyCode, currency)
+		}
+
+		quantity := int64(item.GetItem().GetQuantity())
+		cost := sumToMoney(currency, item.Cost.Units*quantity, int64(item.Cost.Nanos)*quantity)
+		totalUnits += cost.Units
+		totalNanos += int64(cost.Nanos)
+		items = append(items, orderItemJSON{
+			ProductID: item.GetItem().GetProductId(),
+			Quantity:  item.GetItem().GetQuantity(),
+			UnitCost:  newMoneyJSON(item.Cost),
+			Cost:      newMoneyJSON(cost),
+		})
+	}
+
+	doc := orderJSON{
+		OrderID:            order.OrderId,
+		ShippingTrackingID: order.ShippingTrackingId,
+		ShippingCost:       newMoneyJSON(order.ShippingCost),
+		Items:              items,
+		Total:              newMoneyJSON(sumToMoney(currency, totalUnits, totalNanos)),
+	}
+	if a := order.ShippingAddress; a != nil {
+		doc.ShippingAddress = &addressJSON{
+			StreetAddress: a.StreetAddress,
+			City:          a.City,
+			State:         a.State,
+			Country:       a.Country,
+			ZipCode:       a.ZipCode,
+		}
+	}
+	return json.Marshal(doc)
+}
+
+func newMoneyJSON(m *pb.Money) moneyJSON {
+	return moneyJSON{Amount: formatAmount(m), CurrencyCode: m.CurrencyCode}
+}
+
+// formatAmount writes a valid Money as a decimal string with the
+// currency's usual number of decimals, two unless it is in
+// zeroDecimalCurrencies. Digits beyond those are kept, without trailing
+// zeros, so no precision is lost.
+func formatAmount(m *pb.Money) string {
+	units, nanos := m.Units, int64(m.Nanos)
+	sign := ""
+	if units < 0 || nanos < 0 {
+		sign = "-"
+		units, nanos = -units, -nanos
+	}
+
+	minDecimals := 2
+	if zeroDecimalCurrencies[m.CurrencyCode] {
+		minDecimals = 0
+	}
+	fraction := strings.TrimRight(fmt.Sprintf("%09d", nanos), "0")
+	if len(fraction) < minDecimals {
+		fraction += strings.Repeat("0", minDecimals-len(fraction))
+	}
+
+	amount := sign + strconv.FormatUint(uint64(units), 10)
+	if fraction != "" {
+		amount += "." + fraction
+	}
+	return amount
+}
@@ -0,0 +1,122 @@
+// Copyright 2024
+// Tests for the canonical order JSON
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+func TestFormatAmount(t *testing.T) {
+	tests := []struct {
+		name string
+		m    *pb.Money
+		want string
+	}{
+		{"cents", &pb.Money{CurrencyCode: "USD", Units: 12, Nanos: 990000000}, "12.99"},
+		{"whole", &pb.Money{CurrencyCode: "USD", Units: 12}, "12.00"},
+		{"one decimal", &pb.Money{CurrencyCode: "EUR", Nanos: 500000000}, "0.50"},
+		{"zero", &pb.Money{CurrencyCode: "USD"}, "0.00"},
+		{"sub-cent precision", &pb.Money{CurrencyCode: "USD", Units: 1, Nanos: 1000000}, "1.001"},
+		{"smallest nano", &pb.Money{CurrencyCode: "USD", Nanos: 1}, "0.000000001"},
+		{"negative", &pb.Money{CurrencyCode: "USD", Units: -5, Nanos: -500000000}, "-5.50"},
+		{"negative below one", &pb.Money{CurrencyCode: "USD", Nanos: -10000000}, "-0.01"},
+		{"negative whole", &pb.Money{CurrencyCode: "USD", Units: -3}, "-3.00"},
+		{"zero-decimal currency", &pb.Money{CurrencyCode: "JPY", Units: 1500}, "1500"},
+		{"zero-decimal currency with a fraction", &pb.Money{CurrencyCode: "JPY", Units: 1500, Nanos: 250000000}, "1500.25"},
+		{"negative zero-decimal currency", &pb.Money{CurrencyCode: "KRW", Units: -12000}, "-12000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatAmount(tt.m); got != tt.want {
+				t.Errorf("formatAmount(%v) = %q, want %q", tt.m, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrderToJSON(t *testing.T) {
+	_, result, _ := newTestOrder("order-1")
+
+	got, err := OrderToJSON(result)
+	if err != nil {
+		t.Fatalf("OrderToJSON() error = %v", err)
+	}
+
+	want := `{
+		"order_id": "order-1",
+		"shipping_tracking_id": "track-order-1",
+		"shipping_address": {
+			"street_address": "1600 Amphitheatre Pkwy",
+			"city": "Mountain View",
+			"state": "CA",
+			"country": "USA",
+			"zip_code": 94043
+		},
+		"shipping_cost": {"amount": "8.99", "currency_code": "USD"},
+		"items": [
+			{
+				"product_id": "OLJCESPC7Z",
+				"quantity": 1,
+				"unit_cost": {"amount": "19.99", "currency_code": "USD"},
+				"cost": {"amount": "19.99", "currency_code": "USD"}
+			},
+			{
+				"product_id": "66VCHSJNUP",
+				"quantity": 2,
+				"unit_cost": {"amount": "34.99", "currency_code": "USD"},
+				"cost": {"amount": "69.98", "currency_code": "USD"}
+			}
+		],
+		"total": {"amount": "98.96", "currency_code": "USD"}
+	}`
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, []byte(want)); err != nil {
+		t.Fatalf("invalid expected JSON: %v", err)
+	}
+	if string(got) != compact.String() {
+		t.Errorf("OrderToJSON() =\n%s\nwant\n%s", got, compact.String())
+	}
+}
+
+func TestOrderToJSONWithoutItems(t *testing.T) {
+	order := &pb.OrderResult{
+		OrderId:      "order-1",
+		ShippingCost: &pb.Money{CurrencyCode: "JPY", Units: 800},
+	}
+	got, err := OrderToJSON(order)
+	if err != nil {
+		t.Fatalf("OrderToJSON() error = %v", err)
+	}
+	want := `{"order_id":"order-1","shipping_tracking_id":"","shipping_address":null,` +
+		`"shipping_cost":{"amount":"800","currency_code":"JPY"},"items":[],` +
+		`"total":{"amount":"800","currency_code":"JPY"}}`
+	if string(got) != want {
+		t.Errorf("OrderToJSON() = %s, want %s", got, want)
+	}
+}
+
+func TestOrderToJSONRejectsInvalidMoney(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(result *pb.OrderResult)
+	}{
+		{"missing shipping cost", func(result *pb.OrderResult) { result.ShippingCost = nil }},
+		{"nanos out of range", func(result *pb.OrderResult) { result.Items[0].Cost.Nanos = 1000000000 }},
+		{"mismatched currency", func(result *pb.OrderResult) { result.Items[1].Cost.CurrencyCode = "EUR" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, result, _ := newTestOrder("order-1")
+			tt.corrupt(result)
+			if _, err := OrderToJSON(result); !errors.Is(err, ErrInvalidMoney) {
+				t.Errorf("OrderToJSON() error = %v, want ErrInvalidMoney", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2024
+// Masked payment details kept with an order
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+const (
+	maxCardTypeLen       = 32
+	maxProcessorTxnIDLen = 255
+)
+
+// PaymentInfo is what is kept of the card an order was paid with, for
+// receipts and disputes. It deliberately has no field that could hold the
+// card number, CVV or expiry date.
+type PaymentInfo struct {
+	// CardLastFour is the last four digits of the card number.
+	CardLastFour string
+	// CardType is the card brand, such as "visa", or empty if unknown.
+	CardType string
+	// ProcessorTxnID is the transaction ID the payment service returned.
+	ProcessorTxnID string
+	// Authorized reports whether the charge was authorized.
+	Authorized bool
+}
+
+// NewPaymentInfo masks card down to what PaymentInfo keeps, for a charge
+// the payment service authorized as txnID.
+func NewPaymentInfo(card *pb.CreditCardInfo, txnID string) *PaymentInfo {
+	number := cardDigits(card.GetCreditCardNumber())
+	lastFour := number
+	if len(number) > 4 {
+		lastFour = number[len(number)-4:]
+	}
+	return &PaymentInfo{
+		CardLastFour:   lastFour,
+		CardType:       cardType(number),
+		ProcessorTxnID: txnID,
+		Authorized:     true,
+	}
+}
+
+// validatePayment checks that payment holds only masked details. Any field
+// that is a whole card number is rejected, so a PAN passed by mistake, for
+// example as the last four digits or the transaction ID, is never stored.
+// Errors never include the values.
+func validatePayment(payment *PaymentInfo) error {
+	if payment == nil {
+		return fmt.Errorf("%w: payment is missing", ErrInvalidPayment)
+	}
+	fields := []struct {
+		name, value string
+	}{
+		{"card last four", payment.CardLastFour},
+		{"card type", payment.CardType},
+		{"processor transaction ID", payment.ProcessorTxnID},
+	}
+	for _, f := range fields {
+		if isCardNumber(f.value) {
+			return fmt.Errorf("%w: %s is a full card number", ErrInvalidPayment, f.name)
+		}
+	}
+
+	if len(payment.CardLastFour) != 4 || cardDigits(payment.CardLastFour) != payment.CardLastFour {
+		return fmt.Errorf("%w: card last four must be exactly four digits", ErrInvalidPayment)
+	}
+	if len(payment.CardType) > maxCardTypeLen {
+		return fmt.Errorf("%w: card type is longer than %d bytes", ErrInvalidPayment, maxCardTypeLen)
+	}
+	if len(payment.ProcessorTxnID) > maxProcessorTxnIDLen {
+		return fmt.Errorf("%w: processor transaction ID is longer than %d bytes", ErrInvalidPayment, maxProcessorTxnIDLen)
+	}
+	return nil
+}
+
+// isCardNumber reports whether s, ignoring spaces and dashes, is 12 to 19
+// digits that pass the Luhn check, as every card number does.
+func isCardNumber(s string) bool {
+	digits := strings.NewReplacer(" ", "", "-", "").Replace(s)
+	if len(digits) < 12 || len(digits) > 19 || cardDigits(digits) != digits {
+		return false
+	}
+
+	sum := 0
+	for i := range digits {
+		d := int(digits[len(digits)-1-i] - '0')
+		if i%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// cardDigits returns the ASCII digits of s, dropping everything else.
+func cardDigits(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// cardType returns the brand of a card number from its leading digits, or
+// "" if it isn't one the payment service is likely to see.
+func cardType(number string) string {
+	prefix := func(n int) int {
+		if len(number) < n {
+			return -1
+		}
+		v := 0
+		for _, c := range number[:n] {
+			v = v*10 + int(c-'0')
+		}
+		return v
+	}
+	switch {
+	case prefix(1) == 4:
+		return "visa"
+	case prefix(2) >= 51 && prefix(2) <= 55, prefix(4) >= 2221 && prefix(4) <= 2720:
+		return "mastercard"
+	case prefix(2) == 34, prefix(2) == 37:
+		return "amex"
+	case prefix(4) == 6011, prefix(2) == 65, prefix(3) >= 644 && prefix(3) <= 649:
+		return "discover"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2024
+// Tests for masked payment details
+
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+// testCardNumber is a Visa test number that passes the Luhn check.
+const testCardNumber = "4432801561520454"
+
+func newTestPayment() *PaymentInfo {
+	return &PaymentInfo{CardLastFour: "0454", CardType: "visa", ProcessorTxnID: "3f2c1a0e-txn", Authorized: true}
+}
+
+func TestIsCardNumber(t *testing.T) {
+	tests := []struct {
+		s    string
+		want bool
+	}{
+		{testCardNumber, true},
+		{"4432 8015 6152 0454", true},
+		{"4432-8015-6152-0454", true},
+		{"5555555555554444", true},
+		{"378282246310005", true},
+		{"4432801561520455", false},
+		{"0454", false},
+		{"3f2c1a0e-8b4d-4c6e-9a1b-2d3e4f5a6b7c", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isCardNumber(tt.s); got != tt.want {
+			t.Errorf("isCardNumber(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestValidatePaymentRejectsCardNumbers(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(p *PaymentInfo)
+	}{
+		{"card number as last four", func(p *PaymentInfo) { p.CardLastFour = testCardNumber }},
+		{"spaced card number as last four", func(p *PaymentInfo) { p.CardLastFour = "4432 8015 6152 0454" }},
+		{"card number as card type", func(p *PaymentInfo) { p.CardType = testCardNumber }},
+		{"card number as transaction ID", func(p *PaymentInfo) { p.ProcessorTxnID = "4432-8015-6152-0454" }},
+		{"too few digits", func(p *PaymentInfo) { p.CardLastFour = "454" }},
+		{"last eight digits", func(p *PaymentInfo) { p.CardLastFour = "61520454" }},
+		{"letters", func(p *PaymentInfo) { p.CardLastFour = "04a4" }},
+		{"long card type", func(p *PaymentInfo) { p.CardType = strings.Repeat("x", maxCardTypeLen+1) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payment := newTestPayment()
+			tt.corrupt(payment)
+			err := validatePayment(payment)
+			if !errors.Is(err, ErrInvalidPayment) {
+				t.Fatalf("validatePayment() error = %v, want ErrInvalidPayment", err)
+			}
+			if strings.Contains(err.Error(), "0454") {
+				t.Errorf("validatePayment() error = %q, want it not to include the card digits", err)
+			}
+		})
+	}
+
+	if err := validatePayment(newTestPayment()); err != nil {
+		t.Errorf("validatePayment(valid) error = %v", err)
+	}
+	if err := validatePayment(nil); !errors.Is(err, ErrInvalidPayment) {
+		t.Errorf("validatePayment(nil) error = %v, want ErrInvalidPayment", err)
+	}
+}
+
+func TestNewPaymentInfoMasksCard(t *testing.T) {
+	tests := []struct {
+		number       string
+		wantLastFour string
+		wantType     string
+	}{
+		{testCardNumber, "0454", "visa"},
+		{"5555 5555 5555 4444", "4444", "mastercard"},
+		{"2223003122003222", "3222", "mastercard"},
+		{"378282246310005", "0005", "amex"},
+		{"6011111111111117", "1117", "discover"},
+		{"3530111333300000", "0000", ""},
+	}
+	for _, tt := range tests {
+		got := NewPaymentInfo(&pb.CreditCardInfo{CreditCardNumber: tt.number, CreditCardCvv: 672}, "txn-1")
+		want := &PaymentInfo{CardLastFour: tt.wantLastFour, CardType: tt.wantType, ProcessorTxnID: "txn-1", Authorized: true}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("NewPaymentInfo(%q) = %+v, want %+v", tt.number, got, want)
+		}
+		if err := validatePayment(got); err != nil {
+			t.Errorf("validatePayment(NewPaymentInfo(%q)) error = %v", tt.number, err)
+		}
+	}
+}
+
+func TestSaveOrderWithPaymentRejectsCardNumber(t *testing.T) {
+	stores := map[string]OrderStore{"memory": NewMemoryOrderStore()}
+	// No expectations: the order must be rejected before any query.
+	stores["database"], _ = newMockOrderDatabase(t)
+	for name, store := range stores {
+		req, result, total := newTestOrder("order-1")
+		payment := newTestPayment()
+		payment.CardLastFour = testCardNumber
+
+		err := store.SaveOrderWithPayment(context.Background(), req, result, total, payment)
+		if !errors.Is(err, ErrInvalidPayment) {
+			t.Errorf("%s SaveOrderWithPayment() error = %v, want ErrInvalidPayment", name, err)
+		}
+	}
+}
+
+func TestSaveOrderWithPaymentWritesMaskedPayment(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	_, result, _ := newTestOrder("order-1")
+	payment := newTestPayment()
+
+	expectPrepareSaveOrder(mock)
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO orders`).WillReturnResult(sqlmock.NewResult(1, 1))
+	for range result.Items {
+		mock.ExpectExec(`INSERT INTO order_items`).WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectExec(`INSERT INTO order_payments`).
+		WithArgs("order-1", "0454", "visa", "3f2c1a0e-txn", true, recentUTC{}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectOutboxEvent(mock, "order-1")
+	mock.ExpectCommit()
+
+	mock.ExpectQuery(`FROM orders\s+WHERE order_id = \$1`).
+		WillReturnRows(sqlmock.NewRows(orderColumns).AddRow(orderRow("order-1")...))
+	mock.ExpectQuery(`FROM order_items`).WillReturnRows(sqlmock.NewRows(orderItemColumns))
+	mock.ExpectQuery(`FROM order_payments\s+WHERE order_id = \$1`).
+		WithArgs("order-1").
+		WillReturnRows(sqlmock.NewRows(paymentColumns).AddRow("0454", "visa", "3f2c1a0e-txn", true))
+
+	ctx := context.Background()
+	req, result, total := newTestOrder("order-1")
+	if err := odb.SaveOrderWithPayment(ctx, req, result, total, payment); err != nil {
+		t.Fatalf("SaveOrderWithPayment() error = %v", err)
+	}
+	got, err := odb.GetOrder(ctx, "order-1")
+	if err != nil {
+		t.Fatalf("GetOrder() error = %v", err)
+	}
+	if !reflect.DeepEqual(got.Payment, payment) {
+		t.Errorf("GetOrder() payment = %+v, want %+v", got.Payment, payment)
+	}
+}
+
+func TestMemoryOrderStorePayment(t *testing.T) {
+	store := NewMemoryOrderStore()
+	ctx := context.Background()
+
+	req, result, total := newTestOrder("order-1")
+	if err := store.SaveOrderWithPayment(ctx, req, result, total, newTestPayment()); err != nil {
+		t.Fatalf("SaveOrderWithPayment() error = %v", err)
+	}
+	got, err := store.GetOrder(ctx, "order-1")
+	if err != nil {
+		t.Fatalf("GetOrder() error = %v", err)
+	}
+	if !reflect.DeepEqual(got.Payment, newTestPayment()) {
+		t.Errorf("GetOrder() payment = %+v, want %+v", got.Payment, newTestPayment())
+	}
+	got.Payment.CardLastFour = "9999"
+	if again, _ := store.GetOrder(ctx, "order-1"); again.Payment.CardLastFour != "0454" {
+		t.Errorf("modifying a returned payment changed the stored one")
+	}
+}
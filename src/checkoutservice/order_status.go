@@ -0,0 +1,66 @@
+// Copyright 2024
+// Order lifecycle states and the transitions allowed between them
+
+package main
+
+import (
+	"errors"
+	"sort"
+)
+
+type OrderStatus string
+
+const (
+	OrderStatusPending   OrderStatus = "PENDING"
+	OrderStatusPaid      OrderStatus = "PAID"
+	OrderStatusShipped   OrderStatus = "SHIPPED"
+	OrderStatusCancelled OrderStatus = "CANCELLED"
+)
+
+var (
+	ErrInvalidStatusTransition = errors.New("invalid order status transition")
+	ErrOrderNotCancellable     = errors.New("order can no longer be cancelled")
+	ErrOrderNotEditable        = errors.New("order can no longer be changed")
+)
+
+// orderStatusTransitions lists, for every status, the statuses an order may
+// move to next. SHIPPED and CANCELLED are terminal.
+var orderStatusTransitions = map[OrderStatus][]OrderStatus{
+	OrderStatusPending:   {OrderStatusPaid, OrderStatusCancelled},
+	OrderStatusPaid:      {OrderStatusShipped, OrderStatusCancelled},
+	OrderStatusShipped:   {},
+	OrderStatusCancelled: {},
+}
+
+func (s OrderStatus) IsValid() bool {
+	_, ok := orderStatusTransitions[s]
+	return ok
+}
+
+func (s OrderStatus) CanTransitionTo(next OrderStatus) bool {
+	for _, allowed := range orderStatusTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTerminal reports whether an order in this status is finished: it can't
+// move to another status and its details can no longer be changed.
+func (s OrderStatus) IsTerminal() bool {
+	return len(orderStatusTransitions[s]) == 0
+}
+
+// statusesLeadingTo returns every status from which an order may move to
+// next.
+func statusesLeadingTo(next OrderStatus) []string {
+	var from []string
+	for status := range orderStatusTransitions {
+		if status.CanTransitionTo(next) {
+			from = append(from, string(status))
+		}
+	}
+	sort.Strings(from)
+	return from
+}
@@ -0,0 +1,43 @@
+// Copyright 2024
+// Tests for order lifecycle transitions
+
+package main
+
+import "testing"
+
+func TestOrderStatusCanTransitionTo(t *testing.T) {
+	tests := []struct {
+		from, to OrderStatus
+		want     bool
+	}{
+		{OrderStatusPending, OrderStatusPaid, true},
+		{OrderStatusPending, OrderStatusCancelled, true},
+		{OrderStatusPending, OrderStatusShipped, false},
+		{OrderStatusPaid, OrderStatusShipped, true},
+		{OrderStatusPaid, OrderStatusCancelled, true},
+		{OrderStatusPaid, OrderStatusPending, false},
+		{OrderStatusShipped, OrderStatusCancelled, false},
+		{OrderStatusCancelled, OrderStatusPending, false},
+		{OrderStatusCancelled, OrderStatusPaid, false},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.from)+"->"+string(tt.to), func(t *testing.T) {
+			if got := tt.from.CanTransitionTo(tt.to); got != tt.want {
+				t.Errorf("%s.CanTransitionTo(%s) = %v, want %v", tt.from, tt.to, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatusesLeadingTo(t *testing.T) {
+	got := statusesLeadingTo(OrderStatusCancelled)
+	want := []string{"PAID", "PENDING"}
+	if len(got) != len(want) {
+		t.Fatalf("statusesLeadingTo(CANCELLED) = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("statusesLeadingTo(CANCELLED) = %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright 2024
+// Storage abstraction for persisted orders
+
+package main
+
+import (
+	"context"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+// OrderStore persists placed orders. OrderDatabase is the SQL-backed
+// implementation (Postgres, MySQL or SQLite); MemoryOrderStore is for tests
+// and local development.
+type OrderStore interface {
+	SaveOrder(ctx context.Context, req *pb.PlaceOrderRequest, orderResult *pb.OrderResult, totalAmount *pb.Money) error
+	// SaveOrderWithPayment is SaveOrder that also keeps the masked details
+	// of the card the order was paid with.
+	SaveOrderWithPayment(ctx context.Context, req *pb.PlaceOrderRequest, orderResult *pb.OrderResult, totalAmount *pb.Money, payment *PaymentInfo) error
+	GetOrder(ctx context.Context, orderID string) (*OrderRecord, error)
+	GetUserOrders(ctx context.Context, userID string) ([]*OrderRecord, error)
+	// HealthCheck returns nil if the store can serve requests.
+	HealthCheck(ctx context.Context) error
+	// Shutdown waits, bounded by ctx, for in-flight operations and then
+	// releases the store's resources.
+	Shutdown(ctx context.Context) error
+	Close() error
+}
+
+var (
+	_ OrderStore = (*OrderDatabase)(nil)
+	_ OrderStore = (*MemoryOrderStore)(nil)
+)
@@ -0,0 +1,124 @@
+// Copyright 2024
+// Checking that a stored total matches its order's items and shipping
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+const nanosPerUnit = 1000000000
+
+// ErrTotalMismatch is returned by VerifyOrderTotals when an order's total
+// isn't what its items and shipping add up to.
+var ErrTotalMismatch = errors.New("order total doesn't match its items and shipping")
+
+// WithTotalsVerification makes GetOrder check every order it reads with
+// VerifyOrderTotals and fail with ErrTotalMismatch, rather than return the
+// order, if the total is off.
+func WithTotalsVerification() Option {
+	return func(o *dbOptions) { o.verifyTotals = true }
+}
+
+// VerifyOrderTotals checks that expectedTotal is the sum of the order's
+// shipping cost and each item's cost times its quantity, the way checkout
+// computes it, to catch a corrupt row. It fails with ErrTotalMismatch,
+// naming both amounts, if they differ or an amount isn't in the total's
+// currency, and with ErrInvalidMoney if an amount is malformed or the sum
+// overflows.
+func VerifyOrderTotals(order *pb.OrderResult, expectedTotal *pb.Money) error {
+	if order == nil {
+		return fmt.Errorf("%w: order is missing", ErrInvalidItems)
+	}
+	if err := validateMoney(expectedTotal); err != nil {
+		return fmt.Errorf("order %s total: %w", order.OrderId, err)
+	}
+	currency := expectedTotal.CurrencyCode
+
+	var sum moneySum
+	add := func(what string, m *pb.Money, quantity int64) error {
+		if err := validateMoney(m); err != nil {
+			return fmt.Errorf("order %s %s: %w", order.OrderId, what, err)
+		}
+		if m.CurrencyCode != currency {
+			return fmt.Errorf("order %s %s: %w: it is in %s, the total in %s",
+				order.OrderId, what, ErrTotalMismatch, m.CurrencyCode, currency)
+		}
+		if !sum.add(m, quantity) {
+			return fmt.Errorf("order %s %s: %w: sum overflows", order.OrderId, what, ErrInvalidMoney)
+		}
+		return nil
+	}
+
+	if err := add("shipping cost", order.ShippingCost, 1); err != nil {
+		return err
+	}
+	for i, item := range order.Items {
+		if err := add(fmt.Sprintf("item %d cost", i), item.GetCost(), int64(item.GetItem().GetQuantity())); err != nil {
+			return err
+		}
+	}
+
+	got := sum.money(currency)
+	if got.Units != expectedTotal.Units || got.Nanos != expectedTotal.Nanos {
+		return fmt.Errorf("order %s: %w: items and shipping add up to %s %s, the total is %s %s",
+			order.OrderId, ErrTotalMismatch,
+			formatAmount(got), currency, formatAmount(expectedTotal), currency)
+	}
+	return nil
+}
+
+// moneySum adds up amounts exactly. Whole units are carried out of nanos
+// after every addition, so nanos stays within ±999,999,999 and can't
+// overflow however many amounts are added.
+type moneySum struct {
+	units, nanos int64
+}
+
+// add adds m times quantity, and reports false if units overflowed, in
+// which case the sum is no longer usable.
+func (s *moneySum) add(m *pb.Money, quantity int64) bool {
+	units, ok := mulInt64(m.Units, quantity)
+	if !ok {
+		return false
+	}
+	// |m.Nanos| < 10^9 and |quantity| <= 2^31, so this fits in an int64.
+	nanos := int64(m.Nanos) * quantity
+	if units, ok = addInt64(units, nanos/nanosPerUnit); !ok {
+		return false
+	}
+	if s.units, ok = addInt64(s.units, units); !ok {
+		return false
+	}
+	s.nanos += nanos % nanosPerUnit
+	s.units, ok = addInt64(s.units, s.nanos/nanosPerUnit)
+	s.nanos %= nanosPerUnit
+	return ok
+}
+
+// money returns the sum in currency.
+func (s *moneySum) money(currency string) *pb.Money {
+	return sumToMoney(currency, s.units, s.nanos)
+}
+
+func addInt64(a, b int64) (int64, bool) {
+	if (b > 0 && a > math.MaxInt64-b) || (b < 0 && a < math.MinInt64-b) {
+		return 0, false
+	}
+	return a + b, true
+}
+
+func mulInt64(a, b int64) (int64, bool) {
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+	p := a * b
+	if p/b != a || (a == -1 && b == math.MinInt64) || (b == -1 && a == math.MinInt64) {
+		return 0, false
+	}
+	return p, true
+}
@@ -0,0 +1,124 @@
+// Copyright 2024
+// Tests for checking order totals
+
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+func usd(units int64, nanos int32) *pb.Money {
+	return &pb.Money{CurrencyCode: "USD", Units: units, Nanos: nanos}
+}
+
+func totalsItem(cost *pb.Money, quantity int32) *pb.OrderItem {
+	return &pb.OrderItem{Item: &pb.CartItem{ProductId: "OLJCESPC7Z", Quantity: quantity}, Cost: cost}
+}
+
+func totalsOrder(shipping *pb.Money, items ...*pb.OrderItem) *pb.OrderResult {
+	return &pb.OrderResult{OrderId: "order-1", ShippingCost: shipping, Items: items}
+}
+
+func TestVerifyOrderTotals(t *testing.T) {
+	tests := []struct {
+		name  string
+		order *pb.OrderResult
+		total *pb.Money
+	}{
+		{"fixture", func() *pb.OrderResult { _, result, _ := newTestOrder("order-1"); return result }(), usd(98, 960000000)},
+		{"nanos carry into units", totalsOrder(usd(0, 500000000), totalsItem(usd(0, 700000000), 1)), usd(1, 200000000)},
+		{"nanos at the boundary", totalsOrder(usd(0, 999999999), totalsItem(usd(0, 1), 1)), usd(1, 0)},
+		{"nanos just under the boundary", totalsOrder(usd(0, 999999998), totalsItem(usd(0, 1), 1)), usd(0, 999999999)},
+		{"quantity carries repeatedly", totalsOrder(usd(0, 0), totalsItem(usd(0, 999999999), 3)), usd(2, 999999997)},
+		{"many items", totalsOrder(usd(4, 990000000),
+			totalsItem(usd(0, 999999999), 1000000), totalsItem(usd(12, 500000000), 2), totalsItem(usd(0, 1), 7)), usd(1000029, 989000007)},
+		{"negative amounts", totalsOrder(usd(-1, -500000000), totalsItem(usd(-2, -700000000), 1)), usd(-4, -200000000)},
+		{"signs that cancel out", totalsOrder(usd(-1, -500000000), totalsItem(usd(2, 0), 1)), usd(0, 500000000)},
+		{"signs that leave a negative fraction", totalsOrder(usd(1, 0), totalsItem(usd(-1, -250000000), 1)), usd(0, -250000000)},
+		{"units exactly offset by nanos", totalsOrder(usd(-1, 0), totalsItem(usd(0, 999999999), 1)), usd(0, -1)},
+		{"no items", totalsOrder(usd(5, 0)), usd(5, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := VerifyOrderTotals(tt.order, tt.total); err != nil {
+				t.Errorf("VerifyOrderTotals() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifyOrderTotalsMismatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		order *pb.OrderResult
+		total *pb.Money
+		want  error
+		// wantText is in the error message.
+		wantText string
+	}{
+		{"off by a nano", totalsOrder(usd(0, 999999999), totalsItem(usd(0, 1), 1)), usd(0, 999999999), ErrTotalMismatch, "add up to 1.00 USD, the total is 0.999999999 USD"},
+		{"nanos not carried", totalsOrder(usd(0, 500000000), totalsItem(usd(0, 700000000), 1)), usd(0, 200000000), ErrTotalMismatch, "add up to 1.20 USD"},
+		{"quantity ignored", totalsOrder(usd(0, 0), totalsItem(usd(2, 0), 3)), usd(2, 0), ErrTotalMismatch, "add up to 6.00 USD"},
+		{"item in another currency", totalsOrder(usd(1, 0), totalsItem(&pb.Money{CurrencyCode: "EUR", Units: 1}, 1)), usd(2, 0), ErrTotalMismatch, "item 0 cost"},
+		{"malformed item cost", totalsOrder(usd(1, 0), totalsItem(usd(1, -1), 1)), usd(2, 0), ErrInvalidMoney, "item 0 cost"},
+		{"missing shipping cost", totalsOrder(nil, totalsItem(usd(1, 0), 1)), usd(1, 0), ErrInvalidMoney, "shipping cost"},
+		{"missing total", totalsOrder(usd(1, 0)), nil, ErrInvalidMoney, "total"},
+		{"overflow", totalsOrder(usd(1, 0), totalsItem(usd(math.MaxInt64/2, 0), 3)), usd(1, 0), ErrInvalidMoney, "overflows"},
+		{"missing order", nil, usd(1, 0), ErrInvalidItems, "order is missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyOrderTotals(tt.order, tt.total)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("VerifyOrderTotals() error = %v, want %v", err, tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.wantText) {
+				t.Errorf("VerifyOrderTotals() error = %q, want it to contain %q", err, tt.wantText)
+			}
+		})
+	}
+}
+
+func TestGetOrderWithTotalsVerification(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	odb.opts.verifyTotals = true
+	_, result, _ := newTestOrder("order-1")
+
+	expectItems := func(orderID string) {
+		items := sqlmock.NewRows(orderItemColumns)
+		for _, item := range result.Items {
+			items.AddRow(orderID, item.Item.ProductId, item.Item.Quantity, item.Cost.Units, item.Cost.Nanos, item.Cost.CurrencyCode)
+		}
+		mock.ExpectQuery(`FROM order_items`).WithArgs(pq.Array([]string{orderID})).WillReturnRows(items)
+	}
+
+	mock.ExpectQuery(`FROM orders\s+WHERE order_id = \$1`).
+		WithArgs("order-1").
+		WillReturnRows(sqlmock.NewRows(orderColumns).AddRow(orderRow("order-1")...))
+	expectItems("order-1")
+	expectNoPayment(mock)
+	if _, err := odb.GetOrder(context.Background(), "order-1"); err != nil {
+		t.Fatalf("GetOrder() of a consistent order error = %v", err)
+	}
+
+	// A total that lost a cent.
+	corrupt := orderRow("order-2")
+	corrupt[3] = int32(950000000)
+	mock.ExpectQuery(`FROM orders\s+WHERE order_id = \$1`).
+		WithArgs("order-2").
+		WillReturnRows(sqlmock.NewRows(orderColumns).AddRow(corrupt...))
+	expectItems("order-2")
+	expectNoPayment(mock)
+	if record, err := odb.GetOrder(context.Background(), "order-2"); !errors.Is(err, ErrTotalMismatch) {
+		t.Errorf("GetOrder() of a corrupt order = %v, %v, want ErrTotalMismatch", record, err)
+	}
+}
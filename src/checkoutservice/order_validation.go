@@ -0,0 +1,155 @@
+// Copyright 2024
+// Checks applied to orders before they are persisted
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+const (
+	nanosMin = -999999999
+	nanosMax = +999999999
+)
+
+var (
+	ErrInvalidMoney   = errors.New("invalid money value")
+	ErrInvalidAddress = errors.New("invalid shipping address")
+	ErrInvalidEmail   = errors.New("invalid email address")
+	ErrInvalidItems   = errors.New("invalid order items")
+	ErrInvalidPayment = errors.New("invalid payment details")
+)
+
+// validateMoney checks that m is a well-formed amount: it has a currency
+// code, nanos is within ±999,999,999 and units and nanos don't have
+// opposite signs.
+func validateMoney(m *pb.Money) error {
+	if m == nil {
+		return fmt.Errorf("%w: amount is missing", ErrInvalidMoney)
+	}
+	if m.CurrencyCode == "" {
+		return fmt.Errorf("%w: currency code is empty", ErrInvalidMoney)
+	}
+	if m.Nanos < nanosMin || m.Nanos > nanosMax {
+		return fmt.Errorf("%w: nanos %d is outside [%d, %d]", ErrInvalidMoney, m.Nanos, nanosMin, nanosMax)
+	}
+	if (m.Units > 0 && m.Nanos < 0) || (m.Units < 0 && m.Nanos > 0) {
+		return fmt.Errorf("%w: units %d and nanos %d have different signs", ErrInvalidMoney, m.Units, m.Nanos)
+	}
+	return nil
+}
+
+// validateOrderMoney checks every amount SaveOrder writes. None of them may
+// be negative, since a checkout never pays out.
+func validateOrderMoney(orderResult *pb.OrderResult, totalAmount *pb.Money) error {
+	check := func(what string, m *pb.Money) error {
+		if err := validateMoney(m); err != nil {
+			return fmt.Errorf("order %s %s: %w", orderResult.OrderId, what, err)
+		}
+		if m.Units < 0 || m.Nanos < 0 {
+			return fmt.Errorf("order %s %s: %w: amount is negative", orderResult.OrderId, what, ErrInvalidMoney)
+		}
+		return nil
+	}
+
+	if err := check("total", totalAmount); err != nil {
+		return err
+	}
+	if err := check("shipping cost", orderResult.ShippingCost); err != nil {
+		return err
+	}
+	for i, item := range orderResult.Items {
+		if err := check(fmt.Sprintf("item %d cost", i), item.Cost); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateOrder runs every check SaveOrder applies before writing, so that
+// a request with a missing part fails with an error rather than a panic.
+func validateOrder(req *pb.PlaceOrderRequest, orderResult *pb.OrderResult, totalAmount *pb.Money) error {
+	if err := validateOrderItems(orderResult); err != nil {
+		return err
+	}
+	if err := validateOrderMoney(orderResult, totalAmount); err != nil {
+		return err
+	}
+	if err := validateOrderAddress(req.GetAddress()); err != nil {
+		return fmt.Errorf("order %s: %w", orderResult.OrderId, err)
+	}
+	return nil
+}
+
+// validateOrderItems checks that an order has at least one item and that
+// every item names its product. A checkout always charges for something, so
+// an itemless order is a bug upstream rather than something to persist.
+func validateOrderItems(orderResult *pb.OrderResult) error {
+	if orderResult == nil {
+		return fmt.Errorf("%w: order is missing", ErrInvalidItems)
+	}
+	if len(orderResult.Items) == 0 {
+		return fmt.Errorf("order %s: %w: order has no items", orderResult.OrderId, ErrInvalidItems)
+	}
+	for i, item := range orderResult.Items {
+		if item.GetItem() == nil {
+			return fmt.Errorf("order %s item %d: %w: product is missing", orderResult.OrderId, i, ErrInvalidItems)
+		}
+	}
+	return nil
+}
+
+// validateAddress checks that every field of a shipping address is set.
+func validateAddress(address *pb.Address) error {
+	return checkAddress(address, true)
+}
+
+// validateOrderAddress checks the shipping address of an order being
+// saved. Unlike validateAddress it allows an empty state, which not every
+// country has: the card has already been charged by then, so only an
+// address nothing could be shipped to is rejected.
+func validateOrderAddress(address *pb.Address) error {
+	return checkAddress(address, false)
+}
+
+func checkAddress(address *pb.Address, requireState bool) error {
+	if address == nil {
+		return fmt.Errorf("%w: address is missing", ErrInvalidAddress)
+	}
+	fields := []struct {
+		name, value string
+	}{
+		{"street address", address.StreetAddress},
+		{"city", address.City},
+		{"country", address.Country},
+	}
+	if requireState {
+		fields = append(fields, struct{ name, value string }{"state", address.State})
+	}
+	for _, f := range fields {
+		if strings.TrimSpace(f.value) == "" {
+			return fmt.Errorf("%w: %s is empty", ErrInvalidAddress, f.name)
+		}
+	}
+	if address.ZipCode <= 0 {
+		return fmt.Errorf("%w: zip code %d is not positive", ErrInvalidAddress, address.ZipCode)
+	}
+	return nil
+}
+
+func validateEmail(email string) error {
+	if strings.TrimSpace(email) == "" {
+		return fmt.Errorf("%w: email is empty", ErrInvalidEmail)
+	}
+	parsed, err := mail.ParseAddress(email)
+	if err != nil || parsed.Address != email {
+		// Don't echo the address back: errors end up in logs.
+		return fmt.Errorf("%w: not a plain email address", ErrInvalidEmail)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2024
+// Tests for order validation
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	pb "github.com/GoogleCloudPlatform/microservices-demo/src/checkoutservice/genproto"
+)
+
+func TestValidateMoney(t *testing.T) {
+	tests := []struct {
+		name    string
+		m       *pb.Money
+		wantErr bool
+	}{
+		{"positive", &pb.Money{CurrencyCode: "USD", Units: 12, Nanos: 990000000}, false},
+		{"zero", &pb.Money{CurrencyCode: "USD"}, false},
+		{"negative", &pb.Money{CurrencyCode: "USD", Units: -1, Nanos: -500000000}, false},
+		{"nanos only", &pb.Money{CurrencyCode: "USD", Nanos: -1}, false},
+		{"nil", nil, true},
+		{"empty currency", &pb.Money{Units: 1}, true},
+		{"nanos too large", &pb.Money{CurrencyCode: "USD", Nanos: 1000000000}, true},
+		{"nanos too small", &pb.Money{CurrencyCode: "USD", Nanos: -1000000000}, true},
+		{"positive units, negative nanos", &pb.Money{CurrencyCode: "USD", Units: 1, Nanos: -1}, true},
+		{"negative units, positive nanos", &pb.Money{CurrencyCode: "USD", Units: -1, Nanos: 1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateMoney(tt.m)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateMoney(%v) error = %v, wantErr %v", tt.m, err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidMoney) {
+				t.Errorf("validateMoney(%v) error = %v, want ErrInvalidMoney", tt.m, err)
+			}
+		})
+	}
+}
+
+func TestSaveOrderRejectsInvalidMoney(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(result *pb.OrderResult, total *pb.Money)
+	}{
+		{"negative total", func(_ *pb.OrderResult, total *pb.Money) { total.Units = -total.Units }},
+		{"total nanos out of range", func(_ *pb.OrderResult, total *pb.Money) { total.Nanos = 1000000000 }},
+		{"shipping cost without currency", func(result *pb.OrderResult, _ *pb.Money) { result.ShippingCost.CurrencyCode = "" }},
+		{"item cost with mismatched signs", func(result *pb.OrderResult, _ *pb.Money) { result.Items[1].Cost.Units = -1 }},
+		{"missing item cost", func(result *pb.OrderResult, _ *pb.Money) { result.Items[0].Cost = nil }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// No expectations: the order must be rejected before any query.
+			odb, _ := newMockOrderDatabase(t)
+			req, result, total := newTestOrder("order-1")
+			tt.corrupt(result, total)
+
+			if err := odb.SaveOrder(context.Background(), req, result, total); !errors.Is(err, ErrInvalidMoney) {
+				t.Errorf("SaveOrder() error = %v, want ErrInvalidMoney", err)
+			}
+		})
+	}
+}
+
+func TestSaveOrderRejectsInvalidItems(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(result *pb.OrderResult)
+	}{
+		{"no items", func(result *pb.OrderResult) { result.Items = nil }},
+		{"empty items", func(result *pb.OrderResult) { result.Items = []*pb.OrderItem{} }},
+		{"nil item", func(result *pb.OrderResult) { result.Items[1] = nil }},
+		{"missing product", func(result *pb.OrderResult) { result.Items[0].Item = nil }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stores := map[string]OrderStore{"memory": NewMemoryOrderStore()}
+			// No expectations: the order must be rejected before any query.
+			stores["database"], _ = newMockOrderDatabase(t)
+			for name, store := range stores {
+				req, result, total := newTestOrder("order-1")
+				tt.corrupt(result)
+
+				if err := store.SaveOrder(context.Background(), req, result, total); !errors.Is(err, ErrInvalidItems) {
+					t.Errorf("%s SaveOrder() error = %v, want ErrInvalidItems", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSaveOrderRejectsMissingParts(t *testing.T) {
+	type order struct {
+		req    *pb.PlaceOrderRequest
+		result *pb.OrderResult
+		total  *pb.Money
+	}
+	tests := []struct {
+		name    string
+		corrupt func(o *order)
+		want    error
+	}{
+		{"nil address", func(o *order) { o.req.Address = nil }, ErrInvalidAddress},
+		{"nil request", func(o *order) { o.req = nil }, ErrInvalidAddress},
+		{"empty street", func(o *order) { o.req.Address.StreetAddress = " " }, ErrInvalidAddress},
+		{"empty city", func(o *order) { o.req.Address.City = "" }, ErrInvalidAddress},
+		{"empty country", func(o *order) { o.req.Address.Country = "" }, ErrInvalidAddress},
+		{"zero zip code", func(o *order) { o.req.Address.ZipCode = 0 }, ErrInvalidAddress},
+		{"nil shipping cost", func(o *order) { o.result.ShippingCost = nil }, ErrInvalidMoney},
+		{"nil total", func(o *order) { o.total = nil }, ErrInvalidMoney},
+		{"nil order", func(o *order) { o.result = nil }, ErrInvalidItems},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stores := map[string]OrderStore{"memory": NewMemoryOrderStore()}
+			// No expectations: the order must be rejected before any query.
+			stores["database"], _ = newMockOrderDatabase(t)
+			for name, store := range stores {
+				var o order
+				o.req, o.result, o.total = newTestOrder("order-1")
+				tt.corrupt(&o)
+
+				if err := store.SaveOrder(context.Background(), o.req, o.result, o.total); !errors.Is(err, tt.want) {
+					t.Errorf("%s SaveOrder() error = %v, want %v", name, err, tt.want)
+				}
+				payment := NewPaymentInfo(&pb.CreditCardInfo{CreditCardNumber: "4432-8015-6152-0454"}, "txn-1")
+				err := store.SaveOrderWithPayment(context.Background(), o.req, o.result, o.total, payment)
+				if !errors.Is(err, tt.want) {
+					t.Errorf("%s SaveOrderWithPayment() error = %v, want %v", name, err, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSaveOrderAllowsAddressWithoutState(t *testing.T) {
+	store := NewMemoryOrderStore()
+	req, result, total := newTestOrder("order-1")
+	req.Address = &pb.Address{StreetAddress: "1 Main St", City: "Singapore", Country: "SG", ZipCode: 18956}
+
+	if err := store.SaveOrder(context.Background(), req, result, total); err != nil {
+		t.Errorf("SaveOrder() of an address without a state error = %v", err)
+	}
+	if err := validateAddress(req.Address); !errors.Is(err, ErrInvalidAddress) {
+		t.Errorf("validateAddress() of an address without a state error = %v, want ErrInvalidAddress", err)
+	}
+}
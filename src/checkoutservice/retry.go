@@ -0,0 +1,179 @@
+// Copyright 2024
+// Retries for transient database errors
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+// Postgres SQLSTATEs for transactions that lost a race with another one and
+// will usually succeed when run again.
+const (
+	pqSerializationFailure = "40001"
+	pqDeadlockDetected     = "40P01"
+)
+
+// RetryPolicy controls how operations failing with transient errors are
+// retried. The delay before each retry doubles from BaseDelay up to
+// MaxDelay, with jitter so that clients don't retry in lockstep.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of tries, including the first one.
+	// Values below 2 disable retries.
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+func defaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   50 * time.Millisecond,
+		MaxDelay:    time.Second,
+	}
+}
+
+// WithRetryPolicy sets how SaveOrder and the read methods retry transient
+// failures.
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(o *dbOptions) { o.retry = p }
+}
+
+// withRetry runs op until it succeeds, fails with an error that isn't
+// transient, or runs out of attempts. It never waits past ctx's deadline.
+// The first time op fails on a stale connection it is also run again
+// straight away, once the primary answers a ping, without using up an
+// attempt: after a failover or a long idle spell that is usually all it
+// takes, even with retries disabled.
+func (odb *OrderDatabase) withRetry(ctx context.Context, name string, op func() error) error {
+	return odb.retryOn(ctx, name, odb.db, op)
+}
+
+// withReadRetry is withRetry for a read, which op runs on the pool it is
+// passed: the replica, or the primary if there is none or ctx asks for
+// it. A stale connection is retried once that pool answers a ping.
+func (odb *OrderDatabase) withReadRetry(ctx context.Context, name string, op func(q *sql.DB) error) error {
+	q := odb.reader(ctx)
+	return odb.retryOn(ctx, name, q, func() error { return op(q) })
+}
+
+// retryOn is withRetry for an op that runs on pool.
+func (odb *OrderDatabase) retryOn(ctx context.Context, name string, pool *sql.DB, op func() error) error {
+	policy := odb.opts.retry
+	delay := policy.BaseDelay
+	reconnected := false
+	for attempt := 1; ; attempt++ {
+		err := withContextError(ctx, op())
+		if !reconnected && isStaleConnError(err) {
+			reconnected = true
+			if odb.reconnect(ctx, name, pool, err) {
+				err = withContextError(ctx, op())
+			}
+		}
+		if err == nil || attempt >= policy.MaxAttempts || !isTransientError(err) {
+			return markUnavailable(err)
+		}
+
+		wait := withJitter(delay)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return markUnavailable(err)
+		}
+		log.Warnf("%s failed with a transient error (attempt %d of %d), retrying in %v: %v", name, attempt, policy.MaxAttempts, wait, err)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return markUnavailable(err)
+		case <-timer.C:
+		}
+
+		delay *= 2
+		if delay > policy.MaxDelay {
+			delay = policy.MaxDelay
+		}
+	}
+}
+
+// withContextError adds ctx's error to err if ctx ended, so that a query
+// cut short by a deadline matches context.DeadlineExceeded whatever the
+// driver reported, such as Postgres's "canceling statement" error.
+func withContextError(ctx context.Context, err error) error {
+	ctxErr := ctx.Err()
+	if err == nil || ctxErr == nil || errors.Is(err, ctxErr) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ctxErr, err)
+}
+
+// withJitter returns a random duration between d/2 and d.
+func withJitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+// isTransientError reports whether err is worth retrying: lost
+// serialization races, deadlocks and dropped connections. Constraint
+// violations and context cancellation are not.
+func isTransientError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case pqSerializationFailure, pqDeadlockDetected:
+			return true
+		}
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlLockDeadlock {
+		return true
+	}
+	return isConnectionError(err)
+}
+
+// isConnectionError reports whether err means the database could not be
+// reached or dropped the connection, as opposed to rejecting the query.
+func isConnectionError(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// Class 08 is "connection exception".
+		return pqErr.Code.Class() == "08"
+	}
+
+	if errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// markUnavailable wraps connection errors with ErrDatabaseUnavailable so
+// callers can tell an outage apart from a bad request with errors.Is.
+func markUnavailable(err error) error {
+	if err == nil || errors.Is(err, ErrDatabaseUnavailable) || !isConnectionError(err) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrDatabaseUnavailable, err)
+}
@@ -0,0 +1,195 @@
+// Copyright 2024
+// Tests for transient database error retries
+
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+func fastRetryPolicy(attempts int) RetryPolicy {
+	return RetryPolicy{MaxAttempts: attempts, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+}
+
+func TestIsTransientError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"serialization failure", &pq.Error{Code: pqSerializationFailure}, true},
+		{"deadlock", fmt.Errorf("failed to insert order: %w", &pq.Error{Code: pqDeadlockDetected}), true},
+		{"connection failure", &pq.Error{Code: "08006"}, true},
+		{"unique violation", &pq.Error{Code: pqUniqueViolation}, false},
+		{"not null violation", &pq.Error{Code: "23502"}, false},
+		{"mysql deadlock", &mysql.MySQLError{Number: mysqlLockDeadlock}, true},
+		{"mysql duplicate entry", &mysql.MySQLError{Number: mysqlDuplicateEntry}, false},
+		{"mysql invalid connection", mysql.ErrInvalidConn, true},
+		{"bad conn", driver.ErrBadConn, true},
+		{"unexpected EOF", fmt.Errorf("failed to query order: %w", io.ErrUnexpectedEOF), true},
+		{"connection reset", syscall.ECONNRESET, true},
+		{"context canceled", context.Canceled, false},
+		{"deadline exceeded", fmt.Errorf("failed to query order: %w", context.DeadlineExceeded), false},
+		{"plain error", errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTransientError(tt.err); got != tt.want {
+				t.Errorf("isTransientError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSaveOrderRetriesTransientErrors(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	odb.opts.retry = fastRetryPolicy(3)
+	req, result, total := newTestOrder("order-1")
+
+	expectPrepareSaveOrder(mock)
+	for _, code := range []pq.ErrorCode{pqSerializationFailure, pqDeadlockDetected} {
+		mock.ExpectBegin()
+		mock.ExpectExec(`INSERT INTO orders`).WillReturnError(&pq.Error{Code: code})
+		mock.ExpectRollback()
+	}
+	expectSaveOrder(mock, result)
+
+	if err := odb.SaveOrder(context.Background(), req, result, total); err != nil {
+		t.Errorf("SaveOrder() error = %v, want success on the third attempt", err)
+	}
+}
+
+func TestSaveOrderGivesUpAfterMaxAttempts(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	odb.opts.retry = fastRetryPolicy(2)
+	req, result, total := newTestOrder("order-1")
+
+	expectPrepareSaveOrder(mock)
+	for i := 0; i < 2; i++ {
+		mock.ExpectBegin()
+		mock.ExpectExec(`INSERT INTO orders`).WillReturnError(&pq.Error{Code: pqSerializationFailure})
+		mock.ExpectRollback()
+	}
+
+	err := odb.SaveOrder(context.Background(), req, result, total)
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != pqSerializationFailure {
+		t.Errorf("SaveOrder() error = %v, want the serialization failure", err)
+	}
+}
+
+func TestSaveOrderDoesNotRetryPermanentErrors(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	odb.opts.retry = fastRetryPolicy(3)
+	req, result, total := newTestOrder("order-1")
+
+	expectPrepareSaveOrder(mock)
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO orders`).WillReturnError(&pq.Error{Code: "23502"})
+	mock.ExpectRollback()
+
+	if err := odb.SaveOrder(context.Background(), req, result, total); err == nil {
+		t.Error("SaveOrder() error = nil, want the not-null violation")
+	}
+}
+
+func TestGetOrderRetriesTransientErrors(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	odb.opts.retry = fastRetryPolicy(2)
+
+	mock.ExpectQuery(`FROM orders\s+WHERE order_id = \$1`).WillReturnError(io.ErrUnexpectedEOF)
+	mock.ExpectQuery(`FROM orders\s+WHERE order_id = \$1`).
+		WillReturnRows(sqlmock.NewRows(orderColumns).AddRow(orderRow("order-1")...))
+	mock.ExpectQuery(`FROM order_items`).WillReturnRows(sqlmock.NewRows(orderItemColumns))
+	expectNoPayment(mock)
+
+	if _, err := odb.GetOrder(context.Background(), "order-1"); err != nil {
+		t.Errorf("GetOrder() error = %v, want success on the second attempt", err)
+	}
+}
+
+func TestGetOrderReportsUnavailableAfterRetries(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	odb.opts.retry = fastRetryPolicy(2)
+
+	// Two attempts, the first of them retried on a new connection too.
+	for i := 0; i < 3; i++ {
+		mock.ExpectQuery(`FROM orders\s+WHERE order_id = \$1`).WillReturnError(io.ErrUnexpectedEOF)
+	}
+
+	_, err := odb.GetOrder(context.Background(), "order-1")
+	if !errors.Is(err, ErrDatabaseUnavailable) {
+		t.Errorf("GetOrder() error = %v, want ErrDatabaseUnavailable", err)
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("GetOrder() error = %v, want the underlying error to stay wrapped", err)
+	}
+}
+
+func TestWithRetryDoesNotMarkQueryErrorsUnavailable(t *testing.T) {
+	odb, _ := newMockOrderDatabase(t)
+	odb.opts.retry = fastRetryPolicy(3)
+
+	err := odb.withRetry(context.Background(), "test", func() error {
+		return &pq.Error{Code: pqSerializationFailure}
+	})
+	if errors.Is(err, ErrDatabaseUnavailable) {
+		t.Errorf("withRetry() error = %v, a serialization failure is not an outage", err)
+	}
+}
+
+func TestWithRetryRespectsContextDeadline(t *testing.T) {
+	odb := newOrderDatabase(nil, postgresDialect{}, defaultDBOptions())
+	odb.opts.retry = RetryPolicy{MaxAttempts: 5, BaseDelay: time.Second, MaxDelay: time.Second}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	attempts := 0
+	err := odb.withRetry(ctx, "test", func() error {
+		attempts++
+		return &pq.Error{Code: pqSerializationFailure}
+	})
+	if err == nil {
+		t.Fatal("withRetry() error = nil, want the transient error")
+	}
+	if attempts != 1 {
+		t.Errorf("withRetry() made %d attempts, want 1 since the backoff would outlive the deadline", attempts)
+	}
+}
+
+func TestWithRetryReportsContextErrorOverDriverError(t *testing.T) {
+	odb := newOrderDatabase(nil, postgresDialect{}, defaultDBOptions())
+	odb.opts.retry = fastRetryPolicy(3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	err := odb.withRetry(ctx, "test", func() error {
+		attempts++
+		cancel()
+		// Drivers often report a cancelled query as a dropped connection
+		// or their own error rather than as ctx.Err().
+		return io.ErrUnexpectedEOF
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("withRetry() error = %v, want context.Canceled", err)
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("withRetry() error = %v, want the driver error to stay wrapped", err)
+	}
+	if attempts != 1 {
+		t.Errorf("withRetry() made %d attempts, want 1 once the context has ended", attempts)
+	}
+}
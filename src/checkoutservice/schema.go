@@ -0,0 +1,200 @@
+// Copyright 2024
+// Embedded schema migrations for the order tables
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/postgres/*.sql
+var postgresMigrations embed.FS
+
+//go:embed migrations/sqlite/*.sql
+var sqliteMigrations embed.FS
+
+//go:embed migrations/mysql/*.sql
+var mysqlMigrations embed.FS
+
+// schemaLockID is the Postgres advisory lock key held while migrating, so
+// replicas starting at the same time don't race on the same DDL.
+const schemaLockID int64 = 0x636865636b6f7574 // "checkout"
+
+// schemaLockPollInterval is how often EnsureSchema retries the schema lock
+// while another process holds it.
+const schemaLockPollInterval = 250 * time.Millisecond
+
+// noTransactionDirective, as the first line of a migration, runs its
+// statements one by one outside a transaction, for statements Postgres
+// refuses to run in one such as CREATE INDEX CONCURRENTLY. Each statement
+// must be safe to run again, since a failure leaves the earlier ones
+// applied and the migration is retried in full on the next startup.
+const noTransactionDirective = "-- migrate: no-transaction"
+
+type migration struct {
+	version string
+	sql     string
+	// noTransaction is set by noTransactionDirective.
+	noTransaction bool
+}
+
+// EnsureSchema creates the order tables and brings them up to date by
+// applying every embedded migration that hasn't been applied yet. Applied
+// versions are tracked in schema_migrations, and every migration is written
+// to be idempotent on its own, so it is safe to call on every startup,
+// including against databases created by the old init script. With
+// WithSchema or WithTablePrefix the tables, schema_migrations included,
+// are created under their configured names, and the schema if needed.
+func (odb *OrderDatabase) EnsureSchema(ctx context.Context) error {
+	migrations, err := loadMigrations(odb.dialect.migrations())
+	if err != nil {
+		return err
+	}
+
+	conn, err := odb.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection for schema migration: %w", err)
+	}
+	defer conn.Close()
+
+	unlock, err := odb.dialect.lockSchema(ctx, conn)
+	if err != nil {
+		return fmt.Errorf("failed to acquire schema migration lock: %w", err)
+	}
+	defer unlock()
+
+	if schema := odb.opts.tables.schema; schema != "" {
+		if _, err := conn.ExecContext(ctx, `CREATE SCHEMA IF NOT EXISTS `+schema); err != nil {
+			return fmt.Errorf("failed to create schema %s: %w", schema, err)
+		}
+	}
+
+	createMigrationsTable := `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version VARCHAR(255) PRIMARY KEY,
+			applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)
+	`
+	if _, err := odb.execContext(ctx, conn, createMigrationsTable); err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+
+	rows, err := odb.queryContext(ctx, conn, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return fmt.Errorf("failed to query applied migrations: %w", err)
+	}
+	applied := make(map[string]bool)
+	for rows.Next() {
+		var version string
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan applied migration: %w", err)
+		}
+		applied[version] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating applied migrations: %w", err)
+	}
+
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+
+		if m.noTransaction {
+			if err := odb.applyMigrationWithoutTx(ctx, conn, m); err != nil {
+				return err
+			}
+			log.Infof("Applied database migration %s", m.version)
+			continue
+		}
+
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to begin migration %s: %w", m.version, err)
+		}
+		for _, stmt := range splitStatements(m.sql) {
+			if _, err := tx.ExecContext(ctx, odb.opts.tables.qualify(stmt)); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("failed to apply migration %s: %w", m.version, err)
+			}
+		}
+		if _, err := odb.execContext(ctx, tx, `INSERT INTO schema_migrations (version) VALUES ($1)`, m.version); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to record migration %s: %w", m.version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit migration %s: %w", m.version, err)
+		}
+		log.Infof("Applied database migration %s", m.version)
+	}
+
+	return nil
+}
+
+// applyMigrationWithoutTx runs the statements of a noTransactionDirective
+// migration one at a time and records it once they have all succeeded.
+func (odb *OrderDatabase) applyMigrationWithoutTx(ctx context.Context, conn *sql.Conn, m migration) error {
+	for _, stmt := range splitStatements(m.sql) {
+		if _, err := conn.ExecContext(ctx, odb.opts.tables.qualify(stmt)); err != nil {
+			return fmt.Errorf("failed to apply migration %s: %w", m.version, err)
+		}
+	}
+	if _, err := odb.execContext(ctx, conn, `INSERT INTO schema_migrations (version) VALUES ($1)`, m.version); err != nil {
+		return fmt.Errorf("failed to record migration %s: %w", m.version, err)
+	}
+	return nil
+}
+
+// loadMigrations reads the .sql files in dir, sorted by file name. The
+// version of a migration is its file name without the extension.
+func loadMigrations(fsys fs.FS, dir string) ([]migration, error) {
+	names, err := fs.Glob(fsys, path.Join(dir, "*.sql"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list migrations: %w", err)
+	}
+	sort.Strings(names)
+
+	migrations := make([]migration, 0, len(names))
+	for _, name := range names {
+		contents, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %w", name, err)
+		}
+		migrations = append(migrations, migration{
+			version:       strings.TrimSuffix(path.Base(name), ".sql"),
+			sql:           string(contents),
+			noTransaction: strings.HasPrefix(string(contents), noTransactionDirective+"\n"),
+		})
+	}
+	return migrations, nil
+}
+
+// splitStatements splits a migration into its statements. Migrations never
+// put semicolons inside string literals, so splitting on them is enough.
+// Comment lines are dropped.
+func splitStatements(script string) []string {
+	var lines []string
+	for _, line := range strings.Split(script, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines = append(lines, line)
+		}
+	}
+
+	var statements []string
+	for _, stmt := range strings.Split(strings.Join(lines, "\n"), ";") {
+		if stmt = strings.TrimSpace(stmt); stmt != "" {
+			statements = append(statements, stmt)
+		}
+	}
+	return statements
+}
@@ -0,0 +1,164 @@
+// Copyright 2024
+// Tests for the embedded schema migrations
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"testing/fstest"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestLoadMigrationsInVersionOrder(t *testing.T) {
+	migrations, err := loadMigrations(postgresMigrations, "migrations/postgres")
+	if err != nil {
+		t.Fatalf("loadMigrations() error = %v", err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("loadMigrations() found no migrations")
+	}
+	if migrations[0].version != "0001_create_orders" {
+		t.Errorf("first migration = %s, want 0001_create_orders", migrations[0].version)
+	}
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i-1].version >= migrations[i].version {
+			t.Errorf("migrations out of order: %s before %s", migrations[i-1].version, migrations[i].version)
+		}
+	}
+}
+
+// TestMigrationsMirrorPostgres checks that every SQLite and MySQL migration
+// after the initial one has a Postgres migration of the same version, so the
+// schemas don't drift apart.
+func TestMigrationsMirrorPostgres(t *testing.T) {
+	postgres, err := loadMigrations(postgresMigrations, "migrations/postgres")
+	if err != nil {
+		t.Fatalf("loadMigrations(postgres) error = %v", err)
+	}
+	versions := make(map[string]bool, len(postgres))
+	for _, m := range postgres {
+		versions[m.version] = true
+	}
+
+	for _, d := range []dialect{sqliteDialect{}, mysqlDialect{}} {
+		migrations, err := loadMigrations(d.migrations())
+		if err != nil {
+			t.Fatalf("loadMigrations(%s) error = %v", d.system(), err)
+		}
+		for _, m := range migrations {
+			if !versions[m.version] {
+				t.Errorf("%s migration %s has no Postgres counterpart", d.system(), m.version)
+			}
+		}
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	script := `-- A comment; with a semicolon
+CREATE TABLE a (
+    id INTEGER
+);
+
+ALTER TABLE a ADD COLUMN b TEXT;
+-- trailing comment
+`
+	want := []string{
+		"CREATE TABLE a (\n    id INTEGER\n)",
+		"ALTER TABLE a ADD COLUMN b TEXT",
+	}
+	if got := splitStatements(script); !reflect.DeepEqual(got, want) {
+		t.Errorf("splitStatements() = %q, want %q", got, want)
+	}
+}
+
+func TestEnsureSchemaSkipsAppliedMigrations(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	migrations, err := loadMigrations(postgresMigrations, "migrations/postgres")
+	if err != nil {
+		t.Fatalf("loadMigrations() error = %v", err)
+	}
+
+	applied := sqlmock.NewRows([]string{"version"})
+	for _, m := range migrations[:len(migrations)-1] {
+		applied.AddRow(m.version)
+	}
+	last := migrations[len(migrations)-1]
+
+	mock.ExpectQuery(`SELECT pg_try_advisory_lock\(\$1\)`).WithArgs(schemaLockID).
+		WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_lock"}).AddRow(true))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS schema_migrations`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT version FROM schema_migrations`).WillReturnRows(applied)
+	if !last.noTransaction {
+		mock.ExpectBegin()
+	}
+	for range splitStatements(last.sql) {
+		mock.ExpectExec(`.+`).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectExec(`INSERT INTO schema_migrations \(version\) VALUES \(\$1\)`).WithArgs(last.version).WillReturnResult(sqlmock.NewResult(0, 1))
+	if !last.noTransaction {
+		mock.ExpectCommit()
+	}
+	mock.ExpectExec(`SELECT pg_advisory_unlock\(\$1\)`).WithArgs(schemaLockID).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := odb.EnsureSchema(context.Background()); err != nil {
+		t.Errorf("EnsureSchema() error = %v", err)
+	}
+}
+
+func TestLoadMigrationsNoTransactionDirective(t *testing.T) {
+	fsys := fstest.MapFS{
+		"m/0001_tables.sql":  {Data: []byte("CREATE TABLE a (id INTEGER);\n")},
+		"m/0002_indexes.sql": {Data: []byte(noTransactionDirective + "\n-- Built without blocking writes.\nCREATE INDEX CONCURRENTLY IF NOT EXISTS idx_a ON a(id);\n")},
+	}
+	migrations, err := loadMigrations(fsys, "m")
+	if err != nil {
+		t.Fatalf("loadMigrations() error = %v", err)
+	}
+	if migrations[0].noTransaction || !migrations[1].noTransaction {
+		t.Errorf("noTransaction = %v, %v, want false, true", migrations[0].noTransaction, migrations[1].noTransaction)
+	}
+	if got := splitStatements(migrations[1].sql); len(got) != 1 {
+		t.Errorf("splitStatements() = %q, want only the CREATE INDEX", got)
+	}
+}
+
+func TestEnsureSchemaRunsNoTransactionMigrationOutsideTx(t *testing.T) {
+	odb, mock := newMockOrderDatabase(t)
+	migrations, err := loadMigrations(postgresMigrations, "migrations/postgres")
+	if err != nil {
+		t.Fatalf("loadMigrations() error = %v", err)
+	}
+
+	applied := sqlmock.NewRows([]string{"version"})
+	var pending migration
+	for _, m := range migrations {
+		if m.version == "0004_add_orders_user_created_index" {
+			pending = m
+			continue
+		}
+		applied.AddRow(m.version)
+	}
+	if !pending.noTransaction {
+		t.Fatalf("migration 0004 = %+v, want it to run outside a transaction", pending)
+	}
+
+	// The first attempt finds the lock taken by another replica.
+	mock.ExpectQuery(`SELECT pg_try_advisory_lock\(\$1\)`).WithArgs(schemaLockID).
+		WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_lock"}).AddRow(false))
+	mock.ExpectQuery(`SELECT pg_try_advisory_lock\(\$1\)`).WithArgs(schemaLockID).
+		WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_lock"}).AddRow(true))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS schema_migrations`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT version FROM schema_migrations`).WillReturnRows(applied)
+	mock.ExpectExec(`DROP INDEX CONCURRENTLY IF EXISTS idx_orders_user_created`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`CREATE INDEX CONCURRENTLY IF NOT EXISTS idx_orders_user_created`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`DROP INDEX CONCURRENTLY IF EXISTS idx_orders_user_id`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO schema_migrations \(version\) VALUES \(\$1\)`).WithArgs(pending.version).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`SELECT pg_advisory_unlock\(\$1\)`).WithArgs(schemaLockID).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := odb.EnsureSchema(context.Background()); err != nil {
+		t.Errorf("EnsureSchema() error = %v", err)
+	}
+}